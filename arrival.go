@@ -0,0 +1,244 @@
+package recstation
+
+import (
+	"math"
+	"time"
+
+	"recstation/mpeg"
+)
+
+const (
+	// Datagrams closer together than this belong to the same burst
+	ARRIVAL_BURST_GAP = 100 * time.Microsecond
+
+	// Weight of each new sample in the smoothed interval and jitter, as in
+	// RFC 3550
+	ARRIVAL_SMOOTHING = 16
+
+	// PCR jitter is the peak to peak deviation of arrival time from PCR
+	// over this long, which keeps clock drift out of it
+	ARRIVAL_PCR_WINDOW = 1 * time.Second
+
+	// A PCR step larger than this, or backwards, restarts the comparison
+	ARRIVAL_MAX_PCR_STEP = 1 * mpeg.PCR_HZ
+)
+
+// Upper bounds of the inter-arrival histogram buckets. The last bucket counts
+// everything longer.
+var ARRIVAL_INTERVAL_BUCKETS = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+}
+
+// Upper bounds of the burst length histogram buckets, in datagrams
+var ARRIVAL_BURST_BUCKETS = []int{1, 2, 4, 8, 16, 32}
+
+// arrivalStats analyses the arrival times of the datagrams on one path: the
+// spread of the intervals between them, how they bunch up into bursts and
+// how far their timing strays from the PCR they carry.
+type arrivalStats struct {
+	kernel bool
+	last   time.Time
+	mean   float64
+	jitter float64
+	maxGap time.Duration
+
+	intervals []uint64
+	bursts    []uint64
+	burst     int
+	maxBurst  int
+
+	pcrPid      mpeg.PID
+	havePcr     bool
+	lastPcr     uint64
+	basePcr     uint64
+	baseArrival time.Time
+
+	windowStart  time.Time
+	windowMin    time.Duration
+	windowMax    time.Duration
+	pcrJitter    time.Duration
+	pcrJitterMax time.Duration
+}
+
+type ArrivalStatusMessage struct {
+	KernelTimestamps bool    `json:"kernel_timestamps"`
+	JitterMs         float64 `json:"jitter_ms"`
+	MeanIntervalMs   float64 `json:"mean_interval_ms"`
+	MaxGapMs         float64 `json:"max_gap_ms"`
+
+	// Histogram counts, one more than the bucket bounds
+	IntervalBucketsUs []int64  `json:"interval_buckets_us"`
+	Intervals         []uint64 `json:"intervals"`
+	BurstBuckets      []int    `json:"burst_buckets"`
+	Bursts            []uint64 `json:"bursts"`
+	MaxBurst          int      `json:"max_burst"`
+
+	PcrPid         int     `json:"pcr_pid,omitempty"`
+	PcrJitterMs    float64 `json:"pcr_jitter_ms"`
+	PcrJitterMaxMs float64 `json:"pcr_jitter_max_ms"`
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Arrive records the arrival of a datagram.
+func (a *arrivalStats) Arrive(ts time.Time, kernel bool) {
+	if a.intervals == nil {
+		a.intervals = make([]uint64, len(ARRIVAL_INTERVAL_BUCKETS)+1)
+		a.bursts = make([]uint64, len(ARRIVAL_BURST_BUCKETS)+1)
+	}
+
+	a.kernel = kernel
+
+	if a.last.IsZero() {
+		a.last = ts
+		a.burst = 1
+		return
+	}
+
+	gap := ts.Sub(a.last)
+	a.last = ts
+
+	if gap < 0 {
+		gap = 0
+	}
+
+	i := 0
+	for i < len(ARRIVAL_INTERVAL_BUCKETS) && gap > ARRIVAL_INTERVAL_BUCKETS[i] {
+		i++
+	}
+	a.intervals[i]++
+
+	if gap > a.maxGap {
+		a.maxGap = gap
+	}
+
+	if a.mean == 0 {
+		a.mean = float64(gap)
+	} else {
+		a.jitter += (math.Abs(float64(gap)-a.mean) - a.jitter) / ARRIVAL_SMOOTHING
+		a.mean += (float64(gap) - a.mean) / ARRIVAL_SMOOTHING
+	}
+
+	if gap < ARRIVAL_BURST_GAP {
+		a.burst++
+		return
+	}
+
+	a.endBurst()
+	a.burst = 1
+}
+
+func (a *arrivalStats) endBurst() {
+	i := 0
+	for i < len(ARRIVAL_BURST_BUCKETS) && a.burst > ARRIVAL_BURST_BUCKETS[i] {
+		i++
+	}
+	a.bursts[i]++
+
+	if a.burst > a.maxBurst {
+		a.maxBurst = a.burst
+	}
+}
+
+// ScanPcr compares the PCRs in a datagram of TS packets with its arrival
+// time. Only the first PID seen carrying a PCR is used.
+func (a *arrivalStats) ScanPcr(buf []byte, ts time.Time) {
+	for offs := 0; offs+mpeg.TS_PACKET_LENGTH <= len(buf); offs += mpeg.TS_PACKET_LENGTH {
+		pkt := mpeg.TsBuffer(buf[offs : offs+mpeg.TS_PACKET_LENGTH])
+
+		if !pkt.IsValid() {
+			continue
+		}
+
+		pcr, ok := pkt.GetPcr()
+		if !ok {
+			continue
+		}
+
+		if !a.havePcr {
+			a.pcrPid = pkt.GetPid()
+			a.havePcr = true
+			a.rebasePcr(pcr, ts)
+			continue
+		}
+
+		if pkt.GetPid() != a.pcrPid {
+			continue
+		}
+
+		step := (pcr + mpeg.PCR_WRAP - a.lastPcr) % mpeg.PCR_WRAP
+		if step > ARRIVAL_MAX_PCR_STEP {
+			a.rebasePcr(pcr, ts)
+			continue
+		}
+
+		a.lastPcr = pcr
+
+		elapsed := (pcr + mpeg.PCR_WRAP - a.basePcr) % mpeg.PCR_WRAP
+		offset := ts.Sub(a.baseArrival) - time.Duration(elapsed*1000/27)
+
+		if ts.Sub(a.windowStart) >= ARRIVAL_PCR_WINDOW {
+			a.pcrJitter = a.windowMax - a.windowMin
+			if a.pcrJitter > a.pcrJitterMax {
+				a.pcrJitterMax = a.pcrJitter
+			}
+
+			a.windowStart = ts
+			a.windowMin = offset
+			a.windowMax = offset
+			continue
+		}
+
+		if offset < a.windowMin {
+			a.windowMin = offset
+		}
+
+		if offset > a.windowMax {
+			a.windowMax = offset
+		}
+	}
+}
+
+func (a *arrivalStats) rebasePcr(pcr uint64, ts time.Time) {
+	a.basePcr = pcr
+	a.lastPcr = pcr
+	a.baseArrival = ts
+	a.windowStart = ts
+	a.windowMin = 0
+	a.windowMax = 0
+}
+
+func (a *arrivalStats) Status() *ArrivalStatusMessage {
+	msg := &ArrivalStatusMessage{
+		KernelTimestamps: a.kernel,
+		JitterMs:         a.jitter / float64(time.Millisecond),
+		MeanIntervalMs:   a.mean / float64(time.Millisecond),
+		MaxGapMs:         durationMs(a.maxGap),
+		Intervals:        append([]uint64(nil), a.intervals...),
+		BurstBuckets:     ARRIVAL_BURST_BUCKETS,
+		Bursts:           append([]uint64(nil), a.bursts...),
+		MaxBurst:         a.maxBurst,
+		PcrJitterMs:      durationMs(a.pcrJitter),
+		PcrJitterMaxMs:   durationMs(a.pcrJitterMax),
+	}
+
+	for _, b := range ARRIVAL_INTERVAL_BUCKETS {
+		msg.IntervalBucketsUs = append(msg.IntervalBucketsUs, int64(b/time.Microsecond))
+	}
+
+	if a.havePcr {
+		msg.PcrPid = int(a.pcrPid)
+	}
+
+	return msg
+}
@@ -0,0 +1,117 @@
+package recstation
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"recstation/mpeg"
+)
+
+func TestArrivalBursts(t *testing.T) {
+	var a arrivalStats
+
+	ts := time.Unix(1000, 0)
+
+	// Ten bursts of four datagrams 10us apart, every 5ms
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 4; j++ {
+			a.Arrive(ts, true)
+			ts = ts.Add(10 * time.Microsecond)
+		}
+
+		ts = ts.Add(5 * time.Millisecond)
+	}
+
+	st := a.Status()
+
+	if st.MaxBurst != 4 || st.Bursts[2] != 9 {
+		t.Errorf("Bad bursts %v, max %d", st.Bursts, st.MaxBurst)
+	}
+
+	if st.Intervals[0] != 30 || st.Intervals[6] != 9 {
+		t.Errorf("Bad intervals %v", st.Intervals)
+	}
+
+	if st.MaxGapMs < 5 || st.MaxGapMs > 5.1 {
+		t.Errorf("Bad max gap %f", st.MaxGapMs)
+	}
+}
+
+func TestArrivalPcrJitter(t *testing.T) {
+	var a arrivalStats
+
+	pkt := mpeg.TsBuffer(makeTestTsPacket(0))
+	pkt[3] = 0x30
+	pkt[4] = 7
+
+	ts := time.Unix(1000, 0)
+	pcr := uint64(0)
+
+	// A PCR every 10ms arriving alternately on time and 2ms late
+	for i := 0; i < 300; i++ {
+		pkt.SetPcr(pcr)
+
+		arrival := ts
+		if i%2 == 1 {
+			arrival = arrival.Add(2 * time.Millisecond)
+		}
+
+		a.ScanPcr(pkt, arrival)
+
+		ts = ts.Add(10 * time.Millisecond)
+		pcr += 10 * mpeg.PCR_HZ / 1000
+	}
+
+	st := a.Status()
+
+	if st.PcrPid != 0x100 {
+		t.Errorf("Bad PCR PID %x", st.PcrPid)
+	}
+
+	if st.PcrJitterMs < 1.99 || st.PcrJitterMs > 2.01 || st.PcrJitterMaxMs < st.PcrJitterMs {
+		t.Errorf("Bad PCR jitter %f, max %f", st.PcrJitterMs, st.PcrJitterMaxMs)
+	}
+}
+
+func TestKernelTimestamps(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_TIMESTAMPNS is Linux only")
+	}
+
+	rx, err := ListenMcast(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rx.UdpConn.Close()
+
+	tx, err := net.DialUDP("udp4", nil, rx.UdpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+
+	before := time.Now()
+
+	if _, err := tx.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	oob := make([]byte, 1024)
+
+	_, oobn, _, _, err := rx.UdpConn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts, ok := rx.ParseTimestamp(oob[:oobn])
+	if !ok {
+		t.Fatal("No kernel timestamp")
+	}
+
+	if ts.Before(before.Add(-time.Second)) || ts.After(time.Now().Add(time.Second)) {
+		t.Errorf("Timestamp %s out of range", ts)
+	}
+}
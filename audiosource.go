@@ -12,6 +12,9 @@ import (
 
 const (
 	AUDIO_RAW_BUF_SIZE = 100 * mpeg.TS_PACKET_LENGTH
+
+	// Name of the sink and output config of the ALSA capture
+	AUDIO_SINK_NAME = "audio"
 )
 
 const (
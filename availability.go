@@ -0,0 +1,143 @@
+package recstation
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// Outages kept per stream, older ones only count towards the total
+	AVAILABILITY_MAX_OUTAGES = 50
+
+	OFFLINE_DEFAULT_GRACE    = 10 * time.Second
+	OFFLINE_CHECK_INTERVAL   = 1 * time.Second
+	AVAILABILITY_TIME_FORMAT = time.RFC3339
+)
+
+type outage struct {
+	start time.Time
+	end   time.Time
+
+	// Over within the grace period, so the stream kept its sink and file
+	short bool
+}
+
+// availability is the online history of one stream since it was first seen.
+type availability struct {
+	first      time.Time
+	since      time.Time
+	online     bool
+	upTotal    time.Duration
+	outages    []*outage
+	numOutages int
+}
+
+type AvailabilityStatusMessage struct {
+	Name            string                 `json:"name"`
+	Online          bool                   `json:"online"`
+	UptimePercent   float64                `json:"uptime_percent"`
+	ObservedSeconds float64                `json:"observed_seconds"`
+	NumOutages      int                    `json:"num_outages"`
+	Outages         []*OutageStatusMessage `json:"outages"`
+}
+
+type OutageStatusMessage struct {
+	Start    string  `json:"start"`
+	End      string  `json:"end,omitempty"`
+	Duration float64 `json:"duration"`
+	Short    bool    `json:"short"`
+}
+
+// offlineGrace holds the sink of a stream that has gone offline until the
+// deadline, in case it comes back. Heartbeat streams are torn down by group,
+// the others through their input.
+type offlineGrace struct {
+	Deadline time.Time
+	Group    net.IP
+	Input    StreamInput
+}
+
+func (a *availability) Up(now time.Time) {
+	if a.first.IsZero() {
+		a.first = now
+	}
+
+	if a.online {
+		return
+	}
+
+	if n := len(a.outages); n > 0 && a.outages[n-1].end.IsZero() {
+		a.outages[n-1].end = now
+	}
+
+	a.online = true
+	a.since = now
+}
+
+// Resume ends an outage that was over within the grace period.
+func (a *availability) Resume(now time.Time) {
+	if n := len(a.outages); n > 0 && a.outages[n-1].end.IsZero() {
+		a.outages[n-1].short = true
+	}
+
+	a.Up(now)
+}
+
+func (a *availability) Down(now time.Time) {
+	if !a.online {
+		return
+	}
+
+	a.upTotal += now.Sub(a.since)
+	a.online = false
+	a.since = now
+	a.numOutages++
+
+	a.outages = append(a.outages, &outage{start: now})
+	if len(a.outages) > AVAILABILITY_MAX_OUTAGES {
+		a.outages = a.outages[1:]
+	}
+}
+
+func (a *availability) Status(name string, now time.Time) *AvailabilityStatusMessage {
+	up := a.upTotal
+	if a.online {
+		up += now.Sub(a.since)
+	}
+
+	observed := now.Sub(a.first)
+
+	msg := &AvailabilityStatusMessage{
+		Name:            name,
+		Online:          a.online,
+		UptimePercent:   100,
+		ObservedSeconds: observed.Seconds(),
+		NumOutages:      a.numOutages,
+		Outages:         make([]*OutageStatusMessage, 0, len(a.outages)),
+	}
+
+	if observed > 0 {
+		msg.UptimePercent = 100 * float64(up) / float64(observed)
+	}
+
+	for _, o := range a.outages {
+		end := o.end
+		if end.IsZero() {
+			end = now
+		}
+
+		out := &OutageStatusMessage{
+			Start:    o.start.Format(AVAILABILITY_TIME_FORMAT),
+			Duration: end.Sub(o.start).Seconds(),
+			Short:    o.short,
+		}
+
+		if !o.end.IsZero() {
+			out.End = o.end.Format(AVAILABILITY_TIME_FORMAT)
+		}
+
+		msg.Outages = append(msg.Outages, out)
+	}
+
+	return msg
+}
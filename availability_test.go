@@ -0,0 +1,50 @@
+package recstation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAvailability(t *testing.T) {
+	var a availability
+	start := time.Now()
+
+	at := func(s int) time.Time {
+		return start.Add(time.Duration(s) * time.Second)
+	}
+
+	a.Up(at(0))
+	a.Down(at(60))
+	a.Resume(at(65))
+	a.Down(at(90))
+	a.Up(at(100))
+
+	st := a.Status("test", at(100))
+
+	if st.UptimePercent != 85 {
+		t.Errorf("Uptime %f%%, expected 85%%", st.UptimePercent)
+	}
+
+	if st.NumOutages != 2 || len(st.Outages) != 2 {
+		t.Fatalf("Got %d outages", st.NumOutages)
+	}
+
+	if !st.Outages[0].Short || st.Outages[0].Duration != 5 {
+		t.Errorf("First outage %+v", st.Outages[0])
+	}
+
+	if st.Outages[1].Short || st.Outages[1].Duration != 10 {
+		t.Errorf("Second outage %+v", st.Outages[1])
+	}
+
+	for i := 0; i < AVAILABILITY_MAX_OUTAGES; i++ {
+		a.Down(at(200 + 2*i))
+		a.Up(at(201 + 2*i))
+	}
+
+	st = a.Status("test", at(1000))
+
+	if st.NumOutages != AVAILABILITY_MAX_OUTAGES+2 || len(st.Outages) != AVAILABILITY_MAX_OUTAGES {
+		t.Errorf("Got %d outages, %d listed", st.NumOutages, len(st.Outages))
+	}
+}
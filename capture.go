@@ -0,0 +1,286 @@
+package recstation
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"recstation/pcap"
+)
+
+const (
+	// Datagrams waiting to be written before the capture starts dropping
+	CAPTURE_QUEUE_LENGTH = 4096
+
+	CAPTURE_DEFAULT_MAX_BYTES = 64 << 20
+	CAPTURE_DEFAULT_DURATION  = 60 * time.Second
+
+	CAPTURE_LIMIT_MAX_BYTES = 1 << 30
+	CAPTURE_LIMIT_DURATION  = 1 * time.Hour
+
+	// Finished captures kept for download, oldest removed first
+	CAPTURE_KEEP = 10
+
+	CAPTURE_WRITE_BUFFER = 256 * 1024
+)
+
+type capturedPacket struct {
+	ts  time.Time
+	src *net.UDPAddr
+	dst *net.UDPAddr
+	buf []byte
+}
+
+// Capture writes the raw datagrams received for a group, or on the heartbeat
+// socket, to a pcapng file until it is stopped or reaches its size or
+// duration limit. The receive loops hand it copies without blocking.
+type Capture struct {
+	// Counters first for 64-bit atomic alignment
+	packets  uint64
+	bytes    uint64
+	dropped  uint64
+	finished int32
+
+	Id        int
+	Group     net.IP
+	Heartbeat bool
+	Filename  string
+	MaxBytes  int64
+	Duration  time.Duration
+	Started   time.Time
+
+	err   error
+	queue chan capturedPacket
+	stop  chan bool
+}
+
+type CaptureStatusMessage struct {
+	Id        int     `json:"id"`
+	Group     string  `json:"group"`
+	Heartbeat bool    `json:"heartbeat"`
+	Started   string  `json:"started"`
+	Elapsed   float64 `json:"elapsed"`
+	Packets   uint64  `json:"packets"`
+	Bytes     uint64  `json:"bytes"`
+	Dropped   uint64  `json:"dropped"`
+	Running   bool    `json:"running"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// MakeCapture opens the capture file in dir and starts writing. A nil group
+// captures every datagram on the socket.
+func MakeCapture(id int, dir string, group net.IP, heartbeat bool, maxBytes int64, duration time.Duration) (*Capture, error) {
+	if maxBytes <= 0 {
+		maxBytes = CAPTURE_DEFAULT_MAX_BYTES
+	}
+
+	if maxBytes > CAPTURE_LIMIT_MAX_BYTES {
+		maxBytes = CAPTURE_LIMIT_MAX_BYTES
+	}
+
+	if duration <= 0 {
+		duration = CAPTURE_DEFAULT_DURATION
+	}
+
+	if duration > CAPTURE_LIMIT_DURATION {
+		duration = CAPTURE_LIMIT_DURATION
+	}
+
+	what := "all"
+	if group != nil {
+		what = strings.Replace(group.String(), ":", "-", -1)
+	}
+
+	if heartbeat {
+		what = "heartbeat-" + what
+	}
+
+	started := time.Now()
+
+	capture := &Capture{
+		Id:        id,
+		Group:     group,
+		Heartbeat: heartbeat,
+		Filename:  filepath.Join(dir, fmt.Sprintf("recstation-capture-%d-%s-%s.pcapng", id, what, started.Format("20060102-150405"))),
+		MaxBytes:  maxBytes,
+		Duration:  duration,
+		Started:   started,
+		queue:     make(chan capturedPacket, CAPTURE_QUEUE_LENGTH),
+		stop:      make(chan bool, 1),
+	}
+
+	f, err := os.Create(capture.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriterSize(f, CAPTURE_WRITE_BUFFER)
+
+	pw, err := pcap.NewWriter(w)
+	if err != nil {
+		f.Close()
+		os.Remove(capture.Filename)
+		return nil, err
+	}
+
+	log.Printf("Capture %d of %s started to %s", id, what, capture.Filename)
+
+	go capture.WriteLoop(f, w, pw)
+
+	return capture, nil
+}
+
+func (capture *Capture) WriteLoop(f *os.File, w *bufio.Writer, pw *pcap.Writer) {
+	timer := time.NewTimer(capture.Duration)
+	defer timer.Stop()
+
+	total := int64(0)
+	running := true
+
+	for running {
+		select {
+		case pkt := <-capture.queue:
+			n, err := pw.WriteUdp(pkt.ts, pkt.src, pkt.dst, pkt.buf)
+			if err == pcap.ErrMixedFamilies {
+				continue
+			}
+
+			if err != nil {
+				capture.err = err
+				running = false
+				break
+			}
+
+			total += int64(n)
+
+			atomic.AddUint64(&capture.packets, 1)
+			atomic.StoreUint64(&capture.bytes, uint64(total))
+
+			if total >= capture.MaxBytes {
+				running = false
+			}
+
+		case <-timer.C:
+			running = false
+
+		case <-capture.stop:
+			running = false
+		}
+	}
+
+	if err := w.Flush(); err != nil && capture.err == nil {
+		capture.err = err
+	}
+
+	if err := f.Close(); err != nil && capture.err == nil {
+		capture.err = err
+	}
+
+	if capture.err != nil {
+		log.Printf("Capture %d failed: %s", capture.Id, capture.err)
+	} else {
+		log.Printf("Capture %d finished, %d packets", capture.Id, atomic.LoadUint64(&capture.packets))
+	}
+
+	atomic.StoreInt32(&capture.finished, 1)
+}
+
+func (capture *Capture) Finished() bool {
+	return atomic.LoadInt32(&capture.finished) != 0
+}
+
+func (capture *Capture) Stop() {
+	select {
+	case capture.stop <- true:
+	default:
+	}
+}
+
+// Remove stops the capture and deletes its file once it has finished.
+func (capture *Capture) Remove() {
+	capture.Stop()
+
+	go (func() {
+		for !capture.Finished() {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		os.Remove(capture.Filename)
+	})()
+}
+
+func (capture *Capture) Matches(dst net.IP, heartbeat bool) bool {
+	return capture.Heartbeat == heartbeat && (capture.Group == nil || capture.Group.Equal(dst))
+}
+
+// Write queues a copy of a datagram, or counts it as dropped when the writer
+// has fallen behind.
+func (capture *Capture) Write(ts time.Time, src, dst *net.UDPAddr, buf []byte) {
+	pkt := capturedPacket{
+		ts:  ts,
+		src: src,
+		dst: dst,
+		buf: append([]byte(nil), buf...),
+	}
+
+	select {
+	case capture.queue <- pkt:
+	default:
+		atomic.AddUint64(&capture.dropped, 1)
+	}
+}
+
+func (capture *Capture) Status() *CaptureStatusMessage {
+	st := &CaptureStatusMessage{
+		Id:        capture.Id,
+		Group:     "all",
+		Heartbeat: capture.Heartbeat,
+		Started:   capture.Started.Format(time.RFC3339),
+		Packets:   atomic.LoadUint64(&capture.packets),
+		Bytes:     atomic.LoadUint64(&capture.bytes),
+		Dropped:   atomic.LoadUint64(&capture.dropped),
+		Running:   !capture.Finished(),
+	}
+
+	if capture.Group != nil {
+		st.Group = capture.Group.String()
+	}
+
+	if st.Running {
+		st.Elapsed = time.Since(capture.Started).Seconds()
+	} else if capture.err != nil {
+		st.Error = capture.err.Error()
+	}
+
+	return st
+}
+
+// writeCaptures hands a datagram to the matching captures and returns the
+// list without the ones that have finished.
+func writeCaptures(captures []*Capture, heartbeat bool, ts time.Time, src, dst *net.UDPAddr, buf []byte) []*Capture {
+	live := captures[:0]
+
+	for _, capture := range captures {
+		if capture.Finished() {
+			continue
+		}
+
+		live = append(live, capture)
+
+		if capture.Matches(dst.IP, heartbeat) {
+			capture.Write(ts, src, dst, buf)
+		}
+	}
+
+	for i := len(live); i < len(captures); i++ {
+		captures[i] = nil
+	}
+
+	return live
+}
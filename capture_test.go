@@ -0,0 +1,50 @@
+package recstation
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCaptureLimit(t *testing.T) {
+	group := net.IPv4(239, 1, 1, 1)
+
+	capture, err := MakeCapture(1, t.TempDir(), group, false, 4096, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captures := []*Capture{capture}
+
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	other := &net.UDPAddr{IP: net.IPv4(239, 1, 1, 2), Port: 5004}
+	dst := &net.UDPAddr{IP: group, Port: 5004}
+	payload := make([]byte, 7*188)
+
+	for i := 0; i < 100 && len(captures) > 0; i++ {
+		captures = writeCaptures(captures, false, time.Now(), src, other, payload)
+		captures = writeCaptures(captures, true, time.Now(), src, dst, payload)
+		captures = writeCaptures(captures, false, time.Now(), src, dst, payload)
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(captures) != 0 {
+		t.Fatal("Capture did not stop at its size limit")
+	}
+
+	st := capture.Status()
+	if st.Running || st.Error != "" || st.Packets != 3 {
+		t.Fatalf("Bad status %+v", st)
+	}
+
+	fi, err := os.Stat(capture.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uint64(fi.Size()) <= st.Bytes {
+		t.Errorf("File is %d bytes, %d written", fi.Size(), st.Bytes)
+	}
+}
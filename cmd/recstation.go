@@ -4,11 +4,17 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 
 	"recstation"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		recstation.RunSimulate(os.Args[2:])
+		return
+	}
+
 	go func() {
 		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
 	}()
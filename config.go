@@ -7,22 +7,57 @@ import (
 )
 
 type ConfigJson struct {
-	IfaceName           string            `json:"iface"`
-	OutputFilename      string            `json:"output_filename"`
-	OutputTimestamp     string            `json:"output_timestamp"`
-	Multicast2Name      map[string]string `json:"multicasts"`
-	NewOutputEveryDur   string            `json:"new_output_every"`
-	SourceListen        string            `json:"source_listen"`
-	HeartbeatListen     string            `json:"heartbeat_listen"`
-	HeartbeatTimeoutDur string            `json:"heartbeat_timeout"`
-	HttpListen          string            `json:"http_listen"`
-	AlsaDevice          string            `json:"alsa_device"`
-	AlsaNumChannels     int               `json:"alsa_num_channels"`
-	AlsaBitrate         int               `json:"alsa_bitrate"`
+	IfaceName               string            `json:"iface"`
+	OutputFilename          string            `json:"output_filename"`
+	OutputTimestamp         string            `json:"output_timestamp"`
+	Multicast2Name          map[string]string `json:"multicasts"`
+	NewOutputEveryDur       string            `json:"new_output_every"`
+	SourceListen            string            `json:"source_listen"`
+	SourceRcvBuf            int               `json:"source_rcvbuf"`
+	HeartbeatListen         string            `json:"heartbeat_listen"`
+	HeartbeatTimeoutDur     string            `json:"heartbeat_timeout"`
+	HeartbeatOnlineCount    int               `json:"heartbeat_online_count"`
+	RequireSignedHeartbeats bool              `json:"require_signed_heartbeats"`
+	OfflineGraceDur         string            `json:"offline_grace"`
+	IgmpQuerier             bool              `json:"igmp_querier"`
+	IgmpQueryIntervalDur    string            `json:"igmp_query_interval"`
+	HttpListen              string            `json:"http_listen"`
+	CaptureDir              string            `json:"capture_dir"`
+	AlsaDevice              string            `json:"alsa_device"`
+	AlsaNumChannels         int               `json:"alsa_num_channels"`
+	AlsaBitrate             int               `json:"alsa_bitrate"`
 
 	PreviewFramerate int `json:"preview_framerate"`
 	PreviewWidth     int `json:"preview_width"`
 	PreviewHeight    int `json:"preview_height"`
+
+	Outputs map[string]OutputConfigJson       `json:"outputs"`
+	Streams map[string]StreamConfigJson       `json:"streams"`
+	Statics map[string]StaticStreamConfigJson `json:"static_streams"`
+
+	// Stream name to http://, https:// or tcp:// URL to pull TS from
+	Pulls map[string]string `json:"pulls"`
+
+	Replays map[string]ReplayConfigJson `json:"replays"`
+	Relays  map[string]RelayConfigJson  `json:"relays"`
+}
+
+const (
+	OUTPUT_FORMAT_TS  = "ts"
+	OUTPUT_FORMAT_MP4 = "mp4"
+)
+
+type OutputConfigJson struct {
+	Format string `json:"format"`
+	KeepTs bool   `json:"keep_ts"`
+}
+
+func (out OutputConfigJson) WantTs() bool {
+	return out.Format != OUTPUT_FORMAT_MP4 || out.KeepTs
+}
+
+func (out OutputConfigJson) WantMp4() bool {
+	return out.Format == OUTPUT_FORMAT_MP4
 }
 
 func (cfg *ConfigJson) DecodeJson(r io.Reader) error {
@@ -43,3 +78,99 @@ func (cfg *ConfigJson) OpenJson(filename string) error {
 
 	return cfg.DecodeJson(f)
 }
+
+const (
+	RTP_MODE_AUTO = "auto"
+	RTP_MODE_ON   = "on"
+	RTP_MODE_OFF  = "off"
+)
+
+const (
+	LIVENESS_HEARTBEAT = "heartbeat"
+	LIVENESS_TRAFFIC   = "traffic"
+)
+
+type StreamConfigJson struct {
+	Rtp             string `json:"rtp"`
+	RtpReorderDepth int    `json:"rtp_reorder_depth"`
+	Fec             bool   `json:"fec"`
+	Secondary       string `json:"secondary"`
+	SecondaryIface  string `json:"secondary_iface"`
+
+	// Sender addresses for source-specific multicast
+	Source          string `json:"source"`
+	SecondarySource string `json:"secondary_source"`
+
+	// Drop packets and heartbeats from anyone but these senders, or from
+	// anyone but the first sender heard
+	AllowedSources []string `json:"allowed_sources"`
+	LockSource     bool     `json:"lock_source"`
+
+	// With traffic liveness the group is joined up front and the stream is
+	// online while packets arrive, for encoders that send no heartbeats.
+	// The idle timeout defaults to the heartbeat timeout.
+	Liveness       string `json:"liveness"`
+	IdleTimeoutDur string `json:"idle_timeout"`
+
+	// Hex key shared with the encoders of the stream, which sign the
+	// control datagrams sent to them and must sign their heartbeats
+	Key string `json:"key"`
+
+	// Hex keys of single encoders by encoder ID, in place of the key
+	EncoderKeys map[string]string `json:"encoder_keys"`
+
+	// Refuse heartbeats for the stream that are not signed with the key,
+	// which is already the case once it has any
+	SignedHeartbeats bool `json:"signed_heartbeats"`
+
+	// Take unsigned heartbeats in spite of the key, for encoders that can
+	// be controlled but cannot sign
+	AllowUnsignedHeartbeats bool `json:"allow_unsigned_heartbeats"`
+}
+
+func (sc StreamConfigJson) WantSignedHeartbeats() bool {
+	return sc.SignedHeartbeats || (sc.HasKeys() && !sc.AllowUnsignedHeartbeats)
+}
+
+func (sc StreamConfigJson) HasKeys() bool {
+	return sc.Key != "" || len(sc.EncoderKeys) > 0
+}
+
+func (sc StreamConfigJson) AllowRtp() bool {
+	return sc.Rtp != RTP_MODE_OFF
+}
+
+func (sc StreamConfigJson) AllowTs() bool {
+	return sc.Rtp != RTP_MODE_ON
+}
+
+func (sc StreamConfigJson) TrafficLiveness() bool {
+	return sc.Liveness == LIVENESS_TRAFFIC
+}
+
+// StaticStreamConfigJson describes a unicast stream that is not announced by
+// heartbeat. It either has a port of its own or is told apart from the other
+// streams on the shared source port by its sender address.
+type StaticStreamConfigJson struct {
+	Listen string `json:"listen"`
+	Source string `json:"source"`
+}
+
+// ReplayConfigJson plays a TS file as if it were a live stream.
+type ReplayConfigJson struct {
+	File string `json:"file"`
+	Loop bool   `json:"loop"`
+}
+
+// RelayConfigJson forwards a received stream to a group or unicast
+// host:port. A zero TTL keeps the system default and no PIDs passes every
+// PID.
+type RelayConfigJson struct {
+	Stream string `json:"stream"`
+	Dest   string `json:"dest"`
+	Iface  string `json:"iface"`
+	Rtp    bool   `json:"rtp"`
+	Ttl    int    `json:"ttl"`
+	Dscp   int    `json:"dscp"`
+	Pids   []int  `json:"pids"`
+}
@@ -0,0 +1,221 @@
+package recstation
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"recstation/hbproto"
+)
+
+const (
+	// Sent again if no heartbeat has acknowledged it by then
+	CONTROL_RETRY_INTERVAL = 2 * time.Second
+	CONTROL_MAX_ATTEMPTS   = 5
+
+	// Commands waiting their turn per encoder
+	CONTROL_MAX_QUEUE = 8
+
+	// Finished commands kept per encoder for the status
+	CONTROL_HISTORY = 10
+)
+
+const (
+	CONTROL_STATE_QUEUED   = "queued"
+	CONTROL_STATE_SENT     = "sent"
+	CONTROL_STATE_ACKED    = "acked"
+	CONTROL_STATE_REJECTED = "rejected"
+	CONTROL_STATE_TIMEOUT  = "timeout"
+)
+
+var (
+	ErrNoSuchEncoder      = errors.New("No such encoder")
+	ErrNotControllable    = errors.New("Encoder has no key or predates control")
+	ErrControlQueueFull   = errors.New("Too many commands waiting for the encoder")
+	ErrBadControlArgument = errors.New("Bad argument for command")
+)
+
+// controlCommand is a command for an encoder. Commands go out one at a time,
+// each once the heartbeats have acknowledged the one before or it has given
+// up on it.
+type controlCommand struct {
+	ctl      hbproto.Control
+	state    string
+	created  time.Time
+	sent     time.Time
+	attempts int
+	ack      uint8
+}
+
+type ControlStatusMessage struct {
+	Sequence  uint32  `json:"sequence"`
+	Command   string  `json:"command"`
+	Argument  uint32  `json:"argument"`
+	State     string  `json:"state"`
+	Attempts  int     `json:"attempts"`
+	AckStatus uint8   `json:"ack_status"`
+	Age       float64 `json:"age"`
+}
+
+type controlRequest struct {
+	src      net.IP
+	dst      net.IP
+	command  uint8
+	argument uint32
+	resp     chan controlResponse
+}
+
+type controlResponse struct {
+	sequence uint32
+	err      error
+}
+
+// ControlRequestMessage asks RunMain to send a command to the encoder that
+// sends heartbeats from Src to Dst.
+type ControlRequestMessage struct {
+	Src      net.IP
+	Dst      net.IP
+	Command  uint8
+	Argument uint32
+	Resp     chan ControlResponse
+}
+
+type ControlResponse struct {
+	Sequence uint32
+	Err      error
+}
+
+func checkControlArgument(command uint8, argument uint32) error {
+	switch command {
+	case hbproto.COMMAND_START, hbproto.COMMAND_STOP, hbproto.COMMAND_KEYFRAME:
+		return nil
+
+	case hbproto.COMMAND_TALLY:
+		if argument > hbproto.TALLY_PREVIEW {
+			return ErrBadControlArgument
+		}
+
+		return nil
+
+	case hbproto.COMMAND_BITRATE:
+		if argument == 0 {
+			return ErrBadControlArgument
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Unknown command %d", command)
+}
+
+func (cmd *controlCommand) Status(now time.Time) *ControlStatusMessage {
+	return &ControlStatusMessage{
+		Sequence:  cmd.ctl.Sequence,
+		Command:   cmd.ctl.Name(),
+		Argument:  cmd.ctl.Argument,
+		State:     cmd.state,
+		Attempts:  cmd.attempts,
+		AckStatus: cmd.ack,
+		Age:       now.Sub(cmd.created).Seconds(),
+	}
+}
+
+// queueControl adds a command behind the ones that are still unfinished.
+func (node *activeNode) queueControl(ctl hbproto.Control, now time.Time) error {
+	waiting := 0
+	for _, cmd := range node.commands {
+		if cmd.state == CONTROL_STATE_QUEUED || cmd.state == CONTROL_STATE_SENT {
+			waiting++
+		}
+	}
+
+	if waiting >= CONTROL_MAX_QUEUE {
+		return ErrControlQueueFull
+	}
+
+	node.commands = append(node.commands, &controlCommand{
+		ctl:     ctl,
+		state:   CONTROL_STATE_QUEUED,
+		created: now,
+	})
+
+	// Forget the oldest finished commands
+	excess := len(node.commands) - CONTROL_HISTORY - waiting - 1
+	kept := node.commands[:0]
+	for _, cmd := range node.commands {
+		if excess > 0 && cmd.state != CONTROL_STATE_QUEUED && cmd.state != CONTROL_STATE_SENT {
+			excess--
+			continue
+		}
+
+		kept = append(kept, cmd)
+	}
+	node.commands = kept
+
+	return nil
+}
+
+// ackControl finishes the command in flight if the heartbeat acknowledges
+// it.
+func (node *activeNode) ackControl(hb *hbproto.Heartbeat) {
+	if hb.Version < hbproto.VERSION_2 {
+		return
+	}
+
+	for _, cmd := range node.commands {
+		if cmd.state != CONTROL_STATE_SENT || cmd.ctl.Sequence != hb.AckSequence {
+			continue
+		}
+
+		cmd.ack = hb.AckStatus
+		cmd.state = CONTROL_STATE_ACKED
+		if hb.AckStatus != hbproto.ACK_OK {
+			cmd.state = CONTROL_STATE_REJECTED
+		}
+	}
+}
+
+// nextControl returns the command to send now, if any: the one in flight once
+// it is due to be sent again, or else the next one queued.
+func (node *activeNode) nextControl(now time.Time) *controlCommand {
+	for _, cmd := range node.commands {
+		switch cmd.state {
+		case CONTROL_STATE_SENT:
+			if now.Sub(cmd.sent) < CONTROL_RETRY_INTERVAL {
+				return nil
+			}
+
+			if cmd.attempts < CONTROL_MAX_ATTEMPTS {
+				return cmd
+			}
+
+			cmd.state = CONTROL_STATE_TIMEOUT
+
+		case CONTROL_STATE_QUEUED:
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+// sendControl sends whatever command is due to the address the heartbeats
+// come from, on the socket they arrive on.
+func (node *activeNode) sendControl(key []byte, now time.Time) {
+	cmd := node.nextControl(now)
+	if cmd == nil {
+		return
+	}
+
+	cmd.state = CONTROL_STATE_SENT
+	cmd.sent = now
+	cmd.attempts++
+
+	addr := &net.UDPAddr{IP: node.src, Port: node.srcPort}
+
+	if _, err := node.conn.UdpConn.WriteToUDP(cmd.ctl.Encode(nil, key), addr); err != nil {
+		log.Printf("Control %s to %s failed: %s", cmd.ctl.Name(), addr, err)
+	}
+}
@@ -0,0 +1,138 @@
+package recstation
+
+import (
+	"net"
+	"time"
+
+	"recstation/hbproto"
+)
+
+const (
+	// Signed heartbeats further from our clock than this are refused
+	HEARTBEAT_MAX_SKEW = 30 * time.Second
+)
+
+// encoderKey identifies an encoder for replay protection. The key is that of
+// the group, so it is only unique together with the group.
+type encoderKey struct {
+	dst IPKey
+	id  uint16
+}
+
+// heartbeatAuth checks signed heartbeats against the key of the encoder that
+// sends them, or else that of the group they are sent to. A signature is
+// checked whenever there is a key to check it with, and required for groups
+// that ask for it, or for all of them.
+type heartbeatAuth struct {
+	Require bool
+
+	keys        map[IPKey][]byte
+	encoderKeys map[encoderKey][]byte
+	signed      map[IPKey]bool
+
+	// Timestamp of the last heartbeat accepted from each encoder
+	last map[encoderKey]uint64
+
+	Unsigned     uint64
+	BadSignature uint64
+	Replayed     uint64
+	LastRejected string
+}
+
+type HeartbeatRejectStatusMessage struct {
+	Unsigned     uint64 `json:"unsigned"`
+	BadSignature uint64 `json:"bad_signature"`
+	Replayed     uint64 `json:"replayed"`
+	LastRejected string `json:"last_rejected,omitempty"`
+}
+
+func makeHeartbeatAuth(require bool) *heartbeatAuth {
+	return &heartbeatAuth{
+		Require:     require,
+		keys:        make(map[IPKey][]byte),
+		encoderKeys: make(map[encoderKey][]byte),
+		signed:      make(map[IPKey]bool),
+		last:        make(map[encoderKey]uint64),
+	}
+}
+
+func (auth *heartbeatAuth) AddGroup(group net.IP, key []byte, encoderKeys map[uint16][]byte, signed bool) {
+	if key != nil {
+		auth.keys[MakeIPKey(group)] = key
+	}
+
+	for id, key := range encoderKeys {
+		auth.encoderKeys[encoderKey{dst: MakeIPKey(group), id: id}] = key
+	}
+
+	if signed {
+		auth.signed[MakeIPKey(group)] = true
+	}
+}
+
+// Key returns the key of an encoder sending to a group.
+func (auth *heartbeatAuth) Key(group net.IP, id uint16) []byte {
+	if key, found := auth.encoderKeys[encoderKey{dst: MakeIPKey(group), id: id}]; found {
+		return key
+	}
+
+	return auth.keys[MakeIPKey(group)]
+}
+
+func (auth *heartbeatAuth) reject(counter *uint64, src net.IP) bool {
+	*counter++
+	auth.LastRejected = src.String()
+
+	return false
+}
+
+// Check decides whether to take a heartbeat, hb being nil for legacy ones.
+func (auth *heartbeatAuth) Check(buf []byte, hb *hbproto.Heartbeat, src, dst net.IP, now time.Time) bool {
+	dk := MakeIPKey(dst)
+	required := auth.Require || auth.signed[dk]
+
+	if hb == nil || !hb.Signed {
+		if required {
+			return auth.reject(&auth.Unsigned, src)
+		}
+
+		return true
+	}
+
+	// Nothing to check it with
+	key := auth.Key(dst, hb.EncoderId)
+	if key == nil {
+		if required {
+			return auth.reject(&auth.Unsigned, src)
+		}
+
+		return true
+	}
+
+	if hbproto.Verify(buf, key) != nil {
+		return auth.reject(&auth.BadSignature, src)
+	}
+
+	skew := time.Duration(int64(hb.Timestamp)-now.UnixNano()/int64(time.Millisecond)) * time.Millisecond
+	if skew > HEARTBEAT_MAX_SKEW || skew < -HEARTBEAT_MAX_SKEW {
+		return auth.reject(&auth.Replayed, src)
+	}
+
+	ek := encoderKey{dst: dk, id: hb.EncoderId}
+	if hb.Timestamp <= auth.last[ek] {
+		return auth.reject(&auth.Replayed, src)
+	}
+
+	auth.last[ek] = hb.Timestamp
+
+	return true
+}
+
+func (auth *heartbeatAuth) Status() *HeartbeatRejectStatusMessage {
+	return &HeartbeatRejectStatusMessage{
+		Unsigned:     auth.Unsigned,
+		BadSignature: auth.BadSignature,
+		Replayed:     auth.Replayed,
+		LastRejected: auth.LastRejected,
+	}
+}
@@ -0,0 +1,129 @@
+package recstation
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"recstation/hbproto"
+)
+
+func TestHeartbeatAuth(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+	src := net.IPv4(10, 1, 1, 47)
+	signedGroup := net.IPv4(239, 255, 1, 1)
+	keyedGroup := net.IPv4(239, 255, 1, 2)
+	openGroup := net.IPv4(239, 255, 1, 3)
+
+	auth := makeHeartbeatAuth(false)
+	auth.AddGroup(signedGroup, key, nil, true)
+	auth.AddGroup(keyedGroup, key, nil, false)
+
+	hb := hbproto.Heartbeat{EncoderId: 1}
+
+	check := func(dst net.IP, key []byte, ts time.Time) bool {
+		hb.Sequence++
+		hb.Timestamp = uint64(ts.UnixNano() / int64(time.Millisecond))
+
+		buf := hb.Encode(nil)
+		if key != nil {
+			buf = hb.EncodeSigned(nil, key)
+		}
+
+		var decoded hbproto.Heartbeat
+		if err := hbproto.Decode(buf, &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		return auth.Check(buf, &decoded, src, dst, now)
+	}
+
+	if check(signedGroup, nil, now) || auth.Unsigned != 1 {
+		t.Error("Unsigned heartbeat taken for a group that wants them signed")
+	}
+
+	if auth.Check(make([]byte, hbproto.HEADER_LENGTH), nil, src, signedGroup, now) || auth.Unsigned != 2 {
+		t.Error("Legacy heartbeat taken for a group that wants them signed")
+	}
+
+	if !check(signedGroup, key, now) {
+		t.Error("Signed heartbeat refused")
+	}
+
+	if !check(signedGroup, key, now.Add(time.Millisecond)) {
+		t.Error("Next signed heartbeat refused")
+	}
+
+	if check(signedGroup, key, now) || auth.Replayed != 1 {
+		t.Error("Replayed heartbeat taken")
+	}
+
+	if check(signedGroup, key, now.Add(-2*HEARTBEAT_MAX_SKEW)) || check(signedGroup, key, now.Add(2*HEARTBEAT_MAX_SKEW)) || auth.Replayed != 3 {
+		t.Error("Heartbeat with a timestamp out of range taken")
+	}
+
+	// A bad signature is refused even where none is needed
+	if check(keyedGroup, []byte("guess"), now) || auth.BadSignature != 1 {
+		t.Error("Heartbeat with a bad signature taken")
+	}
+
+	if !check(keyedGroup, nil, now) || !check(openGroup, nil, now) || !check(openGroup, key, now) {
+		t.Error("Heartbeat refused for a group that does not need signatures")
+	}
+
+	if auth.LastRejected != src.String() {
+		t.Errorf("Last rejected %s", auth.LastRejected)
+	}
+
+	auth.Require = true
+
+	if check(openGroup, nil, now) || check(openGroup, key, now.Add(time.Second)) {
+		t.Error("Heartbeat taken without a signature that can be checked")
+	}
+
+	if !check(keyedGroup, key, now.Add(time.Second)) {
+		t.Error("Signed heartbeat refused with signatures required")
+	}
+}
+
+func TestHeartbeatAuthEncoderKeys(t *testing.T) {
+	groupKey := []byte("group secret")
+	ownKey := []byte("encoder secret")
+	now := time.Now()
+	src := net.IPv4(10, 1, 1, 47)
+	group := net.IPv4(239, 255, 1, 1)
+
+	auth := makeHeartbeatAuth(false)
+	auth.AddGroup(group, groupKey, map[uint16][]byte{2: ownKey}, true)
+
+	if !bytes.Equal(auth.Key(group, 1), groupKey) || !bytes.Equal(auth.Key(group, 2), ownKey) {
+		t.Fatal("Wrong keys for the encoders")
+	}
+
+	check := func(id uint16, key []byte) bool {
+		hb := hbproto.Heartbeat{
+			EncoderId: id,
+			Timestamp: uint64(now.UnixNano() / int64(time.Millisecond)),
+		}
+
+		buf := hb.EncodeSigned(nil, key)
+
+		var decoded hbproto.Heartbeat
+		if err := hbproto.Decode(buf, &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		return auth.Check(buf, &decoded, src, group, now)
+	}
+
+	if !check(1, groupKey) || !check(2, ownKey) {
+		t.Error("Heartbeat signed with the right key refused")
+	}
+
+	// The group key is no good for an encoder with its own
+	if check(3, ownKey) || check(2, groupKey) || auth.BadSignature != 2 {
+		t.Error("Heartbeat signed with another encoder's key taken")
+	}
+}
@@ -0,0 +1,139 @@
+package hbproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	CONTROL_MAGIC_0 = 'R'
+	CONTROL_MAGIC_1 = 'C'
+
+	CONTROL_VERSION = 1
+
+	CONTROL_HEADER_LENGTH = 14
+	CONTROL_LENGTH        = CONTROL_HEADER_LENGTH + sha256.Size
+)
+
+const (
+	COMMAND_START    = 1
+	COMMAND_STOP     = 2
+	COMMAND_TALLY    = 3
+	COMMAND_KEYFRAME = 4
+
+	// Argument in kbit/s
+	COMMAND_BITRATE = 5
+)
+
+const (
+	TALLY_OFF     = 0
+	TALLY_PROGRAM = 1
+	TALLY_PREVIEW = 2
+)
+
+const (
+	ACK_OK          = 0
+	ACK_UNSUPPORTED = 1
+	ACK_FAILED      = 2
+)
+
+var COMMAND_NAMES = map[uint8]string{
+	COMMAND_START:    "start",
+	COMMAND_STOP:     "stop",
+	COMMAND_TALLY:    "tally",
+	COMMAND_KEYFRAME: "keyframe",
+	COMMAND_BITRATE:  "bitrate",
+}
+
+var ErrBadSignature = errors.New("hbproto: bad signature")
+
+// Control is the datagram recstation sends back to an encoder, at the address
+// its heartbeats come from. It is 46 bytes, all fields big endian:
+//
+//	0  magic "RC"
+//	2  version
+//	3  command
+//	4  encoder ID (16 bits)
+//	6  sequence number (32 bits), increasing from one command to the next
+//	10 argument (32 bits)
+//	14 HMAC-SHA256 of the bytes before it, with the key of the encoder
+//
+// The encoder acts on a command once, ignoring sequence numbers it has seen,
+// and acknowledges it in its heartbeats.
+type Control struct {
+	Command   uint8
+	EncoderId uint16
+	Sequence  uint32
+	Argument  uint32
+}
+
+func (ctl *Control) Name() string {
+	if name, ok := COMMAND_NAMES[ctl.Command]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// CommandByName returns the command of a name in COMMAND_NAMES, or 0.
+func CommandByName(name string) uint8 {
+	for cmd, n := range COMMAND_NAMES {
+		if n == name {
+			return cmd
+		}
+	}
+
+	return 0
+}
+
+func sign(key, buf []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf)
+
+	return mac.Sum(nil)
+}
+
+// Encode appends the signed datagram to buf.
+func (ctl *Control) Encode(buf []byte, key []byte) []byte {
+	var b [CONTROL_HEADER_LENGTH]byte
+
+	b[0] = CONTROL_MAGIC_0
+	b[1] = CONTROL_MAGIC_1
+	b[2] = CONTROL_VERSION
+	b[3] = ctl.Command
+	binary.BigEndian.PutUint16(b[4:], ctl.EncoderId)
+	binary.BigEndian.PutUint32(b[6:], ctl.Sequence)
+	binary.BigEndian.PutUint32(b[10:], ctl.Argument)
+
+	buf = append(buf, b[:]...)
+
+	return append(buf, sign(key, b[:])...)
+}
+
+// DecodeControl checks the signature of a control datagram and parses it.
+func DecodeControl(buf []byte, key []byte, ctl *Control) error {
+	if len(buf) < CONTROL_LENGTH {
+		return ErrShortPacket
+	}
+
+	if buf[0] != CONTROL_MAGIC_0 || buf[1] != CONTROL_MAGIC_1 {
+		return ErrBadMagic
+	}
+
+	if buf[2] != CONTROL_VERSION {
+		return ErrUnsupportedVersion
+	}
+
+	if !hmac.Equal(buf[CONTROL_HEADER_LENGTH:CONTROL_LENGTH], sign(key, buf[:CONTROL_HEADER_LENGTH])) {
+		return ErrBadSignature
+	}
+
+	ctl.Command = buf[3]
+	ctl.EncoderId = binary.BigEndian.Uint16(buf[4:])
+	ctl.Sequence = binary.BigEndian.Uint32(buf[6:])
+	ctl.Argument = binary.BigEndian.Uint32(buf[10:])
+
+	return nil
+}
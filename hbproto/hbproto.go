@@ -0,0 +1,185 @@
+package hbproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	MAGIC_0 = 'R'
+	MAGIC_1 = 'S'
+
+	VERSION_1 = 1
+	VERSION_2 = 2
+	VERSION   = VERSION_2
+
+	HEADER_LENGTH    = 14
+	V2_HEADER_LENGTH = 20
+
+	// Set in the version byte of signed heartbeats
+	VERSION_SIGNED = 0x80
+
+	// Timestamp and HMAC at the end of a signed heartbeat
+	SIGNATURE_LENGTH = 8 + sha256.Size
+
+	FLAG_STREAMING = 0x01
+	FLAG_AUDIO     = 0x02
+	FLAG_FAULT     = 0x80
+)
+
+var (
+	ErrShortPacket        = errors.New("hbproto: packet too short")
+	ErrBadMagic           = errors.New("hbproto: bad magic")
+	ErrUnsupportedVersion = errors.New("hbproto: unsupported version")
+	ErrNotSigned          = errors.New("hbproto: not signed")
+)
+
+// Heartbeat is the datagram an encoder sends to announce its stream.
+// Version 1 is 14 bytes, all fields big endian:
+//
+//	0  magic "RS"
+//	2  version
+//	3  state flags
+//	4  encoder ID (16 bits)
+//	6  sequence number (32 bits), incremented by one per heartbeat
+//	10 uptime in seconds (32 bits)
+//
+// Later versions keep this header and append to it. Version 2 adds the
+// acknowledgement of control datagrams, 20 bytes in all:
+//
+//	14 sequence number of the last control datagram acted on (32 bits)
+//	18 ack status of that datagram
+//	19 tally
+//
+// A signed heartbeat of any version has VERSION_SIGNED set in the version
+// byte and is followed by
+//
+//	timestamp in milliseconds since the Unix epoch (64 bits)
+//	HMAC-SHA256 of everything before it, with the key of the encoder
+type Heartbeat struct {
+	Version   uint8
+	Flags     uint8
+	EncoderId uint16
+	Sequence  uint32
+	Uptime    uint32
+
+	AckSequence uint32
+	AckStatus   uint8
+	Tally       uint8
+
+	Signed    bool
+	Timestamp uint64
+}
+
+func (hb *Heartbeat) Streaming() bool {
+	return hb.Flags&FLAG_STREAMING != 0
+}
+
+func (hb *Heartbeat) Fault() bool {
+	return hb.Flags&FLAG_FAULT != 0
+}
+
+// Encode appends the current version of the heartbeat to buf.
+func (hb *Heartbeat) Encode(buf []byte) []byte {
+	var b [V2_HEADER_LENGTH]byte
+
+	b[0] = MAGIC_0
+	b[1] = MAGIC_1
+	b[2] = VERSION
+	b[3] = hb.Flags
+	binary.BigEndian.PutUint16(b[4:], hb.EncoderId)
+	binary.BigEndian.PutUint32(b[6:], hb.Sequence)
+	binary.BigEndian.PutUint32(b[10:], hb.Uptime)
+	binary.BigEndian.PutUint32(b[14:], hb.AckSequence)
+	b[18] = hb.AckStatus
+	b[19] = hb.Tally
+
+	return append(buf, b[:]...)
+}
+
+// EncodeSigned appends the heartbeat signed with key, taking the timestamp
+// from hb.
+func (hb *Heartbeat) EncodeSigned(buf []byte, key []byte) []byte {
+	start := len(buf)
+
+	buf = hb.Encode(buf)
+	buf[start+2] |= VERSION_SIGNED
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], hb.Timestamp)
+	buf = append(buf, ts[:]...)
+
+	return append(buf, sign(key, buf[start:])...)
+}
+
+// Verify checks the signature of a signed heartbeat.
+func Verify(buf []byte, key []byte) error {
+	if len(buf) < HEADER_LENGTH+SIGNATURE_LENGTH || buf[2]&VERSION_SIGNED == 0 {
+		return ErrNotSigned
+	}
+
+	body := buf[:len(buf)-sha256.Size]
+
+	if !hmac.Equal(buf[len(body):], sign(key, body)) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+// Decode parses a heartbeat. Bytes beyond those the version defines are
+// ignored. The signature of a signed heartbeat is not checked, see Verify.
+func Decode(buf []byte, hb *Heartbeat) error {
+	if len(buf) < HEADER_LENGTH {
+		return ErrShortPacket
+	}
+
+	if buf[0] != MAGIC_0 || buf[1] != MAGIC_1 {
+		return ErrBadMagic
+	}
+
+	signed := buf[2]&VERSION_SIGNED != 0
+	var timestamp uint64
+
+	if signed {
+		if len(buf) < HEADER_LENGTH+SIGNATURE_LENGTH {
+			return ErrShortPacket
+		}
+
+		timestamp = binary.BigEndian.Uint64(buf[len(buf)-SIGNATURE_LENGTH:])
+		buf = buf[:len(buf)-SIGNATURE_LENGTH]
+	}
+
+	version := buf[2] &^ VERSION_SIGNED
+
+	switch version {
+	case VERSION_1:
+	case VERSION_2:
+		if len(buf) < V2_HEADER_LENGTH {
+			return ErrShortPacket
+		}
+
+	default:
+		return ErrUnsupportedVersion
+	}
+
+	*hb = Heartbeat{
+		Version:   version,
+		Flags:     buf[3],
+		EncoderId: binary.BigEndian.Uint16(buf[4:]),
+		Sequence:  binary.BigEndian.Uint32(buf[6:]),
+		Uptime:    binary.BigEndian.Uint32(buf[10:]),
+		Signed:    signed,
+		Timestamp: timestamp,
+	}
+
+	if hb.Version >= VERSION_2 {
+		hb.AckSequence = binary.BigEndian.Uint32(buf[14:])
+		hb.AckStatus = buf[18]
+		hb.Tally = buf[19]
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package hbproto
+
+import (
+	"testing"
+)
+
+func Test_Hbproto_Roundtrip(t *testing.T) {
+	in := Heartbeat{
+		Version:   VERSION,
+		Flags:     FLAG_STREAMING | FLAG_AUDIO,
+		EncoderId: 0x1234,
+		Sequence:  0xdeadbeef,
+		Uptime:    86400,
+
+		AckSequence: 42,
+		AckStatus:   ACK_UNSUPPORTED,
+		Tally:       TALLY_PROGRAM,
+	}
+
+	buf := in.Encode(nil)
+	if len(buf) != V2_HEADER_LENGTH {
+		t.Fatalf("Encoded %d bytes", len(buf))
+	}
+
+	var out Heartbeat
+
+	if err := Decode(buf, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out != in {
+		t.Errorf("Got %+v, expected %+v", out, in)
+	}
+
+	if !out.Streaming() || out.Fault() {
+		t.Errorf("Bad flags %x", out.Flags)
+	}
+}
+
+// Version 1 heartbeats decode without the acknowledgement.
+func Test_Hbproto_V1(t *testing.T) {
+	in := Heartbeat{
+		Flags:       FLAG_STREAMING,
+		EncoderId:   7,
+		Sequence:    3,
+		AckSequence: 9,
+	}
+
+	buf := in.Encode(nil)[:HEADER_LENGTH]
+	buf[2] = VERSION_1
+
+	var out Heartbeat
+
+	if err := Decode(buf, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Version != VERSION_1 || out.EncoderId != 7 || out.Sequence != 3 || out.AckSequence != 0 {
+		t.Errorf("Got %+v", out)
+	}
+}
+
+func Test_Hbproto_Control(t *testing.T) {
+	key := []byte("encoder key")
+
+	in := Control{
+		Command:   COMMAND_BITRATE,
+		EncoderId: 0x1234,
+		Sequence:  100,
+		Argument:  8000,
+	}
+
+	buf := in.Encode(nil, key)
+	if len(buf) != CONTROL_LENGTH {
+		t.Fatalf("Encoded %d bytes", len(buf))
+	}
+
+	var out Control
+
+	if err := DecodeControl(buf, key, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out != in || out.Name() != "bitrate" || CommandByName("bitrate") != COMMAND_BITRATE {
+		t.Errorf("Got %+v, expected %+v", out, in)
+	}
+
+	if err := DecodeControl(buf, []byte("other key"), &out); err != ErrBadSignature {
+		t.Errorf("Expected ErrBadSignature with the wrong key, got %v", err)
+	}
+
+	buf[13] ^= 1
+	if err := DecodeControl(buf, key, &out); err != ErrBadSignature {
+		t.Errorf("Expected ErrBadSignature for a changed argument, got %v", err)
+	}
+}
+
+func Test_Hbproto_Signed(t *testing.T) {
+	key := []byte("encoder key")
+
+	in := Heartbeat{
+		Version:   VERSION,
+		Flags:     FLAG_STREAMING,
+		EncoderId: 3,
+		Sequence:  17,
+		Signed:    true,
+		Timestamp: 1700000000123,
+	}
+
+	buf := in.EncodeSigned(nil, key)
+	if len(buf) != V2_HEADER_LENGTH+SIGNATURE_LENGTH {
+		t.Fatalf("Encoded %d bytes", len(buf))
+	}
+
+	if err := Verify(buf, key); err != nil {
+		t.Fatal(err)
+	}
+
+	var out Heartbeat
+
+	if err := Decode(buf, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out != in {
+		t.Errorf("Got %+v, expected %+v", out, in)
+	}
+
+	if err := Verify(buf, []byte("other key")); err != ErrBadSignature {
+		t.Errorf("Expected ErrBadSignature with the wrong key, got %v", err)
+	}
+
+	if err := Verify(in.Encode(nil), key); err != ErrNotSigned {
+		t.Errorf("Expected ErrNotSigned, got %v", err)
+	}
+
+	// The timestamp is covered too
+	buf[V2_HEADER_LENGTH] ^= 1
+	if err := Verify(buf, key); err != ErrBadSignature {
+		t.Errorf("Expected ErrBadSignature for a changed timestamp, got %v", err)
+	}
+}
+
+func Test_Hbproto_Errors(t *testing.T) {
+	var hb Heartbeat
+
+	buf := (&Heartbeat{}).Encode(nil)
+
+	if err := Decode(buf[:HEADER_LENGTH-1], &hb); err != ErrShortPacket {
+		t.Errorf("Expected ErrShortPacket, got %v", err)
+	}
+
+	legacy := make([]byte, HEADER_LENGTH)
+	if err := Decode(legacy, &hb); err != ErrBadMagic {
+		t.Errorf("Expected ErrBadMagic, got %v", err)
+	}
+
+	buf[2] = 99
+	if err := Decode(buf, &hb); err != ErrUnsupportedVersion {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
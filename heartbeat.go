@@ -1,18 +1,70 @@
 package recstation
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"time"
 
-	"golang.org/x/net/ipv4"
+	"recstation/hbproto"
 )
 
 type Heartbeat struct {
-	Conn    net.PacketConn
-	V4Conn  *ipv4.PacketConn
+	Conns   []*McastConn
 	Events  chan HeartbeatEvent
 	Timeout time.Duration
+
+	// Heartbeats heard before a stream goes online, so that an encoder
+	// whose link flaps does not bring its stream up on every stray one
+	OnlineCount int
+
+	// Refuse heartbeats without a valid signature for every group, not just
+	// those that ask for it
+	RequireSigned bool
+
+	StatusRequest chan chan *HeartbeatStatusMessage
+	addGroup      chan heartbeatGroup
+	addCapture    chan *Capture
+	control       chan controlRequest
+}
+
+type HeartbeatStatusMessage struct {
+	// Groups that have heard heartbeats from foreign sources
+	Foreign map[string]*SourceFilterStatusMessage `json:"foreign"`
+
+	Nodes    []*HeartbeatNodeStatusMessage `json:"nodes"`
+	Invalid  uint64                        `json:"invalid"`
+	Rejected *HeartbeatRejectStatusMessage `json:"rejected"`
+}
+
+type HeartbeatNodeStatusMessage struct {
+	Src       string  `json:"src"`
+	Dst       string  `json:"dst"`
+	Legacy    bool    `json:"legacy"`
+	Signed    bool    `json:"signed"`
+	Online    bool    `json:"online"`
+	Version   uint8   `json:"version,omitempty"`
+	EncoderId uint16  `json:"encoder_id"`
+	Flags     uint8   `json:"flags"`
+	Sequence  uint32  `json:"sequence"`
+	Uptime    uint32  `json:"uptime"`
+	Received  uint64  `json:"received"`
+	Lost      uint64  `json:"lost"`
+	Restarts  uint64  `json:"restarts"`
+	LastSeen  float64 `json:"last_seen"`
+
+	// The encoder has a key and acknowledges commands
+	Controllable bool                    `json:"controllable"`
+	Tally        uint8                   `json:"tally"`
+	Commands     []*ControlStatusMessage `json:"commands,omitempty"`
+}
+
+type heartbeatGroup struct {
+	group       net.IP
+	filter      *sourceFilter
+	key         []byte
+	encoderKeys map[uint16][]byte
+	signed      bool
 }
 
 const (
@@ -24,13 +76,44 @@ type HeartbeatEvent struct {
 	Event int
 	Src   net.IP
 	Dst   net.IP
+
+	// The heartbeat that brought the stream online, nil for encoders that
+	// predate the heartbeat format
+	Info *hbproto.Heartbeat
+
+	// Set for streams that are announced by an input rather than by a
+	// heartbeat
+	Name  string
+	Input StreamInput
+}
+
+// StreamInput is a source whose streams announce themselves, so the sink is
+// handed to the input once RunMain has made it.
+type StreamInput interface {
+	AttachSink(name string, sink *Sink)
+	DetachSink(name string)
 }
 
-const HEARTBEAT_PKTLEN = 14
+const (
+	HEARTBEAT_PKTLEN = hbproto.HEADER_LENGTH
+
+	// Sequence numbers further away than this mean the encoder restarted
+	// rather than that heartbeats were lost or reordered
+	HEARTBEAT_MAX_SEQ_GAP = 1000
+
+	// A heartbeat from behind the sequence is late rather than from a
+	// restarted encoder if its uptime is at most this many seconds behind
+	HEARTBEAT_LATE_UPTIME = 2
+
+	HEARTBEAT_DEFAULT_ONLINE_COUNT = 3
+)
 
 type listenMessage struct {
-	src net.IP
-	dst net.IP
+	conn *McastConn
+	src  *net.UDPAddr
+	dst  *net.UDPAddr
+	ts   time.Time
+	buf  []byte
 }
 
 const (
@@ -39,11 +122,110 @@ const (
 	WATCHDOG_STOP
 )
 
+// nodeKey identifies a stream announced by heartbeats. An encoder that sends
+// several programs to several groups is a node for each of them.
+type nodeKey struct {
+	src IPKey
+	dst IPKey
+}
+
+func makeNodeKey(src, dst net.IP) nodeKey {
+	return nodeKey{
+		src: MakeIPKey(src),
+		dst: MakeIPKey(dst),
+	}
+}
+
 type activeNode struct {
-	src net.IP
-	dst net.IP
+	src     net.IP
+	srcPort int
+	dst     net.IP
+
+	// Socket the heartbeats arrive on, which control datagrams go out of
+	conn *McastConn
 
 	control chan int
+
+	// Online has been sent for it
+	announced bool
+
+	info     hbproto.Heartbeat
+	legacy   bool
+	haveSeq  bool
+	received uint64
+	lost     uint64
+	restarts uint64
+	lastSeen time.Time
+
+	commands []*controlCommand
+}
+
+// update records a heartbeat and counts the ones missing from the sequence.
+func (node *activeNode) update(hb *hbproto.Heartbeat, legacy bool, now time.Time) {
+	node.received++
+	node.lastSeen = now
+	node.legacy = legacy
+
+	if legacy {
+		node.haveSeq = false
+		return
+	}
+
+	if node.haveSeq {
+		gap := int32(hb.Sequence - node.info.Sequence)
+
+		switch {
+		case gap > 0 && gap <= HEARTBEAT_MAX_SEQ_GAP && hb.Uptime >= node.info.Uptime:
+			node.lost += uint64(gap - 1)
+
+		case gap <= 0 && gap > -HEARTBEAT_MAX_SEQ_GAP && hb.Uptime <= node.info.Uptime && hb.Uptime+HEARTBEAT_LATE_UPTIME >= node.info.Uptime:
+			// Duplicate or late
+			return
+
+		default:
+			node.restarts++
+		}
+	}
+
+	node.info = *hb
+	node.haveSeq = true
+}
+
+func (node *activeNode) Controllable(key []byte) bool {
+	return key != nil && !node.legacy && node.info.Version >= hbproto.VERSION_2
+}
+
+func (node *activeNode) Status(key []byte) *HeartbeatNodeStatusMessage {
+	now := time.Now()
+
+	msg := &HeartbeatNodeStatusMessage{
+		Src:      node.src.String(),
+		Dst:      node.dst.String(),
+		Legacy:   node.legacy,
+		Online:   node.announced,
+		Received: node.received,
+		Lost:     node.lost,
+		Restarts: node.restarts,
+		LastSeen: now.Sub(node.lastSeen).Seconds(),
+
+		Controllable: node.Controllable(key),
+	}
+
+	if !node.legacy {
+		msg.Version = node.info.Version
+		msg.EncoderId = node.info.EncoderId
+		msg.Flags = node.info.Flags
+		msg.Sequence = node.info.Sequence
+		msg.Uptime = node.info.Uptime
+		msg.Tally = node.info.Tally
+		msg.Signed = node.info.Signed
+	}
+
+	for _, cmd := range node.commands {
+		msg.Commands = append(msg.Commands, cmd.Status(now))
+	}
+
+	return msg
 }
 
 func (node *activeNode) watchdog(timeout time.Duration, stop chan<- *activeNode) {
@@ -74,106 +256,370 @@ func (node *activeNode) watchdog(timeout time.Duration, stop chan<- *activeNode)
 	}
 }
 
-func listenLoop(conn *ipv4.PacketConn, msg chan<- listenMessage) error {
+func listenLoop(conn *McastConn, msg chan<- listenMessage) error {
 	buf := make([]byte, 2048)
+	oob := make([]byte, 2048)
+	port := conn.UdpConn.LocalAddr().(*net.UDPAddr).Port
 
 	for {
-		n, cm, _, err := conn.ReadFrom(buf)
+		n, oobn, _, src, err := conn.UdpConn.ReadMsgUDP(buf, oob)
 
 		if err != nil {
 			return err
 		}
 
-		if n != HEARTBEAT_PKTLEN {
+		ts := time.Now()
+
+		dst, _, err := conn.ParseControl(oob[:oobn])
+		if err != nil {
 			continue
 		}
 
-		// TODO FIXME: Parse content of heartbeat packet
-
+		// Everything on the socket goes to the run loop so that captures
+		// see it, the size is checked there
 		msg <- listenMessage{
-			src: cm.Src,
-			dst: cm.Dst,
+			conn: conn,
+			src:  &net.UDPAddr{IP: normalizeIP(src.IP), Port: src.Port},
+			dst:  &net.UDPAddr{IP: dst, Port: port},
+			ts:   ts,
+			buf:  append([]byte(nil), buf[:n]...),
 		}
 	}
 }
 
-func RunHeartbeat(conn *ipv4.PacketConn, timeout time.Duration, events chan<- HeartbeatEvent) {
+func (heartbeat *Heartbeat) RunLoop() {
 
-	live := make(map[uint32]*activeNode)
+	live := make(map[nodeKey]*activeNode)
+	filters := make(map[IPKey]*sourceFilter)
+	auth := makeHeartbeatAuth(heartbeat.RequireSigned)
+	invalid := uint64(0)
+
+	// Shared by all encoders, and starting from the time so that it keeps
+	// increasing across restarts
+	controlSeq := uint32(time.Now().Unix())
+	var captures []*Capture
 	stop := make(chan *activeNode)
 	incoming := make(chan listenMessage)
 
-	go (func() {
-		err := listenLoop(conn, incoming)
+	for _, conn := range heartbeat.Conns {
+		go (func(conn *McastConn) {
+			err := listenLoop(conn, incoming)
+
+			log.Printf("Listen loop failed: %s", err)
+		})(conn)
+	}
+
+	timeout := heartbeat.Timeout
+
+	// Events wait here rather than block the loop while the main loop may
+	// be waiting on it
+	var queued []HeartbeatEvent
 
-		log.Printf("Listen loop failed: %s", err)
-	})()
+	emit := func(ev HeartbeatEvent) {
+		if len(queued) == 0 {
+			select {
+			case heartbeat.Events <- ev:
+				return
+			default:
+			}
+		}
+
+		queued = append(queued, ev)
+	}
 
 	for {
+		var events chan HeartbeatEvent
+		var next HeartbeatEvent
+
+		if len(queued) > 0 {
+			events = heartbeat.Events
+			next = queued[0]
+		}
+
 		select {
+		case events <- next:
+			queued = queued[1:]
+
+		case hg := <-heartbeat.addGroup:
+			if hg.filter != nil {
+				filters[MakeIPKey(hg.group)] = hg.filter
+			}
+
+			auth.AddGroup(hg.group, hg.key, hg.encoderKeys, hg.signed)
+
+		case req := <-heartbeat.control:
+			node, found := live[makeNodeKey(req.src, req.dst)]
+			if !found {
+				req.resp <- controlResponse{err: ErrNoSuchEncoder}
+				continue
+			}
+
+			key := auth.Key(req.dst, node.info.EncoderId)
+
+			switch {
+			case !node.Controllable(key):
+				req.resp <- controlResponse{err: ErrNotControllable}
+				continue
+			}
+
+			controlSeq++
+
+			ctl := hbproto.Control{
+				Command:   req.command,
+				EncoderId: node.info.EncoderId,
+				Sequence:  controlSeq,
+				Argument:  req.argument,
+			}
+
+			if err := node.queueControl(ctl, time.Now()); err != nil {
+				req.resp <- controlResponse{err: err}
+				continue
+			}
+
+			node.sendControl(key, time.Now())
+
+			req.resp <- controlResponse{sequence: controlSeq}
+
+		case capture := <-heartbeat.addCapture:
+			captures = append(captures, capture)
+
+		case resp := <-heartbeat.StatusRequest:
+			st := &HeartbeatStatusMessage{
+				Foreign: make(map[string]*SourceFilterStatusMessage),
+			}
+
+			for key, filter := range filters {
+				if filter.Foreign > 0 {
+					st.Foreign[key.IP().String()] = filter.Status()
+				}
+			}
+
+			for _, node := range live {
+				st.Nodes = append(st.Nodes, node.Status(auth.Key(node.dst, node.info.EncoderId)))
+			}
+
+			st.Invalid = invalid
+			st.Rejected = auth.Status()
+
+			resp <- st
+
 		case msg := <-incoming:
-			key := IPtoU32(msg.src)
+			if len(captures) > 0 {
+				captures = writeCaptures(captures, true, msg.ts, msg.src, msg.dst, msg.buf)
+			}
+
+			var hb hbproto.Heartbeat
+
+			legacy := false
+
+			if err := hbproto.Decode(msg.buf, &hb); err != nil {
+				// Encoders that predate the format send 14 bytes of
+				// anything
+				if err != hbproto.ErrBadMagic || len(msg.buf) != HEARTBEAT_PKTLEN {
+					invalid++
+					continue
+				}
+
+				legacy = true
+			}
+
+			src := msg.src.IP
+			dst := msg.dst.IP
+
+			checked := &hb
+			if legacy {
+				checked = nil
+			}
+
+			if !auth.Check(msg.buf, checked, src, dst, msg.ts) {
+				continue
+			}
+
+			// Only after authenticating, so that a forged heartbeat cannot
+			// lock the group to its sender
+			if filter, found := filters[MakeIPKey(dst)]; found {
+				if !filter.Allow(src, 0, fmt.Sprintf("heartbeat for %s", dst)) {
+					continue
+				}
+			}
+
+			key := makeNodeKey(src, dst)
 
-			if node, found := live[key]; found {
+			node, found := live[key]
+			if found {
+				node.update(&hb, legacy, msg.ts)
 				node.control <- WATCHDOG_HEARTBEAT
 			} else {
-				node := &activeNode{
-					src:     msg.src,
-					dst:     msg.dst,
+				node = &activeNode{
+					src:     src,
+					dst:     dst,
 					control: make(chan int),
 				}
 
-				events <- HeartbeatEvent{
-					Event: HEARTBEAT_ONLINE,
-					Src:   node.src,
-					Dst:   node.dst,
-				}
+				node.update(&hb, legacy, msg.ts)
 
 				live[key] = node
 
 				go node.watchdog(timeout, stop)
 			}
 
+			// Answer on the socket and to the port the encoder uses now
+			node.conn = msg.conn
+			node.srcPort = msg.src.Port
+
+			if !legacy {
+				node.ackControl(&hb)
+			}
+
+			if len(node.commands) > 0 {
+				node.sendControl(auth.Key(dst, hb.EncoderId), msg.ts)
+			}
+
+			if node.announced || node.received < uint64(heartbeat.OnlineCount) {
+				continue
+			}
+
+			node.announced = true
+
+			ev := HeartbeatEvent{
+				Event: HEARTBEAT_ONLINE,
+				Src:   node.src,
+				Dst:   node.dst,
+			}
+
+			if !legacy {
+				info := hb
+				ev.Info = &info
+			}
+
+			emit(ev)
+
 		case node := <-stop:
-			delete(live, IPtoU32(node.src))
+			delete(live, makeNodeKey(node.src, node.dst))
+
+			if filter, found := filters[MakeIPKey(node.dst)]; found {
+				filter.Unlock()
+			}
 
 			node.control <- WATCHDOG_STOP
 
-			events <- HeartbeatEvent{
+			if !node.announced {
+				continue
+			}
+
+			emit(HeartbeatEvent{
 				Event: HEARTBEAT_OFFLINE,
 				Src:   node.src,
 				Dst:   node.dst,
-			}
+			})
 		}
 	}
 }
 
-func MakeHeartbeat(iface *net.Interface, listenAddr string, timeout time.Duration, groupAddrs []net.IP) (*Heartbeat, error) {
-	conn, err := net.ListenPacket("udp4", listenAddr)
-	if err != nil {
-		return nil, err
+func (heartbeat *Heartbeat) JoinGroup(iface *net.Interface, group *Group) error {
+	conns := mcastConnsFor(heartbeat.Conns, group.Addr)
+	if len(conns) == 0 {
+		return fmt.Errorf("No heartbeat socket for group %s", group.Addr)
 	}
 
-	v4conn := ipv4.NewPacketConn(conn)
+	for _, conn := range conns {
+		if err := conn.JoinGroup(iface, group.Addr, group.Source); err != nil {
+			return err
+		}
+	}
 
-	for _, group := range groupAddrs {
-		if err := v4conn.JoinGroup(iface, &net.UDPAddr{IP: group}); err != nil {
-			return nil, err
+	filter := makeSourceFilter(group.Allowed, group.LockSource)
+
+	if filter != nil || group.Key != nil || group.EncoderKeys != nil || group.SignedHeartbeats {
+		heartbeat.addGroup <- heartbeatGroup{
+			group:       group.Addr,
+			filter:      filter,
+			key:         group.Key,
+			encoderKeys: group.EncoderKeys,
+			signed:      group.SignedHeartbeats,
 		}
 	}
 
-	if err := v4conn.SetControlMessage(ipv4.FlagDst, true); err != nil {
+	return nil
+}
+
+func (heartbeat *Heartbeat) AddCapture(capture *Capture) {
+	heartbeat.addCapture <- capture
+}
+
+// SendControl queues a command for the encoder that sends heartbeats from src
+// to dst and returns its sequence number, by which the status tracks it.
+func (heartbeat *Heartbeat) SendControl(src, dst net.IP, command uint8, argument uint32) (uint32, error) {
+	if err := checkControlArgument(command, argument); err != nil {
+		return 0, err
+	}
+
+	resp := make(chan controlResponse)
+
+	heartbeat.control <- controlRequest{
+		src:      normalizeIP(src),
+		dst:      dst,
+		command:  command,
+		argument: argument,
+		resp:     resp,
+	}
+
+	r := <-resp
+
+	return r.sequence, r.err
+}
+
+func (heartbeat *Heartbeat) Status() *HeartbeatStatusMessage {
+	resp := make(chan *HeartbeatStatusMessage)
+
+	heartbeat.StatusRequest <- resp
+
+	return <-resp
+}
+
+func MakeHeartbeat(iface *net.Interface, listenAddr string, timeout time.Duration, onlineCount int, requireSigned bool, groups []*Group, enableV6 bool, memberships *Memberships) (*Heartbeat, error) {
+	laddr, err := net.ResolveUDPAddr("udp4", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ListenMcast(laddr)
+	if err != nil {
 		return nil, err
 	}
 
+	conn.Memberships = memberships
+
 	heartbeat := &Heartbeat{
-		Conn:    conn,
-		V4Conn:  v4conn,
-		Events:  make(chan HeartbeatEvent),
-		Timeout: timeout,
+		Conns:         []*McastConn{conn},
+		Events:        make(chan HeartbeatEvent, NUM_STREAM_EVENTS),
+		Timeout:       timeout,
+		OnlineCount:   onlineCount,
+		RequireSigned: requireSigned,
+		StatusRequest: make(chan chan *HeartbeatStatusMessage),
+		addGroup:      make(chan heartbeatGroup),
+		addCapture:    make(chan *Capture),
+		control:       make(chan controlRequest),
 	}
 
-	go RunHeartbeat(heartbeat.V4Conn, heartbeat.Timeout, heartbeat.Events)
+	if enableV6 {
+		conn, err := ListenMcast6(laddr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.Memberships = memberships
+
+		heartbeat.Conns = append(heartbeat.Conns, conn)
+	}
+
+	go heartbeat.RunLoop()
+
+	for _, group := range groups {
+		if err := heartbeat.JoinGroup(iface, group); err != nil {
+			return nil, err
+		}
+	}
 
 	return heartbeat, nil
 }
@@ -0,0 +1,313 @@
+package recstation
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"recstation/hbproto"
+)
+
+func TestHeartbeatSequence(t *testing.T) {
+	node := &activeNode{}
+	now := time.Now()
+
+	beat := func(seq, uptime uint32) {
+		node.update(&hbproto.Heartbeat{Version: hbproto.VERSION, Sequence: seq, Uptime: uptime}, false, now)
+	}
+
+	beat(100, 50)
+	beat(101, 50)
+	beat(105, 52)
+
+	if node.lost != 3 {
+		t.Errorf("Lost %d, expected 3", node.lost)
+	}
+
+	// A late heartbeat is neither lost nor a restart
+	beat(103, 51)
+
+	if node.lost != 3 || node.restarts != 0 || node.info.Sequence != 105 {
+		t.Errorf("Late heartbeat counted: lost %d, restarts %d, seq %d", node.lost, node.restarts, node.info.Sequence)
+	}
+
+	beat(0, 0)
+	beat(1, 0)
+
+	if node.restarts != 1 || node.lost != 3 {
+		t.Errorf("Restart not counted: lost %d, restarts %d", node.lost, node.restarts)
+	}
+
+	// Sequence numbers wrap
+	beat(0xffffffff, 10)
+	beat(1, 10)
+
+	if node.restarts != 2 || node.lost != 4 {
+		t.Errorf("Bad wrap: lost %d, restarts %d", node.lost, node.restarts)
+	}
+}
+
+// makeTestHeartbeat runs a heartbeat listener on loopback and returns it with
+// a socket to send heartbeats from and the port to send them to.
+func makeTestHeartbeat(t *testing.T, onlineCount int) (*Heartbeat, *net.UDPConn, int) {
+	conn, err := ListenMcast(&net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.UdpConn.Close() })
+
+	heartbeat := &Heartbeat{
+		Conns:         []*McastConn{conn},
+		Events:        make(chan HeartbeatEvent, NUM_STREAM_EVENTS),
+		Timeout:       200 * time.Millisecond,
+		OnlineCount:   onlineCount,
+		StatusRequest: make(chan chan *HeartbeatStatusMessage),
+		addGroup:      make(chan heartbeatGroup),
+		addCapture:    make(chan *Capture),
+		control:       make(chan controlRequest),
+	}
+
+	go heartbeat.RunLoop()
+
+	tx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tx.Close() })
+
+	return heartbeat, tx, conn.UdpConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// One encoder announcing two streams on two destinations gets a node, and
+// events, for each of them.
+func TestHeartbeatPerGroup(t *testing.T) {
+	heartbeat, tx, port := makeTestHeartbeat(t, 1)
+
+	dsts := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}
+
+	hb := hbproto.Heartbeat{EncoderId: 1}
+	for _, dst := range dsts {
+		if _, err := tx.WriteToUDP(hb.Encode(nil), &net.UDPAddr{IP: dst, Port: port}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	online := make(map[string]bool)
+	for range dsts {
+		ev := expectEvent(t, heartbeat.Events, HEARTBEAT_ONLINE)
+		online[ev.Dst.String()] = true
+	}
+
+	if !online["127.0.0.1"] || !online["127.0.0.2"] {
+		t.Fatalf("Online for %v", online)
+	}
+
+	if nodes := heartbeat.Status().Nodes; len(nodes) != 2 {
+		t.Errorf("Got %d nodes, expected 2", len(nodes))
+	}
+
+	for range dsts {
+		expectEvent(t, heartbeat.Events, HEARTBEAT_OFFLINE)
+	}
+}
+
+// A stream only goes online once enough heartbeats have been heard, and a
+// node that never went online goes away without an event.
+func TestHeartbeatOnlineCount(t *testing.T) {
+	heartbeat, tx, port := makeTestHeartbeat(t, 3)
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+
+	hb := hbproto.Heartbeat{EncoderId: 1}
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, err := tx.WriteToUDP(hb.Encode(nil), dst); err != nil {
+				t.Fatal(err)
+			}
+			hb.Sequence++
+		}
+	}
+
+	send(2)
+
+	// Let the node time out
+	time.Sleep(400 * time.Millisecond)
+
+	if len(heartbeat.Events) != 0 {
+		t.Fatalf("Event after two heartbeats: %+v", <-heartbeat.Events)
+	}
+
+	send(3)
+
+	ev := expectEvent(t, heartbeat.Events, HEARTBEAT_ONLINE)
+	if ev.Info == nil || ev.Info.Sequence != 4 {
+		t.Errorf("Online with %+v", ev.Info)
+	}
+
+	expectEvent(t, heartbeat.Events, HEARTBEAT_OFFLINE)
+}
+
+// An unsigned heartbeat from another sender must not lock a signed group to
+// it, shutting out the real encoder.
+func TestHeartbeatLockSourceSigned(t *testing.T) {
+	heartbeat, tx, port := makeTestHeartbeat(t, 1)
+	key := []byte("secret")
+	local := net.IPv4(127, 0, 0, 1)
+	dst := &net.UDPAddr{IP: local, Port: port}
+
+	heartbeat.addGroup <- heartbeatGroup{
+		group:  local,
+		filter: makeSourceFilter(nil, true),
+		key:    key,
+		signed: true,
+	}
+
+	forger, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forger.Close()
+
+	hb := hbproto.Heartbeat{EncoderId: 1}
+	if _, err := forger.WriteToUDP(hb.Encode(nil), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(time.Second); heartbeat.Status().Rejected.Unsigned == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Unsigned heartbeat not rejected")
+		}
+	}
+
+	hb.Timestamp = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if _, err := tx.WriteToUDP(hb.EncodeSigned(nil, key), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := expectEvent(t, heartbeat.Events, HEARTBEAT_ONLINE); !ev.Src.Equal(local) {
+		t.Errorf("Online from %s", ev.Src)
+	}
+
+	expectEvent(t, heartbeat.Events, HEARTBEAT_OFFLINE)
+}
+
+// A command goes to the address the heartbeats come from, signed with the key
+// of the group, and the heartbeat that acknowledges it finishes it.
+func TestHeartbeatControl(t *testing.T) {
+	heartbeat, tx, port := makeTestHeartbeat(t, 1)
+	key := []byte("secret")
+	local := net.IPv4(127, 0, 0, 1)
+	dst := &net.UDPAddr{IP: local, Port: port}
+
+	heartbeat.addGroup <- heartbeatGroup{group: local, key: key}
+
+	hb := hbproto.Heartbeat{EncoderId: 9}
+	if _, err := tx.WriteToUDP(hb.Encode(nil), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent(t, heartbeat.Events, HEARTBEAT_ONLINE)
+
+	if _, err := heartbeat.SendControl(net.IPv4(127, 0, 0, 3), local, hbproto.COMMAND_KEYFRAME, 0); err != ErrNoSuchEncoder {
+		t.Errorf("Expected ErrNoSuchEncoder, got %v", err)
+	}
+
+	if _, err := heartbeat.SendControl(local, local, hbproto.COMMAND_TALLY, 7); err != ErrBadControlArgument {
+		t.Errorf("Expected ErrBadControlArgument, got %v", err)
+	}
+
+	seq, err := heartbeat.SendControl(local, local, hbproto.COMMAND_TALLY, hbproto.TALLY_PROGRAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	tx.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, _, err := tx.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctl hbproto.Control
+
+	if err := hbproto.DecodeControl(buf[:n], key, &ctl); err != nil {
+		t.Fatal(err)
+	}
+
+	if ctl.Command != hbproto.COMMAND_TALLY || ctl.EncoderId != 9 || ctl.Sequence != seq || ctl.Argument != hbproto.TALLY_PROGRAM {
+		t.Fatalf("Got %+v", ctl)
+	}
+
+	hb.Sequence++
+	hb.AckSequence = seq
+	hb.Tally = hbproto.TALLY_PROGRAM
+	if _, err := tx.WriteToUDP(hb.Encode(nil), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		nodes := heartbeat.Status().Nodes
+
+		if len(nodes) == 1 && len(nodes[0].Commands) == 1 && nodes[0].Commands[0].State == CONTROL_STATE_ACKED {
+			if !nodes[0].Controllable || nodes[0].Tally != hbproto.TALLY_PROGRAM {
+				t.Errorf("Node %+v", nodes[0])
+			}
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Command not acknowledged: %+v", nodes)
+		}
+	}
+}
+
+// A command is sent again until it runs out of attempts, and only then does
+// the next one go.
+func TestControlRetry(t *testing.T) {
+	node := &activeNode{}
+	now := time.Now()
+
+	for seq := uint32(1); seq <= 2; seq++ {
+		if err := node.queueControl(hbproto.Control{Command: hbproto.COMMAND_KEYFRAME, Sequence: seq}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send := func() *controlCommand {
+		cmd := node.nextControl(now)
+		if cmd != nil {
+			cmd.state = CONTROL_STATE_SENT
+			cmd.sent = now
+			cmd.attempts++
+		}
+
+		return cmd
+	}
+
+	for i := 0; i < CONTROL_MAX_ATTEMPTS; i++ {
+		if cmd := send(); cmd == nil || cmd.ctl.Sequence != 1 {
+			t.Fatalf("Attempt %d sent %+v", i, cmd)
+		}
+
+		if cmd := send(); cmd != nil {
+			t.Fatalf("Sent again straight away")
+		}
+
+		now = now.Add(CONTROL_RETRY_INTERVAL)
+	}
+
+	if cmd := send(); cmd == nil || cmd.ctl.Sequence != 2 {
+		t.Fatalf("Sent %+v after giving up", cmd)
+	}
+
+	if node.commands[0].state != CONTROL_STATE_TIMEOUT {
+		t.Errorf("First command is %s", node.commands[0].state)
+	}
+
+	node.ackControl(&hbproto.Heartbeat{Version: hbproto.VERSION_2, AckSequence: 2, AckStatus: hbproto.ACK_UNSUPPORTED})
+
+	if node.commands[1].state != CONTROL_STATE_REJECTED {
+		t.Errorf("Second command is %s", node.commands[1].state)
+	}
+}
@@ -123,6 +123,56 @@
             if (data.hostname) {
                 setHostname(data.hostname);
             }
+
+            updateSourceStatus(data);
+            updateCaptures(data.captures || []);
+        });
+    }
+
+    function captureStartClick() {
+        var params = {
+            group: $('#capture-group').val(),
+            heartbeat: $('#capture-heartbeat').is(':checked') ? '1' : '0',
+            duration: $('#capture-duration').val(),
+            max_bytes: Math.round(parseFloat($('#capture-max-mb').val()) * 1000000) || '',
+        };
+
+        $.post(BASE_URL + '/capture?' + $.param(params), function() {
+            doStatus();
+        }).fail(function(xhr) {
+            window.alert('Capture failed: ' + xhr.responseText);
+        });
+    }
+
+    function captureStopClick() {
+        $.post(BASE_URL + '/capture/stop?id=' + $(this).data('capture-id'), function() {
+            doStatus();
+        });
+    }
+
+    function updateCaptures(captures) {
+        var list = $('#capture-list');
+        list.empty();
+
+        captures.forEach(function(c) {
+            var what = (c.heartbeat ? 'heartbeats ' : '') + c.group;
+            var line = $('<div>').text('#' + c.id + ' ' + what + ' ' + c.started + ': ' +
+                c.packets + ' packets, ' + format_size(c.bytes) +
+                (c.dropped ? ', ' + c.dropped + ' dropped' : '') +
+                (c.error ? ', ' + c.error : '') + ' ');
+
+            if (c.running) {
+                $('<button class="btn btn-sm btn-secondary">Stop</button>')
+                    .data('capture-id', c.id)
+                    .click(captureStopClick)
+                    .appendTo(line);
+            } else {
+                $('<a>').attr('href', BASE_URL + '/capture/download?id=' + c.id)
+                    .text('download')
+                    .appendTo(line);
+            }
+
+            list.append(line);
         });
     }
 
@@ -171,6 +221,13 @@
                     <div class='sink-stats' id='sink-stats-${name}'>
                         <span id='sink-stats-output-bw'></span> (<span id='sink-stats-output-total'></span> total)
                     </div>
+                    <div class='sink-stats' id='sink-stats-encoders-${name}'></div>
+                    <div class='sink-stats' id='sink-stats-availability-${name}'></div>
+                    <div class='sink-stats' id='sink-stats-rtp-${name}'></div>
+                    <div class='sink-stats' id='sink-stats-arrival-${name}'></div>
+                    <div class='sink-stats' id='sink-stats-paths-${name}'></div>
+                    <div class='sink-stats sink-alert' id='sink-stats-foreign-${name}'></div>
+                    <div class='sink-stats' id='sink-stats-relays-${name}'></div>
                     <div class='sink-preview' id='sink-preview-${name}'>
                         <img class='sink-preview-img' id='sink-preview-img-${name}' />
                     </div>
@@ -197,6 +254,130 @@
         }
     }
 
+    function updateSourceStatus(data)
+    {
+        var alerts = [];
+        for (var group in data.foreign_heartbeats || {}) {
+            var f = data.foreign_heartbeats[group];
+            alerts.push(f.foreign + ' heartbeats for ' + group + ' dropped from foreign sources (last ' + f.last_foreign + ')');
+        }
+
+        if (data.invalid_heartbeats) {
+            alerts.push(data.invalid_heartbeats + ' invalid heartbeats');
+        }
+
+        var rejected = data.rejected_heartbeats;
+        if (rejected && (rejected.unsigned || rejected.bad_signature || rejected.replayed)) {
+            alerts.push('heartbeats rejected: ' + rejected.unsigned + ' unsigned, ' + rejected.bad_signature + ' bad signature, ' +
+                rejected.replayed + ' replayed (last from ' + rejected.last_rejected + ')');
+        }
+
+        (data.igmp || []).forEach(function(h) {
+            if (h.receive_error) {
+                alerts.push(h.protocol + ' on ' + h.iface + ' not receiving: ' + h.receive_error);
+            }
+
+            h.groups.forEach(function(g) {
+                if (g.stale) {
+                    alerts.push(g.group + ' on ' + h.iface + ' stale: ' + g.stale_reason + (g.last_error ? ' (' + g.last_error + ')' : ''));
+                }
+            });
+        });
+
+        $('#source-alerts').text(alerts.join(', '));
+
+        if (!data.sockets) {
+            return;
+        }
+
+        var sockets = data.sockets.map(function(s) {
+            return s.addr + ': ' + format_size(s.rcvbuf) + ' buffer, ' + s.drops + ' dropped';
+        });
+
+        var igmp = (data.igmp || []).map(function(h) {
+            var line = h.iface + ' ' + h.protocol + ': ' + h.groups.length + ' groups joined, ' + h.reports_sent + ' reports sent, ' + h.send_errors + ' failed';
+
+            var q = h.querier;
+            if (q) {
+                var role = q.querier ? 'querier' : 'querier is ' + q.other;
+                line += ', ' + role + ', ' + q.segment.length + ' groups on segment, ' + q.queries_sent + ' queries sent';
+            }
+
+            return line;
+        });
+
+        $('#source-stats').text(sockets.concat(igmp).join(', ') + ' (buffer pool empty ' + data.rxbuf_pool_depleted + ' times)');
+    }
+
+    function format_uptime(s) {
+        var h = Math.floor(s / 3600);
+        var m = Math.floor((s % 3600) / 60);
+
+        return h + 'h ' + ('0' + m).slice(-2) + 'm';
+    }
+
+    function outageList(a) {
+        return a.outages.map(function(o) {
+            return o.start + ': ' + o.duration.toFixed(0) + ' s' + (o.short ? ' (kept open)' : '') + (o.end ? '' : ' (ongoing)');
+        }).join('\n');
+    }
+
+    function arrivalHistogram(a) {
+        var lines = a.intervals.map(function(n, i) {
+            var bound = i < a.interval_buckets_us.length ? '<= ' + a.interval_buckets_us[i] + ' us' : '> ' + a.interval_buckets_us[i - 1] + ' us';
+            return 'interval ' + bound + ': ' + n;
+        });
+
+        return lines.concat(a.bursts.map(function(n, i) {
+            var bound = i < a.burst_buckets.length ? '<= ' + a.burst_buckets[i] : '> ' + a.burst_buckets[i - 1];
+            return 'burst ' + bound + ': ' + n;
+        })).join('\n');
+    }
+
+    var TALLY_NAMES = ['off', 'program', 'preview'];
+
+    function controlClick() {
+        var b = $(this);
+        var params = {
+            src: b.data('src'),
+            dst: b.data('dst'),
+            command: b.data('command'),
+        };
+
+        if (b.data('command') == 'bitrate') {
+            var kbps = window.prompt('Bitrate in kbit/s');
+            if (!kbps) {
+                return;
+            }
+
+            params.argument = kbps;
+        } else if (b.data('argument') !== undefined) {
+            params.argument = b.data('argument');
+        }
+
+        $.post(BASE_URL + '/control?' + $.param(params), function() {
+            doStatus();
+        }).fail(function(xhr) {
+            window.alert('Control failed: ' + xhr.responseText);
+        });
+    }
+
+    function encoderControls(e) {
+        var streaming = (e.flags & 0x01) != 0;
+        var buttons = [
+            [streaming ? 'Stop' : 'Start', streaming ? 'stop' : 'start'],
+            ['Tally: ' + (TALLY_NAMES[e.tally] || e.tally), 'tally', (e.tally + 1) % TALLY_NAMES.length],
+            ['Keyframe', 'keyframe'],
+            ['Bitrate', 'bitrate'],
+        ];
+
+        return buttons.map(function(b) {
+            return $('<button class="btn btn-sm btn-secondary">').text(b[0])
+                .data({src: e.src, dst: e.dst, command: b[1], argument: b[2]})
+                .click(controlClick);
+        });
+    }
+
     function updateSinkStatus(st)
     {
         var sink = sinks[st.name];
@@ -204,12 +385,90 @@
             return;
         }
 
+        if (st.paths) {
+            var paths = st.paths.map(function(p) {
+                return p.group + ' (' + p.iface + '): ' + p.lost + ' lost';
+            });
+
+            sink.elem.find('#sink-stats-paths-' + st.name).text(paths.join(', '));
+        }
+
+        if (st.foreign && st.foreign.foreign > 0) {
+            sink.elem.find('#sink-stats-foreign-' + st.name).text(
+                st.foreign.foreign + ' packets dropped from foreign sources (last ' + st.foreign.last_foreign + ')');
+        }
+
+        if (st.encoders) {
+            var list = sink.elem.find('#sink-stats-encoders-' + st.name);
+            list.empty();
+
+            st.encoders.forEach(function(e) {
+                if (e.legacy) {
+                    list.append($('<div>').text(e.src + ': legacy heartbeats'));
+                    return;
+                }
+
+                var line = $('<div>').text('encoder ' + e.encoder_id + ' (' + e.src + ')' + (e.signed ? ' signed' : '') + (e.online ? '' : ' pending') + ': up ' + format_uptime(e.uptime) +
+                    ((e.flags & 0x80) ? ', FAULT' : '') +
+                    ', ' + e.lost + ' heartbeats lost' + (e.restarts ? ', ' + e.restarts + ' restarts' : '') + ' ');
+
+                if (e.controllable) {
+                    encoderControls(e).forEach(function(button) {
+                        line.append(button);
+                    });
+                }
+
+                if (e.commands) {
+                    var last = e.commands[e.commands.length - 1];
+                    line.append($('<span>').text(' ' + last.command + ' ' + last.state));
+                }
+
+                list.append(line);
+            });
+        }
+
+        if (st.availability) {
+            var av = st.availability;
+            var outage = av.outages.length ? av.outages[av.outages.length - 1] : null;
+
+            sink.elem.find('#sink-stats-availability-' + st.name).text(
+                (av.online ? '' : 'OFFLINE for ' + outage.duration.toFixed(0) + ' s, holding output, ') +
+                'available ' + av.uptime_percent.toFixed(2) + '% over ' + format_uptime(av.observed_seconds) + ', ' + av.num_outages + ' outages');
+            sink.elem.find('#sink-stats-availability-' + st.name).attr('title', outageList(av));
+        }
+
+        if (st.arrival) {
+            var a = st.arrival;
+            var clock = a.kernel_timestamps ? 'kernel' : 'user';
+
+            sink.elem.find('#sink-stats-arrival-' + st.name).text(
+                'Arrival (' + clock + ' time) jitter ' + a.jitter_ms.toFixed(3) + ' ms, max gap ' + a.max_gap_ms.toFixed(1) + ' ms, ' +
+                'max burst ' + a.max_burst + (a.pcr_pid ? ', PCR jitter ' + a.pcr_jitter_ms.toFixed(3) + ' ms (max ' + a.pcr_jitter_max_ms.toFixed(3) + ')' : ''));
+            sink.elem.find('#sink-stats-arrival-' + st.name).attr('title', arrivalHistogram(a));
+        }
+
+        if (st.relays) {
+            var relays = st.relays.map(function(r) {
+                return 'relay ' + r.name + ' to ' + r.dest + (r.rtp ? ' (RTP)' : '') + ': ' + r.datagrams + ' sent' +
+                    (r.errors ? ', ' + r.errors + ' failed' : '');
+            });
+
+            sink.elem.find('#sink-stats-relays-' + st.name).text(relays.join(', '));
+        }
+
         sink.elem.find('#sink-stats-output-bw').text(format_size(st.bytes_in_per_second) + "/s");
         sink.elem.find('#sink-stats-output-total').text(format_size(st.bytes_in));
+
+        if (st.rtp) {
+            sink.elem.find('#sink-stats-rtp-' + st.name).text(
+                'RTP jitter ' + st.rtp.jitter_ms.toFixed(2) + ' ms, ' + st.rtp.lost + ' lost, ' + st.rtp.reordered + ' reordered' +
+                (st.rtp.fec_packets ? ', FEC ' + (st.rtp.fec_recovered || 0) + ' recovered, ' + (st.rtp.fec_unrecoverable || 0) + ' unrecoverable' : ''));
+        }
     }
 
     $(function() {
         $('#transport-record').click(transportRecordClick);
+        $('#capture-start').click(captureStartClick);
 
         setInterval(doStatus, 1000);
 
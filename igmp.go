@@ -1,60 +1,84 @@
 package recstation
 
 import (
+	"bytes"
+	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"sort"
 	"time"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
-	IGMP_V2_MEMBERSHIP_REPORT = 0x16
+	IGMP_MEMBERSHIP_QUERY     = 0x11
+	IGMP_V3_MEMBERSHIP_REPORT = 0x22
+
+	IGMP_V3_MODE_IS_INCLUDE        = 1
+	IGMP_V3_MODE_IS_EXCLUDE        = 2
+	IGMP_V3_CHANGE_TO_INCLUDE_MODE = 3
+	IGMP_V3_CHANGE_TO_EXCLUDE_MODE = 4
+	IGMP_V3_ALLOW_NEW_SOURCES      = 5
+	IGMP_V3_BLOCK_OLD_SOURCES      = 6
+
+	IGMP_PROTOCOL = 2
+
+	// State changes are sent this many times in all
+	IGMP_ROBUSTNESS = 2
+
+	IGMP_UNSOLICITED_REPORT_INTERVAL = 1 * time.Second
+
+	// Max Resp Time of an IGMPv1 query, which has none
+	IGMP_V1_MAX_RESP_TIME = 10 * time.Second
+
+	IGMP_TIMER_INTERVAL = 100 * time.Millisecond
+
+	// Group records per report, keeping it well within the MTU
+	IGMP_MAX_RECORDS = 64
 )
 
-type IgmpMembership struct {
-	Iface           *net.Interface
-	Conn            *ipv4.RawConn
-	GroupAddr       net.IP
-	DestAddr        net.IP
-	MaxResponseTime time.Duration
+// All IGMPv3-capable routers
+var IGMP_V3_ROUTERS = net.IPv4(224, 0, 0, 22).To4()
+
+// IP router alert option (RFC 2113)
+var IGMP_ROUTER_ALERT = []byte{0x94, 0x04, 0x00, 0x00}
+
+// igmpRecord is a group record of an IGMPv3 report.
+type igmpRecord struct {
+	Type    byte
+	Group   net.IP
+	Sources []net.IP
 }
 
-func (m *IgmpMembership) SendMembershipReport() error {
-	const ONE_TENTH_SECOND = 100 * time.Millisecond
+func makeIgmpReport(records []igmpRecord) []byte {
+	pkt := make([]byte, 8)
 
-	maxResponseTime := uint8(m.MaxResponseTime / ONE_TENTH_SECOND)
+	pkt[0] = IGMP_V3_MEMBERSHIP_REPORT
+	pkt[6] = byte(len(records) >> 8)
+	pkt[7] = byte(len(records))
 
-	pkt := [8]byte{
-		IGMP_V2_MEMBERSHIP_REPORT,
-		maxResponseTime,
-		0,
-		0,
-		m.GroupAddr[0],
-		m.GroupAddr[1],
-		m.GroupAddr[2],
-		m.GroupAddr[3],
-	}
+	for _, r := range records {
+		rec := make([]byte, 8+4*len(r.Sources))
+		rec[0] = r.Type
+		rec[2] = byte(len(r.Sources) >> 8)
+		rec[3] = byte(len(r.Sources))
+		copy(rec[4:8], r.Group.To4())
 
-	iph := &ipv4.Header{
-		Version:  ipv4.Version,
-		Len:      ipv4.HeaderLen,
-		TOS:      0xc0, // DSCP CS6
-		TotalLen: ipv4.HeaderLen + len(pkt),
-		TTL:      10,
-		Protocol: 2,
-		Dst:      m.DestAddr.To4(),
+		for i, source := range r.Sources {
+			copy(rec[8+4*i:], source.To4())
+		}
+
+		pkt = append(pkt, rec...)
 	}
 
-	checksum := ChecksumRfc1071(pkt[:], 0)
+	checksum := ChecksumRfc1071(pkt, 0)
 	pkt[2] = byte((checksum & 0xff00) >> 8)
 	pkt[3] = byte(checksum & 0x00ff)
 
-	cm := ipv4.ControlMessage{
-		IfIndex: m.Iface.Index,
-	}
-
-	return m.Conn.WriteTo(iph, pkt[:], &cm)
+	return pkt
 }
 
 func ChecksumRfc1071(buf []byte, checksum uint32) uint16 {
@@ -75,47 +99,706 @@ func ChecksumRfc1071(buf []byte, checksum uint32) uint16 {
 	return ^uint16((checksum >> 16) + checksum)
 }
 
-func SendPeriodicIgmpMembershipReports(iface *net.Interface, groups []net.IP) error {
-	maxResponseTime := 1 * time.Second
-	groupOffset := 250 * time.Millisecond
-	sendPeriod := 5 * time.Second
+// igmpMaxResp decodes the Max Resp Code of a query. IGMPv3 codes from 128
+// up are a floating point value.
+func igmpMaxResp(buf []byte) time.Duration {
+	code := int(buf[1])
 
-	l, err := net.ListenPacket("ip4:2", "0.0.0.0")
-	if err != nil {
-		return err
+	if len(buf) < 12 {
+		if code == 0 {
+			return IGMP_V1_MAX_RESP_TIME
+		}
+
+		return time.Duration(code) * time.Second / 10
+	}
+
+	if code >= 128 {
+		mant := code&0x0f | 0x10
+		exp := uint(code>>4) & 0x07
+		code = mant << (exp + 3)
+	}
+
+	return time.Duration(code) * time.Second / 10
+}
+
+// parseIgmpQuery returns the group of a query, unspecified for a general
+// query, and how long we have to answer it.
+func parseIgmpQuery(buf []byte) (net.IP, time.Duration, bool) {
+	if len(buf) < 8 || buf[0] != IGMP_MEMBERSHIP_QUERY || ChecksumRfc1071(buf, 0) != 0 {
+		return nil, 0, false
+	}
+
+	return net.IP(append([]byte(nil), buf[4:8]...)), igmpMaxResp(buf), true
+}
+
+// igmpFilter is the IGMPv3 filter state of a group, not a member being
+// INCLUDE with no sources.
+type igmpFilter struct {
+	exclude bool
+	sources []net.IP
+}
+
+func (f igmpFilter) member() bool {
+	return f.exclude || len(f.sources) > 0
+}
+
+func ipDifference(a, b []net.IP) []net.IP {
+	var out []net.IP
+
+	for _, ip := range a {
+		found := false
+		for _, other := range b {
+			if ip.Equal(other) {
+				found = true
+			}
+		}
+
+		if !found {
+			out = append(out, ip)
+		}
+	}
+
+	return out
+}
+
+// igmpStateChange returns the records that announce a change of filter state
+// (RFC 3376 5.1).
+func igmpStateChange(group net.IP, before, after igmpFilter) []igmpRecord {
+	if before.exclude != after.exclude {
+		if after.exclude {
+			return []igmpRecord{{Type: IGMP_V3_CHANGE_TO_EXCLUDE_MODE, Group: group}}
+		}
+
+		return []igmpRecord{{Type: IGMP_V3_CHANGE_TO_INCLUDE_MODE, Group: group, Sources: after.sources}}
+	}
+
+	// Any-source both before and after
+	if after.exclude {
+		return nil
 	}
 
-	for i, group := range groups {
-		c, err := ipv4.NewRawConn(l)
+	var records []igmpRecord
+
+	if allow := ipDifference(after.sources, before.sources); allow != nil {
+		records = append(records, igmpRecord{Type: IGMP_V3_ALLOW_NEW_SOURCES, Group: group, Sources: allow})
+	}
+
+	if block := ipDifference(before.sources, after.sources); block != nil {
+		records = append(records, igmpRecord{Type: IGMP_V3_BLOCK_OLD_SOURCES, Group: group, Sources: block})
+	}
+
+	return records
+}
+
+// igmpGroup is our membership of a group, made up of the joins of any number
+// of sockets. A single any-source join makes it EXCLUDE with no sources.
+type igmpGroup struct {
+	addr      net.IP
+	anySource int
+	sources   map[IPKey]int
+
+	// Joins by local address of the socket
+	sockets map[string]int
+
+	// When the answer to a query is due
+	due time.Time
+
+	joined     time.Time
+	lastReport time.Time
+	lastError  string
+	errorTime  time.Time
+	queries    uint64
+	lastQuery  time.Time
+}
+
+type IgmpGroupStatusMessage struct {
+	Group       string   `json:"group"`
+	Sources     []string `json:"sources,omitempty"`
+	Sockets     []string `json:"sockets"`
+	Joined      float64  `json:"joined"`
+	LastReport  float64  `json:"last_report,omitempty"`
+	LastError   string   `json:"last_error,omitempty"`
+	Queries     uint64   `json:"queries"`
+	LastQuery   float64  `json:"last_query,omitempty"`
+	Stale       bool     `json:"stale"`
+	StaleReason string   `json:"stale_reason,omitempty"`
+}
+
+func (g *igmpGroup) filter() igmpFilter {
+	if g.anySource > 0 {
+		return igmpFilter{exclude: true}
+	}
+
+	var f igmpFilter
+	for key := range g.sources {
+		f.sources = append(f.sources, key.IP())
+	}
+
+	sort.Slice(f.sources, func(i, j int) bool {
+		return bytes.Compare(f.sources[i], f.sources[j]) < 0
+	})
+
+	return f
+}
+
+// current returns the record for the answer to a query.
+func (g *igmpGroup) current() igmpRecord {
+	f := g.filter()
+
+	if f.exclude {
+		return igmpRecord{Type: IGMP_V3_MODE_IS_EXCLUDE, Group: g.addr}
+	}
+
+	return igmpRecord{Type: IGMP_V3_MODE_IS_INCLUDE, Group: g.addr, Sources: f.sources}
+}
+
+// igmpStaleAfter is how long a membership nobody has asked about lasts: the
+// membership interval for the query interval, or the default one if zero.
+// After that, with no querier, snooping switches may stop forwarding it.
+func igmpStaleAfter(queryInterval time.Duration) time.Duration {
+	if queryInterval <= 0 {
+		queryInterval = IGMP_DEFAULT_QUERY_INTERVAL
+	}
+
+	return IGMP_ROBUSTNESS*queryInterval + IGMP_QUERY_RESPONSE_TIME
+}
+
+// staleReason says why nothing may be keeping the membership alive, if so.
+// Queries from ourselves count when we are the querier.
+func (g *igmpGroup) staleReason(now time.Time, staleAfter time.Duration, querying bool, receiveError string) string {
+	if g.errorTime.After(g.lastReport) {
+		return "last report failed"
+	}
+
+	if querying {
+		return ""
+	}
+
+	if receiveError != "" {
+		return "not receiving queries"
+	}
+
+	last := g.joined
+	if g.lastQuery.After(last) {
+		last = g.lastQuery
+	}
+
+	if now.Sub(last) > staleAfter {
+		return "no query heard"
+	}
+
+	return ""
+}
+
+func (g *igmpGroup) Status(now time.Time, staleAfter time.Duration, querying bool, receiveError string) *IgmpGroupStatusMessage {
+	st := &IgmpGroupStatusMessage{
+		Group:     g.addr.String(),
+		Sockets:   make([]string, 0, len(g.sockets)),
+		Joined:    now.Sub(g.joined).Seconds(),
+		LastError: g.lastError,
+		Queries:   g.queries,
+	}
+
+	for _, source := range g.filter().sources {
+		st.Sources = append(st.Sources, source.String())
+	}
+
+	for socket := range g.sockets {
+		st.Sockets = append(st.Sockets, socket)
+	}
+
+	sort.Strings(st.Sockets)
+
+	if !g.lastReport.IsZero() {
+		st.LastReport = now.Sub(g.lastReport).Seconds()
+	}
+
+	if !g.lastQuery.IsZero() {
+		st.LastQuery = now.Sub(g.lastQuery).Seconds()
+	}
+
+	st.StaleReason = g.staleReason(now, staleAfter, querying, receiveError)
+	st.Stale = st.StaleReason != ""
+
+	return st
+}
+
+type igmpChange struct {
+	group  net.IP
+	source net.IP
+	socket string
+	delta  int
+}
+
+type igmpPending struct {
+	due     time.Time
+	records []igmpRecord
+}
+
+// groupProtocol is what differs between IGMPv3 and MLDv2, which is the same
+// protocol for IPv6 in other packets (RFC 3810).
+type groupProtocol struct {
+	Name       string
+	QueryType  byte
+	ReportDst  net.IP
+	MaxRecords int
+
+	makeReport func(records []igmpRecord) []byte
+	parseQuery func(buf []byte) (net.IP, time.Duration, bool)
+}
+
+var igmpV3 = &groupProtocol{
+	Name:       "IGMP",
+	QueryType:  IGMP_MEMBERSHIP_QUERY,
+	ReportDst:  IGMP_V3_ROUTERS,
+	MaxRecords: IGMP_MAX_RECORDS,
+	makeReport: makeIgmpReport,
+	parseQuery: parseIgmpQuery,
+}
+
+type igmpPacket struct {
+	src net.IP
+	buf []byte
+	err error
+}
+
+// IgmpHost is the IGMPv3 host side for one interface: it announces joins and
+// leaves as they happen and answers queries for the groups currently joined.
+// It can also be the querier for the segment. For IPv6 it is the MLDv2 host
+// side instead, without a querier.
+type IgmpHost struct {
+	Iface *net.Interface
+	Conn  *ipv4.RawConn
+	Conn6 *ipv6.PacketConn
+
+	proto *groupProtocol
+
+	groups  map[IPKey]*igmpGroup
+	pending []*igmpPending
+	querier *igmpQuerier
+
+	// Memberships go stale with no query for this long
+	staleAfter time.Duration
+
+	reportsSent  uint64
+	sendErrors   uint64
+	lastError    string
+	receiveError string
+
+	// Writes an IGMP message, replaced by tests
+	send func(dst net.IP, pkt []byte) error
+
+	change        chan igmpChange
+	incoming      chan igmpPacket
+	statusRequest chan chan *IgmpStatusMessage
+	closeRequest  chan chan bool
+}
+
+type IgmpStatusMessage struct {
+	Iface        string                    `json:"iface"`
+	Protocol     string                    `json:"protocol"`
+	Groups       []*IgmpGroupStatusMessage `json:"groups"`
+	Stale        int                       `json:"stale"`
+	ReportsSent  uint64                    `json:"reports_sent"`
+	SendErrors   uint64                    `json:"send_errors"`
+	LastError    string                    `json:"last_error,omitempty"`
+	ReceiveError string                    `json:"receive_error,omitempty"`
+	Querier      *IgmpQuerierStatusMessage `json:"querier,omitempty"`
+}
+
+// Join adds a join by the socket with the given local address.
+func (host *IgmpHost) Join(group, source net.IP, socket string) {
+	host.change <- igmpChange{group: normalizeIP(group), source: source, socket: socket, delta: 1}
+}
+
+func (host *IgmpHost) Leave(group, source net.IP, socket string) {
+	host.change <- igmpChange{group: normalizeIP(group), source: source, socket: socket, delta: -1}
+}
+
+// Close leaves every group and stops the host.
+func (host *IgmpHost) Close() {
+	done := make(chan bool)
+
+	host.closeRequest <- done
+
+	<-done
+}
+
+// sendReport sends the records, noting the outcome on the groups that are
+// still joined.
+func (host *IgmpHost) sendReport(records []igmpRecord, now time.Time) {
+	for len(records) > 0 {
+		n := len(records)
+		if n > host.proto.MaxRecords {
+			n = host.proto.MaxRecords
+		}
+
+		err := host.send(host.proto.ReportDst, host.proto.makeReport(records[:n]))
 		if err != nil {
-			return err
+			log.Printf("Failed to send %s report on %s: %v", host.proto.Name, host.Iface.Name, err)
+
+			host.sendErrors++
+			host.lastError = err.Error()
+		} else {
+			host.reportsSent++
 		}
 
-		go (func(i int, group net.IP, c *ipv4.RawConn) {
+		for _, r := range records[:n] {
+			g, found := host.groups[MakeIPKey(r.Group)]
+			if !found {
+				continue
+			}
 
-			im := IgmpMembership{
-				Iface:           iface,
-				Conn:            c,
-				GroupAddr:       group.To4(),
-				DestAddr:        group.To4(),
-				MaxResponseTime: maxResponseTime,
+			if err != nil {
+				g.lastError = err.Error()
+				g.errorTime = now
+			} else {
+				g.lastReport = now
 			}
+		}
 
-			time.Sleep(time.Duration(i+1) * groupOffset)
+		records = records[n:]
+	}
+}
+
+func (host *IgmpHost) Status() *IgmpStatusMessage {
+	resp := make(chan *IgmpStatusMessage)
+
+	host.statusRequest <- resp
+
+	return <-resp
+}
+
+func (host *IgmpHost) sendQuery(dst net.IP, pkt []byte) {
+	if err := host.send(dst, pkt); err != nil {
+		log.Printf("Failed to send IGMP query on %s: %v", host.Iface.Name, err)
+	}
+}
+
+func (host *IgmpHost) write(dst net.IP, pkt []byte) error {
+	iph := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen + len(IGMP_ROUTER_ALERT),
+		TOS:      0xc0, // DSCP CS6
+		TotalLen: ipv4.HeaderLen + len(IGMP_ROUTER_ALERT) + len(pkt),
+		TTL:      1,
+		Protocol: IGMP_PROTOCOL,
+		Dst:      dst,
+		Options:  IGMP_ROUTER_ALERT,
+	}
+
+	cm := ipv4.ControlMessage{
+		IfIndex: host.Iface.Index,
+	}
+
+	return host.Conn.WriteTo(iph, pkt, &cm)
+}
+
+// announce sends a state change now and again once more within the
+// unsolicited report interval.
+func (host *IgmpHost) announce(records []igmpRecord, now time.Time) {
+	if len(records) == 0 {
+		return
+	}
+
+	host.sendReport(records, now)
+
+	for i := 1; i < IGMP_ROBUSTNESS; i++ {
+		host.pending = append(host.pending, &igmpPending{
+			due:     now.Add(time.Duration(rand.Int63n(int64(IGMP_UNSOLICITED_REPORT_INTERVAL)))),
+			records: records,
+		})
+	}
+}
+
+func (host *IgmpHost) apply(c igmpChange, now time.Time) {
+	key := MakeIPKey(c.group)
+
+	g, found := host.groups[key]
+	if !found {
+		if c.delta < 0 {
+			return
+		}
+
+		g = &igmpGroup{
+			addr:    c.group,
+			sources: make(map[IPKey]int),
+			sockets: make(map[string]int),
+			joined:  now,
+		}
+
+		host.groups[key] = g
+	}
+
+	before := g.filter()
+
+	if c.source == nil {
+		g.anySource += c.delta
+	} else {
+		sk := MakeIPKey(c.source)
+
+		g.sources[sk] += c.delta
+		if g.sources[sk] <= 0 {
+			delete(g.sources, sk)
+		}
+	}
+
+	if g.anySource < 0 {
+		g.anySource = 0
+	}
+
+	if c.socket != "" {
+		g.sockets[c.socket] += c.delta
+		if g.sockets[c.socket] <= 0 {
+			delete(g.sockets, c.socket)
+		}
+	}
+
+	after := g.filter()
+
+	if !after.member() {
+		delete(host.groups, key)
+	}
+
+	host.announce(igmpStateChange(c.group, before, after), now)
+}
+
+// handleQuery schedules the answer to a query at a random point within its
+// Max Resp Time, unless an earlier answer is already due.
+func (host *IgmpHost) handleQuery(buf []byte, now time.Time) {
+	group, maxResp, ok := host.proto.parseQuery(buf)
+	if !ok {
+		return
+	}
+
+	if maxResp <= 0 {
+		maxResp = IGMP_TIMER_INTERVAL
+	}
+
+	for _, g := range host.groups {
+		if !group.IsUnspecified() && !group.Equal(g.addr) {
+			continue
+		}
+
+		g.queries++
+		g.lastQuery = now
+
+		due := now.Add(time.Duration(rand.Int63n(int64(maxResp))))
+		if g.due.IsZero() || due.Before(g.due) {
+			g.due = due
+		}
+	}
+}
+
+// tick sends the answers and retransmissions that are due.
+func (host *IgmpHost) tick(now time.Time) {
+	var records []igmpRecord
+
+	for _, g := range host.groups {
+		if g.due.IsZero() || g.due.After(now) {
+			continue
+		}
+
+		records = append(records, g.current())
+		g.due = time.Time{}
+	}
+
+	kept := host.pending[:0]
+	for _, p := range host.pending {
+		if p.due.After(now) {
+			kept = append(kept, p)
+			continue
+		}
+
+		records = append(records, p.records...)
+	}
+	host.pending = kept
+
+	host.sendReport(records, now)
+}
 
-			tick := time.NewTicker(sendPeriod)
+func (host *IgmpHost) leaveAll() {
+	var records []igmpRecord
 
-			for {
-				err := im.SendMembershipReport()
-				if err != nil {
-					log.Printf("Failed to send IGMP membership for %s: %v", group, err)
-					break
+	for key, g := range host.groups {
+		records = append(records, igmpStateChange(g.addr, g.filter(), igmpFilter{})...)
+		delete(host.groups, key)
+	}
+
+	host.sendReport(records, time.Now())
+}
+
+func (host *IgmpHost) status(now time.Time) *IgmpStatusMessage {
+	st := &IgmpStatusMessage{
+		Iface:        host.Iface.Name,
+		Protocol:     host.proto.Name,
+		Groups:       make([]*IgmpGroupStatusMessage, 0, len(host.groups)),
+		ReportsSent:  host.reportsSent,
+		SendErrors:   host.sendErrors,
+		LastError:    host.lastError,
+		ReceiveError: host.receiveError,
+	}
+
+	querying := false
+	if host.querier != nil {
+		st.Querier = host.querier.Status(now)
+		querying = host.querier.querier
+	}
+
+	for _, g := range host.groups {
+		gs := g.Status(now, host.staleAfter, querying, host.receiveError)
+		if gs.Stale {
+			st.Stale++
+		}
+
+		st.Groups = append(st.Groups, gs)
+	}
+
+	sort.Slice(st.Groups, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(st.Groups[i].Group), net.ParseIP(st.Groups[j].Group)) < 0
+	})
+
+	return st
+}
+
+func (host *IgmpHost) receiveLoop() {
+	buf := make([]byte, 2048)
+
+	for {
+		h, p, cm, err := host.Conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("IGMP receive on %s failed: %v", host.Iface.Name, err)
+			host.incoming <- igmpPacket{err: err}
+			return
+		}
+
+		if cm != nil && cm.IfIndex != host.Iface.Index {
+			continue
+		}
+
+		host.incoming <- igmpPacket{
+			src: h.Src,
+			buf: append([]byte(nil), p...),
+		}
+	}
+}
+
+func (host *IgmpHost) RunLoop() {
+	tick := time.NewTicker(IGMP_TIMER_INTERVAL)
+
+	for {
+		select {
+		case c := <-host.change:
+			host.apply(c, time.Now())
+
+		case pkt := <-host.incoming:
+			if pkt.err != nil {
+				host.receiveError = pkt.err.Error()
+				continue
+			}
+
+			if len(pkt.buf) == 0 {
+				continue
+			}
+
+			now := time.Now()
+
+			if pkt.buf[0] == host.proto.QueryType {
+				host.handleQuery(pkt.buf, now)
+
+				if host.querier != nil {
+					host.querier.heardQuery(pkt.src, now)
 				}
+			} else if host.querier != nil {
+				host.querier.heardReport(pkt.src, pkt.buf, now)
+			}
+
+		case now := <-tick.C:
+			host.tick(now)
 
-				<-tick.C
+			if host.querier != nil {
+				host.querier.tick(now, host.sendQuery)
 			}
-		})(i, group, c)
+
+		case resp := <-host.statusRequest:
+			resp <- host.status(time.Now())
+
+		case done := <-host.closeRequest:
+			host.leaveAll()
+			tick.Stop()
+			done <- true
+			return
+		}
+	}
+}
+
+func makeGroupHost(iface *net.Interface, proto *groupProtocol, send func(net.IP, []byte) error) *IgmpHost {
+	return &IgmpHost{
+		Iface:         iface,
+		proto:         proto,
+		groups:        make(map[IPKey]*igmpGroup),
+		staleAfter:    igmpStaleAfter(0),
+		send:          send,
+		change:        make(chan igmpChange),
+		incoming:      make(chan igmpPacket),
+		statusRequest: make(chan chan *IgmpStatusMessage),
+		closeRequest:  make(chan chan bool),
+	}
+}
+
+func makeIgmpHost(iface *net.Interface, send func(net.IP, []byte) error) *IgmpHost {
+	return makeGroupHost(iface, igmpV3, send)
+}
+
+func ifaceAddr4(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("No IPv4 address on %s", iface.Name)
+}
+
+// MakeIgmpHost starts the IGMP host for an interface, and the querier unless
+// the query interval is zero.
+func MakeIgmpHost(iface *net.Interface, queryInterval time.Duration) (*IgmpHost, error) {
+	host := makeIgmpHost(iface, nil)
+	host.staleAfter = igmpStaleAfter(queryInterval)
+
+	if queryInterval > 0 {
+		addr, err := ifaceAddr4(iface)
+		if err != nil {
+			return nil, err
+		}
+
+		host.querier = makeIgmpQuerier(addr, queryInterval, time.Now())
 	}
 
-	return nil
+	l, err := net.ListenPacket("ip4:2", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := ipv4.NewRawConn(l)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		return nil, err
+	}
+
+	host.Conn = c
+	host.send = host.write
+
+	go host.RunLoop()
+	go host.receiveLoop()
+
+	return host, nil
 }
@@ -0,0 +1,248 @@
+package recstation
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func makeTestIgmpQuery(group net.IP, code byte, v3 bool) []byte {
+	buf := make([]byte, 8)
+	if v3 {
+		buf = make([]byte, 12)
+	}
+
+	buf[0] = IGMP_MEMBERSHIP_QUERY
+	buf[1] = code
+	copy(buf[4:8], group.To4())
+
+	checksum := ChecksumRfc1071(buf, 0)
+	buf[2] = byte(checksum >> 8)
+	buf[3] = byte(checksum)
+
+	return buf
+}
+
+// parseIgmpReport returns the records of a report as record type by group.
+func parseIgmpReport(t *testing.T, pkt []byte) map[string]igmpRecord {
+	if pkt[0] != IGMP_V3_MEMBERSHIP_REPORT || ChecksumRfc1071(pkt, 0) != 0 {
+		t.Fatalf("Bad report %x", pkt)
+	}
+
+	records := make(map[string]igmpRecord)
+	rec := pkt[8:]
+
+	for i := 0; i < int(pkt[7]); i++ {
+		r := igmpRecord{
+			Type:  rec[0],
+			Group: net.IP(rec[4:8]),
+		}
+
+		n := int(rec[3])
+		for j := 0; j < n; j++ {
+			r.Sources = append(r.Sources, net.IP(rec[8+4*j:12+4*j]))
+		}
+
+		records[r.Group.String()] = r
+		rec = rec[8+4*n:]
+	}
+
+	return records
+}
+
+func TestIgmpMaxResp(t *testing.T) {
+	cases := []struct {
+		code byte
+		v3   bool
+		want time.Duration
+	}{
+		{0, false, IGMP_V1_MAX_RESP_TIME},
+		{100, false, 10 * time.Second},
+		{100, true, 10 * time.Second},
+		{0x8f, true, 24800 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		_, got, ok := parseIgmpQuery(makeTestIgmpQuery(net.IPv4zero, c.code, c.v3))
+		if !ok || got != c.want {
+			t.Errorf("Code %#x (v3 %v) is %s, expected %s", c.code, c.v3, got, c.want)
+		}
+	}
+
+	buf := makeTestIgmpQuery(net.IPv4zero, 100, true)
+	buf[5] ^= 1
+
+	if _, _, ok := parseIgmpQuery(buf); ok {
+		t.Error("Query with a bad checksum parsed")
+	}
+}
+
+func TestIgmpHost(t *testing.T) {
+	var sent []map[string]igmpRecord
+
+	host := makeIgmpHost(&net.Interface{Name: "test"}, func(dst net.IP, pkt []byte) error {
+		if !dst.Equal(IGMP_V3_ROUTERS) {
+			t.Errorf("Report sent to %s", dst)
+		}
+
+		sent = append(sent, parseIgmpReport(t, pkt))
+		return nil
+	})
+
+	now := time.Now()
+	asm := net.IPv4(239, 255, 1, 1).To4()
+	ssm := net.IPv4(232, 1, 1, 1).To4()
+	sender := net.IPv4(10, 1, 1, 50).To4()
+
+	expect := func(group net.IP, recordType byte, sources int) {
+		t.Helper()
+
+		if len(sent) != 1 {
+			t.Fatalf("Sent %d reports, expected 1", len(sent))
+		}
+
+		r, ok := sent[0][group.String()]
+		if !ok || r.Type != recordType || len(r.Sources) != sources {
+			t.Errorf("Record for %s is %+v, expected type %d with %d sources", group, r, recordType, sources)
+		}
+
+		sent = nil
+	}
+
+	host.apply(igmpChange{group: asm, delta: 1}, now)
+	expect(asm, IGMP_V3_CHANGE_TO_EXCLUDE_MODE, 0)
+
+	// A second socket joining changes nothing
+	host.apply(igmpChange{group: asm, delta: 1}, now)
+	if len(sent) != 0 {
+		t.Fatalf("Sent %d reports for a second join", len(sent))
+	}
+
+	host.apply(igmpChange{group: ssm, source: sender, delta: 1}, now)
+	expect(ssm, IGMP_V3_ALLOW_NEW_SOURCES, 1)
+
+	// The state changes go out once more within the unsolicited report
+	// interval
+	host.tick(now.Add(IGMP_UNSOLICITED_REPORT_INTERVAL))
+	if len(sent) != 1 || len(sent[0]) != 2 {
+		t.Fatalf("Retransmitted %v", sent)
+	}
+	sent = nil
+
+	// Nothing for a query about a group we are not in
+	host.handleQuery(makeTestIgmpQuery(net.IPv4(239, 9, 9, 9), 10, true), now)
+	host.tick(now.Add(time.Second))
+	if len(sent) != 0 {
+		t.Fatalf("Answered a query for another group")
+	}
+
+	host.handleQuery(makeTestIgmpQuery(net.IPv4zero, 10, true), now)
+
+	if r := host.groups[MakeIPKey(asm)]; r.due.Before(now) || !r.due.Before(now.Add(time.Second)) {
+		t.Errorf("Answer due at %s", r.due.Sub(now))
+	}
+
+	host.tick(now.Add(time.Second))
+	if len(sent) != 1 || len(sent[0]) != 2 {
+		t.Fatalf("Answered the general query with %v", sent)
+	}
+
+	if sent[0][asm.String()].Type != IGMP_V3_MODE_IS_EXCLUDE || sent[0][ssm.String()].Type != IGMP_V3_MODE_IS_INCLUDE {
+		t.Errorf("Answered the general query with %v", sent[0])
+	}
+	sent = nil
+
+	host.handleQuery(makeTestIgmpQuery(ssm, 10, false), now)
+	host.tick(now.Add(time.Second))
+	expect(ssm, IGMP_V3_MODE_IS_INCLUDE, 1)
+
+	host.apply(igmpChange{group: asm, delta: -1}, now)
+	if len(sent) != 0 {
+		t.Fatalf("Left a group that another socket is still in")
+	}
+
+	host.apply(igmpChange{group: asm, delta: -1}, now)
+	expect(asm, IGMP_V3_CHANGE_TO_INCLUDE_MODE, 0)
+
+	if len(host.groups) != 1 {
+		t.Errorf("In %d groups, expected 1", len(host.groups))
+	}
+
+	host.pending = nil
+	host.leaveAll()
+	expect(ssm, IGMP_V3_BLOCK_OLD_SOURCES, 1)
+}
+
+func TestIgmpMembershipStatus(t *testing.T) {
+	var sendErr error
+
+	host := makeIgmpHost(&net.Interface{Name: "test"}, func(dst net.IP, pkt []byte) error {
+		return sendErr
+	})
+
+	now := time.Now()
+	group := net.IPv4(239, 255, 1, 1).To4()
+
+	host.apply(igmpChange{group: group, socket: "0.0.0.0:5004", delta: 1}, now)
+	host.apply(igmpChange{group: group, socket: "0.0.0.0:6000", delta: 1}, now)
+
+	st := host.status(now)
+	if len(st.Groups) != 1 || len(st.Groups[0].Sockets) != 2 || st.Stale != 0 || st.ReportsSent != 1 {
+		t.Fatalf("Status %+v", st)
+	}
+
+	// A failed retransmission makes it stale until a report gets through
+	sendErr = errors.New("no route")
+	host.tick(now.Add(IGMP_UNSOLICITED_REPORT_INTERVAL))
+
+	st = host.status(now)
+	if st.Stale != 1 || st.SendErrors != 1 || st.Groups[0].LastError != "no route" {
+		t.Fatalf("Status after a failed report %+v %+v", st, st.Groups[0])
+	}
+
+	sendErr = nil
+	host.handleQuery(makeTestIgmpQuery(net.IPv4zero, 10, true), now)
+	host.tick(now.Add(2 * time.Second))
+
+	if g := host.status(now).Groups[0]; g.Stale || g.Queries != 1 {
+		t.Fatalf("Group status after answering a query %+v", g)
+	}
+
+	// Stale once no query has been heard for a while
+	later := now.Add(igmpStaleAfter(0) + time.Second)
+	if g := host.status(later).Groups[0]; !g.Stale || g.StaleReason != "no query heard" {
+		t.Errorf("Group status with no queries %+v", g)
+	}
+
+	host.apply(igmpChange{group: group, socket: "0.0.0.0:6000", delta: -1}, now)
+
+	if g := host.status(now).Groups[0]; len(g.Sockets) != 1 || g.Sockets[0] != "0.0.0.0:5004" {
+		t.Errorf("Joined on %v after a socket left", g.Sockets)
+	}
+}
+
+func TestIgmpStaleAfter(t *testing.T) {
+	if d := igmpStaleAfter(0); d != IGMP_ROBUSTNESS*IGMP_DEFAULT_QUERY_INTERVAL+IGMP_QUERY_RESPONSE_TIME {
+		t.Errorf("Default stale after %s", d)
+	}
+
+	host := makeIgmpHost(&net.Interface{Name: "test"}, func(dst net.IP, pkt []byte) error {
+		return nil
+	})
+
+	// Queries only every ten minutes are not a sign of trouble
+	interval := 10 * time.Minute
+	host.staleAfter = igmpStaleAfter(interval)
+
+	now := time.Now()
+	host.apply(igmpChange{group: net.IPv4(239, 255, 1, 1).To4(), socket: "0.0.0.0:5004", delta: 1}, now)
+
+	if st := host.status(now.Add(interval + time.Minute)); st.Stale != 0 {
+		t.Errorf("Stale after one query interval %+v", st.Groups[0])
+	}
+
+	if st := host.status(now.Add(IGMP_ROBUSTNESS*interval + IGMP_QUERY_RESPONSE_TIME + time.Second)); st.Stale != 1 {
+		t.Errorf("Not stale after the membership interval %+v", st.Groups[0])
+	}
+}
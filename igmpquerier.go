@@ -0,0 +1,304 @@
+package recstation
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	IGMP_V2_MEMBERSHIP_REPORT = 0x16
+	IGMP_V2_LEAVE_GROUP       = 0x17
+
+	IGMP_DEFAULT_QUERY_INTERVAL = 125 * time.Second
+	IGMP_QUERY_RESPONSE_TIME    = 10 * time.Second
+
+	IGMP_STARTUP_QUERY_COUNT = IGMP_ROBUSTNESS
+
+	IGMP_LAST_MEMBER_QUERY_INTERVAL = 1 * time.Second
+	IGMP_LAST_MEMBER_QUERY_COUNT    = IGMP_ROBUSTNESS
+)
+
+// All systems on this subnet
+var IGMP_ALL_SYSTEMS = net.IPv4(224, 0, 0, 1).To4()
+
+// igmpCode encodes a Max Resp Code or QQIC, exactly up to 127 and as a
+// floating point value from there.
+func igmpCode(v int) byte {
+	if v < 128 {
+		return byte(v)
+	}
+
+	for exp := 0; exp < 8; exp++ {
+		if mant := v >> uint(exp+3); mant < 0x20 {
+			return byte(0x80 | exp<<4 | mant&0x0f)
+		}
+	}
+
+	return 0xff
+}
+
+// makeIgmpQuery makes an IGMPv3 query, a general one for the unspecified
+// group.
+func makeIgmpQuery(group net.IP, maxResp, interval time.Duration) []byte {
+	pkt := make([]byte, 12)
+
+	pkt[0] = IGMP_MEMBERSHIP_QUERY
+	pkt[1] = igmpCode(int(maxResp / (time.Second / 10)))
+	copy(pkt[4:8], group.To4())
+	pkt[8] = IGMP_ROBUSTNESS
+	pkt[9] = igmpCode(int(interval / time.Second))
+
+	checksum := ChecksumRfc1071(pkt, 0)
+	pkt[2] = byte((checksum & 0xff00) >> 8)
+	pkt[3] = byte(checksum & 0x00ff)
+
+	return pkt
+}
+
+// segmentGroup is a group that hosts on the segment have reported.
+type segmentGroup struct {
+	addr      net.IP
+	reporters map[IPKey]time.Time
+	expires   time.Time
+
+	// Group-specific queries still to send after a leave
+	lastMemberQueries int
+	nextQuery         time.Time
+}
+
+// igmpQuerier sends the queries that keep snooping switches forwarding when
+// there is no router to do it, standing down for any querier with a lower
+// address (RFC 3376 6.6.2).
+type igmpQuerier struct {
+	addr     net.IP
+	interval time.Duration
+
+	querier   bool
+	other     net.IP
+	otherSeen time.Time
+	nextQuery time.Time
+	startup   int
+
+	queriesSent uint64
+	segment     map[IPKey]*segmentGroup
+}
+
+type IgmpQuerierStatusMessage struct {
+	Addr        string                           `json:"addr"`
+	Querier     bool                             `json:"querier"`
+	Other       string                           `json:"other,omitempty"`
+	QueriesSent uint64                           `json:"queries_sent"`
+	Segment     []*IgmpSegmentGroupStatusMessage `json:"segment"`
+}
+
+type IgmpSegmentGroupStatusMessage struct {
+	Group      string   `json:"group"`
+	Reporters  []string `json:"reporters"`
+	LastReport float64  `json:"last_report"`
+	Expires    float64  `json:"expires"`
+}
+
+func makeIgmpQuerier(addr net.IP, interval time.Duration, now time.Time) *igmpQuerier {
+	return &igmpQuerier{
+		addr:      addr.To4(),
+		interval:  interval,
+		querier:   true,
+		nextQuery: now,
+		startup:   IGMP_STARTUP_QUERY_COUNT,
+		segment:   make(map[IPKey]*segmentGroup),
+	}
+}
+
+// membershipInterval is how long a group lasts on the segment without a
+// report.
+func (q *igmpQuerier) membershipInterval() time.Duration {
+	return IGMP_ROBUSTNESS*q.interval + IGMP_QUERY_RESPONSE_TIME
+}
+
+func (q *igmpQuerier) otherPresentInterval() time.Duration {
+	return IGMP_ROBUSTNESS*q.interval + IGMP_QUERY_RESPONSE_TIME/2
+}
+
+func (q *igmpQuerier) heardQuery(src net.IP, now time.Time) {
+	src = src.To4()
+	if src == nil || src.Equal(q.addr) {
+		return
+	}
+
+	if bytes.Compare(src, q.addr) > 0 {
+		return
+	}
+
+	q.querier = false
+	q.other = src
+	q.otherSeen = now
+}
+
+func (q *igmpQuerier) joined(group, src net.IP, now time.Time) {
+	key := MakeIPKey(group)
+
+	g, found := q.segment[key]
+	if !found {
+		g = &segmentGroup{
+			addr:      group,
+			reporters: make(map[IPKey]time.Time),
+		}
+
+		q.segment[key] = g
+	}
+
+	g.reporters[MakeIPKey(src)] = now
+	g.expires = now.Add(q.membershipInterval())
+	g.lastMemberQueries = 0
+}
+
+// left checks whether anyone else is still in the group, if it is up to us to
+// ask.
+func (q *igmpQuerier) left(group, src net.IP, now time.Time) {
+	g, found := q.segment[MakeIPKey(group)]
+	if !found {
+		return
+	}
+
+	delete(g.reporters, MakeIPKey(src))
+
+	if !q.querier {
+		return
+	}
+
+	g.lastMemberQueries = IGMP_LAST_MEMBER_QUERY_COUNT
+	g.nextQuery = now
+
+	lastMemberTime := now.Add(IGMP_LAST_MEMBER_QUERY_COUNT * IGMP_LAST_MEMBER_QUERY_INTERVAL)
+	if lastMemberTime.Before(g.expires) {
+		g.expires = lastMemberTime
+	}
+}
+
+// heardReport follows membership on the segment from the reports of every
+// host on it.
+func (q *igmpQuerier) heardReport(src net.IP, buf []byte, now time.Time) {
+	if len(buf) < 8 || ChecksumRfc1071(buf, 0) != 0 {
+		return
+	}
+
+	switch buf[0] {
+	case IGMP_V2_MEMBERSHIP_REPORT:
+		q.joined(net.IP(buf[4:8]).To4(), src, now)
+
+	case IGMP_V2_LEAVE_GROUP:
+		q.left(net.IP(buf[4:8]).To4(), src, now)
+
+	case IGMP_V3_MEMBERSHIP_REPORT:
+		rec := buf[8:]
+
+		for i := 0; i < int(buf[6])<<8|int(buf[7]); i++ {
+			if len(rec) < 8 {
+				return
+			}
+
+			numSources := int(rec[2])<<8 | int(rec[3])
+			length := 8 + 4*numSources + 4*int(rec[1])
+			if len(rec) < length {
+				return
+			}
+
+			group := append(net.IP(nil), rec[4:8]...)
+
+			switch {
+			case rec[0] == IGMP_V3_BLOCK_OLD_SOURCES:
+				q.left(group, src, now)
+
+			case (rec[0] == IGMP_V3_CHANGE_TO_INCLUDE_MODE || rec[0] == IGMP_V3_MODE_IS_INCLUDE) && numSources == 0:
+				q.left(group, src, now)
+
+			default:
+				q.joined(group, src, now)
+			}
+
+			rec = rec[length:]
+		}
+	}
+}
+
+// tick sends the queries that are due and ages the segment.
+func (q *igmpQuerier) tick(now time.Time, send func(dst net.IP, pkt []byte)) {
+	if !q.querier && now.Sub(q.otherSeen) > q.otherPresentInterval() {
+		q.querier = true
+		q.other = nil
+		q.nextQuery = now
+	}
+
+	if q.querier && !now.Before(q.nextQuery) {
+		send(IGMP_ALL_SYSTEMS, makeIgmpQuery(net.IPv4zero, IGMP_QUERY_RESPONSE_TIME, q.interval))
+		q.queriesSent++
+
+		next := q.interval
+		if q.startup > 0 {
+			q.startup--
+			next /= 4
+		}
+
+		q.nextQuery = now.Add(next)
+	}
+
+	for key, g := range q.segment {
+		if now.After(g.expires) {
+			delete(q.segment, key)
+			continue
+		}
+
+		if q.querier && g.lastMemberQueries > 0 && !now.Before(g.nextQuery) {
+			send(g.addr, makeIgmpQuery(g.addr, IGMP_LAST_MEMBER_QUERY_INTERVAL, q.interval))
+			q.queriesSent++
+
+			g.lastMemberQueries--
+			g.nextQuery = now.Add(IGMP_LAST_MEMBER_QUERY_INTERVAL)
+		}
+	}
+}
+
+func (q *igmpQuerier) Status(now time.Time) *IgmpQuerierStatusMessage {
+	msg := &IgmpQuerierStatusMessage{
+		Addr:        q.addr.String(),
+		Querier:     q.querier,
+		QueriesSent: q.queriesSent,
+		Segment:     make([]*IgmpSegmentGroupStatusMessage, 0, len(q.segment)),
+	}
+
+	if q.other != nil {
+		msg.Other = q.other.String()
+	}
+
+	for _, g := range q.segment {
+		st := &IgmpSegmentGroupStatusMessage{
+			Group:   g.addr.String(),
+			Expires: g.expires.Sub(now).Seconds(),
+		}
+
+		var last time.Time
+		for key, seen := range g.reporters {
+			st.Reporters = append(st.Reporters, key.IP().String())
+
+			if seen.After(last) {
+				last = seen
+			}
+		}
+
+		sort.Strings(st.Reporters)
+
+		if !last.IsZero() {
+			st.LastReport = now.Sub(last).Seconds()
+		}
+
+		msg.Segment = append(msg.Segment, st)
+	}
+
+	sort.Slice(msg.Segment, func(i, j int) bool {
+		return msg.Segment[i].Group < msg.Segment[j].Group
+	})
+
+	return msg
+}
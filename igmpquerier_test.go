@@ -0,0 +1,125 @@
+package recstation
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIgmpCode(t *testing.T) {
+	for _, v := range []int{0, 100, 127, 248, 1250, 31744} {
+		buf := makeTestIgmpQuery(net.IPv4zero, igmpCode(v), true)
+
+		// Past 127 the code keeps four bits of mantissa
+		want := time.Duration(v) * time.Second / 10
+		if got := igmpMaxResp(buf); got > want || want-got > want/16 {
+			t.Errorf("%d encodes as %#x, which decodes to %s", v, igmpCode(v), got)
+		}
+	}
+}
+
+type sentQuery struct {
+	dst     net.IP
+	group   net.IP
+	maxResp time.Duration
+}
+
+func TestIgmpQuerier(t *testing.T) {
+	now := time.Now()
+	interval := 20 * time.Second
+	q := makeIgmpQuerier(net.IPv4(10, 1, 1, 20), interval, now)
+
+	var sent []sentQuery
+	send := func(dst net.IP, pkt []byte) {
+		group, maxResp, ok := parseIgmpQuery(pkt)
+		if !ok {
+			t.Fatalf("Sent bad query %x", pkt)
+		}
+
+		sent = append(sent, sentQuery{dst: dst, group: group, maxResp: maxResp})
+	}
+
+	q.tick(now, send)
+
+	if len(sent) != 1 || !sent[0].dst.Equal(IGMP_ALL_SYSTEMS) || !sent[0].group.IsUnspecified() || sent[0].maxResp != IGMP_QUERY_RESPONSE_TIME {
+		t.Fatalf("Sent %+v", sent)
+	}
+
+	// Startup queries come a quarter interval apart
+	now = now.Add(interval / 4)
+	q.tick(now, send)
+
+	if len(sent) != 2 {
+		t.Fatalf("Sent %d queries, expected a second startup query", len(sent))
+	}
+
+	// A querier with a higher address defers to us, a lower one wins
+	q.heardQuery(net.IPv4(10, 1, 1, 30), now)
+	if !q.querier {
+		t.Fatal("Stood down for a higher address")
+	}
+
+	q.heardQuery(net.IPv4(10, 1, 1, 1), now)
+	if q.querier {
+		t.Fatal("Still querier after hearing a lower address")
+	}
+
+	sent = nil
+	q.tick(now.Add(interval), send)
+
+	if len(sent) != 0 {
+		t.Fatalf("Sent %d queries while another querier is present", len(sent))
+	}
+
+	// Hosts join a group, with IGMPv3 and with IGMPv2
+	group := net.IPv4(239, 255, 1, 1).To4()
+	v3host := net.IPv4(10, 1, 1, 40).To4()
+	v2host := net.IPv4(10, 1, 1, 41).To4()
+
+	q.heardReport(v3host, makeIgmpReport([]igmpRecord{{Type: IGMP_V3_MODE_IS_EXCLUDE, Group: group}}), now)
+
+	v2report := make([]byte, 8)
+	v2report[0] = IGMP_V2_MEMBERSHIP_REPORT
+	copy(v2report[4:], group)
+	checksum := ChecksumRfc1071(v2report, 0)
+	v2report[2] = byte(checksum >> 8)
+	v2report[3] = byte(checksum)
+
+	q.heardReport(v2host, v2report, now)
+
+	st := q.Status(now)
+	if st.Querier || st.Other != "10.1.1.1" || len(st.Segment) != 1 || len(st.Segment[0].Reporters) != 2 {
+		t.Fatalf("Status %+v", st)
+	}
+
+	// We take over once the other querier has gone quiet
+	now = now.Add(q.otherPresentInterval() + time.Second)
+	q.heardReport(v3host, makeIgmpReport([]igmpRecord{{Type: IGMP_V3_MODE_IS_EXCLUDE, Group: group}}), now)
+	q.heardReport(v2host, v2report, now)
+
+	q.tick(now, send)
+
+	if !q.querier || len(sent) != 1 {
+		t.Fatalf("Querier %v after the other went away, sent %d", q.querier, len(sent))
+	}
+	sent = nil
+
+	// A leave brings group-specific queries, and the group goes unless
+	// someone answers them
+	q.heardReport(v3host, makeIgmpReport([]igmpRecord{{Type: IGMP_V3_CHANGE_TO_INCLUDE_MODE, Group: group}}), now)
+
+	for i := 0; i < IGMP_LAST_MEMBER_QUERY_COUNT; i++ {
+		q.tick(now, send)
+		now = now.Add(IGMP_LAST_MEMBER_QUERY_INTERVAL)
+	}
+
+	if len(sent) != IGMP_LAST_MEMBER_QUERY_COUNT || !sent[0].dst.Equal(group) || !sent[0].group.Equal(group) || sent[0].maxResp != IGMP_LAST_MEMBER_QUERY_INTERVAL {
+		t.Fatalf("Sent %+v", sent)
+	}
+
+	q.tick(now.Add(time.Millisecond), send)
+
+	if st := q.Status(now); len(st.Segment) != 0 {
+		t.Errorf("Group still on the segment: %+v", st.Segment[0])
+	}
+}
@@ -0,0 +1,49 @@
+package recstation
+
+import (
+	"recstation/mpeg"
+)
+
+// inputSink forwards packets from an input's reader to the sink RunMain has
+// attached. Packets wait until a sink is attached rather than being dropped.
+type inputSink struct {
+	chunks     chan []mpeg.TsBuffer
+	attachSink chan *Sink
+}
+
+func makeInputSink() *inputSink {
+	in := &inputSink{
+		chunks:     make(chan []mpeg.TsBuffer),
+		attachSink: make(chan *Sink),
+	}
+
+	go in.RunLoop()
+
+	return in
+}
+
+func (in *inputSink) AttachSink(name string, sink *Sink) {
+	in.attachSink <- sink
+}
+
+func (in *inputSink) DetachSink(name string) {
+	in.attachSink <- nil
+}
+
+func (in *inputSink) RunLoop() {
+	var sink *Sink
+
+	for {
+		if sink == nil {
+			sink = <-in.attachSink
+			continue
+		}
+
+		select {
+		case sink = <-in.attachSink:
+
+		case pkts := <-in.chunks:
+			sink.WritePackets(pkts)
+		}
+	}
+}
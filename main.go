@@ -4,9 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"sort"
+	"syscall"
 	"time"
+
+	"recstation/hbproto"
 )
 
 func Usage() {
@@ -71,27 +76,143 @@ func RunMain() {
 		panic(err)
 	}
 
-	source, err := MakeUdpSource(state.Iface, state.SourceListen)
+	memberships, err := MakeMemberships(state.Ifaces(), state.IgmpQueryInterval, state.AnyIPv6())
 	if err != nil {
 		panic(err)
 	}
 
-	if err := SendPeriodicIgmpMembershipReports(state.Iface, state.GroupAddrs); err != nil {
+	source, err := MakeUdpSource(state.Iface, state.SourceListen, state.AnyFec(), state.AnyIPv6(), state.SourceRcvBuf, memberships)
+	if err != nil {
 		panic(err)
 	}
 
-	heartbeat, err := MakeHeartbeat(state.Iface, state.HeartbeatListen, state.HeartbeatTimeout, state.GroupAddrs)
+	heartbeat, err := MakeHeartbeat(state.Iface, state.HeartbeatListen, state.HeartbeatTimeout, state.HeartbeatOnlineCount, state.RequireSignedHeartbeats, state.HeartbeatGroups(), state.AnyIPv6(), memberships)
 	if err != nil {
 		panic(err)
 	}
 
+	for _, group := range state.Groups {
+		if group.Traffic {
+			source.AddTraffic(group, state.StreamConfig(group.Name), state.Secondaries[group.Name])
+		}
+	}
+
+	for _, static := range state.StaticStreams {
+		if err := source.AddStatic(static, state.StreamConfig(static.Name), state.HeartbeatTimeout); err != nil {
+			panic(err)
+		}
+	}
+
+	for name, u := range state.PullUrls {
+		MakePullSource(name, u, state.HeartbeatTimeout, source.Events)
+	}
+
+	for name, rc := range state.Replays {
+		MakeReplaySource(name, rc.File, rc.Loop, source.Events)
+	}
+
+	for _, sec := range state.Secondaries {
+		if err := heartbeat.JoinGroup(sec.Iface, sec.Group()); err != nil {
+			panic(err)
+		}
+	}
+
 	//func MakeAudioSource(device string, num_channels, bitrate int) *AudioSource {
 	audio := MakeAudioSource(state.AlsaDevice, state.AlsaNumChannels, state.AlsaBitrate)
 	log.Printf("Audio device %s", audio.Device)
 
 	sinks := make(map[string]*Sink)
+	streamRefs := make(map[string]int)
+
+	var captures []*Capture
+	nextCaptureId := 1
+
+	relays := make(map[string][]*Relay)
+	for name, rc := range state.Relays {
+		relay, err := MakeRelay(name, rc)
+		if err != nil {
+			panic(err)
+		}
+
+		relays[rc.Stream] = append(relays[rc.Stream], relay)
+	}
+
+	audio.Sink = MakeSink(AUDIO_SINK_NAME, MakeFilenameMaker(state, AUDIO_SINK_NAME), state.SinkOutput(AUDIO_SINK_NAME))
+
+	makeStreamSink := func(name string) *Sink {
+		sink := MakeSink(name, MakeFilenameMaker(state, name), state.SinkOutput(name))
+
+		sink.Preview = MakePreview(state.PreviewFramerate, state.PreviewWidth, state.PreviewHeight)
+		sink.Relays = relays[name]
+
+		return sink
+	}
+
+	history := make(map[string]*availability)
+	graces := make(map[string]*offlineGrace)
+
+	streamUp := func(name string) {
+		a, ok := history[name]
+		if !ok {
+			a = &availability{}
+			history[name] = a
+		}
+
+		a.Up(time.Now())
+	}
+
+	teardown := func(name string, grace *offlineGrace) {
+		if grace.Input != nil {
+			grace.Input.DetachSink(name)
+		} else {
+			source.leaveGroup <- grace.Group
+			source.RemoveSink(grace.Group)
+		}
+
+		if sink, ok := sinks[name]; ok {
+			sink.OfflineRequest <- true
+		}
+
+		delete(sinks, name)
+	}
+
+	// A stream that goes offline keeps its sink, and so its file, for the
+	// grace period in case it comes straight back
+	streamDown := func(name string, grace *offlineGrace) {
+		now := time.Now()
+
+		if a, ok := history[name]; ok {
+			a.Down(now)
+		}
+
+		if state.OfflineGrace <= 0 {
+			teardown(name, grace)
+			return
+		}
+
+		grace.Deadline = now.Add(state.OfflineGrace)
+		graces[name] = grace
+	}
+
+	streamResume := func(name string) bool {
+		if _, ok := graces[name]; !ok {
+			return false
+		}
+
+		log.Printf("%s back within the grace period", name)
+
+		delete(graces, name)
+		history[name].Resume(time.Now())
+
+		return true
+	}
+
+	grace_tick := time.NewTicker(OFFLINE_CHECK_INTERVAL)
 
-	audio.Sink = MakeSink("audio", MakeFilenameMaker(state, "audio"))
+	// Finish the files and leave the groups on the way out rather than have
+	// them time out
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
 	new_output_tick := time.NewTicker(state.NewOutputEvery)
 	new_output_tick.Stop()
@@ -101,7 +222,7 @@ func RunMain() {
 		case ev := <-audio.Event:
 			switch ev {
 			case AUDIO_EVENT_STARTUP:
-				sinks["audio"] = audio.Sink
+				sinks[AUDIO_SINK_NAME] = audio.Sink
 
 				if state.Recording {
 					audio.Sink.OpenFileRequest <- true
@@ -109,7 +230,7 @@ func RunMain() {
 
 			case AUDIO_EVENT_SHUTDOWN:
 				audio.Sink.StopRequest <- true
-				delete(sinks, "audio")
+				delete(sinks, AUDIO_SINK_NAME)
 			}
 
 		case resp := <-state.RecordRequest:
@@ -167,8 +288,68 @@ func RunMain() {
 				st.Sinks = append(st.Sinks, msg)
 			}
 
+			sourceStatus := source.Status()
+
+			heartbeatStatus := heartbeat.Status()
+
+			st.ForeignHeartbeats = heartbeatStatus.Foreign
+			st.Heartbeats = heartbeatStatus.Nodes
+			st.InvalidHeartbeats = heartbeatStatus.Invalid
+			st.RejectedHeartbeats = heartbeatStatus.Rejected
+
+			encoders := make(map[string][]*HeartbeatNodeStatusMessage)
+			for _, node := range heartbeatStatus.Nodes {
+				name := state.StreamName(net.ParseIP(node.Dst))
+				encoders[name] = append(encoders[name], node)
+			}
+
+			st.Sockets = sourceStatus.Sockets
+			st.RxBufPoolDepleted = sourceStatus.PoolDepleted
+
+			ingest := make(map[string]*UdpStreamStatusMessage)
+			for _, stream := range sourceStatus.Streams {
+				ingest[stream.Name] = stream
+			}
+
+			now := time.Now()
+			available := make(map[string]*AvailabilityStatusMessage)
+
+			st.Availability = make([]*AvailabilityStatusMessage, 0, len(history))
+			for name, a := range history {
+				available[name] = a.Status(name, now)
+				st.Availability = append(st.Availability, available[name])
+			}
+
+			sort.Slice(st.Availability, func(i, j int) bool {
+				return st.Availability[i].Name < st.Availability[j].Name
+			})
+
+			for _, msg := range st.Sinks {
+				msg.Availability = available[msg.Name]
+
+				if stream, ok := ingest[msg.Name]; ok {
+					msg.Rtp = stream.Rtp
+					msg.Paths = stream.Paths
+					msg.Foreign = stream.Foreign
+					msg.Arrival = stream.Arrival
+				}
+
+				msg.Encoders = encoders[msg.Name]
+
+				for _, relay := range relays[msg.Name] {
+					msg.Relays = append(msg.Relays, relay.Status())
+				}
+			}
+
 			sort.Sort(SinkStatusMessage_ByName(st.Sinks))
 
+			st.Captures = make([]*CaptureStatusMessage, 0, len(captures))
+			for _, capture := range captures {
+				st.Captures = append(st.Captures, capture.Status())
+			}
+
+			st.Igmp = memberships.Status()
+
 			resp <- &st
 
 		case req := <-state.PreviewRequest:
@@ -188,23 +369,92 @@ func RunMain() {
 
 			req.Ready <- nil
 
+		case req := <-state.CaptureRequest:
+			if req.Action == CAPTURE_START {
+				capture, err := MakeCapture(nextCaptureId, state.CaptureDir, req.Group, req.Heartbeat, req.MaxBytes, req.Duration)
+				if err != nil {
+					req.Resp <- CaptureResponse{Err: err}
+					continue
+				}
+
+				nextCaptureId++
+
+				if req.Heartbeat {
+					heartbeat.AddCapture(capture)
+				} else {
+					source.AddCapture(capture)
+				}
+
+				captures = append(captures, capture)
+
+				// Forget the oldest finished captures
+				kept := captures[:0]
+				excess := len(captures) - CAPTURE_KEEP
+				for _, c := range captures {
+					if excess > 0 && c.Finished() {
+						c.Remove()
+						excess--
+						continue
+					}
+
+					kept = append(kept, c)
+				}
+				captures = kept
+
+				req.Resp <- CaptureResponse{Capture: capture}
+				continue
+			}
+
+			var found *Capture
+			for _, capture := range captures {
+				if capture.Id == req.Id {
+					found = capture
+				}
+			}
+
+			if found != nil && req.Action == CAPTURE_STOP {
+				found.Stop()
+			}
+
+			req.Resp <- CaptureResponse{Capture: found}
+
+		case req := <-state.ControlRequest:
+			seq, err := heartbeat.SendControl(req.Src, req.Dst, req.Command, req.Argument)
+			if err == nil {
+				log.Printf("Control %s %d to %s => %s as %d", hbproto.COMMAND_NAMES[req.Command], req.Argument, req.Src, req.Dst, seq)
+			}
+
+			req.Resp <- ControlResponse{Sequence: seq, Err: err}
+
 		case ev := <-heartbeat.Events:
 			switch ev.Event {
 			case HEARTBEAT_ONLINE:
-				key := ev.Dst.String()
+				group := state.PrimaryGroup(ev.Dst)
+				name := state.StreamName(group)
+
+				// The source announces these itself
+				if state.IsTraffic(group) {
+					continue
+				}
 
-				name, ok := state.Multicast2Name[key]
-				if !ok {
-					name = key
+				if ev.Info != nil {
+					log.Printf("Online %s => %s (%s) encoder %d", ev.Src, ev.Dst, name, ev.Info.EncoderId)
+				} else {
+					log.Printf("Online %s => %s (%s)", ev.Src, ev.Dst, name)
 				}
 
-				log.Printf("Online %s => %s (%s)", ev.Src, ev.Dst, name)
+				// With 2022-7 protection the heartbeat may be heard on
+				// both paths
+				streamRefs[name]++
+				if streamRefs[name] > 1 || streamResume(name) {
+					continue
+				}
 
-				sink := MakeSink(name, MakeFilenameMaker(state, name))
+				streamUp(name)
 
-				sink.Preview = MakePreview(state.PreviewFramerate, state.PreviewWidth, state.PreviewHeight)
+				sink := makeStreamSink(name)
 
-				source.AddSink(ev.Dst, sink)
+				source.AddSink(group, state.SourceFor(group), sink, state.StreamConfig(name), state.Secondaries[name])
 
 				sinks[name] = sink
 
@@ -214,24 +464,78 @@ func RunMain() {
 
 			case HEARTBEAT_OFFLINE:
 				log.Printf("OFFLINE %s => %s", ev.Src, ev.Dst)
-				source.leaveGroup <- ev.Dst
 
-				source.RemoveSink(ev.Dst)
+				group := state.PrimaryGroup(ev.Dst)
+				name := state.StreamName(group)
 
-				key := ev.Dst.String()
+				if state.IsTraffic(group) {
+					continue
+				}
 
-				name, ok := state.Multicast2Name[key]
-				if !ok {
-					name = key
+				streamRefs[name]--
+				if streamRefs[name] > 0 {
+					continue
 				}
 
-				if sink, ok := sinks[name]; ok {
-					sink.OfflineRequest <- true
+				delete(streamRefs, name)
+
+				streamDown(name, &offlineGrace{Group: group})
+			}
+
+		case ev := <-source.Events:
+			switch ev.Event {
+			case HEARTBEAT_ONLINE:
+				log.Printf("Online %s (%s)", ev.Name, ev.Src)
+
+				// The input still has the sink attached
+				if streamResume(ev.Name) {
+					continue
+				}
+
+				streamUp(ev.Name)
+
+				sink := makeStreamSink(ev.Name)
+
+				ev.Input.AttachSink(ev.Name, sink)
+
+				sinks[ev.Name] = sink
+
+				if state.Recording {
+					sink.OpenFileRequest <- true
 				}
 
-				delete(sinks, name)
+			case HEARTBEAT_OFFLINE:
+				log.Printf("OFFLINE %s", ev.Name)
+
+				streamDown(ev.Name, &offlineGrace{Input: ev.Input})
+			}
+
+		case now := <-grace_tick.C:
+			for name, grace := range graces {
+				if now.Before(grace.Deadline) {
+					continue
+				}
+
+				log.Printf("%s still offline after %s", name, state.OfflineGrace)
+
+				teardown(name, grace)
+				delete(graces, name)
 			}
 
+		case sig := <-signals:
+			log.Printf("%s, closing sinks and leaving groups", sig)
+
+			for _, sink := range sinks {
+				sink.OfflineRequest <- true
+			}
+
+			for _, sink := range sinks {
+				<-sink.Closed
+			}
+
+			memberships.Close()
+			os.Exit(0)
+
 		case <-new_output_tick.C:
 			if !state.Recording {
 				continue
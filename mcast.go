@@ -0,0 +1,230 @@
+package recstation
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// McastConn is a UDP socket that can join multicast groups of its own
+// address family and report the destination of each received datagram.
+type McastConn struct {
+	UdpConn *net.UDPConn
+	V4Conn  *ipv4.PacketConn
+	V6Conn  *ipv6.PacketConn
+
+	// Effective SO_RCVBUF, and the datagrams the kernel has dropped on the
+	// socket going by the last SO_RXQ_OVFL count seen
+	RcvBuf   int
+	Drops    uint64
+	lastOvfl uint32
+
+	// Told of joins and leaves, if set
+	Memberships *Memberships
+}
+
+func ListenMcast(laddr *net.UDPAddr) (*McastConn, error) {
+	network := "udp4"
+	if isIPv6(laddr.IP) {
+		network = "udp6"
+	}
+
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &McastConn{
+		UdpConn: conn,
+	}
+
+	if network == "udp4" {
+		c.V4Conn = ipv4.NewPacketConn(conn)
+		err = c.V4Conn.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true)
+	} else {
+		c.V6Conn = ipv6.NewPacketConn(conn)
+		err = c.V6Conn.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true)
+	}
+
+	if err == nil {
+		err = enableRxqOvfl(conn)
+	}
+
+	if err == nil {
+		err = enableTimestampNs(conn)
+	}
+
+	if err == nil {
+		c.RcvBuf, err = getRcvBuf(conn)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *McastConn) SetReadBuffer(bytes int) error {
+	if err := c.UdpConn.SetReadBuffer(bytes); err != nil {
+		return err
+	}
+
+	size, err := getRcvBuf(c.UdpConn)
+	if err != nil {
+		return err
+	}
+
+	c.RcvBuf = size
+
+	return nil
+}
+
+// ListenMcast6 listens on the IPv6 wildcard address with the same port as an
+// IPv4 listen address.
+func ListenMcast6(laddr *net.UDPAddr) (*McastConn, error) {
+	return ListenMcast(&net.UDPAddr{
+		IP:   net.IPv6unspecified,
+		Port: laddr.Port,
+	})
+}
+
+func (c *McastConn) IsV6() bool {
+	return c.V6Conn != nil
+}
+
+// Handles reports whether a group belongs to this socket's address family.
+func (c *McastConn) Handles(group net.IP) bool {
+	return c.IsV6() == isIPv6(group)
+}
+
+// JoinGroup joins a group, restricted to a single sender when source is not
+// nil.
+func (c *McastConn) JoinGroup(iface *net.Interface, group, source net.IP) error {
+	if err := c.joinGroup(iface, group, source); err != nil {
+		return err
+	}
+
+	c.Memberships.Join(iface, group, source, c.UdpConn.LocalAddr().String())
+
+	return nil
+}
+
+func (c *McastConn) joinGroup(iface *net.Interface, group, source net.IP) error {
+	g := &net.UDPAddr{IP: group}
+
+	if source != nil {
+		s := &net.UDPAddr{IP: source}
+
+		if c.IsV6() {
+			return c.V6Conn.JoinSourceSpecificGroup(iface, g, s)
+		}
+
+		return c.V4Conn.JoinSourceSpecificGroup(iface, g, s)
+	}
+
+	if c.IsV6() {
+		return c.V6Conn.JoinGroup(iface, g)
+	}
+
+	return c.V4Conn.JoinGroup(iface, g)
+}
+
+func (c *McastConn) LeaveGroup(iface *net.Interface, group, source net.IP) error {
+	if err := c.leaveGroup(iface, group, source); err != nil {
+		return err
+	}
+
+	c.Memberships.Leave(iface, group, source, c.UdpConn.LocalAddr().String())
+
+	return nil
+}
+
+func (c *McastConn) leaveGroup(iface *net.Interface, group, source net.IP) error {
+	g := &net.UDPAddr{IP: group}
+
+	if source != nil {
+		s := &net.UDPAddr{IP: source}
+
+		if c.IsV6() {
+			return c.V6Conn.LeaveSourceSpecificGroup(iface, g, s)
+		}
+
+		return c.V4Conn.LeaveSourceSpecificGroup(iface, g, s)
+	}
+
+	if c.IsV6() {
+		return c.V6Conn.LeaveGroup(iface, g)
+	}
+
+	return c.V4Conn.LeaveGroup(iface, g)
+}
+
+// ParseControl extracts the destination address and receiving interface from
+// the control messages of a received datagram.
+func (c *McastConn) ParseControl(oob []byte) (net.IP, int, error) {
+	if c.IsV6() {
+		var cm ipv6.ControlMessage
+
+		if err := cm.Parse(oob); err != nil {
+			return nil, 0, err
+		}
+
+		return cm.Dst, cm.IfIndex, nil
+	}
+
+	var cm ipv4.ControlMessage
+
+	if err := cm.Parse(oob); err != nil {
+		return nil, 0, err
+	}
+
+	return cm.Dst.To4(), cm.IfIndex, nil
+}
+
+// ReadBatch reads up to len(ms) datagrams with a single recvmmsg call where the
+// platform supports it.
+func (c *McastConn) ReadBatch(ms []ipv4.Message) (int, error) {
+	if c.IsV6() {
+		return c.V6Conn.ReadBatch(ms, 0)
+	}
+
+	return c.V4Conn.ReadBatch(ms, 0)
+}
+
+// countDrops takes the kernel's drop count from a datagram, returning how many
+// were dropped since the last one. The count is 32 bits and wraps.
+func (c *McastConn) countDrops(ovfl uint32) uint32 {
+	delta := ovfl - c.lastOvfl
+
+	c.lastOvfl = ovfl
+	c.Drops += uint64(delta)
+
+	return delta
+}
+
+// ParseDrops returns the kernel's count of datagrams dropped on this socket,
+// present in the control messages once the first drop has happened.
+func (c *McastConn) ParseDrops(oob []byte) (uint32, bool) {
+	return parseRxqOvfl(oob)
+}
+
+// ParseTimestamp returns the kernel receive time of a datagram.
+func (c *McastConn) ParseTimestamp(oob []byte) (time.Time, bool) {
+	return parseTimestampNs(oob)
+}
+
+func mcastConnsFor(conns []*McastConn, group net.IP) []*McastConn {
+	var out []*McastConn
+
+	for _, c := range conns {
+		if c.Handles(group) {
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,108 @@
+package recstation
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// Memberships passes the joins and leaves of our sockets on to the IGMP or
+// MLD host of their interface, so that what we report is what we have joined.
+type Memberships struct {
+	hosts  map[int]*IgmpHost
+	hosts6 map[int]*IgmpHost
+}
+
+// MakeMemberships starts an IGMP host for each interface, which is also the
+// querier if the query interval is not zero, and an MLD host too if there
+// are IPv6 groups.
+func MakeMemberships(ifaces []*net.Interface, queryInterval time.Duration, enableV6 bool) (*Memberships, error) {
+	m := &Memberships{
+		hosts:  make(map[int]*IgmpHost),
+		hosts6: make(map[int]*IgmpHost),
+	}
+
+	for _, iface := range ifaces {
+		if _, found := m.hosts[iface.Index]; found {
+			continue
+		}
+
+		host, err := MakeIgmpHost(iface, queryInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		m.hosts[iface.Index] = host
+
+		if !enableV6 {
+			continue
+		}
+
+		host6, err := MakeMldHost(iface, queryInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		m.hosts6[iface.Index] = host6
+	}
+
+	return m, nil
+}
+
+func (m *Memberships) host(iface *net.Interface, group net.IP) *IgmpHost {
+	if m == nil || iface == nil {
+		return nil
+	}
+
+	if isIPv6(group) {
+		return m.hosts6[iface.Index]
+	}
+
+	return m.hosts[iface.Index]
+}
+
+// Join adds a join by the socket with the given local address.
+func (m *Memberships) Join(iface *net.Interface, group, source net.IP, socket string) {
+	if host := m.host(iface, group); host != nil {
+		host.Join(group, source, socket)
+	}
+}
+
+func (m *Memberships) Leave(iface *net.Interface, group, source net.IP, socket string) {
+	if host := m.host(iface, group); host != nil {
+		host.Leave(group, source, socket)
+	}
+}
+
+func (m *Memberships) Status() []*IgmpStatusMessage {
+	var st []*IgmpStatusMessage
+
+	for _, host := range m.hosts {
+		st = append(st, host.Status())
+	}
+
+	for _, host := range m.hosts6 {
+		st = append(st, host.Status())
+	}
+
+	sort.Slice(st, func(i, j int) bool {
+		if st[i].Iface != st[j].Iface {
+			return st[i].Iface < st[j].Iface
+		}
+
+		return st[i].Protocol < st[j].Protocol
+	})
+
+	return st
+}
+
+// Close leaves every group on every interface.
+func (m *Memberships) Close() {
+	for _, host := range m.hosts {
+		host.Close()
+	}
+
+	for _, host := range m.hosts6 {
+		host.Close()
+	}
+}
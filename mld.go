@@ -0,0 +1,160 @@
+package recstation
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	MLD_LISTENER_QUERY     = 130
+	MLD_V2_LISTENER_REPORT = 143
+
+	MLD_V1_QUERY_LENGTH = 24
+	MLD_V2_QUERY_LENGTH = 28
+
+	MLD_RECORD_LENGTH = 4 + net.IPv6len
+
+	// Address records per report, keeping it within the minimum IPv6 MTU
+	MLD_MAX_RECORDS = 32
+)
+
+// All MLDv2-capable routers
+var MLD_V2_ROUTERS = net.ParseIP("ff02::16")
+
+var mldV2 = &groupProtocol{
+	Name:       "MLD",
+	QueryType:  MLD_LISTENER_QUERY,
+	ReportDst:  MLD_V2_ROUTERS,
+	MaxRecords: MLD_MAX_RECORDS,
+	makeReport: makeMldReport,
+	parseQuery: parseMldQuery,
+}
+
+// makeMldReport makes an MLDv2 listener report. The record types are those of
+// IGMPv3, and the checksum is filled in by the kernel.
+func makeMldReport(records []igmpRecord) []byte {
+	pkt := make([]byte, 8)
+
+	pkt[0] = MLD_V2_LISTENER_REPORT
+	pkt[6] = byte(len(records) >> 8)
+	pkt[7] = byte(len(records))
+
+	for _, r := range records {
+		rec := make([]byte, MLD_RECORD_LENGTH+net.IPv6len*len(r.Sources))
+		rec[0] = r.Type
+		rec[2] = byte(len(r.Sources) >> 8)
+		rec[3] = byte(len(r.Sources))
+		copy(rec[4:], r.Group.To16())
+
+		for i, source := range r.Sources {
+			copy(rec[MLD_RECORD_LENGTH+net.IPv6len*i:], source.To16())
+		}
+
+		pkt = append(pkt, rec...)
+	}
+
+	return pkt
+}
+
+// parseMldQuery returns the group of a query, unspecified for a general
+// query, and how long we have to answer it. MLDv2 codes from 32768 up are a
+// floating point value.
+func parseMldQuery(buf []byte) (net.IP, time.Duration, bool) {
+	if len(buf) < MLD_V1_QUERY_LENGTH || buf[0] != MLD_LISTENER_QUERY {
+		return nil, 0, false
+	}
+
+	code := int(buf[4])<<8 | int(buf[5])
+
+	if len(buf) >= MLD_V2_QUERY_LENGTH && code >= 32768 {
+		mant := code&0x0fff | 0x1000
+		exp := uint(code>>12) & 0x07
+		code = mant << (exp + 3)
+	}
+
+	return net.IP(append([]byte(nil), buf[8:24]...)), time.Duration(code) * time.Millisecond, true
+}
+
+func (host *IgmpHost) write6(dst net.IP, pkt []byte) error {
+	cm := ipv6.ControlMessage{
+		IfIndex:  host.Iface.Index,
+		HopLimit: 1,
+	}
+
+	_, err := host.Conn6.WriteTo(pkt, &cm, &net.IPAddr{IP: dst, Zone: host.Iface.Name})
+
+	return err
+}
+
+func (host *IgmpHost) receiveLoop6() {
+	buf := make([]byte, 2048)
+
+	for {
+		n, cm, src, err := host.Conn6.ReadFrom(buf)
+		if err != nil {
+			log.Printf("MLD receive on %s failed: %v", host.Iface.Name, err)
+			host.incoming <- igmpPacket{err: err}
+			return
+		}
+
+		if cm != nil && cm.IfIndex != host.Iface.Index {
+			continue
+		}
+
+		pkt := igmpPacket{
+			buf: append([]byte(nil), buf[:n]...),
+		}
+
+		if addr, ok := src.(*net.IPAddr); ok {
+			pkt.src = addr.IP
+		}
+
+		host.incoming <- pkt
+	}
+}
+
+func makeMldHost(iface *net.Interface, send func(net.IP, []byte) error) *IgmpHost {
+	return makeGroupHost(iface, mldV2, send)
+}
+
+// MakeMldHost starts the MLD host for an interface. The query interval is
+// only for telling when memberships are stale, as there is no MLD querier.
+func MakeMldHost(iface *net.Interface, queryInterval time.Duration) (*IgmpHost, error) {
+	host := makeMldHost(iface, nil)
+	host.staleAfter = igmpStaleAfter(queryInterval)
+
+	l, err := net.ListenPacket("ip6:58", "::")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setRouterAlert6(l); err != nil {
+		return nil, err
+	}
+
+	c := ipv6.NewPacketConn(l)
+
+	if err := c.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		return nil, err
+	}
+
+	// Only queries, not the rest of ICMPv6
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeMulticastListenerQuery)
+
+	if err := c.SetICMPFilter(&filter); err != nil {
+		return nil, err
+	}
+
+	host.Conn6 = c
+	host.send = host.write6
+
+	go host.RunLoop()
+	go host.receiveLoop6()
+
+	return host, nil
+}
@@ -0,0 +1,105 @@
+package recstation
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMldReport(t *testing.T) {
+	group := net.ParseIP("ff3e::8000:1")
+	source := net.ParseIP("2001:db8::50")
+
+	pkt := makeMldReport([]igmpRecord{
+		{Type: IGMP_V3_CHANGE_TO_EXCLUDE_MODE, Group: net.ParseIP("ff15::42")},
+		{Type: IGMP_V3_ALLOW_NEW_SOURCES, Group: group, Sources: []net.IP{source}},
+	})
+
+	want := []byte{
+		143, 0, 0, 0, 0, 0, 0, 2,
+		4, 0, 0, 0,
+		0xff, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x42,
+		5, 0, 0, 1,
+		0xff, 0x3e, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x50,
+	}
+
+	if !bytes.Equal(pkt, want) {
+		t.Errorf("Report\n%x, expected\n%x", pkt, want)
+	}
+}
+
+func makeTestMldQuery(group net.IP, code uint16, v2 bool) []byte {
+	buf := make([]byte, MLD_V1_QUERY_LENGTH)
+	if v2 {
+		buf = make([]byte, MLD_V2_QUERY_LENGTH)
+	}
+
+	buf[0] = MLD_LISTENER_QUERY
+	buf[4] = byte(code >> 8)
+	buf[5] = byte(code)
+	copy(buf[8:24], group.To16())
+
+	return buf
+}
+
+func TestMldQuery(t *testing.T) {
+	cases := []struct {
+		code uint16
+		v2   bool
+		want time.Duration
+	}{
+		{10000, false, 10 * time.Second},
+		{10000, true, 10 * time.Second},
+		{0x8fff, true, 0x1fff << 3 * time.Millisecond},
+		{0x9000, true, 0x1000 << 4 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		group, got, ok := parseMldQuery(makeTestMldQuery(net.IPv6unspecified, c.code, c.v2))
+		if !ok || got != c.want || !group.IsUnspecified() {
+			t.Errorf("Code %#x (v2 %v) is %s for %s, expected %s", c.code, c.v2, got, group, c.want)
+		}
+	}
+
+	if _, _, ok := parseMldQuery(make([]byte, MLD_V1_QUERY_LENGTH-1)); ok {
+		t.Error("Short query parsed")
+	}
+}
+
+func TestMldHost(t *testing.T) {
+	var sent [][]byte
+
+	host := makeMldHost(&net.Interface{Name: "test"}, func(dst net.IP, pkt []byte) error {
+		if !dst.Equal(MLD_V2_ROUTERS) {
+			t.Errorf("Report sent to %s", dst)
+		}
+
+		sent = append(sent, pkt)
+		return nil
+	})
+
+	now := time.Now()
+	group := net.ParseIP("ff15::42")
+
+	host.apply(igmpChange{group: group, socket: "[::]:5004", delta: 1}, now)
+
+	if len(sent) != 1 || sent[0][0] != MLD_V2_LISTENER_REPORT || sent[0][8] != IGMP_V3_CHANGE_TO_EXCLUDE_MODE {
+		t.Fatalf("Sent %x", sent)
+	}
+	sent = nil
+
+	host.pending = nil
+	host.handleQuery(makeTestMldQuery(group, 1000, true), now)
+	host.tick(now.Add(time.Second))
+
+	if len(sent) != 1 || sent[0][8] != IGMP_V3_MODE_IS_EXCLUDE || !net.IP(sent[0][12:28]).Equal(group) {
+		t.Fatalf("Answered the query with %x", sent)
+	}
+
+	st := host.status(now)
+	if st.Protocol != "MLD" || len(st.Groups) != 1 || st.Groups[0].Queries != 1 || st.Groups[0].Group != "ff15::42" {
+		t.Errorf("Status %+v", st)
+	}
+}
@@ -0,0 +1,69 @@
+package mp4
+
+import (
+	"errors"
+)
+
+const (
+	ADTS_HEADER_LENGTH     = 7
+	ADTS_CRC_LENGTH        = 2
+	AAC_SAMPLES_PER_FRAME  = 1024
+	AAC_OBJECT_TYPE_OFFSET = 1
+)
+
+var adtsSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+var errBadAdts = errors.New("mp4: bad ADTS header")
+
+type AdtsHeader struct {
+	Profile         uint
+	SampleRateIndex uint
+	ChannelConfig   uint
+	HeaderLength    int
+	FrameLength     int
+}
+
+func (h *AdtsHeader) SampleRate() int {
+	return adtsSampleRates[h.SampleRateIndex]
+}
+
+// AudioSpecificConfig returns the two byte decoder configuration carried in
+// the esds box.
+func (h *AdtsHeader) AudioSpecificConfig() []byte {
+	objectType := h.Profile + AAC_OBJECT_TYPE_OFFSET
+
+	return []byte{
+		byte((objectType << 3) | (h.SampleRateIndex >> 1)),
+		byte(((h.SampleRateIndex & 0x1) << 7) | (h.ChannelConfig << 3)),
+	}
+}
+
+func ParseAdtsHeader(buf []byte) (*AdtsHeader, error) {
+	if len(buf) < ADTS_HEADER_LENGTH {
+		return nil, errBadAdts
+	}
+
+	if buf[0] != 0xff || (buf[1]&0xf0) != 0xf0 {
+		return nil, errBadAdts
+	}
+
+	h := &AdtsHeader{
+		Profile:         uint(buf[2]>>6) & 0x3,
+		SampleRateIndex: uint(buf[2]>>2) & 0xf,
+		ChannelConfig:   (uint(buf[2]&0x1) << 2) | uint(buf[3]>>6),
+		HeaderLength:    ADTS_HEADER_LENGTH,
+		FrameLength:     (int(buf[3]&0x3) << 11) | (int(buf[4]) << 3) | int(buf[5]>>5),
+	}
+
+	if (buf[1] & 0x1) == 0 {
+		h.HeaderLength += ADTS_CRC_LENGTH
+	}
+
+	if int(h.SampleRateIndex) >= len(adtsSampleRates) || h.FrameLength < h.HeaderLength {
+		return nil, errBadAdts
+	}
+
+	return h, nil
+}
@@ -0,0 +1,83 @@
+package mp4
+
+import (
+	"encoding/binary"
+)
+
+const (
+	BOX_HEADER_LENGTH = 8
+)
+
+type boxBuffer struct {
+	buf []byte
+}
+
+func (b *boxBuffer) u8(v uint8) {
+	b.buf = append(b.buf, v)
+}
+
+func (b *boxBuffer) u16(v uint16) {
+	b.buf = append(b.buf, byte(v>>8), byte(v))
+}
+
+func (b *boxBuffer) u24(v uint32) {
+	b.buf = append(b.buf, byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (b *boxBuffer) u32(v uint32) {
+	b.buf = append(b.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (b *boxBuffer) u64(v uint64) {
+	b.u32(uint32(v >> 32))
+	b.u32(uint32(v))
+}
+
+func (b *boxBuffer) bytes(v []byte) {
+	b.buf = append(b.buf, v...)
+}
+
+func (b *boxBuffer) zeros(n int) {
+	for i := 0; i < n; i++ {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *boxBuffer) fourcc(typ string) {
+	b.buf = append(b.buf, typ[:4]...)
+}
+
+func box(typ string, children ...[]byte) []byte {
+	n := BOX_HEADER_LENGTH
+	for _, c := range children {
+		n += len(c)
+	}
+
+	out := make([]byte, BOX_HEADER_LENGTH, n)
+	binary.BigEndian.PutUint32(out[0:4], uint32(n))
+	copy(out[4:8], typ)
+
+	for _, c := range children {
+		out = append(out, c...)
+	}
+
+	return out
+}
+
+func fullBox(typ string, version uint8, flags uint32, children ...[]byte) []byte {
+	hdr := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+
+	return box(typ, append([][]byte{hdr}, children...)...)
+}
+
+var unityMatrix = []uint32{
+	0x00010000, 0, 0,
+	0, 0x00010000, 0,
+	0, 0, 0x40000000,
+}
+
+func (b *boxBuffer) matrix() {
+	for _, v := range unityMatrix {
+		b.u32(v)
+	}
+}
@@ -0,0 +1,245 @@
+package mp4
+
+import (
+	"errors"
+)
+
+const (
+	NAL_TYPE_SLICE = 1
+	NAL_TYPE_IDR   = 5
+	NAL_TYPE_SEI   = 6
+	NAL_TYPE_SPS   = 7
+	NAL_TYPE_PPS   = 8
+	NAL_TYPE_AUD   = 9
+
+	NAL_TYPE_MASK = 0x1f
+)
+
+var errShortSps = errors.New("mp4: truncated SPS")
+
+// SplitAnnexB returns the NAL units of an Annex B byte stream, without their
+// start codes.
+func SplitAnnexB(buf []byte) [][]byte {
+	var nals [][]byte
+
+	start := -1
+	n := len(buf)
+
+	for i := 0; i+2 < n; {
+		if buf[i] == 0 && buf[i+1] == 0 && buf[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				for end > start && buf[end-1] == 0 {
+					end--
+				}
+
+				if end > start {
+					nals = append(nals, buf[start:end])
+				}
+			}
+
+			i += 3
+			start = i
+			continue
+		}
+
+		i++
+	}
+
+	if start >= 0 && start < n {
+		nals = append(nals, buf[start:])
+	}
+
+	return nals
+}
+
+type bitReader struct {
+	buf  []byte
+	offs uint
+	err  error
+}
+
+func unescapeRbsp(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
+
+func (r *bitReader) u(n uint) uint {
+	v := uint(0)
+
+	for i := uint(0); i < n; i++ {
+		if r.offs >= uint(len(r.buf))*8 {
+			r.err = errShortSps
+			return 0
+		}
+
+		bit := (r.buf[r.offs/8] >> (7 - (r.offs % 8))) & 1
+		v = (v << 1) | uint(bit)
+		r.offs++
+	}
+
+	return v
+}
+
+func (r *bitReader) ue() uint {
+	zeros := uint(0)
+
+	for r.u(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errShortSps
+			return 0
+		}
+
+		zeros++
+	}
+
+	return (1 << zeros) - 1 + r.u(zeros)
+}
+
+func (r *bitReader) se() int {
+	v := r.ue()
+
+	if v&1 != 0 {
+		return int((v + 1) / 2)
+	}
+
+	return -int(v / 2)
+}
+
+func (r *bitReader) skipScalingList(size int) {
+	last, next := 8, 8
+
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+type Sps struct {
+	ProfileIdc     uint
+	ConstraintSets uint
+	LevelIdc       uint
+	Width          int
+	Height         int
+}
+
+func ParseSps(nal []byte) (*Sps, error) {
+	if len(nal) < 4 {
+		return nil, errShortSps
+	}
+
+	r := bitReader{buf: unescapeRbsp(nal[1:])}
+	sps := &Sps{}
+
+	sps.ProfileIdc = r.u(8)
+	sps.ConstraintSets = r.u(8)
+	sps.LevelIdc = r.u(8)
+	r.ue() // seq_parameter_set_id
+
+	chromaFormatIdc := uint(1)
+
+	switch sps.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = r.ue()
+		if chromaFormatIdc == 3 {
+			r.u(1) // separate_colour_plane_flag
+		}
+
+		r.ue()           // bit_depth_luma_minus8
+		r.ue()           // bit_depth_chroma_minus8
+		r.u(1)           // qpprime_y_zero_transform_bypass_flag
+		if r.u(1) != 0 { // seq_scaling_matrix_present_flag
+			n := 8
+			if chromaFormatIdc == 3 {
+				n = 12
+			}
+
+			for i := 0; i < n; i++ {
+				if r.u(1) != 0 {
+					if i < 6 {
+						r.skipScalingList(16)
+					} else {
+						r.skipScalingList(64)
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.u(1) // delta_pic_order_always_zero_flag
+		r.se() // offset_for_non_ref_pic
+		r.se() // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+
+	r.ue() // max_num_ref_frames
+	r.u(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.u(1))
+
+	if frameMbsOnly == 0 {
+		r.u(1) // mb_adaptive_frame_field_flag
+	}
+
+	r.u(1) // direct_8x8_inference_flag
+
+	sps.Width = widthMbs * 16
+	sps.Height = (2 - frameMbsOnly) * heightMapUnits * 16
+
+	if r.u(1) != 0 { // frame_cropping_flag
+		left := int(r.ue())
+		right := int(r.ue())
+		top := int(r.ue())
+		bottom := int(r.ue())
+
+		cropX, cropY := 1, 2-frameMbsOnly
+		if chromaFormatIdc == 1 || chromaFormatIdc == 2 {
+			cropX = 2
+		}
+		if chromaFormatIdc == 1 {
+			cropY *= 2
+		}
+
+		sps.Width -= (left + right) * cropX
+		sps.Height -= (top + bottom) * cropY
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return sps, nil
+}
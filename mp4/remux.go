@@ -0,0 +1,363 @@
+package mp4
+
+import (
+	"io"
+
+	"recstation/mpeg"
+)
+
+const (
+	VIDEO_TRACK_ID = 1
+	AUDIO_TRACK_ID = 2
+
+	// Start without audio if the PMT announces an audio stream but no audio
+	// has arrived by this many video keyframes.
+	MAX_KEYFRAMES_WITHOUT_AUDIO = 2
+)
+
+// Remuxer demultiplexes an MPEG-TS stream carrying H.264 video and ADTS AAC
+// audio and rewrites it as fragmented MP4.
+type Remuxer struct {
+	out  io.WriteCloser
+	next io.WriteCloser
+
+	writer *Writer
+	video  *Track
+	audio  *Track
+	err    error
+
+	pmtPid   mpeg.PID
+	videoPid mpeg.PID
+	audioPid mpeg.PID
+	videoAsm mpeg.PesAssembler
+	audioAsm mpeg.PesAssembler
+
+	sps  []byte
+	pps  []byte
+	adts *AdtsHeader
+
+	videoClock timestampUnwrapper
+	audioClock timestampUnwrapper
+
+	origin          int64
+	keyframesWaited int
+	lastAudioDts    int64
+	haveAudioDts    bool
+}
+
+type timestampUnwrapper struct {
+	valid bool
+	last  uint64
+	value int64
+}
+
+func (u *timestampUnwrapper) unwrap(ts uint64) int64 {
+	if !u.valid {
+		u.valid = true
+		u.last = ts
+		u.value = int64(ts)
+		return u.value
+	}
+
+	diff := int64((ts - u.last) & mpeg.TIMESTAMP_MASK)
+	if diff >= int64(1)<<(mpeg.TIMESTAMP_BITS-1) {
+		diff -= int64(1) << mpeg.TIMESTAMP_BITS
+	}
+
+	u.last = ts
+	u.value += diff
+
+	return u.value
+}
+
+func NewRemuxer(out io.WriteCloser) *Remuxer {
+	return &Remuxer{
+		out: out,
+	}
+}
+
+// Switch arranges for output to continue into a new file. The change happens
+// on the next video keyframe so that both files are independently playable;
+// the previous output is closed once it is complete.
+func (r *Remuxer) Switch(out io.WriteCloser) {
+	if r.next != nil {
+		r.next.Close()
+	}
+
+	r.next = out
+
+	if r.writer == nil {
+		r.switchOutput()
+	}
+}
+
+func (r *Remuxer) switchOutput() {
+	if r.writer != nil {
+		if err := r.writer.Close(); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+
+	r.out.Close()
+
+	r.out = r.next
+	r.next = nil
+	r.writer = nil
+	r.video = nil
+	r.audio = nil
+	r.haveAudioDts = false
+	r.keyframesWaited = 0
+}
+
+func (r *Remuxer) Close() error {
+	if r.writer != nil {
+		if err := r.writer.Close(); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+
+	if r.next != nil {
+		r.next.Close()
+		r.next = nil
+	}
+
+	if err := r.out.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+
+	return r.err
+}
+
+func (r *Remuxer) WritePacket(pkt mpeg.TsBuffer) error {
+	if !pkt.IsValid() {
+		return r.err
+	}
+
+	pid := pkt.GetPid()
+
+	switch {
+	case pid == mpeg.PID_PAT:
+		var pat mpeg.PAT
+		if pat.ParsePAT(pkt) {
+			for i := 0; i < pat.NumEntry; i++ {
+				if pat.Entry[i].Flag_PMT {
+					r.pmtPid = pat.Entry[i].ProgramMapPID
+					break
+				}
+			}
+		}
+
+	case r.pmtPid != 0 && pid == r.pmtPid:
+		var pmt mpeg.PMT
+		if pmt.ParsePMT(pkt) {
+			r.updatePids(&pmt)
+		}
+
+	case r.videoPid != 0 && pid == r.videoPid:
+		if buf := r.videoAsm.Push(pkt); buf != nil {
+			r.handleVideo(buf)
+		}
+
+	case r.audioPid != 0 && pid == r.audioPid:
+		if buf := r.audioAsm.Push(pkt); buf != nil {
+			r.handleAudio(buf)
+		}
+	}
+
+	return r.err
+}
+
+func (r *Remuxer) updatePids(pmt *mpeg.PMT) {
+	var videoPid, audioPid mpeg.PID
+
+	for i := 0; i < pmt.NumEntry; i++ {
+		entry := &pmt.Entry[i]
+
+		switch entry.StreamType {
+		case mpeg.STREAM_TYPE_H264:
+			if videoPid == 0 {
+				videoPid = entry.ElementaryPID
+			}
+
+		case mpeg.STREAM_TYPE_AAC_ADTS:
+			if audioPid == 0 {
+				audioPid = entry.ElementaryPID
+			}
+		}
+	}
+
+	if videoPid != r.videoPid {
+		r.videoPid = videoPid
+		r.videoAsm = mpeg.PesAssembler{Pid: videoPid}
+	}
+
+	if audioPid != r.audioPid {
+		r.audioPid = audioPid
+		r.audioAsm = mpeg.PesAssembler{Pid: audioPid}
+	}
+}
+
+func (r *Remuxer) start(origin int64) {
+	var tracks []*Track
+
+	if r.videoPid != 0 && r.sps != nil && r.pps != nil {
+		r.video = &Track{
+			Id:        VIDEO_TRACK_ID,
+			Timescale: mpeg.TIMESTAMP_HZ,
+			Handler:   HANDLER_VIDEO,
+			Sps:       r.sps,
+			Pps:       r.pps,
+		}
+
+		if sps, err := ParseSps(r.sps); err == nil {
+			r.video.Width = sps.Width
+			r.video.Height = sps.Height
+		}
+
+		tracks = append(tracks, r.video)
+	}
+
+	if r.audioPid != 0 && r.adts != nil {
+		r.audio = &Track{
+			Id:         AUDIO_TRACK_ID,
+			Timescale:  uint32(r.adts.SampleRate()),
+			Handler:    HANDLER_AUDIO,
+			Asc:        r.adts.AudioSpecificConfig(),
+			SampleRate: r.adts.SampleRate(),
+			Channels:   int(r.adts.ChannelConfig),
+		}
+
+		tracks = append(tracks, r.audio)
+	}
+
+	r.origin = origin
+	r.writer = NewWriter(r.out, tracks...)
+	r.err = r.writer.WriteInit()
+}
+
+func (r *Remuxer) handleVideo(buf []byte) {
+	var pes mpeg.Pes
+	if !pes.ParsePes(buf) || !pes.HasPts {
+		return
+	}
+
+	pts := r.videoClock.unwrap(pes.Pts)
+	dts := pts - int64((pes.Pts-pes.Dts)&mpeg.TIMESTAMP_MASK)
+
+	key := false
+	var data []byte
+
+	for _, nal := range SplitAnnexB(pes.Payload) {
+		switch nal[0] & NAL_TYPE_MASK {
+		case NAL_TYPE_SPS:
+			r.sps = append([]byte(nil), nal...)
+			continue
+
+		case NAL_TYPE_PPS:
+			r.pps = append([]byte(nil), nal...)
+			continue
+
+		case NAL_TYPE_AUD:
+			continue
+
+		case NAL_TYPE_IDR:
+			key = true
+		}
+
+		n := len(nal)
+		data = append(data, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		data = append(data, nal...)
+	}
+
+	if len(data) == 0 {
+		return
+	}
+
+	if key && r.next != nil {
+		r.switchOutput()
+	}
+
+	if r.writer == nil {
+		if !key || r.sps == nil || r.pps == nil {
+			return
+		}
+
+		if r.audioPid != 0 && r.adts == nil && r.keyframesWaited < MAX_KEYFRAMES_WITHOUT_AUDIO {
+			r.keyframesWaited++
+			return
+		}
+
+		r.start(dts)
+	}
+
+	if r.video == nil || dts < r.origin {
+		return
+	}
+
+	r.writer.AddSample(r.video, &Sample{
+		Dts:  dts - r.origin,
+		Cts:  int32(pts - dts),
+		Key:  key,
+		Data: data,
+	})
+}
+
+func (r *Remuxer) handleAudio(buf []byte) {
+	var pes mpeg.Pes
+	if !pes.ParsePes(buf) || !pes.HasPts {
+		return
+	}
+
+	pts := r.audioClock.unwrap(pes.Pts)
+	payload := pes.Payload
+
+	for i := 0; len(payload) > 0; i++ {
+		hdr, err := ParseAdtsHeader(payload)
+		if err != nil || hdr.FrameLength > len(payload) {
+			return
+		}
+
+		frame := payload[hdr.HeaderLength:hdr.FrameLength]
+		payload = payload[hdr.FrameLength:]
+
+		if r.adts == nil {
+			r.adts = hdr
+		}
+
+		if r.next != nil && r.videoPid == 0 {
+			r.switchOutput()
+		}
+
+		if r.writer == nil {
+			if r.videoPid != 0 {
+				continue
+			}
+
+			r.start(pts)
+		}
+
+		if r.audio == nil || pts < r.origin {
+			continue
+		}
+
+		rate := int64(r.audio.SampleRate)
+		dts := (pts-r.origin)*rate/mpeg.TIMESTAMP_HZ + int64(i*AAC_SAMPLES_PER_FRAME)
+
+		if r.haveAudioDts {
+			// Snap small rounding differences onto a continuous timeline
+			expected := r.lastAudioDts + AAC_SAMPLES_PER_FRAME
+			if diff := dts - expected; diff > -AAC_SAMPLES_PER_FRAME/4 && diff < AAC_SAMPLES_PER_FRAME/4 {
+				dts = expected
+			}
+		}
+
+		r.lastAudioDts = dts
+		r.haveAudioDts = true
+
+		r.writer.AddSample(r.audio, &Sample{
+			Dts:  dts,
+			Key:  true,
+			Data: append([]byte(nil), frame...),
+		})
+	}
+}
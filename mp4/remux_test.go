@@ -0,0 +1,283 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"recstation/mpeg"
+)
+
+type nopCloser struct {
+	bytes.Buffer
+}
+
+func (_ *nopCloser) Close() error { return nil }
+
+type bitWriter struct {
+	buf  []byte
+	bits uint
+}
+
+func (w *bitWriter) u(n uint, v uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+
+		if (v>>uint(i))&1 != 0 {
+			w.buf[len(w.buf)-1] |= 1 << (7 - (w.bits % 8))
+		}
+
+		w.bits++
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	n := uint(0)
+	for (v >> n) > 1 {
+		n++
+	}
+
+	w.u(n, 0)
+	w.u(n+1, v)
+}
+
+// Baseline SPS for a 320x180 picture, cropped from 320x192
+func testSps() []byte {
+	var w bitWriter
+	w.u(8, 0x67)
+	w.u(8, 66) // profile_idc
+	w.u(8, 0)  // constraint flags
+	w.u(8, 30) // level_idc
+	w.ue(0)    // seq_parameter_set_id
+	w.ue(0)    // log2_max_frame_num_minus4
+	w.ue(2)    // pic_order_cnt_type
+	w.ue(1)    // max_num_ref_frames
+	w.u(1, 0)  // gaps_in_frame_num_value_allowed_flag
+	w.ue(19)   // pic_width_in_mbs_minus1
+	w.ue(11)   // pic_height_in_map_units_minus1
+	w.u(1, 1)  // frame_mbs_only_flag
+	w.u(1, 1)  // direct_8x8_inference_flag
+	w.u(1, 1)  // frame_cropping_flag
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(6)
+	w.u(1, 0) // vui_parameters_present_flag
+	w.u(1, 1) // rbsp_stop_one_bit
+
+	return w.buf
+}
+
+func Test_Sps_Dimensions(t *testing.T) {
+	sps, err := ParseSps(testSps())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sps.Width != 320 || sps.Height != 180 {
+		t.Errorf("Got %dx%d, expected 320x180", sps.Width, sps.Height)
+	}
+}
+
+func testPes(streamId byte, pts uint64, payload []byte) []byte {
+	pes := []byte{0, 0, 1, streamId, 0, 0, 0x80, 0x80, 5}
+	pes = append(pes,
+		byte(0x21|((pts>>29)&0x0e)),
+		byte(pts>>22),
+		byte(0x01|((pts>>14)&0xfe)),
+		byte(pts>>7),
+		byte(0x01|((pts<<1)&0xfe)),
+	)
+	pes = append(pes, payload...)
+
+	if streamId != 0xe0 {
+		binary.BigEndian.PutUint16(pes[4:6], uint16(len(pes)-mpeg.PES_HEADER_LENGTH))
+	}
+
+	return pes
+}
+
+type testMuxer struct {
+	cc  map[mpeg.PID]byte
+	out []mpeg.TsBuffer
+}
+
+func (m *testMuxer) packetize(pid mpeg.PID, data []byte) {
+	pusi := true
+
+	for len(data) > 0 {
+		var frm mpeg.TsFrame
+		for i := range frm {
+			frm[i] = 0xff
+		}
+
+		n := len(data)
+		if n > mpeg.TS_MAX_PAYLOAD_LENGTH {
+			n = mpeg.TS_MAX_PAYLOAD_LENGTH
+		}
+
+		frm[0] = mpeg.TS_MAGIC_BYTE
+		buf := frm.ToBuffer()
+		buf.SetPid(pid)
+		buf.SetPusi(pusi)
+		buf.SetCc(mpeg.CC(m.cc[pid]))
+		m.cc[pid] = (m.cc[pid] + 1) % mpeg.MAX_CC
+
+		if n < mpeg.TS_MAX_PAYLOAD_LENGTH {
+			// Stuff with an adaptation field
+			buf.SetAfc(0x3)
+			stuff := mpeg.TS_MAX_PAYLOAD_LENGTH - n - 1
+			frm[4] = byte(stuff)
+			if stuff > 0 {
+				frm[5] = 0
+			}
+			copy(frm[5+stuff:], data[:n])
+		} else {
+			buf.SetAfc(0x1)
+			copy(frm[4:], data[:n])
+		}
+
+		m.out = append(m.out, buf)
+		data = data[n:]
+		pusi = false
+	}
+}
+
+func testStream() []mpeg.TsBuffer {
+	m := &testMuxer{cc: make(map[mpeg.PID]byte)}
+
+	pat := []byte{0x00, 0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xe1, 0x00, 0, 0, 0, 0}
+	pmt := []byte{0x00, 0x02, 0xb0, 0x17, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x01, 0xf0, 0x00,
+		mpeg.STREAM_TYPE_H264, 0xe1, 0x01, 0xf0, 0x00,
+		mpeg.STREAM_TYPE_AAC_ADTS, 0xe1, 0x02, 0xf0, 0x00,
+		0, 0, 0, 0}
+
+	sps := testSps()
+	pps := []byte{0x68, 0xce, 0x38, 0x80}
+
+	adts := []byte{0xff, 0xf1, 0x4c, 0x80, 0x01, 0x7f, 0xfc}
+	frameLength := len(adts) + 4
+	adts[3] = (adts[3] & 0xfc) | byte(frameLength>>11)
+	adts[4] = byte(frameLength >> 3)
+	adts[5] = byte(frameLength<<5) | 0x1f
+	adts = append(adts, 0x21, 0x10, 0x04, 0x60)
+
+	for i := 0; i < 150; i++ {
+		pts := uint64(90000 + i*3000)
+
+		if i%30 == 0 {
+			m.packetize(mpeg.PID_PAT, pat)
+			m.packetize(0x100, pmt)
+		}
+
+		var es []byte
+		if i%30 == 0 {
+			es = append(es, 0, 0, 0, 1, 0x09, 0xf0)
+			es = append(es, 0, 0, 0, 1)
+			es = append(es, sps...)
+			es = append(es, 0, 0, 0, 1)
+			es = append(es, pps...)
+			es = append(es, 0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00)
+		} else {
+			es = append(es, 0, 0, 0, 1, 0x09, 0xf0)
+			es = append(es, 0, 0, 0, 1, 0x41, 0x9a, 0x02, 0x00)
+		}
+
+		m.packetize(0x101, testPes(0xe0, pts, es))
+		m.packetize(0x102, testPes(0xc0, pts, adts))
+	}
+
+	return m.out
+}
+
+func topLevelBoxes(buf []byte) []string {
+	var types []string
+
+	for len(buf) >= BOX_HEADER_LENGTH {
+		n := int(binary.BigEndian.Uint32(buf[0:4]))
+		if n < BOX_HEADER_LENGTH || n > len(buf) {
+			return append(types, "!bad")
+		}
+
+		types = append(types, string(buf[4:8]))
+		buf = buf[n:]
+	}
+
+	return types
+}
+
+func Test_Remux_Fragments(t *testing.T) {
+	out := &nopCloser{}
+	r := NewRemuxer(out)
+
+	for _, pkt := range testStream() {
+		if err := r.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	types := topLevelBoxes(out.Bytes())
+
+	if len(types) < 4 || types[0] != "ftyp" || types[1] != "moov" {
+		t.Fatalf("Unexpected box layout %v", types)
+	}
+
+	nmoof := 0
+	for i, typ := range types[2:] {
+		expected := "moof"
+		if i%2 == 1 {
+			expected = "mdat"
+		}
+
+		if typ != expected {
+			t.Fatalf("Box %d is %s, expected %s", i+2, typ, expected)
+		}
+
+		if typ == "moof" {
+			nmoof++
+		}
+	}
+
+	// Five seconds of content in two second fragments, video and audio each
+	if nmoof != 6 {
+		t.Errorf("Got %d fragments, expected 6", nmoof)
+	}
+}
+
+func Test_Writer_NoKeyframes(t *testing.T) {
+	var out bytes.Buffer
+
+	video := &Track{Id: VIDEO_TRACK_ID, Timescale: 90000, Handler: HANDLER_VIDEO}
+	w := NewWriter(&out, video)
+
+	// A minute of video that never sends a keyframe
+	for i := 0; i < 60*30; i++ {
+		if err := w.AddSample(video, &Sample{Dts: int64(i * 3000), Data: make([]byte, 100)}); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(video.samples) > FRAGMENT_MAX_DURATION_SECONDS*30 {
+			t.Fatalf("%d samples held back", len(video.samples))
+		}
+	}
+
+	if nmoof := len(topLevelBoxes(out.Bytes())) / 2; nmoof != 5 {
+		t.Errorf("Got %d fragments, expected 5", nmoof)
+	}
+
+	// Nor may a few large samples pile up
+	for i := 0; i < 8; i++ {
+		w.AddSample(video, &Sample{Dts: int64(60*90000 + i*3000), Data: make([]byte, FRAGMENT_MAX_BYTES/4)})
+
+		if w.pending > FRAGMENT_MAX_BYTES {
+			t.Fatalf("%d bytes held back", w.pending)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package mp4
+
+import (
+	"io"
+)
+
+const (
+	FRAGMENT_DURATION_SECONDS = 2
+
+	// Fragments are cut anyway at these limits when the first track sends no
+	// sync samples, rather than holding everything back
+	FRAGMENT_MAX_DURATION_SECONDS = 10
+	FRAGMENT_MAX_BYTES            = 16 * 1024 * 1024
+
+	MOVIE_TIMESCALE = 1000
+
+	SAMPLE_FLAGS_SYNC     = 0x02000000
+	SAMPLE_FLAGS_NON_SYNC = 0x01010000
+
+	TFHD_DEFAULT_BASE_IS_MOOF = 0x020000
+
+	TRUN_DATA_OFFSET_PRESENT       = 0x000001
+	TRUN_SAMPLE_DURATION_PRESENT   = 0x000100
+	TRUN_SAMPLE_SIZE_PRESENT       = 0x000200
+	TRUN_SAMPLE_FLAGS_PRESENT      = 0x000400
+	TRUN_SAMPLE_CTS_OFFSET_PRESENT = 0x000800
+
+	TKHD_ENABLED  = 0x000001
+	TKHD_IN_MOVIE = 0x000002
+)
+
+const (
+	HANDLER_VIDEO = "vide"
+	HANDLER_AUDIO = "soun"
+)
+
+type Sample struct {
+	Dts      int64
+	Cts      int32
+	Key      bool
+	Data     []byte
+	Duration uint32
+}
+
+type Track struct {
+	Id        uint32
+	Timescale uint32
+	Handler   string
+
+	// Video
+	Sps    []byte
+	Pps    []byte
+	Width  int
+	Height int
+
+	// Audio
+	Asc        []byte
+	SampleRate int
+	Channels   int
+
+	samples      []*Sample
+	lastDuration uint32
+}
+
+// Writer produces a fragmented MP4 file: an initialization segment (ftyp and
+// moov) followed by a moof/mdat pair for each track and fragment.
+type Writer struct {
+	w      io.Writer
+	tracks []*Track
+	seq    uint32
+	err    error
+
+	initWritten   bool
+	fragmentStart int64
+
+	// Sample data held back over all tracks
+	pending int
+}
+
+func NewWriter(w io.Writer, tracks ...*Track) *Writer {
+	return &Writer{
+		w:      w,
+		tracks: tracks,
+	}
+}
+
+func (w *Writer) write(buf []byte) {
+	if w.err != nil {
+		return
+	}
+
+	_, w.err = w.w.Write(buf)
+}
+
+func (w *Writer) WriteInit() error {
+	if w.initWritten {
+		return w.err
+	}
+
+	var ftyp boxBuffer
+	ftyp.fourcc("iso5")
+	ftyp.u32(512)
+	ftyp.fourcc("iso5")
+	ftyp.fourcc("iso6")
+	ftyp.fourcc("mp41")
+
+	w.write(box("ftyp", ftyp.buf))
+	w.write(w.moov())
+
+	w.initWritten = true
+
+	return w.err
+}
+
+func (w *Writer) moov() []byte {
+	var mvhd boxBuffer
+	mvhd.u32(0) // creation_time
+	mvhd.u32(0) // modification_time
+	mvhd.u32(MOVIE_TIMESCALE)
+	mvhd.u32(0)          // duration
+	mvhd.u32(0x00010000) // rate
+	mvhd.u16(0x0100)     // volume
+	mvhd.zeros(10)
+	mvhd.matrix()
+	mvhd.zeros(24)
+	mvhd.u32(uint32(len(w.tracks) + 1))
+
+	children := [][]byte{fullBox("mvhd", 0, 0, mvhd.buf)}
+
+	var trexs [][]byte
+
+	for _, t := range w.tracks {
+		children = append(children, t.trak())
+
+		var trex boxBuffer
+		trex.u32(t.Id)
+		trex.u32(1) // default_sample_description_index
+		trex.u32(0) // default_sample_duration
+		trex.u32(0) // default_sample_size
+		trex.u32(0) // default_sample_flags
+
+		trexs = append(trexs, fullBox("trex", 0, 0, trex.buf))
+	}
+
+	children = append(children, box("mvex", trexs...))
+
+	return box("moov", children...)
+}
+
+func (t *Track) trak() []byte {
+	var tkhd boxBuffer
+	tkhd.u32(0) // creation_time
+	tkhd.u32(0) // modification_time
+	tkhd.u32(t.Id)
+	tkhd.u32(0) // reserved
+	tkhd.u32(0) // duration
+	tkhd.zeros(8)
+	tkhd.u16(0) // layer
+	tkhd.u16(0) // alternate_group
+	if t.Handler == HANDLER_AUDIO {
+		tkhd.u16(0x0100)
+	} else {
+		tkhd.u16(0)
+	}
+	tkhd.u16(0)
+	tkhd.matrix()
+	tkhd.u32(uint32(t.Width) << 16)
+	tkhd.u32(uint32(t.Height) << 16)
+
+	var mdhd boxBuffer
+	mdhd.u32(0) // creation_time
+	mdhd.u32(0) // modification_time
+	mdhd.u32(t.Timescale)
+	mdhd.u32(0)      // duration
+	mdhd.u16(0x55c4) // language "und"
+	mdhd.u16(0)
+
+	var hdlr boxBuffer
+	hdlr.u32(0)
+	hdlr.fourcc(t.Handler)
+	hdlr.zeros(12)
+	if t.Handler == HANDLER_AUDIO {
+		hdlr.bytes([]byte("SoundHandler\x00"))
+	} else {
+		hdlr.bytes([]byte("VideoHandler\x00"))
+	}
+
+	var mediaHeader []byte
+	if t.Handler == HANDLER_AUDIO {
+		mediaHeader = fullBox("smhd", 0, 0, make([]byte, 4))
+	} else {
+		mediaHeader = fullBox("vmhd", 0, 1, make([]byte, 8))
+	}
+
+	var dref boxBuffer
+	dref.u32(1)
+	dref.bytes(fullBox("url ", 0, 1))
+
+	var empty boxBuffer
+	empty.u32(0)
+
+	var stsz boxBuffer
+	stsz.u32(0)
+	stsz.u32(0)
+
+	var stsd boxBuffer
+	stsd.u32(1)
+	stsd.bytes(t.sampleEntry())
+
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, stsd.buf),
+		fullBox("stts", 0, 0, empty.buf),
+		fullBox("stsc", 0, 0, empty.buf),
+		fullBox("stsz", 0, 0, stsz.buf),
+		fullBox("stco", 0, 0, empty.buf),
+	)
+
+	minf := box("minf",
+		mediaHeader,
+		box("dinf", fullBox("dref", 0, 0, dref.buf)),
+		stbl,
+	)
+
+	return box("trak",
+		fullBox("tkhd", 0, TKHD_ENABLED|TKHD_IN_MOVIE, tkhd.buf),
+		box("mdia",
+			fullBox("mdhd", 0, 0, mdhd.buf),
+			fullBox("hdlr", 0, 0, hdlr.buf),
+			minf,
+		),
+	)
+}
+
+func (t *Track) sampleEntry() []byte {
+	if t.Handler == HANDLER_AUDIO {
+		var mp4a boxBuffer
+		mp4a.zeros(6)
+		mp4a.u16(1) // data_reference_index
+		mp4a.zeros(8)
+		mp4a.u16(uint16(t.Channels))
+		mp4a.u16(16) // samplesize
+		mp4a.zeros(4)
+		mp4a.u32(uint32(t.SampleRate) << 16)
+		mp4a.bytes(t.esds())
+
+		return box("mp4a", mp4a.buf)
+	}
+
+	var avc1 boxBuffer
+	avc1.zeros(6)
+	avc1.u16(1) // data_reference_index
+	avc1.zeros(16)
+	avc1.u16(uint16(t.Width))
+	avc1.u16(uint16(t.Height))
+	avc1.u32(0x00480000) // horizresolution
+	avc1.u32(0x00480000) // vertresolution
+	avc1.u32(0)
+	avc1.u16(1) // frame_count
+	avc1.zeros(32)
+	avc1.u16(0x0018) // depth
+	avc1.u16(0xffff) // pre_defined
+
+	var avcc boxBuffer
+	avcc.u8(1)
+	avcc.u8(t.Sps[1])
+	avcc.u8(t.Sps[2])
+	avcc.u8(t.Sps[3])
+	avcc.u8(0xff) // 4 byte NAL lengths
+	avcc.u8(0xe1) // one SPS
+	avcc.u16(uint16(len(t.Sps)))
+	avcc.bytes(t.Sps)
+	avcc.u8(1)
+	avcc.u16(uint16(len(t.Pps)))
+	avcc.bytes(t.Pps)
+
+	avc1.bytes(box("avcC", avcc.buf))
+
+	return box("avc1", avc1.buf)
+}
+
+func descriptor(tag uint8, payload []byte) []byte {
+	n := len(payload)
+
+	return append([]byte{tag, 0x80 | byte(n>>21), 0x80 | byte(n>>14), 0x80 | byte(n>>7), byte(n & 0x7f)}, payload...)
+}
+
+func (t *Track) esds() []byte {
+	var dcd boxBuffer
+	dcd.u8(0x40) // MPEG-4 audio
+	dcd.u8(0x15) // audio stream
+	dcd.u24(0)   // bufferSizeDB
+	dcd.u32(0)   // maxBitrate
+	dcd.u32(0)   // avgBitrate
+	dcd.bytes(descriptor(0x05, t.Asc))
+
+	var es boxBuffer
+	es.u16(uint16(t.Id))
+	es.u8(0)
+	es.bytes(descriptor(0x04, dcd.buf))
+	es.bytes(descriptor(0x06, []byte{0x02}))
+
+	return fullBox("esds", 0, 0, descriptor(0x03, es.buf))
+}
+
+// AddSample queues a sample on a track. Samples must be added in decode
+// order. A new fragment is started whenever a sync sample arrives on the
+// first track after at least FRAGMENT_DURATION_SECONDS, or whenever the queued
+// samples reach FRAGMENT_MAX_DURATION_SECONDS or FRAGMENT_MAX_BYTES.
+func (w *Writer) AddSample(t *Track, s *Sample) error {
+	if n := len(t.samples); n > 0 {
+		prev := t.samples[n-1]
+
+		if s.Dts > prev.Dts {
+			prev.Duration = uint32(s.Dts - prev.Dts)
+			t.lastDuration = prev.Duration
+		} else {
+			prev.Duration = t.lastDuration
+		}
+	}
+
+	if t == w.tracks[0] && s.Key {
+		if s.Dts-w.fragmentStart >= int64(FRAGMENT_DURATION_SECONDS*t.Timescale) {
+			w.flush(false)
+			w.fragmentStart = s.Dts
+		}
+	} else if w.overdue(t, s) {
+		w.flush(false)
+
+		if t == w.tracks[0] {
+			w.fragmentStart = s.Dts
+		}
+	}
+
+	t.samples = append(t.samples, s)
+	w.pending += len(s.Data)
+
+	return w.err
+}
+
+// overdue says whether the queued samples have outgrown a fragment waiting
+// for a sync sample.
+func (w *Writer) overdue(t *Track, s *Sample) bool {
+	if w.pending+len(s.Data) > FRAGMENT_MAX_BYTES {
+		return true
+	}
+
+	return len(t.samples) > 0 && s.Dts-t.samples[0].Dts >= int64(FRAGMENT_MAX_DURATION_SECONDS*t.Timescale)
+}
+
+// Close writes out all remaining samples. It does not close the underlying
+// writer.
+func (w *Writer) Close() error {
+	w.flush(true)
+
+	return w.err
+}
+
+func (w *Writer) flush(final bool) {
+	for _, t := range w.tracks {
+		n := len(t.samples)
+
+		if !final && t != w.tracks[0] {
+			n--
+		}
+
+		if n <= 0 {
+			continue
+		}
+
+		if final && t.samples[n-1].Duration == 0 {
+			t.samples[n-1].Duration = t.lastDuration
+		}
+
+		w.writeFragment(t, t.samples[:n])
+
+		for _, s := range t.samples[:n] {
+			w.pending -= len(s.Data)
+		}
+
+		t.samples = append(t.samples[:0], t.samples[n:]...)
+	}
+}
+
+func (w *Writer) writeFragment(t *Track, samples []*Sample) {
+	w.seq++
+
+	mdatLength := BOX_HEADER_LENGTH
+	for _, s := range samples {
+		mdatLength += len(s.Data)
+	}
+
+	var mfhd boxBuffer
+	mfhd.u32(w.seq)
+
+	var tfhd boxBuffer
+	tfhd.u32(t.Id)
+
+	var tfdt boxBuffer
+	tfdt.u64(uint64(samples[0].Dts))
+
+	trunFlags := uint32(TRUN_DATA_OFFSET_PRESENT | TRUN_SAMPLE_DURATION_PRESENT | TRUN_SAMPLE_SIZE_PRESENT | TRUN_SAMPLE_FLAGS_PRESENT | TRUN_SAMPLE_CTS_OFFSET_PRESENT)
+
+	var trun boxBuffer
+	trun.u32(uint32(len(samples)))
+	trun.u32(0) // data_offset, patched below
+	dataOffsetPos := len(trun.buf) - 4
+
+	for _, s := range samples {
+		flags := uint32(SAMPLE_FLAGS_NON_SYNC)
+		if s.Key {
+			flags = SAMPLE_FLAGS_SYNC
+		}
+
+		trun.u32(s.Duration)
+		trun.u32(uint32(len(s.Data)))
+		trun.u32(flags)
+		trun.u32(uint32(s.Cts))
+	}
+
+	// moof + mfhd + traf + tfhd + tfdt + trun headers
+	trunBox := fullBox("trun", 1, trunFlags, trun.buf)
+	traf := box("traf",
+		fullBox("tfhd", 0, TFHD_DEFAULT_BASE_IS_MOOF, tfhd.buf),
+		fullBox("tfdt", 1, 0, tfdt.buf),
+		trunBox,
+	)
+	moofLength := BOX_HEADER_LENGTH + BOX_HEADER_LENGTH + 4 + len(mfhd.buf) + len(traf)
+
+	dataOffset := uint32(moofLength + BOX_HEADER_LENGTH)
+	trunStart := len(traf) - len(trunBox) + BOX_HEADER_LENGTH + 4
+	pos := trunStart + dataOffsetPos
+	traf[pos+0] = byte(dataOffset >> 24)
+	traf[pos+1] = byte(dataOffset >> 16)
+	traf[pos+2] = byte(dataOffset >> 8)
+	traf[pos+3] = byte(dataOffset)
+
+	w.write(box("moof", fullBox("mfhd", 0, 0, mfhd.buf), traf))
+
+	var hdr boxBuffer
+	hdr.u32(uint32(mdatLength))
+	hdr.fourcc("mdat")
+	w.write(hdr.buf)
+
+	for _, s := range samples {
+		w.write(s.Data)
+	}
+}
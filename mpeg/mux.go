@@ -0,0 +1,223 @@
+package mpeg
+
+import (
+	"encoding/binary"
+)
+
+const (
+	TABLE_ID_PAT = 0x00
+
+	STREAM_ID_AUDIO = 0xc0
+	STREAM_ID_VIDEO = 0xe0
+
+	DESCRIPTOR_TAG_REGISTRATION = 0x05
+
+	// PES packets longer than this get a zero length, which is only
+	// allowed for video
+	PES_MAX_PACKET_LENGTH = 0xffff
+
+	AFC_PAYLOAD            = AFC(ADAPTATION_PAYLOAD_PRESENT_MASK)
+	AFC_ADAPTATION_PAYLOAD = AFC(ADAPTATION_FIELD_PRESENT_MASK | ADAPTATION_PAYLOAD_PRESENT_MASK)
+)
+
+// Crc32 is the CRC of PSI sections: polynomial 0x04c11db7, not reflected.
+// This is not hash/crc32's IEEE variant.
+func Crc32(buf []byte) uint32 {
+	crc := uint32(0xffffffff)
+
+	for _, b := range buf {
+		crc ^= uint32(b) << 24
+
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// makeSection wraps a long section body in its header and CRC, preceded by
+// the pointer field.
+func makeSection(tableId uint8, tableIdExtension uint16, body []byte) []byte {
+	length := TABLE_LONG_SUBHEADER_LENGTH + len(body) + TABLE_CRC_LENGTH
+
+	buf := []byte{
+		0, // pointer field
+		tableId,
+		0xb0 | byte(length>>8),
+		byte(length),
+		byte(tableIdExtension >> 8),
+		byte(tableIdExtension),
+		0xc1, // version 0, current
+		0,
+		0,
+	}
+
+	buf = append(buf, body...)
+	buf = append(buf, 0, 0, 0, 0)
+
+	binary.BigEndian.PutUint32(buf[len(buf)-TABLE_CRC_LENGTH:], Crc32(buf[1:len(buf)-TABLE_CRC_LENGTH]))
+
+	return buf
+}
+
+// MakePat returns a PAT with a single program, ready to packetize.
+func MakePat(transportStreamId, program uint16, pmtPid PID) []byte {
+	return makeSection(TABLE_ID_PAT, transportStreamId, []byte{
+		byte(program >> 8),
+		byte(program),
+		0xe0 | byte(pmtPid>>8),
+		byte(pmtPid),
+	})
+}
+
+type PmtStream struct {
+	StreamType  uint8
+	Pid         PID
+	Descriptors []byte
+}
+
+// MakePmt returns a PMT, ready to packetize.
+func MakePmt(program uint16, pcrPid PID, streams []PmtStream) []byte {
+	body := []byte{
+		0xe0 | byte(pcrPid>>8),
+		byte(pcrPid),
+		0xf0, 0x00, // no program info
+	}
+
+	for _, s := range streams {
+		body = append(body,
+			s.StreamType,
+			0xe0|byte(s.Pid>>8),
+			byte(s.Pid),
+			0xf0|byte(len(s.Descriptors)>>8),
+			byte(len(s.Descriptors)),
+		)
+		body = append(body, s.Descriptors...)
+	}
+
+	return makeSection(TABLE_ID_PMT, program, body)
+}
+
+func putTimestamp(buf []byte, prefix byte, ts uint64) {
+	ts &= TIMESTAMP_MASK
+
+	buf[0] = prefix<<4 | byte(ts>>29)&0x0e | 0x01
+	buf[1] = byte(ts >> 22)
+	buf[2] = byte(ts>>14) | 0x01
+	buf[3] = byte(ts >> 7)
+	buf[4] = byte(ts<<1) | 0x01
+}
+
+// MakePes returns a PES packet with a PTS.
+func MakePes(streamId uint8, pts uint64, payload []byte) []byte {
+	buf := make([]byte, PES_HEADER_LENGTH+PES_OPTIONAL_HEADER_LENGTH+PES_TIMESTAMP_LENGTH, PES_HEADER_LENGTH+PES_OPTIONAL_HEADER_LENGTH+PES_TIMESTAMP_LENGTH+len(payload))
+
+	buf[2] = 0x01
+	buf[3] = streamId
+	buf[6] = 0x80
+	buf[7] = PTS_DTS_FLAGS_PTS << PTS_DTS_FLAGS_SHIFT
+	buf[8] = PES_TIMESTAMP_LENGTH
+
+	putTimestamp(buf[9:], PTS_DTS_FLAGS_PTS, pts)
+
+	buf = append(buf, payload...)
+
+	if length := len(buf) - PES_HEADER_LENGTH; length <= PES_MAX_PACKET_LENGTH {
+		binary.BigEndian.PutUint16(buf[4:], uint16(length))
+	}
+
+	return buf
+}
+
+// Muxer splits sections and PES packets into TS packets, keeping the
+// continuity counter of each PID.
+type Muxer struct {
+	cc map[PID]CC
+}
+
+func NewMuxer() *Muxer {
+	return &Muxer{
+		cc: make(map[PID]CC),
+	}
+}
+
+func (m *Muxer) Packetize(pid PID, data []byte) []TsBuffer {
+	return m.packetize(pid, data, 0, false)
+}
+
+// PacketizeWithPcr carries the PCR in the first packet.
+func (m *Muxer) PacketizeWithPcr(pid PID, data []byte, pcr uint64) []TsBuffer {
+	return m.packetize(pid, data, pcr, true)
+}
+
+func (m *Muxer) packetize(pid PID, data []byte, pcr uint64, hasPcr bool) []TsBuffer {
+	var out []TsBuffer
+
+	pusi := true
+
+	for len(data) > 0 {
+		buf := TsBuffer(make([]byte, TS_PACKET_LENGTH))
+
+		buf[0] = TS_MAGIC_BYTE
+		buf.SetPid(pid)
+		buf.SetPusi(pusi)
+		buf.SetCc(m.cc[pid])
+		m.cc[pid] = (m.cc[pid] + 1) % MAX_CC
+
+		afLen := -1
+		if hasPcr {
+			afLen = 1 + PCR_LENGTH
+		}
+
+		capacity := TS_MAX_PAYLOAD_LENGTH
+		if afLen >= 0 {
+			capacity -= 1 + afLen
+		}
+
+		n := len(data)
+		if n >= capacity {
+			n = capacity
+		} else if afLen < 0 {
+			afLen = capacity - n - 1
+		} else {
+			afLen += capacity - n
+		}
+
+		offs := 4
+
+		if afLen >= 0 {
+			buf.SetAfc(AFC_ADAPTATION_PAYLOAD)
+			buf[ADAPTATION_FIELD_LENGTH] = byte(afLen)
+
+			for i := ADAPTATION_FIELD_LENGTH + 1; i <= ADAPTATION_FIELD_LENGTH+afLen; i++ {
+				buf[i] = 0xff
+			}
+
+			if afLen > 0 {
+				buf[ADAPTATION_FLAGS_OFFSET] = 0
+			}
+
+			if hasPcr {
+				buf.SetPcr(pcr)
+			}
+
+			offs += 1 + afLen
+		} else {
+			buf.SetAfc(AFC_PAYLOAD)
+		}
+
+		copy(buf[offs:], data[:n])
+
+		out = append(out, buf)
+		data = data[n:]
+		pusi = false
+		hasPcr = false
+	}
+
+	return out
+}
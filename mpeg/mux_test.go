@@ -0,0 +1,75 @@
+package mpeg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Mux_Pat(t *testing.T) {
+	frm := PID_0_PAT
+	want := frm.ToBuffer().GetPayload()
+
+	pat := MakePat(0x0080, 0x0100, 0x1000)
+
+	if !bytes.Equal(pat, want[:len(pat)]) {
+		t.Errorf("PAT mismatch:\n%x\n%x", pat, want[:len(pat)])
+	}
+}
+
+func Test_Mux_Pmt(t *testing.T) {
+	frm := PID_4096_PMT
+	want := frm.ToBuffer().GetPayload()
+
+	pmt := MakePmt(0x0100, 0x07d1, []PmtStream{
+		{StreamType: STREAM_TYPE_H264, Pid: 0x07d1},
+		{StreamType: STREAM_TYPE_MPEG2_AUDIO, Pid: 0x07d2},
+	})
+
+	if !bytes.Equal(pmt, want[:len(pmt)]) {
+		t.Errorf("PMT mismatch:\n%x\n%x", pmt, want[:len(pmt)])
+	}
+}
+
+func Test_Mux_PesRoundtrip(t *testing.T) {
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	muxer := NewMuxer()
+	pkts := muxer.PacketizeWithPcr(0x100, MakePes(STREAM_ID_VIDEO, 123456789, payload), 123456789*300)
+
+	var asm PesAssembler
+	var out []byte
+
+	for i, pkt := range pkts {
+		if pkt.GetCc() != CC(i%MAX_CC) {
+			t.Errorf("Packet %d has CC %d", i, pkt.GetCc())
+		}
+
+		if pcr, ok := pkt.GetPcr(); ok != (i == 0) || (ok && pcr != 123456789*300) {
+			t.Errorf("Packet %d has PCR %d %v", i, pcr, ok)
+		}
+
+		if buf := asm.Push(pkt); buf != nil {
+			out = buf
+		}
+	}
+
+	if out == nil {
+		out = asm.Flush()
+	}
+
+	var pes Pes
+	if !pes.ParsePes(out) {
+		t.Fatal("PES does not parse")
+	}
+
+	if pes.Pts != 123456789 {
+		t.Errorf("PTS %d", pes.Pts)
+	}
+
+	if !bytes.Equal(pes.Payload, payload) {
+		t.Error("Payload mismatch")
+	}
+}
@@ -0,0 +1,237 @@
+package mpeg
+
+const (
+	PES_HEADER_LENGTH          = 6
+	PES_OPTIONAL_HEADER_LENGTH = 3
+	PES_TIMESTAMP_LENGTH       = 5
+
+	PES_MAX_LENGTH = 4 * 1024 * 1024
+
+	PTS_DTS_FLAGS_MASK  = 0xc0
+	PTS_DTS_FLAGS_SHIFT = 6
+	PTS_DTS_FLAGS_PTS   = 0x2
+	PTS_DTS_FLAGS_DTS   = 0x1
+
+	TIMESTAMP_BITS = 33
+	TIMESTAMP_MASK = (uint64(1) << TIMESTAMP_BITS) - 1
+	TIMESTAMP_HZ   = 90000
+)
+
+const (
+	STREAM_ID_PROGRAM_STREAM_MAP = 0xbc
+	STREAM_ID_PRIVATE_STREAM_1   = 0xbd
+	STREAM_ID_PADDING_STREAM     = 0xbe
+	STREAM_ID_PRIVATE_STREAM_2   = 0xbf
+	STREAM_ID_ECM                = 0xf0
+	STREAM_ID_EMM                = 0xf1
+	STREAM_ID_DSMCC              = 0xf2
+	STREAM_ID_H222_TYPE_E        = 0xf8
+	STREAM_ID_PROGRAM_DIRECTORY  = 0xff
+)
+
+type Pes struct {
+	StreamId     uint
+	PacketLength uint
+
+	HasPts bool
+	Pts    uint64
+	HasDts bool
+	Dts    uint64
+
+	Payload []byte
+}
+
+func pesHasOptionalHeader(streamId uint) bool {
+	switch streamId {
+	case STREAM_ID_PROGRAM_STREAM_MAP,
+		STREAM_ID_PADDING_STREAM,
+		STREAM_ID_PRIVATE_STREAM_2,
+		STREAM_ID_ECM,
+		STREAM_ID_EMM,
+		STREAM_ID_DSMCC,
+		STREAM_ID_H222_TYPE_E,
+		STREAM_ID_PROGRAM_DIRECTORY:
+		return false
+	}
+
+	return true
+}
+
+func parseTimestamp(buf []byte) uint64 {
+	t0 := uint64(buf[0])
+	t1 := uint64(buf[1])
+	t2 := uint64(buf[2])
+	t3 := uint64(buf[3])
+	t4 := uint64(buf[4])
+
+	return ((t0 & 0x0e) << 29) | (t1 << 22) | ((t2 & 0xfe) << 14) | (t3 << 7) | (t4 >> 1)
+}
+
+func (pes *Pes) ParsePes(buf []byte) bool {
+	offs := uint(0)
+	remain := uint(len(buf))
+
+	if remain < PES_HEADER_LENGTH {
+		return false
+	}
+
+	if buf[0] != 0x00 || buf[1] != 0x00 || buf[2] != 0x01 {
+		return false
+	}
+
+	pes.StreamId = uint(buf[3])
+	pes.PacketLength = (uint(buf[4]) << 8) | uint(buf[5])
+	pes.HasPts = false
+	pes.Pts = 0
+	pes.HasDts = false
+	offs += PES_HEADER_LENGTH
+	remain -= PES_HEADER_LENGTH
+
+	if pes.PacketLength != 0 && pes.PacketLength < remain {
+		remain = pes.PacketLength
+	}
+
+	if pesHasOptionalHeader(pes.StreamId) {
+		if remain < PES_OPTIONAL_HEADER_LENGTH {
+			return false
+		}
+
+		h1 := uint(buf[offs+1])
+		h2 := uint(buf[offs+2])
+		offs += PES_OPTIONAL_HEADER_LENGTH
+		remain -= PES_OPTIONAL_HEADER_LENGTH
+
+		if remain < h2 {
+			return false
+		}
+
+		flags := (h1 & PTS_DTS_FLAGS_MASK) >> PTS_DTS_FLAGS_SHIFT
+
+		if (flags&PTS_DTS_FLAGS_PTS) != 0 && h2 >= PES_TIMESTAMP_LENGTH {
+			pes.HasPts = true
+			pes.Pts = parseTimestamp(buf[offs:])
+
+			if (flags&PTS_DTS_FLAGS_DTS) != 0 && h2 >= 2*PES_TIMESTAMP_LENGTH {
+				pes.HasDts = true
+				pes.Dts = parseTimestamp(buf[offs+PES_TIMESTAMP_LENGTH:])
+			}
+		}
+
+		offs += h2
+		remain -= h2
+	}
+
+	if !pes.HasDts {
+		pes.Dts = pes.Pts
+	}
+
+	pes.Payload = buf[offs : offs+remain]
+
+	return true
+}
+
+// PesAssembler collects the TS payloads of a single PID into complete PES
+// packets. Packets are returned once their declared length has been reached,
+// or for unbounded (video) PES, when the next unit starts.
+type PesAssembler struct {
+	Pid PID
+
+	buf       []byte
+	started   bool
+	lastCc    CC
+	haveCc    bool
+	duplicate bool
+}
+
+func (a *PesAssembler) complete() []byte {
+	if !a.started || len(a.buf) < PES_HEADER_LENGTH {
+		return nil
+	}
+
+	out := a.buf
+	a.buf = nil
+	a.started = false
+
+	return out
+}
+
+func (a *PesAssembler) wanted() int {
+	if len(a.buf) < PES_HEADER_LENGTH {
+		return 0
+	}
+
+	length := (int(a.buf[4]) << 8) | int(a.buf[5])
+	if length == 0 {
+		return 0
+	}
+
+	return PES_HEADER_LENGTH + length
+}
+
+// Push adds one TS packet, returning the bytes of a PES packet when one has
+// been completed. The returned slice is owned by the caller.
+func (a *PesAssembler) Push(tsbuf TsBuffer) []byte {
+	var out []byte
+
+	cc := tsbuf.GetCc()
+	afc := tsbuf.GetAfc()
+	hasPayload := (afc & ADAPTATION_PAYLOAD_PRESENT_MASK) != 0
+
+	if hasPayload && a.haveCc && cc == a.lastCc && !a.duplicate {
+		// A packet may be sent twice, the copy carrying nothing new
+		a.duplicate = true
+		return nil
+	}
+
+	if a.started && hasPayload && cc != (a.lastCc+1)%MAX_CC {
+		// Continuity error, the unit in progress is damaged
+		a.buf = nil
+		a.started = false
+	}
+
+	if hasPayload {
+		a.lastCc = cc
+		a.haveCc = true
+		a.duplicate = false
+	}
+
+	payload := tsbuf.GetPayload()
+	if len(payload) == 0 {
+		return nil
+	}
+
+	if tsbuf.GetPusi() {
+		out = a.complete()
+
+		a.buf = make([]byte, 0, 2*TS_MAX_PAYLOAD_LENGTH)
+		a.started = true
+	} else if !a.started {
+		return nil
+	}
+
+	a.buf = append(a.buf, payload...)
+
+	if want := a.wanted(); want > 0 && len(a.buf) >= want {
+		a.buf = a.buf[:want]
+
+		if out == nil {
+			out = a.complete()
+		}
+	} else if len(a.buf) > PES_MAX_LENGTH {
+		a.buf = nil
+		a.started = false
+	}
+
+	return out
+}
+
+// Flush returns any partial unbounded PES packet still being collected.
+func (a *PesAssembler) Flush() []byte {
+	if a.wanted() != 0 {
+		a.buf = nil
+		a.started = false
+		return nil
+	}
+
+	return a.complete()
+}
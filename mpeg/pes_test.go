@@ -0,0 +1,73 @@
+package mpeg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func assemble(pkts []TsBuffer) []byte {
+	var asm PesAssembler
+	var out []byte
+
+	for _, pkt := range pkts {
+		if buf := asm.Push(pkt); buf != nil {
+			out = buf
+		}
+	}
+
+	if out == nil {
+		out = asm.Flush()
+	}
+
+	return out
+}
+
+func Test_Pes_DuplicateCc(t *testing.T) {
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	pes := MakePes(STREAM_ID_VIDEO, 90000, payload)
+	pkts := NewMuxer().Packetize(0x100, pes)
+
+	// One copy of a packet is ignored
+	dup := append([]TsBuffer{}, pkts[:3]...)
+	dup = append(dup, pkts[2])
+	dup = append(dup, pkts[3:]...)
+
+	if out := assemble(dup); !bytes.Equal(out, pes) {
+		t.Errorf("Duplicate packet damaged the PES: %d bytes", len(out))
+	}
+
+	// A second copy is a continuity error
+	dup = append([]TsBuffer{}, pkts[:3]...)
+	dup = append(dup, pkts[2], pkts[2])
+	dup = append(dup, pkts[3:]...)
+
+	if out := assemble(dup); out != nil {
+		t.Errorf("Got %d bytes after two duplicates", len(out))
+	}
+
+	// A lost packet too
+	lost := append([]TsBuffer{}, pkts[:2]...)
+	lost = append(lost, pkts[3:]...)
+
+	if out := assemble(lost); out != nil {
+		t.Errorf("Got %d bytes after a lost packet", len(out))
+	}
+}
+
+func Test_Pes_NoPts(t *testing.T) {
+	var pes Pes
+
+	if !pes.ParsePes(MakePes(STREAM_ID_VIDEO, 90000, []byte{1, 2, 3})) || !pes.HasPts {
+		t.Fatal("PES with PTS does not parse")
+	}
+
+	buf := []byte{0x00, 0x00, 0x01, STREAM_ID_VIDEO, 0x00, 0x06, 0x80, 0x00, 0x00, 1, 2, 3}
+
+	if !pes.ParsePes(buf) || pes.HasPts || pes.Pts != 0 || pes.Dts != 0 {
+		t.Errorf("PES without PTS parsed as %+v", pes)
+	}
+}
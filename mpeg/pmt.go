@@ -0,0 +1,98 @@
+package mpeg
+
+const (
+	TABLE_ID_PMT = 0x02
+
+	PMT_SUBHEADER_LENGTH = 4
+	PMT_ENTRY_LENGTH     = 5
+
+	PMT_MAX_ENTRIES = ((TS_MAX_PAYLOAD_LENGTH - PMT_SUBHEADER_LENGTH) / PMT_ENTRY_LENGTH) + 1
+)
+
+const (
+	STREAM_TYPE_MPEG1_VIDEO = 0x01
+	STREAM_TYPE_MPEG2_VIDEO = 0x02
+	STREAM_TYPE_MPEG1_AUDIO = 0x03
+	STREAM_TYPE_MPEG2_AUDIO = 0x04
+	STREAM_TYPE_PRIVATE_PES = 0x06
+	STREAM_TYPE_AAC_ADTS    = 0x0f
+	STREAM_TYPE_H264        = 0x1b
+	STREAM_TYPE_HEVC        = 0x24
+)
+
+type PMT struct {
+	PrivateLongTable
+
+	PcrPID PID
+
+	NumEntry int
+	Entry    [PMT_MAX_ENTRIES]PMTEntry
+}
+
+type PMTEntry struct {
+	StreamType    uint
+	ElementaryPID PID
+}
+
+func (pmt *PMT) ParsePMT(tsbuf TsBuffer) bool {
+	if !pmt.ParseLongTable(tsbuf) {
+		return false
+	}
+
+	if pmt.TableId != TABLE_ID_PMT {
+		return false
+	}
+
+	buf := tsbuf.GetPayload()[pmt.BodyOffset : pmt.BodyOffset+pmt.BodyLength]
+	offs := uint(0)
+	remain := pmt.BodyLength
+
+	if remain < PMT_SUBHEADER_LENGTH {
+		return false
+	}
+
+	h0 := uint(buf[offs+0])
+	h1 := uint(buf[offs+1])
+	h2 := uint(buf[offs+2])
+	h3 := uint(buf[offs+3])
+	offs += PMT_SUBHEADER_LENGTH
+	remain -= PMT_SUBHEADER_LENGTH
+
+	pmt.PcrPID = PID(((h0 & 0x1f) << 8) | h1)
+
+	programInfoLength := ((h2 & 0x0f) << 8) | h3
+	if remain < programInfoLength {
+		return false
+	}
+
+	offs += programInfoLength
+	remain -= programInfoLength
+
+	pmt.NumEntry = 0
+
+	for remain >= PMT_ENTRY_LENGTH && pmt.NumEntry < PMT_MAX_ENTRIES {
+		e0 := uint(buf[offs+0])
+		e1 := uint(buf[offs+1])
+		e2 := uint(buf[offs+2])
+		e3 := uint(buf[offs+3])
+		e4 := uint(buf[offs+4])
+		offs += PMT_ENTRY_LENGTH
+		remain -= PMT_ENTRY_LENGTH
+
+		esInfoLength := ((e3 & 0x0f) << 8) | e4
+		if remain < esInfoLength {
+			return false
+		}
+
+		offs += esInfoLength
+		remain -= esInfoLength
+
+		entry := &pmt.Entry[pmt.NumEntry]
+		entry.StreamType = e0
+		entry.ElementaryPID = PID(((e1 & 0x1f) << 8) | e2)
+
+		pmt.NumEntry++
+	}
+
+	return true
+}
@@ -74,6 +74,7 @@ func (tbl *PrivateTable) ParseTable(tsbuf TsBuffer) bool {
 
 	if (b1 & 0x80) != 0 {
 		tbl.Flag_SectionSyntaxIndicator = true
+		tbl.HasCRC32 = true
 	}
 
 	if (b1 & 0x40) != 0 {
@@ -81,7 +82,7 @@ func (tbl *PrivateTable) ParseTable(tsbuf TsBuffer) bool {
 		tbl.HasCRC32 = true
 	}
 
-	tbl.SectionLength = ((b1 & 0x0f) << 4) | b2
+	tbl.SectionLength = ((b1 & 0x0f) << 8) | b2
 
 	if tbl.SectionLength > remain {
 		return false
@@ -0,0 +1,35 @@
+package mpeg
+
+import (
+	"testing"
+)
+
+func Test_Tables_PatCrc(t *testing.T) {
+	frm := PID_0_PAT
+
+	var tbl PrivateLongTable
+	if !tbl.ParseLongTable(frm.ToBuffer()) {
+		t.Fatal("PAT did not parse")
+	}
+
+	if !tbl.HasCRC32 || tbl.CRC32 != 0xd5a5bb7b {
+		t.Errorf("CRC %v %08x", tbl.HasCRC32, tbl.CRC32)
+	}
+
+	if tbl.SectionLength != 13 || tbl.BodyLength != 4 {
+		t.Errorf("Section length %d, body length %d", tbl.SectionLength, tbl.BodyLength)
+	}
+}
+
+func Test_Tables_SectionLength(t *testing.T) {
+	frm := PID_0_PAT
+
+	// 0x100 bytes, more than the packet holds
+	frm[6] = 0xb1
+	frm[7] = 0x00
+
+	var tbl PrivateTable
+	if tbl.ParseTable(frm.ToBuffer()) {
+		t.Errorf("Parsed a section length of %d", tbl.SectionLength)
+	}
+}
@@ -31,6 +31,15 @@ const (
 	ADAPTATION_FIELD_PRESENT_MASK   = 0x2
 	ADAPTATION_FIELD_LENGTH         = 4
 	MAX_ADAPTATION_FIELD_LENGTH     = 183
+
+	ADAPTATION_FLAGS_OFFSET = 5
+	PCR_FLAG_MASK           = 0x10
+	PCR_OFFSET              = 6
+	PCR_LENGTH              = 6
+
+	// PCR is a 33 bit 90 kHz base times 300 plus a 27 MHz extension
+	PCR_HZ   = 27000000
+	PCR_WRAP = (uint64(1) << TIMESTAMP_BITS) * 300
 )
 
 type TsFrame [TS_PACKET_LENGTH]byte
@@ -182,3 +191,49 @@ func (buf TsBuffer) GetPayload() []byte {
 
 	return buf[offs:TS_PACKET_LENGTH]
 }
+
+func (buf TsBuffer) GetPcr() (uint64, bool) {
+	if (buf.GetAfc() & ADAPTATION_FIELD_PRESENT_MASK) == 0 {
+		return 0, false
+	}
+
+	af_len := int(buf[ADAPTATION_FIELD_LENGTH])
+	if af_len < 1+PCR_LENGTH || af_len > MAX_ADAPTATION_FIELD_LENGTH {
+		return 0, false
+	}
+
+	if (buf[ADAPTATION_FLAGS_OFFSET] & PCR_FLAG_MASK) == 0 {
+		return 0, false
+	}
+
+	b := buf[PCR_OFFSET : PCR_OFFSET+PCR_LENGTH]
+
+	base := (uint64(b[0]) << 25) | (uint64(b[1]) << 17) | (uint64(b[2]) << 9) | (uint64(b[3]) << 1) | (uint64(b[4]) >> 7)
+	ext := ((uint64(b[4]) & 0x01) << 8) | uint64(b[5])
+
+	return base*300 + ext, true
+}
+
+func (buf TsBuffer) SetPcr(pcr uint64) bool {
+	if (buf.GetAfc() & ADAPTATION_FIELD_PRESENT_MASK) == 0 {
+		return false
+	}
+
+	af_len := int(buf[ADAPTATION_FIELD_LENGTH])
+	if af_len < 1+PCR_LENGTH || af_len > MAX_ADAPTATION_FIELD_LENGTH {
+		return false
+	}
+
+	base := (pcr / 300) & TIMESTAMP_MASK
+	ext := pcr % 300
+
+	buf[ADAPTATION_FLAGS_OFFSET] |= PCR_FLAG_MASK
+	buf[PCR_OFFSET+0] = byte(base >> 25)
+	buf[PCR_OFFSET+1] = byte(base >> 17)
+	buf[PCR_OFFSET+2] = byte(base >> 9)
+	buf[PCR_OFFSET+3] = byte(base >> 1)
+	buf[PCR_OFFSET+4] = byte((base&0x01)<<7) | 0x7e | byte(ext>>8)
+	buf[PCR_OFFSET+5] = byte(ext)
+
+	return true
+}
@@ -168,3 +168,34 @@ func Test_Ts_Payload(t *testing.T) {
 		}
 	}
 }
+
+func Test_Ts_PcrRoundtrip(t *testing.T) {
+	var frm TsFrame
+	buf := frm.ToBuffer()
+
+	buf[0] = TS_MAGIC_BYTE
+	buf.SetAfc(ADAPTATION_FIELD_PRESENT_MASK | ADAPTATION_PAYLOAD_PRESENT_MASK)
+	buf[ADAPTATION_FIELD_LENGTH] = 7
+
+	if _, ok := buf.GetPcr(); ok {
+		t.Error("Found PCR without PCR flag")
+		return
+	}
+
+	for _, pcr := range []uint64{0, 299, 300, 27000000 * 3600, PCR_WRAP - 1} {
+		if !buf.SetPcr(pcr) {
+			t.Error("Failed to set PCR")
+			return
+		}
+
+		got, ok := buf.GetPcr()
+		if !ok || got != pcr {
+			t.Errorf("Got PCR %d, expected %d", got, pcr)
+			return
+		}
+	}
+
+	if _, ok := PID_0_PAT.ToBuffer().GetPcr(); ok {
+		t.Error("Found PCR in PAT")
+	}
+}
@@ -0,0 +1,213 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	BLOCK_TYPE_SHB = 0x0a0d0d0a
+	BLOCK_TYPE_IDB = 0x00000001
+	BLOCK_TYPE_EPB = 0x00000006
+
+	BYTE_ORDER_MAGIC = 0x1a2b3c4d
+
+	// Packets start with an IPv4 or IPv6 header
+	LINKTYPE_RAW = 101
+
+	OPT_ENDOFOPT   = 0
+	OPT_IF_TSRESOL = 9
+
+	// Timestamps are in nanoseconds
+	TSRESOL_NANO = 9
+
+	SNAPLEN = 65535
+
+	IPV4_HEADER_LENGTH = 20
+	IPV6_HEADER_LENGTH = 40
+	UDP_HEADER_LENGTH  = 8
+
+	IP_PROTO_UDP = 17
+	IP_TTL       = 64
+
+	EPB_HEADER_LENGTH = 28
+)
+
+var ErrMixedFamilies = errors.New("Source and destination address families differ")
+
+// Writer writes UDP datagrams to a pcapng stream with one raw IP interface.
+// The IP and UDP headers are synthesized from the addresses, since the
+// socket only hands us the payload.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func NewWriter(w io.Writer) (*Writer, error) {
+	writer := &Writer{
+		w:   w,
+		buf: make([]byte, 0, EPB_HEADER_LENGTH+IPV6_HEADER_LENGTH+UDP_HEADER_LENGTH+SNAPLEN+8),
+	}
+
+	le := binary.LittleEndian
+
+	shb := make([]byte, 28)
+	le.PutUint32(shb[0:], BLOCK_TYPE_SHB)
+	le.PutUint32(shb[4:], uint32(len(shb)))
+	le.PutUint32(shb[8:], BYTE_ORDER_MAGIC)
+	le.PutUint16(shb[12:], 1)
+	le.PutUint16(shb[14:], 0)
+	// Section length is not known up front
+	le.PutUint64(shb[16:], 0xffffffffffffffff)
+	le.PutUint32(shb[24:], uint32(len(shb)))
+
+	idb := make([]byte, 32)
+	le.PutUint32(idb[0:], BLOCK_TYPE_IDB)
+	le.PutUint32(idb[4:], uint32(len(idb)))
+	le.PutUint16(idb[8:], LINKTYPE_RAW)
+	le.PutUint32(idb[12:], SNAPLEN)
+	le.PutUint16(idb[16:], OPT_IF_TSRESOL)
+	le.PutUint16(idb[18:], 1)
+	idb[20] = TSRESOL_NANO
+	le.PutUint16(idb[24:], OPT_ENDOFOPT)
+	le.PutUint32(idb[28:], uint32(len(idb)))
+
+	if _, err := w.Write(append(shb, idb...)); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// WriteUdp writes one datagram as an enhanced packet block and returns the
+// number of bytes written. Payloads beyond the snap length are truncated.
+func (writer *Writer) WriteUdp(ts time.Time, src, dst *net.UDPAddr, payload []byte) (int, error) {
+	src4 := src.IP.To4()
+	dst4 := dst.IP.To4()
+
+	if (src4 == nil) != (dst4 == nil) {
+		return 0, ErrMixedFamilies
+	}
+
+	be := binary.BigEndian
+	le := binary.LittleEndian
+
+	b := writer.buf[:EPB_HEADER_LENGTH]
+
+	udpLen := UDP_HEADER_LENGTH + len(payload)
+
+	// Pseudo header sum for the UDP checksum
+	var sum uint32
+
+	if src4 != nil {
+		var ip [IPV4_HEADER_LENGTH]byte
+
+		ip[0] = 0x45
+		be.PutUint16(ip[2:], uint16(IPV4_HEADER_LENGTH+udpLen))
+		// Don't fragment
+		ip[6] = 0x40
+		ip[8] = IP_TTL
+		ip[9] = IP_PROTO_UDP
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		be.PutUint16(ip[10:], ^fold(checksum(0, ip[:])))
+
+		b = append(b, ip[:]...)
+
+		sum = checksum(0, ip[12:20])
+	} else {
+		var ip [IPV6_HEADER_LENGTH]byte
+
+		ip[0] = 0x60
+		be.PutUint16(ip[4:], uint16(udpLen))
+		ip[6] = IP_PROTO_UDP
+		ip[7] = IP_TTL
+		copy(ip[8:], src.IP.To16())
+		copy(ip[24:], dst.IP.To16())
+
+		b = append(b, ip[:]...)
+
+		sum = checksum(0, ip[8:40])
+	}
+
+	sum += IP_PROTO_UDP + uint32(udpLen)
+
+	var udp [UDP_HEADER_LENGTH]byte
+
+	be.PutUint16(udp[0:], uint16(src.Port))
+	be.PutUint16(udp[2:], uint16(dst.Port))
+	be.PutUint16(udp[4:], uint16(udpLen))
+
+	sum = checksum(sum, udp[:])
+	sum = checksum(sum, payload)
+
+	csum := ^fold(sum)
+	if csum == 0 {
+		csum = 0xffff
+	}
+	be.PutUint16(udp[6:], csum)
+
+	b = append(b, udp[:]...)
+
+	origLen := len(b) - EPB_HEADER_LENGTH + len(payload)
+
+	if origLen > SNAPLEN {
+		payload = payload[:SNAPLEN-(len(b)-EPB_HEADER_LENGTH)]
+	}
+
+	b = append(b, payload...)
+
+	capLen := len(b) - EPB_HEADER_LENGTH
+
+	for len(b) < pad4(len(b)) {
+		b = append(b, 0)
+	}
+
+	total := len(b) + 4
+	nanos := uint64(ts.UnixNano())
+
+	le.PutUint32(b[0:], BLOCK_TYPE_EPB)
+	le.PutUint32(b[4:], uint32(total))
+	le.PutUint32(b[8:], 0)
+	le.PutUint32(b[12:], uint32(nanos>>32))
+	le.PutUint32(b[16:], uint32(nanos))
+	le.PutUint32(b[20:], uint32(capLen))
+	le.PutUint32(b[24:], uint32(origLen))
+
+	b = append(b, 0, 0, 0, 0)
+	le.PutUint32(b[len(b)-4:], uint32(total))
+
+	writer.buf = b[:0]
+
+	return writer.w.Write(b)
+}
+
+// checksum adds buf to a ones' complement sum.
+func checksum(sum uint32, buf []byte) uint32 {
+	n := len(buf)
+
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(buf[i])<<8 | uint32(buf[i+1])
+	}
+
+	if n%2 == 1 {
+		sum += uint32(buf[n-1]) << 8
+	}
+
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	return uint16(sum)
+}
@@ -0,0 +1,103 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Pcapng_WriteUdp(t *testing.T) {
+	var out bytes.Buffer
+
+	w, err := NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headerLen := out.Len()
+
+	ts := time.Unix(1500000000, 123456789)
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	dst := &net.UDPAddr{IP: net.IPv4(239, 1, 2, 3), Port: 1234}
+	payload := []byte{0x47, 1, 2, 3, 4}
+
+	n, err := w.WriteUdp(ts, src, dst, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	le := binary.LittleEndian
+	be := binary.BigEndian
+	b := out.Bytes()
+
+	if le.Uint32(b[0:]) != BLOCK_TYPE_SHB || le.Uint32(b[8:]) != BYTE_ORDER_MAGIC {
+		t.Fatalf("Bad section header %x", b[:12])
+	}
+
+	epb := b[headerLen:]
+	if len(epb) != n || n%4 != 0 {
+		t.Fatalf("Wrote %d bytes, block is %d", n, len(epb))
+	}
+
+	if le.Uint32(epb[0:]) != BLOCK_TYPE_EPB || le.Uint32(epb[4:]) != uint32(n) || le.Uint32(epb[n-4:]) != uint32(n) {
+		t.Fatalf("Bad block header %x", epb[:8])
+	}
+
+	nanos := uint64(le.Uint32(epb[12:]))<<32 | uint64(le.Uint32(epb[16:]))
+	if int64(nanos) != ts.UnixNano() {
+		t.Errorf("Timestamp %d, expected %d", nanos, ts.UnixNano())
+	}
+
+	capLen := int(le.Uint32(epb[20:]))
+	if capLen != IPV4_HEADER_LENGTH+UDP_HEADER_LENGTH+len(payload) {
+		t.Fatalf("Bad captured length %d", capLen)
+	}
+
+	pkt := epb[EPB_HEADER_LENGTH:][:capLen]
+	ip := pkt[:IPV4_HEADER_LENGTH]
+	udp := pkt[IPV4_HEADER_LENGTH:]
+
+	if fold(checksum(0, ip)) != 0xffff {
+		t.Errorf("Bad IP checksum %x", ip)
+	}
+
+	if !net.IP(ip[12:16]).Equal(src.IP) || !net.IP(ip[16:20]).Equal(dst.IP) {
+		t.Errorf("Bad addresses %x", ip)
+	}
+
+	if be.Uint16(udp[0:]) != 5000 || be.Uint16(udp[2:]) != 1234 {
+		t.Errorf("Bad ports %x", udp[:4])
+	}
+
+	sum := checksum(0, ip[12:20])
+	sum += IP_PROTO_UDP + uint32(len(udp))
+	if fold(checksum(sum, udp)) != 0xffff {
+		t.Errorf("Bad UDP checksum %x", udp)
+	}
+
+	if !bytes.Equal(udp[UDP_HEADER_LENGTH:], payload) {
+		t.Errorf("Bad payload %x", udp[UDP_HEADER_LENGTH:])
+	}
+}
+
+func Test_Pcapng_WriteUdp6(t *testing.T) {
+	var out bytes.Buffer
+
+	w, err := NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 5000}
+	dst := &net.UDPAddr{IP: net.ParseIP("ff3e::1234"), Port: 1234}
+
+	if _, err := w.WriteUdp(time.Now(), src, dst, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteUdp(time.Now(), src, &net.UDPAddr{IP: net.IPv4(239, 1, 2, 3)}, nil); err != ErrMixedFamilies {
+		t.Errorf("Expected ErrMixedFamilies, got %v", err)
+	}
+}
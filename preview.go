@@ -35,6 +35,7 @@ type Preview struct {
 	StartRequest chan bool
 	Exits        chan CmdExit
 	StopRequest  chan bool
+	Stopped      chan bool
 	RecvBuf      chan PreviewRecvBuf
 	JpegRequest  chan PreviewJpegRequest
 }
@@ -76,6 +77,7 @@ func MakePreview(framerate, width, height int) *Preview {
 		StartRequest: make(chan bool),
 		Exits:        make(chan CmdExit),
 		StopRequest:  make(chan bool),
+		Stopped:      make(chan bool),
 		RecvBuf:      make(chan PreviewRecvBuf),
 		JpegRequest:  make(chan PreviewJpegRequest),
 	}
@@ -129,6 +131,44 @@ func (p *Preview) RunLoop() {
 
 			p.Input.Close()
 			p.Input = nil
+			p.Decoder = nil
+
+		case <-p.StopRequest:
+			p.stop()
+			running = false
+		}
+	}
+
+	close(p.Stopped)
+}
+
+// stop closes the decoder's input and waits for it to exit, answering anyone
+// still waiting on the next frame.
+func (p *Preview) stop() {
+	for _, req := range p.NextPreviews {
+		req.Ready <- nil
+	}
+
+	p.NextPreviews = nil
+
+	if p.Input == nil {
+		return
+	}
+
+	p.Input.Close()
+	p.Input = nil
+
+	// The decoder flushes its last frames on the way out
+	for {
+		select {
+		case pix := <-p.RecvBuf:
+			pix.KeepRunning <- pix.Err == nil
+
+		case exit := <-p.Exits:
+			log.Printf("Preview decoder stopped: %v", exit.Err)
+
+			p.Decoder = nil
+			return
 		}
 	}
 }
@@ -141,7 +181,6 @@ func (p *Preview) start() error {
 		return err
 	}
 
-	p.Input = pw
 	p.Decoder.Stdin = pr
 	p.Decoder.Stderr = nil
 
@@ -150,6 +189,7 @@ func (p *Preview) start() error {
 		return err
 	}
 
+	p.Input = pw
 	p.Output = output
 	p.Exits = make(chan CmdExit)
 
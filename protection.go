@@ -0,0 +1,188 @@
+package recstation
+
+import (
+	"hash/fnv"
+	"net"
+	"time"
+)
+
+const (
+	DEDUP_HISTORY     = 1024
+	PATH_ACTIVE_AFTER = 1 * time.Second
+)
+
+// udpPath is one of the (up to two) SMPTE 2022-7 paths feeding a stream.
+type udpPath struct {
+	Group  net.IP
+	Source net.IP
+	Iface  *net.Interface
+
+	Datagrams uint64
+	Lost      uint64
+
+	haveSeq  bool
+	lastSeq  uint16
+	lastSeen time.Time
+
+	arrival arrivalStats
+}
+
+type UdpPathStatusMessage struct {
+	Group     string `json:"group"`
+	Iface     string `json:"iface"`
+	Datagrams uint64 `json:"datagrams"`
+	Lost      uint64 `json:"lost"`
+
+	Arrival *ArrivalStatusMessage `json:"arrival"`
+}
+
+func (path *udpPath) active(now time.Time) bool {
+	return now.Sub(path.lastSeen) < PATH_ACTIVE_AFTER
+}
+
+// trackSeq counts the sequence gaps seen on this path alone, regardless of
+// whether the other path filled them.
+func (path *udpPath) trackSeq(seq uint16) {
+	if path.haveSeq {
+		gap := int(int16(seq - path.lastSeq))
+
+		if gap > 1 {
+			path.Lost += uint64(gap - 1)
+		}
+
+		if gap <= 0 {
+			return
+		}
+	}
+
+	path.haveSeq = true
+	path.lastSeq = seq
+}
+
+func (path *udpPath) Status() *UdpPathStatusMessage {
+	msg := &UdpPathStatusMessage{
+		Group:     path.Group.String(),
+		Datagrams: path.Datagrams,
+		Lost:      path.Lost,
+		Arrival:   path.arrival.Status(),
+	}
+
+	if path.Iface != nil {
+		msg.Iface = path.Iface.Name
+	}
+
+	return msg
+}
+
+type mergeEntry struct {
+	valid bool
+	seq   uint16
+	paths uint8
+}
+
+// rtpMerge merges two paths carrying RTP by sequence number. The first copy
+// of each datagram goes on to the receiver, the other path's copy is only an
+// arrival on that path, and a repeat on the same path is a real duplicate for
+// the receiver to count.
+type rtpMerge struct {
+	history [DEDUP_HISTORY]mergeEntry
+}
+
+// Check records a datagram arriving on a path, returning true if it should
+// go to the receiver.
+func (m *rtpMerge) Check(seq uint16, pathIdx int) bool {
+	e := &m.history[seq%DEDUP_HISTORY]
+	bit := uint8(1) << uint(pathIdx)
+
+	if !e.valid || e.seq != seq {
+		*e = mergeEntry{valid: true, seq: seq, paths: bit}
+		return true
+	}
+
+	if e.paths&bit != 0 {
+		return true
+	}
+
+	e.paths |= bit
+
+	return false
+}
+
+type dedupEntry struct {
+	valid bool
+	hash  uint64
+}
+
+type dedupCount struct {
+	delivered int
+	seen      []int
+}
+
+// tsDedup merges two paths carrying plain MPEG-TS (no RTP sequence numbers)
+// by the content hash of recently delivered datagrams. Copies are counted per
+// path, so that identical datagrams sent more than once, such as padding,
+// are each delivered. A datagram that ages out of the history without having
+// been seen on an active path is counted as lost on that path.
+type tsDedup struct {
+	history [DEDUP_HISTORY]dedupEntry
+	next    int
+	counts  map[uint64]*dedupCount
+}
+
+func (d *tsDedup) hash(buf []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(buf)
+
+	return h.Sum64()
+}
+
+// Check records a datagram arriving on a path, returning true if no other
+// path has delivered this copy of it already.
+func (d *tsDedup) Check(buf []byte, pathIdx int, paths []*udpPath, now time.Time) bool {
+	if d.counts == nil {
+		d.counts = make(map[uint64]*dedupCount)
+	}
+
+	h := d.hash(buf)
+
+	c, found := d.counts[h]
+	if !found {
+		c = &dedupCount{seen: make([]int, len(paths))}
+		d.counts[h] = c
+	}
+
+	c.seen[pathIdx]++
+	if c.seen[pathIdx] <= c.delivered {
+		return false
+	}
+
+	if old := &d.history[d.next]; old.valid {
+		d.expire(old.hash, paths, now)
+	}
+
+	d.history[d.next] = dedupEntry{valid: true, hash: h}
+	d.next = (d.next + 1) % DEDUP_HISTORY
+
+	c.delivered++
+
+	return true
+}
+
+// expire forgets the oldest delivery of a datagram, counting it as lost on
+// the active paths that never had it.
+func (d *tsDedup) expire(h uint64, paths []*udpPath, now time.Time) {
+	c := d.counts[h]
+
+	for i, path := range paths {
+		if c.seen[i] > 0 {
+			c.seen[i]--
+		} else if path.active(now) {
+			path.Lost++
+		}
+	}
+
+	c.delivered--
+	if c.delivered == 0 {
+		delete(d.counts, h)
+	}
+}
@@ -0,0 +1,150 @@
+package recstation
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestTsDedup(t *testing.T) {
+	now := time.Now()
+	paths := []*udpPath{{lastSeen: now}, {lastSeen: now}}
+
+	// Each path drops its own datagrams, never the same one, and the
+	// second runs a few datagrams behind the first
+	const count = 3 * DEDUP_HISTORY
+	const lag = 5
+
+	dropped := func(pathIdx, i int) bool {
+		if pathIdx == 0 {
+			return i%7 == 0
+		}
+
+		return i%7 != 0 && i%11 == 0
+	}
+
+	var d tsDedup
+	delivered := make(map[int]int)
+	var order []int
+
+	send := func(pathIdx, i int) {
+		if i < 0 || i >= count || dropped(pathIdx, i) {
+			return
+		}
+
+		buf := make([]byte, 7*188)
+		binary.BigEndian.PutUint32(buf, uint32(i))
+
+		if d.Check(buf, pathIdx, paths, now) {
+			delivered[i]++
+			order = append(order, i)
+		}
+	}
+
+	for i := 0; i < count+lag; i++ {
+		send(0, i)
+		send(1, i-lag)
+	}
+
+	for i := 0; i < count; i++ {
+		if delivered[i] != 1 {
+			t.Fatalf("Datagram %d delivered %d times", i, delivered[i])
+		}
+	}
+
+	// Loss is counted as datagrams age out of the history, which has
+	// wrapped twice by now
+	aged := order[:len(order)-DEDUP_HISTORY]
+
+	for pathIdx, path := range paths {
+		var want uint64
+		for _, i := range aged {
+			if dropped(pathIdx, i) {
+				want++
+			}
+		}
+
+		if path.Lost != want {
+			t.Errorf("Path %d lost %d, expected %d", pathIdx, path.Lost, want)
+		}
+	}
+}
+
+func TestUdpPathTrackSeq(t *testing.T) {
+	var path udpPath
+
+	for _, seq := range []uint16{65530, 65531, 65534, 1, 0, 2} {
+		path.trackSeq(seq)
+	}
+
+	// 65532, 65533, 65535 and 0 missing when 1 arrives; 0 arriving late
+	// does not undo that
+	if path.Lost != 4 || path.lastSeq != 2 {
+		t.Errorf("Lost %d, last sequence %d", path.Lost, path.lastSeq)
+	}
+}
+
+// Identical datagrams, such as padding, are each delivered once however many
+// paths carry them.
+func TestTsDedupIdentical(t *testing.T) {
+	now := time.Now()
+	paths := []*udpPath{{lastSeen: now}, {lastSeen: now}}
+
+	var d tsDedup
+	padding := make([]byte, 7*188)
+	delivered := 0
+
+	for i := 0; i < 3; i++ {
+		if d.Check(padding, 0, paths, now) {
+			delivered++
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if d.Check(padding, 1, paths, now) {
+			delivered++
+		}
+	}
+
+	if delivered != 3 {
+		t.Errorf("Delivered %d of 3", delivered)
+	}
+
+	// Once aged out, neither path has lost any of them
+	for i := 0; i < DEDUP_HISTORY; i++ {
+		buf := make([]byte, 7*188)
+		binary.BigEndian.PutUint32(buf, uint32(i+1))
+
+		d.Check(buf, 0, paths, now)
+		d.Check(buf, 1, paths, now)
+	}
+
+	if paths[0].Lost != 0 || paths[1].Lost != 0 {
+		t.Errorf("Lost %d and %d", paths[0].Lost, paths[1].Lost)
+	}
+}
+
+func TestRtpMerge(t *testing.T) {
+	var m rtpMerge
+
+	if !m.Check(100, 0) {
+		t.Error("First copy held back")
+	}
+
+	if m.Check(100, 1) {
+		t.Error("Copy from the other path let through")
+	}
+
+	if !m.Check(100, 0) {
+		t.Error("Repeat on the same path held back")
+	}
+
+	if !m.Check(101, 1) || m.Check(101, 0) {
+		t.Error("Second path not merged when first")
+	}
+
+	// Long after, the sequence number is a new datagram
+	if !m.Check(100+DEDUP_HISTORY, 1) {
+		t.Error("Wrapped sequence number held back")
+	}
+}
@@ -0,0 +1,222 @@
+package recstation
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"recstation/mpeg"
+)
+
+const (
+	PULL_MIN_BACKOFF  = 1 * time.Second
+	PULL_MAX_BACKOFF  = 30 * time.Second
+	PULL_DIAL_TIMEOUT = 10 * time.Second
+	PULL_READ_BUFFER  = 64 * 1024
+)
+
+// PullSource fetches MPEG-TS from an HTTP URL or a raw TCP socket
+// (tcp://host:port) and reconnects with backoff when the connection ends.
+// The stream is online while a connection is delivering data.
+type PullSource struct {
+	Name    string
+	Url     *url.URL
+	Timeout time.Duration
+	Events  chan<- HeartbeatEvent
+
+	client *http.Client
+
+	*inputSink
+}
+
+// makePullClient bounds the wait for a connection and for the response
+// headers. The body has no deadline, readLoop gives up on it once it goes
+// quiet.
+func makePullClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+}
+
+func MakePullSource(name string, u *url.URL, timeout time.Duration, events chan<- HeartbeatEvent) *PullSource {
+	source := &PullSource{
+		Name:      name,
+		Url:       u,
+		Timeout:   timeout,
+		Events:    events,
+		client:    makePullClient(PULL_DIAL_TIMEOUT),
+		inputSink: makeInputSink(),
+	}
+
+	go source.ConnectLoop()
+
+	return source
+}
+
+func (source *PullSource) open() (io.ReadCloser, error) {
+	switch source.Url.Scheme {
+	case "http", "https":
+		resp, err := source.client.Get(source.Url.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("HTTP status %s", resp.Status)
+		}
+
+		return resp.Body, nil
+
+	case "tcp":
+		return net.DialTimeout("tcp", source.Url.Host, PULL_DIAL_TIMEOUT)
+	}
+
+	return nil, fmt.Errorf("Unsupported pull scheme '%s'", source.Url.Scheme)
+}
+
+func (source *PullSource) ConnectLoop() {
+	backoff := PULL_MIN_BACKOFF
+
+	for {
+		// Any connection that opens starts the backoff again, even one
+		// that ends before the stream goes online
+		if source.pull() {
+			backoff = PULL_MIN_BACKOFF
+		}
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > PULL_MAX_BACKOFF {
+			backoff = PULL_MAX_BACKOFF
+		}
+	}
+}
+
+// pull makes one connection and reads from it until it ends, reporting
+// whether it opened at all.
+func (source *PullSource) pull() bool {
+	rc, err := source.open()
+	if err != nil {
+		log.Printf("Pull %s from %s failed: %s", source.Name, source.Url, err)
+		return false
+	}
+
+	online, err := source.readLoop(rc)
+
+	rc.Close()
+
+	log.Printf("Pull %s from %s ended: %v", source.Name, source.Url, err)
+
+	if online {
+		source.Events <- HeartbeatEvent{
+			Event: HEARTBEAT_OFFLINE,
+			Name:  source.Name,
+			Input: source,
+		}
+	}
+
+	return true
+}
+
+// readLoop reads TS packets until the connection fails or goes quiet for
+// longer than the timeout, and reports whether the stream went online.
+func (source *PullSource) readLoop(rc io.ReadCloser) (bool, error) {
+	// Closing the connection is the only way to interrupt a blocked read
+	// on an HTTP body
+	idle := time.AfterFunc(source.Timeout, func() {
+		rc.Close()
+	})
+	defer idle.Stop()
+
+	r := bufio.NewReaderSize(rc, PULL_READ_BUFFER)
+	online := false
+
+	for {
+		chunk := make([]byte, NUM_TS_PER_PACKET*mpeg.TS_PACKET_LENGTH)
+		pkts := make([]mpeg.TsBuffer, 0, NUM_TS_PER_PACKET)
+
+		for len(pkts) < NUM_TS_PER_PACKET {
+			pkt := mpeg.TsBuffer(chunk[len(pkts)*mpeg.TS_PACKET_LENGTH:][:mpeg.TS_PACKET_LENGTH])
+
+			if err := readTsPacket(r, pkt); err != nil {
+				return online, err
+			}
+
+			idle.Reset(source.Timeout)
+
+			if pkt.GetPid() != mpeg.PID_PADDING {
+				pkts = append(pkts, pkt)
+			}
+
+			// Hand over what we have rather than wait for more
+			if r.Buffered() < mpeg.TS_PACKET_LENGTH {
+				break
+			}
+		}
+
+		if len(pkts) == 0 {
+			continue
+		}
+
+		if !online {
+			log.Printf("Pull %s from %s online", source.Name, source.Url)
+
+			online = true
+
+			source.Events <- HeartbeatEvent{
+				Event: HEARTBEAT_ONLINE,
+				Name:  source.Name,
+				Input: source,
+			}
+		}
+
+		source.chunks <- pkts
+
+		// Time spent waiting on the sink is not idle time
+		idle.Reset(source.Timeout)
+	}
+}
+
+// readTsPacket reads the next packet. When the stream is not aligned it skips
+// bytes until a sync byte that is followed by another one a packet later.
+func readTsPacket(r *bufio.Reader, pkt mpeg.TsBuffer) error {
+	resync := false
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if b != mpeg.TS_MAGIC_BYTE {
+			resync = true
+			continue
+		}
+
+		if resync {
+			next, err := r.Peek(mpeg.TS_PACKET_LENGTH)
+			if err == nil && next[mpeg.TS_PACKET_LENGTH-1] != mpeg.TS_MAGIC_BYTE {
+				continue
+			}
+		}
+
+		pkt[0] = b
+		break
+	}
+
+	_, err := io.ReadFull(r, pkt[1:mpeg.TS_PACKET_LENGTH])
+
+	return err
+}
@@ -0,0 +1,230 @@
+package recstation
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"recstation/mpeg"
+)
+
+func makeTestTsPacket(seq int) []byte {
+	pkt := make([]byte, mpeg.TS_PACKET_LENGTH)
+	pkt[0] = mpeg.TS_MAGIC_BYTE
+	pkt[1] = 0x01
+	pkt[2] = 0x00
+	pkt[3] = 0x10 | byte(seq&0x0f)
+	pkt[4] = byte(seq)
+
+	return pkt
+}
+
+func expectEvent(t *testing.T, events chan HeartbeatEvent, event int) HeartbeatEvent {
+	select {
+	case ev := <-events:
+		if ev.Event != event {
+			t.Fatalf("Got event %d, expected %d", ev.Event, event)
+		}
+
+		return ev
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for event %d", event)
+	}
+
+	return HeartbeatEvent{}
+}
+
+func TestPullSourceHttp(t *testing.T) {
+	const NUM_PACKETS = 50
+
+	release := make(chan bool)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp2t")
+
+		// Start mid-packet to exercise the resync
+		w.Write([]byte{0x00, 0x47, 0x12})
+		w.Write(makeTestTsPacket(0))
+		w.Write(makeTestTsPacket(1))
+		w.(http.Flusher).Flush()
+
+		<-release
+
+		for i := 2; i < NUM_PACKETS; i++ {
+			w.Write(makeTestTsPacket(i))
+
+			if i%7 == 0 {
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL + "/live.ts")
+	events := make(chan HeartbeatEvent, 4)
+
+	MakePullSource("test", u, time.Second, events)
+
+	ev := expectEvent(t, events, HEARTBEAT_ONLINE)
+	if ev.Name != "test" {
+		t.Fatalf("Bad stream name %s", ev.Name)
+	}
+
+	sink := &Sink{
+		Packets: make(chan []mpeg.TsBuffer),
+	}
+
+	ev.Input.AttachSink(ev.Name, sink)
+	close(release)
+
+	next := -1
+	for next < NUM_PACKETS-1 {
+		select {
+		case pkts := <-sink.Packets:
+			for _, pkt := range pkts {
+				if !pkt.IsValid() || pkt.GetPid() != 0x100 {
+					t.Fatalf("Bad packet %x", []byte(pkt[:5]))
+				}
+
+				seq := int(pkt[4])
+				if next >= 0 && seq != next+1 {
+					t.Fatalf("Packet %d after %d", seq, next)
+				}
+
+				next = seq
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after packet %d", next)
+		}
+	}
+
+	expectEvent(t, events, HEARTBEAT_OFFLINE)
+	ev.Input.DetachSink(ev.Name)
+
+	// The server closes each response, so the source reconnects
+	expectEvent(t, events, HEARTBEAT_ONLINE)
+}
+
+func TestPullSourceTcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go (func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		for i := 0; i < 10; i++ {
+			conn.Write(makeTestTsPacket(i))
+		}
+
+		// Stay connected but silent so the idle timeout fires
+		time.Sleep(2 * time.Second)
+		conn.Close()
+	})()
+
+	u, _ := url.Parse("tcp://" + l.Addr().String())
+	events := make(chan HeartbeatEvent, 4)
+
+	MakePullSource("tcp", u, 200*time.Millisecond, events)
+
+	ev := expectEvent(t, events, HEARTBEAT_ONLINE)
+
+	sink := &Sink{
+		Packets: make(chan []mpeg.TsBuffer, 10),
+	}
+
+	ev.Input.AttachSink(ev.Name, sink)
+
+	expectEvent(t, events, HEARTBEAT_OFFLINE)
+}
+
+func TestPullSourceHeaderTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Accept the connection but never answer
+	go (func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.Copy(ioutil.Discard, conn)
+	})()
+
+	u, _ := url.Parse("http://" + l.Addr().String() + "/live.ts")
+
+	source := &PullSource{
+		Name:   "test",
+		Url:    u,
+		client: makePullClient(100 * time.Millisecond),
+	}
+
+	done := make(chan error)
+	go (func() {
+		_, err := source.open()
+		done <- err
+	})()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Opened a pull that never answered")
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Still waiting for the response headers")
+	}
+}
+
+// A connection that opens counts for resetting the backoff, even when it
+// closes before any data.
+func TestPullSourceOpened(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go (func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		conn.Close()
+	})()
+
+	u, _ := url.Parse("tcp://" + l.Addr().String())
+
+	source := &PullSource{
+		Name:    "test",
+		Url:     u,
+		Timeout: time.Second,
+	}
+
+	if !source.pull() {
+		t.Error("Connection that opened not reported")
+	}
+
+	l.Close()
+
+	if source.pull() {
+		t.Error("Refused connection reported as opened")
+	}
+}
@@ -0,0 +1,302 @@
+package recstation
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"recstation/mpeg"
+	"recstation/rtp"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	RELAY_TS_PER_DATAGRAM = 7
+
+	// A partial datagram is sent once it has waited this long, so that a
+	// low-rate or PID-filtered output is not held back
+	RELAY_FLUSH_AFTER = 50 * time.Millisecond
+
+	// DSCP sits in the upper six bits of the TOS and traffic class bytes
+	DSCP_SHIFT = 2
+	DSCP_MAX   = 63
+)
+
+// Relay forwards the TS packets of a received stream to another group or a
+// unicast destination, as plain UDP or as RTP. Padding has already been
+// removed by the source; when PIDs are given only those are passed, plus the
+// PAT and the PMTs it lists.
+type Relay struct {
+	// Counters first for 64-bit atomic alignment
+	datagrams uint64
+	errors    uint64
+
+	Name   string
+	Stream string
+	Dest   *net.UDPAddr
+	Rtp    bool
+
+	conn    *net.UDPConn
+	pids    map[mpeg.PID]bool
+	pmts    map[mpeg.PID]bool
+	pat     mpeg.PAT
+	hdr     rtp.Header
+	start   time.Time
+	failing bool
+
+	// Shared between Write and the flush timer
+	mutex   sync.Mutex
+	buf     []byte
+	count   int
+	first   time.Time
+	timer   *time.Timer
+	waiting bool
+}
+
+type RelayStatusMessage struct {
+	Name      string `json:"name"`
+	Dest      string `json:"dest"`
+	Rtp       bool   `json:"rtp"`
+	Datagrams uint64 `json:"datagrams"`
+	Errors    uint64 `json:"errors"`
+}
+
+func MakeRelay(name string, cfg RelayConfigJson) (*Relay, error) {
+	dest, err := net.ResolveUDPAddr("udp", cfg.Dest)
+	if err != nil {
+		return nil, err
+	}
+
+	var iface *net.Interface
+	if cfg.Iface != "" {
+		iface, err = net.InterfaceByName(cfg.Iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.DialUDP("udp", nil, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setRelayOptions(conn, dest.IP, iface, cfg.Ttl, cfg.Dscp); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Relay %s: %s", name, err)
+	}
+
+	relay := &Relay{
+		Name:   name,
+		Stream: cfg.Stream,
+		Dest:   dest,
+		Rtp:    cfg.Rtp,
+		conn:   conn,
+		start:  time.Now(),
+		hdr: rtp.Header{
+			PayloadType:    rtp.PAYLOAD_TYPE_MP2T,
+			SequenceNumber: uint16(rand.Uint32()),
+			Ssrc:           rand.Uint32(),
+		},
+	}
+
+	if len(cfg.Pids) > 0 {
+		relay.pids = make(map[mpeg.PID]bool)
+		relay.pmts = make(map[mpeg.PID]bool)
+
+		for _, pid := range cfg.Pids {
+			relay.pids[mpeg.PID(pid)] = true
+		}
+	}
+
+	relay.buf = make([]byte, 0, rtp.HEADER_LENGTH+RELAY_TS_PER_DATAGRAM*mpeg.TS_PACKET_LENGTH)
+	if relay.Rtp {
+		relay.buf = relay.buf[:rtp.HEADER_LENGTH]
+	}
+
+	relay.timer = time.AfterFunc(RELAY_FLUSH_AFTER, relay.timeout)
+	relay.timer.Stop()
+
+	log.Printf("Relaying %s to %s", relay.Stream, relay.Dest)
+
+	return relay, nil
+}
+
+// setRelayOptions applies the TTL or hop limit, DSCP and outgoing multicast
+// interface. A zero TTL keeps the system default.
+func setRelayOptions(conn *net.UDPConn, dest net.IP, iface *net.Interface, ttl, dscp int) error {
+	mcast := dest.IsMulticast()
+
+	if !isIPv6(dest) {
+		c := ipv4.NewConn(conn)
+		p := ipv4.NewPacketConn(conn)
+
+		if err := c.SetTOS(dscp << DSCP_SHIFT); err != nil {
+			return err
+		}
+
+		if ttl > 0 && mcast {
+			if err := p.SetMulticastTTL(ttl); err != nil {
+				return err
+			}
+		} else if ttl > 0 {
+			if err := c.SetTTL(ttl); err != nil {
+				return err
+			}
+		}
+
+		if iface != nil && mcast {
+			return p.SetMulticastInterface(iface)
+		}
+
+		return nil
+	}
+
+	c := ipv6.NewConn(conn)
+	p := ipv6.NewPacketConn(conn)
+
+	if err := c.SetTrafficClass(dscp << DSCP_SHIFT); err != nil {
+		return err
+	}
+
+	if ttl > 0 && mcast {
+		if err := p.SetMulticastHopLimit(ttl); err != nil {
+			return err
+		}
+	} else if ttl > 0 {
+		if err := c.SetHopLimit(ttl); err != nil {
+			return err
+		}
+	}
+
+	if iface != nil && mcast {
+		return p.SetMulticastInterface(iface)
+	}
+
+	return nil
+}
+
+func (relay *Relay) allow(pkt mpeg.TsBuffer) bool {
+	if relay.pids == nil {
+		return true
+	}
+
+	pid := pkt.GetPid()
+
+	if pid == mpeg.PID_PAT {
+		if relay.pat.ParsePAT(pkt) {
+			for _, entry := range relay.pat.Entry[:relay.pat.NumEntry] {
+				if entry.Flag_PMT {
+					relay.pmts[entry.ProgramMapPID] = true
+				}
+			}
+		}
+
+		return true
+	}
+
+	return relay.pids[pid] || relay.pmts[pid]
+}
+
+// Write queues TS packets and sends every full datagram. It is called from
+// Sink.WritePackets, so the packets are only borrowed.
+func (relay *Relay) Write(pkts []mpeg.TsBuffer) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	for _, pkt := range pkts {
+		if !relay.allow(pkt) {
+			continue
+		}
+
+		if relay.count == 0 {
+			relay.first = time.Now()
+		}
+
+		relay.buf = append(relay.buf, pkt[:mpeg.TS_PACKET_LENGTH]...)
+		relay.count++
+
+		if relay.count == RELAY_TS_PER_DATAGRAM {
+			relay.flush()
+		}
+	}
+
+	if relay.count > 0 && !relay.waiting {
+		relay.waiting = true
+		relay.timer.Reset(RELAY_FLUSH_AFTER - time.Since(relay.first))
+	}
+}
+
+// Flush sends the partial datagram, if any. The sink calls it when it
+// closes, so that the end of the stream is not left behind.
+func (relay *Relay) Flush() {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	if relay.count > 0 {
+		relay.flush()
+	}
+}
+
+func (relay *Relay) timeout() {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+
+	relay.waiting = false
+
+	if relay.count == 0 {
+		return
+	}
+
+	// The datagram that armed the timer may have gone out already
+	if wait := RELAY_FLUSH_AFTER - time.Since(relay.first); wait > 0 {
+		relay.waiting = true
+		relay.timer.Reset(wait)
+		return
+	}
+
+	relay.flush()
+}
+
+func (relay *Relay) flush() {
+	if relay.Rtp {
+		relay.hdr.SequenceNumber++
+		elapsed := uint64(time.Since(relay.start))
+		relay.hdr.Timestamp = uint32(elapsed * (rtp.CLOCK_RATE_MP2T / 10000) / uint64(time.Second/10000))
+		relay.hdr.Marshal(relay.buf)
+	}
+
+	_, err := relay.conn.Write(relay.buf)
+	if err != nil {
+		atomic.AddUint64(&relay.errors, 1)
+
+		if !relay.failing {
+			log.Printf("Relay %s to %s failed: %s", relay.Name, relay.Dest, err)
+			relay.failing = true
+		}
+	} else {
+		atomic.AddUint64(&relay.datagrams, 1)
+		relay.failing = false
+	}
+
+	relay.count = 0
+	relay.buf = relay.buf[:0]
+	if relay.Rtp {
+		relay.buf = relay.buf[:rtp.HEADER_LENGTH]
+	}
+}
+
+func (relay *Relay) Status() *RelayStatusMessage {
+	return &RelayStatusMessage{
+		Name:      relay.Name,
+		Dest:      relay.Dest.String(),
+		Rtp:       relay.Rtp,
+		Datagrams: atomic.LoadUint64(&relay.datagrams),
+		Errors:    atomic.LoadUint64(&relay.errors),
+	}
+}
@@ -0,0 +1,152 @@
+package recstation
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"recstation/mpeg"
+	"recstation/rtp"
+)
+
+func makeTestPat(pmtPid mpeg.PID) mpeg.TsBuffer {
+	pkt := mpeg.TsBuffer(make([]byte, mpeg.TS_PACKET_LENGTH))
+	for i := range pkt {
+		pkt[i] = 0xff
+	}
+
+	section := []byte{
+		0x00,       // pointer field
+		0x00,       // table id
+		0xb0, 0x0d, // section length
+		0x00, 0x01, // transport stream id
+		0xc1, 0x00, 0x00,
+		0x00, 0x01, // program number
+		0xe0 | byte(pmtPid>>8), byte(pmtPid),
+		0, 0, 0, 0, // CRC, not checked
+	}
+
+	pkt[0] = mpeg.TS_MAGIC_BYTE
+	pkt[1] = 0x40
+	pkt[2] = 0x00
+	pkt[3] = 0x10
+	copy(pkt[4:], section)
+
+	return pkt
+}
+
+func TestRelayRtpPidFilter(t *testing.T) {
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	relay, err := MakeRelay("test", RelayConfigJson{
+		Stream: "test",
+		Dest:   l.LocalAddr().String(),
+		Rtp:    true,
+		Dscp:   34,
+		Pids:   []int{0x101},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pkts []mpeg.TsBuffer
+
+	pkts = append(pkts, makeTestPat(0x100))
+	for i := 0; i < 20; i++ {
+		pkt := mpeg.TsBuffer(makeTestTsPacket(i))
+
+		// Alternate between the PMT, a wanted PID and an unwanted one
+		pkt[2] = byte(i % 3)
+
+		pkts = append(pkts, pkt)
+	}
+
+	relay.Write(pkts)
+
+	buf := make([]byte, 2048)
+	var hdr rtp.Header
+	var seq uint16
+
+	// Two full datagrams, then the rest once the flush timer fires
+	for i := 0; i < 3; i++ {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, err := l.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := rtp.Parse(buf[:n], &hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.PayloadType != rtp.PAYLOAD_TYPE_MP2T || (i > 0 && hdr.SequenceNumber != seq+1) {
+			t.Fatalf("Bad RTP header %+v", hdr)
+		}
+
+		seq = hdr.SequenceNumber
+
+		if (i < 2 && len(payload) != RELAY_TS_PER_DATAGRAM*mpeg.TS_PACKET_LENGTH) || len(payload) == 0 || len(payload)%mpeg.TS_PACKET_LENGTH != 0 {
+			t.Fatalf("Bad payload length %d", len(payload))
+		}
+
+		for offs := 0; offs < len(payload); offs += mpeg.TS_PACKET_LENGTH {
+			pid := mpeg.TsBuffer(payload[offs:]).GetPid()
+			if pid != mpeg.PID_PAT && pid != 0x100 && pid != 0x101 {
+				t.Fatalf("Relayed unwanted PID %v", pid)
+			}
+		}
+	}
+
+	// Waits for the timer to finish counting the last datagram
+	relay.Flush()
+
+	if st := relay.Status(); st.Datagrams != 3 || st.Errors != 0 {
+		t.Errorf("Bad status %+v", st)
+	}
+}
+
+func TestRelayFlush(t *testing.T) {
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	relay, err := MakeRelay("test", RelayConfigJson{
+		Stream: "test",
+		Dest:   l.LocalAddr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay.Write([]mpeg.TsBuffer{makeTestTsPacket(0), makeTestTsPacket(1)})
+
+	if st := relay.Status(); st.Datagrams != 0 {
+		t.Fatalf("Sent a partial datagram early: %+v", st)
+	}
+
+	relay.Flush()
+
+	if st := relay.Status(); st.Datagrams != 1 {
+		t.Fatalf("Partial datagram not flushed: %+v", st)
+	}
+
+	buf := make([]byte, 2048)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, err := l.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2*mpeg.TS_PACKET_LENGTH {
+		t.Errorf("Flushed %d bytes", n)
+	}
+}
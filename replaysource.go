@@ -0,0 +1,181 @@
+package recstation
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"recstation/mpeg"
+)
+
+const (
+	// A PCR step larger than this, or backwards, is a discontinuity and
+	// restarts the pacing clock
+	REPLAY_MAX_PCR_STEP = 1 * mpeg.PCR_HZ
+
+	REPLAY_READ_BUFFER = 64 * 1024
+)
+
+// ReplaySource plays a TS file into the pipeline in real time, paced by the
+// PCR of the first PID that carries one. It announces itself like a
+// heartbeat-announced stream when playback starts.
+type ReplaySource struct {
+	Name     string
+	Filename string
+	Loop     bool
+	Events   chan<- HeartbeatEvent
+
+	pcrPid  mpeg.PID
+	havePcr bool
+	lastPcr uint64
+	basePcr uint64
+	base    time.Time
+
+	*inputSink
+}
+
+func MakeReplaySource(name, filename string, loop bool, events chan<- HeartbeatEvent) *ReplaySource {
+	source := &ReplaySource{
+		Name:      name,
+		Filename:  filename,
+		Loop:      loop,
+		Events:    events,
+		inputSink: makeInputSink(),
+	}
+
+	go source.PlayLoop()
+
+	return source
+}
+
+func (source *ReplaySource) PlayLoop() {
+	f, err := os.Open(source.Filename)
+	if err != nil {
+		log.Printf("Replay %s failed: %s", source.Name, err)
+		return
+	}
+
+	defer f.Close()
+
+	log.Printf("Replaying %s from %s", source.Name, source.Filename)
+
+	source.Events <- HeartbeatEvent{
+		Event: HEARTBEAT_ONLINE,
+		Name:  source.Name,
+		Input: source,
+	}
+
+	for {
+		err := source.play(bufio.NewReaderSize(f, REPLAY_READ_BUFFER))
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			log.Printf("Replay %s failed: %s", source.Name, err)
+			break
+		}
+
+		if !source.Loop {
+			break
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			log.Printf("Replay %s failed to loop: %s", source.Name, err)
+			break
+		}
+
+		source.havePcr = false
+	}
+
+	log.Printf("Replay %s finished", source.Name)
+
+	source.Events <- HeartbeatEvent{
+		Event: HEARTBEAT_OFFLINE,
+		Name:  source.Name,
+		Input: source,
+	}
+}
+
+// play sends the file to the sink, holding back each PCR-bearing packet
+// until its time has come.
+func (source *ReplaySource) play(r *bufio.Reader) error {
+	var frame mpeg.TsFrame
+	var pkts []mpeg.TsBuffer
+	var chunk []byte
+
+	for {
+		if err := readTsPacket(r, frame.ToBuffer()); err != nil {
+			if len(pkts) > 0 {
+				source.chunks <- pkts
+			}
+
+			return err
+		}
+
+		if wait := source.pace(frame.ToBuffer()); wait > 0 {
+			if len(pkts) > 0 {
+				source.chunks <- pkts
+				pkts = nil
+			}
+
+			time.Sleep(wait)
+		}
+
+		if frame.ToBuffer().GetPid() == mpeg.PID_PADDING {
+			continue
+		}
+
+		if pkts == nil {
+			chunk = make([]byte, NUM_TS_PER_PACKET*mpeg.TS_PACKET_LENGTH)
+			pkts = make([]mpeg.TsBuffer, 0, NUM_TS_PER_PACKET)
+		}
+
+		pkt := mpeg.TsBuffer(chunk[len(pkts)*mpeg.TS_PACKET_LENGTH:][:mpeg.TS_PACKET_LENGTH])
+		copy(pkt, frame[:])
+
+		pkts = append(pkts, pkt)
+
+		if len(pkts) == NUM_TS_PER_PACKET {
+			source.chunks <- pkts
+			pkts = nil
+		}
+	}
+}
+
+// pace returns how long to wait before sending a packet.
+func (source *ReplaySource) pace(pkt mpeg.TsBuffer) time.Duration {
+	pcr, ok := pkt.GetPcr()
+	if !ok {
+		return 0
+	}
+
+	if !source.havePcr {
+		source.pcrPid = pkt.GetPid()
+		source.havePcr = true
+		source.rebase(pcr)
+		return 0
+	}
+
+	if pkt.GetPid() != source.pcrPid {
+		return 0
+	}
+
+	step := (pcr + mpeg.PCR_WRAP - source.lastPcr) % mpeg.PCR_WRAP
+	if step > REPLAY_MAX_PCR_STEP {
+		log.Printf("Replay %s PCR discontinuity", source.Name)
+		source.rebase(pcr)
+		return 0
+	}
+
+	source.lastPcr = pcr
+
+	elapsed := (pcr + mpeg.PCR_WRAP - source.basePcr) % mpeg.PCR_WRAP
+	target := source.base.Add(time.Duration(elapsed * 1000 / 27))
+
+	return time.Until(target)
+}
+
+func (source *ReplaySource) rebase(pcr uint64) {
+	source.base = time.Now()
+	source.basePcr = pcr
+	source.lastPcr = pcr
+}
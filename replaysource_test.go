@@ -0,0 +1,79 @@
+package recstation
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"recstation/mpeg"
+)
+
+func makeTestPcrPacket(pcr uint64) []byte {
+	pkt := makeTestTsPacket(0)
+
+	buf := mpeg.TsBuffer(pkt)
+	buf.SetAfc(mpeg.ADAPTATION_FIELD_PRESENT_MASK | mpeg.ADAPTATION_PAYLOAD_PRESENT_MASK)
+	buf[mpeg.ADAPTATION_FIELD_LENGTH] = 7
+	buf[mpeg.ADAPTATION_FLAGS_OFFSET] = 0
+	buf.SetPcr(pcr)
+
+	return pkt
+}
+
+func TestReplaySourcePacing(t *testing.T) {
+	const NUM_PCRS = 6
+	const PCR_STEP = mpeg.PCR_HZ / 10
+
+	f, err := ioutil.TempFile("", "replay-*.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// Start close to the wrap to check it is handled
+	pcr := mpeg.PCR_WRAP - PCR_STEP
+
+	for i := 0; i < NUM_PCRS; i++ {
+		f.Write(makeTestPcrPacket((pcr + uint64(i)*PCR_STEP) % mpeg.PCR_WRAP))
+
+		for j := 0; j < 3; j++ {
+			f.Write(makeTestTsPacket(j))
+		}
+	}
+
+	f.Close()
+
+	events := make(chan HeartbeatEvent, 4)
+
+	MakeReplaySource("replay", f.Name(), false, events)
+
+	ev := expectEvent(t, events, HEARTBEAT_ONLINE)
+
+	sink := &Sink{
+		Packets: make(chan []mpeg.TsBuffer),
+	}
+
+	start := time.Now()
+	ev.Input.AttachSink(ev.Name, sink)
+
+	total := 0
+	for total < NUM_PCRS*4 {
+		select {
+		case pkts := <-sink.Packets:
+			total += len(pkts)
+
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after %d packets", total)
+		}
+	}
+
+	elapsed := time.Since(start)
+	expected := (NUM_PCRS - 1) * 100 * time.Millisecond
+
+	if elapsed < expected-20*time.Millisecond || elapsed > expected+200*time.Millisecond {
+		t.Errorf("Replay took %s, expected %s", elapsed, expected)
+	}
+
+	expectEvent(t, events, HEARTBEAT_OFFLINE)
+}
@@ -0,0 +1,198 @@
+package rtp
+
+import (
+	"errors"
+)
+
+const (
+	FEC_HEADER_LENGTH = 16
+
+	// SMPTE 2022-1 limits the matrix to L*D <= 100, hold enough packets for
+	// a whole matrix plus the column FEC which trails it.
+	FEC_REORDER_DEPTH = 256
+
+	FEC_MAX_PENDING = 64
+
+	FEC_PORT_OFFSET_COLUMN = 2
+	FEC_PORT_OFFSET_ROW    = 4
+)
+
+var ErrShortFec = errors.New("rtp: FEC packet too short")
+
+// FecHeader is the SMPTE 2022-1 FEC header which follows the RTP header on
+// the column and row FEC streams.
+type FecHeader struct {
+	SnBase         uint16
+	LengthRecovery uint16
+	Extended       bool
+	PtRecovery     uint8
+	Mask           uint32
+	TsRecovery     uint32
+	Row            bool
+	Type           uint8
+	Index          uint8
+	Offset         uint8
+	NA             uint8
+}
+
+func ParseFec(buf []byte, hdr *FecHeader) ([]byte, error) {
+	if len(buf) < FEC_HEADER_LENGTH {
+		return nil, ErrShortFec
+	}
+
+	hdr.SnBase = (uint16(buf[0]) << 8) | uint16(buf[1])
+	hdr.LengthRecovery = (uint16(buf[2]) << 8) | uint16(buf[3])
+	hdr.Extended = (buf[4] & 0x80) != 0
+	hdr.PtRecovery = buf[4] & 0x7f
+	hdr.Mask = (uint32(buf[5]) << 16) | (uint32(buf[6]) << 8) | uint32(buf[7])
+	hdr.TsRecovery = (uint32(buf[8]) << 24) | (uint32(buf[9]) << 16) | (uint32(buf[10]) << 8) | uint32(buf[11])
+	hdr.Row = (buf[12] & 0x40) != 0
+	hdr.Type = (buf[12] >> 3) & 0x7
+	hdr.Index = buf[12] & 0x7
+	hdr.Offset = buf[13]
+	hdr.NA = buf[14]
+
+	return buf[FEC_HEADER_LENGTH:], nil
+}
+
+type fecPacket struct {
+	hdr     FecHeader
+	payload []byte
+}
+
+func (f *fecPacket) seq(i int) uint16 {
+	return f.hdr.SnBase + uint16(i)*uint16(f.hdr.Offset)
+}
+
+func (r *Receiver) have(seq uint16) bool {
+	s := r.slot(seq)
+
+	return s.seen && s.seq == seq
+}
+
+// covered says whether an outstanding FEC packet protects a sequence number,
+// so that losing it means the FEC could not help.
+func (r *Receiver) covered(seq uint16) bool {
+	for _, f := range r.fec {
+		for i := 0; i < int(f.hdr.NA); i++ {
+			if f.seq(i) == seq {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// PushFec adds a column or row FEC packet and recovers whatever missing media
+// packets it can.
+func (r *Receiver) PushFec(hdr *FecHeader, payload []byte) {
+	if hdr.NA == 0 || hdr.Offset == 0 {
+		r.Errors++
+		return
+	}
+
+	r.FecPackets++
+
+	if !r.started {
+		return
+	}
+
+	r.fec = append(r.fec, &fecPacket{
+		hdr:     *hdr,
+		payload: append([]byte(nil), payload...),
+	})
+
+	if len(r.fec) > FEC_MAX_PENDING {
+		r.fec = r.fec[len(r.fec)-FEC_MAX_PENDING:]
+	}
+
+	for r.recoverPending() {
+	}
+}
+
+// recoverPending makes one pass over the outstanding FEC packets, returning
+// true if a packet was recovered that may in turn allow further recoveries.
+func (r *Receiver) recoverPending() bool {
+	recovered := false
+	pending := r.fec[:0]
+
+	for _, f := range r.fec {
+		missing := 0
+		var lost uint16
+
+		for i := 0; i < int(f.hdr.NA); i++ {
+			if seq := f.seq(i); !r.have(seq) {
+				missing++
+				lost = seq
+			}
+		}
+
+		switch {
+		case missing == 0:
+			// Nothing to do
+
+		case seqDiff(lost, r.next) < 0:
+			// Already given up on, or too old to be of use
+
+		case missing == 1:
+			r.recover(f, lost)
+			recovered = true
+
+		default:
+			pending = append(pending, f)
+		}
+	}
+
+	r.fec = pending
+
+	return recovered
+}
+
+func (r *Receiver) recover(f *fecPacket, lost uint16) {
+	length := f.hdr.LengthRecovery
+	pt := f.hdr.PtRecovery
+	ts := f.hdr.TsRecovery
+
+	var buf [MAX_PACKET]byte
+	copy(buf[:], f.payload)
+
+	for i := 0; i < int(f.hdr.NA); i++ {
+		seq := f.seq(i)
+		if seq == lost {
+			continue
+		}
+
+		s := r.slot(seq)
+
+		length ^= uint16(s.len)
+		pt ^= s.pt
+		ts ^= s.ts
+
+		for j := 0; j < s.len; j++ {
+			buf[j] ^= s.buf[j]
+		}
+	}
+
+	if int(length) > MAX_PACKET {
+		r.Errors++
+		return
+	}
+
+	s := r.slot(lost)
+	s.valid = true
+	s.seen = true
+	s.seq = lost
+	s.ts = ts
+	s.pt = pt & PAYLOAD_TYPE_MASK
+	s.len = copy(s.buf[:], buf[:length])
+	s.arrival = r.lastArrival
+
+	r.history[lost%WINDOW_SIZE] = seenSeq{valid: true, seq: lost}
+
+	r.FecRecovered++
+
+	if seqDiff(lost, r.highest) > 0 {
+		r.highest = lost
+	}
+}
@@ -0,0 +1,130 @@
+package rtp
+
+import (
+	"errors"
+)
+
+const (
+	RTP_VERSION       = 2
+	HEADER_LENGTH     = 12
+	CSRC_LENGTH       = 4
+	EXTENSION_LENGTH  = 4
+	PAYLOAD_TYPE_MP2T = 33
+	CLOCK_RATE_MP2T   = 90000
+
+	VERSION_SHIFT     = 6
+	PADDING_MASK      = 0x20
+	EXTENSION_MASK    = 0x10
+	CSRC_COUNT_MASK   = 0x0f
+	MARKER_MASK       = 0x80
+	PAYLOAD_TYPE_MASK = 0x7f
+)
+
+var (
+	ErrShortPacket = errors.New("rtp: packet too short")
+	ErrBadVersion  = errors.New("rtp: bad version")
+	ErrBadPadding  = errors.New("rtp: bad padding")
+)
+
+type Header struct {
+	Padding        bool
+	Extension      bool
+	CsrcCount      uint
+	Marker         bool
+	PayloadType    uint8
+	SequenceNumber uint16
+	Timestamp      uint32
+	Ssrc           uint32
+}
+
+// IsRtp reports whether a datagram looks like RTP rather than raw MPEG-TS,
+// whose sync byte can never carry RTP version 2.
+func IsRtp(buf []byte) bool {
+	return len(buf) >= HEADER_LENGTH && (buf[0]>>VERSION_SHIFT) == RTP_VERSION
+}
+
+// Parse decodes the fixed header and returns the payload with any CSRC list,
+// header extension and padding removed.
+func Parse(buf []byte, hdr *Header) ([]byte, error) {
+	n := len(buf)
+
+	if n < HEADER_LENGTH {
+		return nil, ErrShortPacket
+	}
+
+	b0 := buf[0]
+	b1 := buf[1]
+
+	if (b0 >> VERSION_SHIFT) != RTP_VERSION {
+		return nil, ErrBadVersion
+	}
+
+	hdr.Padding = (b0 & PADDING_MASK) != 0
+	hdr.Extension = (b0 & EXTENSION_MASK) != 0
+	hdr.CsrcCount = uint(b0 & CSRC_COUNT_MASK)
+	hdr.Marker = (b1 & MARKER_MASK) != 0
+	hdr.PayloadType = b1 & PAYLOAD_TYPE_MASK
+	hdr.SequenceNumber = (uint16(buf[2]) << 8) | uint16(buf[3])
+	hdr.Timestamp = (uint32(buf[4]) << 24) | (uint32(buf[5]) << 16) | (uint32(buf[6]) << 8) | uint32(buf[7])
+	hdr.Ssrc = (uint32(buf[8]) << 24) | (uint32(buf[9]) << 16) | (uint32(buf[10]) << 8) | uint32(buf[11])
+
+	offs := HEADER_LENGTH + int(hdr.CsrcCount)*CSRC_LENGTH
+	if offs > n {
+		return nil, ErrShortPacket
+	}
+
+	if hdr.Extension {
+		if offs+EXTENSION_LENGTH > n {
+			return nil, ErrShortPacket
+		}
+
+		words := (int(buf[offs+2]) << 8) | int(buf[offs+3])
+		offs += EXTENSION_LENGTH + 4*words
+
+		if offs > n {
+			return nil, ErrShortPacket
+		}
+	}
+
+	end := n
+
+	if hdr.Padding {
+		pad := int(buf[n-1])
+		if pad == 0 || offs+pad > n {
+			return nil, ErrBadPadding
+		}
+
+		end -= pad
+	}
+
+	return buf[offs:end], nil
+}
+
+// Marshal writes the fixed header, without CSRCs or extension, to the start of
+// buf and returns the number of bytes written.
+func (hdr *Header) Marshal(buf []byte) int {
+	b0 := byte(RTP_VERSION << VERSION_SHIFT)
+	if hdr.Padding {
+		b0 |= PADDING_MASK
+	}
+
+	b1 := hdr.PayloadType & PAYLOAD_TYPE_MASK
+	if hdr.Marker {
+		b1 |= MARKER_MASK
+	}
+
+	buf[0] = b0
+	buf[1] = b1
+	buf[2] = byte(hdr.SequenceNumber >> 8)
+	buf[3] = byte(hdr.SequenceNumber)
+	buf[4] = byte(hdr.Timestamp >> 24)
+	buf[5] = byte(hdr.Timestamp >> 16)
+	buf[6] = byte(hdr.Timestamp >> 8)
+	buf[7] = byte(hdr.Timestamp)
+	buf[8] = byte(hdr.Ssrc >> 24)
+	buf[9] = byte(hdr.Ssrc >> 16)
+	buf[10] = byte(hdr.Ssrc >> 8)
+	buf[11] = byte(hdr.Ssrc)
+
+	return HEADER_LENGTH
+}
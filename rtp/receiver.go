@@ -0,0 +1,289 @@
+package rtp
+
+import (
+	"time"
+)
+
+const (
+	WINDOW_SIZE    = 1024
+	MAX_PACKET     = 2048
+	JITTER_DIVISOR = 16
+
+	DEFAULT_REORDER_DEPTH = 32
+
+	// How long packets wait behind a gap when the depth is not reached, as
+	// when the sender pauses
+	DEFAULT_REORDER_HOLD = 200 * time.Millisecond
+)
+
+type Stats struct {
+	Received   uint64  `json:"received"`
+	Lost       uint64  `json:"lost"`
+	Reordered  uint64  `json:"reordered"`
+	Duplicates uint64  `json:"duplicates"`
+	Late       uint64  `json:"late"`
+	Resyncs    uint64  `json:"resyncs"`
+	Errors     uint64  `json:"errors"`
+	JitterMs   float64 `json:"jitter_ms"`
+
+	FecPackets       uint64 `json:"fec_packets,omitempty"`
+	FecRecovered     uint64 `json:"fec_recovered,omitempty"`
+	FecUnrecoverable uint64 `json:"fec_unrecoverable,omitempty"`
+
+	PayloadType uint8  `json:"payload_type"`
+	Ssrc        uint32 `json:"ssrc"`
+}
+
+type slot struct {
+	valid   bool
+	seen    bool
+	seq     uint16
+	ts      uint32
+	pt      uint8
+	len     int
+	arrival time.Time
+	buf     [MAX_PACKET]byte
+}
+
+type seenSeq struct {
+	valid bool
+	seq   uint16
+}
+
+// Receiver restores sequence order to an RTP stream. Packets are held for up
+// to Depth sequence numbers or for Hold while waiting for a gap to be filled,
+// after which the missing packets are counted as lost.
+type Receiver struct {
+	Depth     int
+	Hold      time.Duration
+	ClockRate int
+
+	Stats
+
+	// Packets held and recently delivered, kept for FEC recovery. A power
+	// of two of at least twice Depth, so that the index survives wrapping.
+	slots []slot
+
+	// Sequence numbers received, telling duplicates from late packets
+	history [WINDOW_SIZE]seenSeq
+
+	started bool
+	next    uint16
+	highest uint16
+
+	// Packets that arrived before this have waited long enough
+	releaseBefore time.Time
+	lastArrival   time.Time
+
+	fec []*fecPacket
+
+	haveTransit bool
+	transit     int64
+	jitter      float64
+	epoch       time.Time
+}
+
+func NewReceiver(depth int) *Receiver {
+	if depth <= 0 || depth >= WINDOW_SIZE {
+		depth = DEFAULT_REORDER_DEPTH
+	}
+
+	size := 1
+	for size < 2*depth {
+		size *= 2
+	}
+
+	return &Receiver{
+		Depth:     depth,
+		Hold:      DEFAULT_REORDER_HOLD,
+		ClockRate: CLOCK_RATE_MP2T,
+		slots:     make([]slot, size),
+		epoch:     time.Now(),
+	}
+}
+
+func seqDiff(a, b uint16) int {
+	return int(int16(a - b))
+}
+
+func (r *Receiver) slot(seq uint16) *slot {
+	return &r.slots[int(seq)%len(r.slots)]
+}
+
+func (r *Receiver) received(seq uint16) bool {
+	h := &r.history[seq%WINDOW_SIZE]
+
+	return h.valid && h.seq == seq
+}
+
+func (r *Receiver) reset(seq uint16) {
+	for i := range r.slots {
+		r.slots[i].valid = false
+		r.slots[i].seen = false
+	}
+
+	for i := range r.history {
+		r.history[i].valid = false
+	}
+
+	r.fec = nil
+
+	r.next = seq
+	r.highest = seq
+	r.started = true
+}
+
+func (r *Receiver) updateJitter(ts uint32, arrival time.Time) {
+	now := int64(arrival.Sub(r.epoch)) * int64(r.ClockRate) / int64(time.Second)
+	transit := now - int64(ts)
+
+	if r.haveTransit {
+		d := transit - r.transit
+		if d < 0 {
+			d = -d
+		}
+
+		// Ignore timestamp discontinuities
+		if d < int64(r.ClockRate) {
+			r.jitter += (float64(d) - r.jitter) / JITTER_DIVISOR
+		}
+	}
+
+	r.transit = transit
+	r.haveTransit = true
+	r.JitterMs = r.jitter * 1000 / float64(r.ClockRate)
+}
+
+// Push stores a copy of a received packet's payload. It returns false if the
+// packet was discarded as a duplicate or as arriving too late.
+func (r *Receiver) Push(hdr *Header, payload []byte, arrival time.Time) bool {
+	seq := hdr.SequenceNumber
+
+	if len(payload) > MAX_PACKET {
+		r.Errors++
+		return false
+	}
+
+	if !r.started || (hdr.Ssrc != r.Ssrc && r.Received > 0) {
+		if r.started {
+			r.Resyncs++
+		}
+
+		r.reset(seq)
+		r.haveTransit = false
+	}
+
+	r.Ssrc = hdr.Ssrc
+	r.PayloadType = hdr.PayloadType
+
+	d := seqDiff(seq, r.next)
+
+	if d < 0 {
+		if -d < WINDOW_SIZE/2 {
+			if r.received(seq) {
+				r.Duplicates++
+			} else {
+				r.Late++
+			}
+
+			return false
+		}
+
+		r.Resyncs++
+		r.reset(seq)
+		d = 0
+	} else if d >= WINDOW_SIZE-r.Depth {
+		r.Resyncs++
+		r.reset(seq)
+		d = 0
+	} else if d >= len(r.slots) {
+		// A gap too long to hold on to what came before it, which goes
+		// with the gap
+		r.Lost += uint64(d)
+		r.reset(seq)
+		d = 0
+	}
+
+	if r.received(seq) {
+		r.Duplicates++
+		return false
+	}
+
+	r.history[seq%WINDOW_SIZE] = seenSeq{valid: true, seq: seq}
+
+	s := r.slot(seq)
+	s.valid = true
+	s.seen = true
+	s.seq = seq
+	s.ts = hdr.Timestamp
+	s.pt = hdr.PayloadType
+	s.len = copy(s.buf[:], payload)
+	s.arrival = arrival
+
+	r.Received++
+	r.lastArrival = arrival
+	r.releaseBefore = arrival.Add(-r.Hold)
+
+	if seqDiff(seq, r.highest) > 0 {
+		r.highest = seq
+	} else if seq != r.highest {
+		r.Reordered++
+	}
+
+	r.updateJitter(hdr.Timestamp, arrival)
+
+	if len(r.fec) > 0 {
+		for r.recoverPending() {
+		}
+	}
+
+	return true
+}
+
+// Expire lets go of packets held behind a gap for longer than Hold, for when
+// no more packets arrive to push them out. Pop then returns them.
+func (r *Receiver) Expire(now time.Time) {
+	r.releaseBefore = now.Add(-r.Hold)
+}
+
+// overdue says whether the first packet held behind the gap at next has
+// waited long enough.
+func (r *Receiver) overdue() bool {
+	for seq := r.next + 1; seqDiff(r.highest, seq) >= 0; seq++ {
+		if s := r.slot(seq); s.valid && s.seq == seq {
+			return s.arrival.Before(r.releaseBefore)
+		}
+	}
+
+	return false
+}
+
+// Pop returns the next payload in sequence order, if one is ready. The
+// returned slice is valid until its slot is reused, at least Depth further
+// packets later.
+func (r *Receiver) Pop() (uint16, []byte, bool) {
+	for r.started {
+		s := r.slot(r.next)
+
+		if s.valid && s.seq == r.next {
+			seq := r.next
+			s.valid = false
+			r.next++
+
+			return seq, s.buf[:s.len], true
+		}
+
+		if seqDiff(r.highest, r.next) < r.Depth && !r.overdue() {
+			break
+		}
+
+		r.Lost++
+		if r.covered(r.next) {
+			r.FecUnrecoverable++
+		}
+
+		r.next++
+	}
+
+	return 0, nil, false
+}
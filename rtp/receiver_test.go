@@ -0,0 +1,261 @@
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func makePacket(seq uint16, csrcs int, ext bool, payload []byte) []byte {
+	buf := []byte{0x80 | byte(csrcs), PAYLOAD_TYPE_MP2T, byte(seq >> 8), byte(seq), 0, 0, 0, 0, 0, 0, 0, 1}
+
+	for i := 0; i < csrcs; i++ {
+		buf = append(buf, 0, 0, 0, byte(i))
+	}
+
+	if ext {
+		buf[0] |= EXTENSION_MASK
+		buf = append(buf, 0xbe, 0xde, 0, 1, 1, 2, 3, 4)
+	}
+
+	return append(buf, payload...)
+}
+
+func Test_Rtp_Parse(t *testing.T) {
+	var hdr Header
+
+	payload, err := Parse(makePacket(1234, 2, true, []byte{0x47, 1, 2}), &hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.SequenceNumber != 1234 || hdr.PayloadType != PAYLOAD_TYPE_MP2T || hdr.CsrcCount != 2 {
+		t.Errorf("Bad header %+v", hdr)
+	}
+
+	if len(payload) != 3 || payload[0] != 0x47 {
+		t.Errorf("Bad payload %v", payload)
+	}
+}
+
+func Test_Rtp_MarshalRoundtrip(t *testing.T) {
+	in := Header{
+		Marker:         true,
+		PayloadType:    PAYLOAD_TYPE_MP2T,
+		SequenceNumber: 0xbeef,
+		Timestamp:      0x12345678,
+		Ssrc:           0xcafef00d,
+	}
+
+	buf := make([]byte, HEADER_LENGTH+3)
+	copy(buf[in.Marshal(buf):], []byte{0x47, 1, 2})
+
+	var out Header
+
+	payload, err := Parse(buf, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out != in {
+		t.Errorf("Got %+v, expected %+v", out, in)
+	}
+
+	if len(payload) != 3 || payload[0] != 0x47 {
+		t.Errorf("Bad payload %v", payload)
+	}
+}
+
+func Test_Rtp_Reorder(t *testing.T) {
+	r := NewReceiver(4)
+	now := time.Now()
+
+	var out []uint16
+
+	for _, seq := range []uint16{65534, 0, 65535, 1, 1, 3, 4, 5, 6, 7, 8} {
+		var hdr Header
+
+		payload, _ := Parse(makePacket(seq, 0, false, []byte{byte(seq)}), &hdr)
+		r.Push(&hdr, payload, now)
+
+		for {
+			seq, payload, ok := r.Pop()
+			if !ok {
+				break
+			}
+
+			if payload[0] != byte(seq) {
+				t.Errorf("Payload mismatch for %d", seq)
+			}
+
+			out = append(out, seq)
+		}
+	}
+
+	expected := []uint16{65534, 65535, 0, 1, 3, 4, 5, 6, 7, 8}
+	if len(out) != len(expected) {
+		t.Fatalf("Got %v, expected %v", out, expected)
+	}
+
+	for i := range out {
+		if out[i] != expected[i] {
+			t.Fatalf("Got %v, expected %v", out, expected)
+		}
+	}
+
+	if r.Lost != 1 || r.Duplicates != 1 || r.Reordered != 1 {
+		t.Errorf("Bad stats %+v", r.Stats)
+	}
+}
+
+func Test_Rtp_FecRecovery(t *testing.T) {
+	r := NewReceiver(FEC_REORDER_DEPTH)
+	now := time.Now()
+
+	const L = 4
+
+	var fec [FEC_HEADER_LENGTH + 8]byte
+	fec[12] = 0x40 // row FEC
+	fec[13] = 1
+	fec[14] = L
+
+	var out []uint16
+
+	for seq := uint16(0); seq < L; seq++ {
+		payload := []byte{byte(seq), byte(seq * 3), 0x47}
+
+		fec[3] ^= byte(len(payload))
+		fec[4] ^= PAYLOAD_TYPE_MP2T
+		for i, b := range payload {
+			fec[FEC_HEADER_LENGTH+i] ^= b
+		}
+
+		if seq == 2 {
+			continue
+		}
+
+		var hdr Header
+		buf, _ := Parse(makePacket(seq, 0, false, payload), &hdr)
+		r.Push(&hdr, buf, now)
+	}
+
+	var hdr FecHeader
+	payload, err := ParseFec(fec[:], &hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.PushFec(&hdr, payload)
+
+	for {
+		seq, payload, ok := r.Pop()
+		if !ok {
+			break
+		}
+
+		if len(payload) != 3 || payload[0] != byte(seq) || payload[1] != byte(seq*3) {
+			t.Errorf("Bad payload %v for %d", payload, seq)
+		}
+
+		out = append(out, seq)
+	}
+
+	if len(out) != L || r.FecRecovered != 1 || r.Lost != 0 {
+		t.Errorf("Got %v, stats %+v", out, r.Stats)
+	}
+}
+
+func Test_Rtp_FecUnrecoverable(t *testing.T) {
+	r := NewReceiver(4)
+	now := time.Now()
+
+	push := func(seq uint16) {
+		var hdr Header
+		payload, _ := Parse(makePacket(seq, 0, false, []byte{byte(seq), 0x47}), &hdr)
+		r.Push(&hdr, payload, now)
+
+		for {
+			if _, _, ok := r.Pop(); !ok {
+				break
+			}
+		}
+	}
+
+	// A row over 0-3 which is missing two of them
+	var fec [FEC_HEADER_LENGTH + 2]byte
+	fec[12] = 0x40
+	fec[13] = 1
+	fec[14] = 4
+
+	var hdr FecHeader
+	payload, err := ParseFec(fec[:], &hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	push(0)
+	push(3)
+	r.PushFec(&hdr, payload)
+
+	// And 8 lost with no FEC over it
+	for _, seq := range []uint16{4, 5, 6, 7, 9, 10, 11, 12, 13} {
+		push(seq)
+	}
+
+	if r.Lost != 3 || r.FecUnrecoverable != 2 {
+		t.Errorf("Bad stats %+v", r.Stats)
+	}
+}
+
+func Test_Rtp_Hold(t *testing.T) {
+	r := NewReceiver(DEFAULT_REORDER_DEPTH)
+	now := time.Now()
+
+	if len(r.slots) != 2*DEFAULT_REORDER_DEPTH {
+		t.Errorf("%d slots for a depth of %d", len(r.slots), r.Depth)
+	}
+
+	var out []uint16
+
+	pop := func() {
+		for {
+			seq, _, ok := r.Pop()
+			if !ok {
+				break
+			}
+
+			out = append(out, seq)
+		}
+	}
+
+	// The sender pauses after a gap, short of the depth
+	for _, seq := range []uint16{10, 12, 13} {
+		var hdr Header
+		payload, _ := Parse(makePacket(seq, 0, false, []byte{0x47}), &hdr)
+		r.Push(&hdr, payload, now)
+		pop()
+	}
+
+	r.Expire(now.Add(r.Hold / 2))
+	pop()
+
+	if len(out) != 1 {
+		t.Fatalf("Released %v before the hold time", out)
+	}
+
+	r.Expire(now.Add(r.Hold + time.Millisecond))
+	pop()
+
+	if len(out) != 3 || out[1] != 12 || out[2] != 13 || r.Lost != 1 {
+		t.Errorf("Got %v, stats %+v", out, r.Stats)
+	}
+
+	// A gap longer than the slots go with the gap
+	var hdr Header
+	payload, _ := Parse(makePacket(14+uint16(len(r.slots)), 0, false, []byte{0x47}), &hdr)
+	r.Push(&hdr, payload, now)
+	pop()
+
+	if len(out) != 4 || r.Lost != 1+uint64(len(r.slots)) || r.Resyncs != 0 {
+		t.Errorf("Got %v, stats %+v", out, r.Stats)
+	}
+}
@@ -0,0 +1,432 @@
+package recstation
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"recstation/hbproto"
+	"recstation/mpeg"
+	"recstation/rtp"
+	"recstation/synth"
+)
+
+const (
+	SIMULATE_DEFAULT_SOURCE_PORT    = 5004
+	SIMULATE_DEFAULT_HEARTBEAT_PORT = 6000
+)
+
+// SimulatedEncoder stands in for a hardware encoder: it sends heartbeats to
+// the heartbeat port of its group and a synthetic stream to the source port,
+// and to the secondary group as well for 2022-7 streams. With a key it acts
+// on the control datagrams that come back to its heartbeat socket and signs
+// its heartbeats.
+type SimulatedEncoder struct {
+	Id        uint16
+	Name      string
+	Group     net.IP
+	Secondary net.IP
+	Rtp       bool
+	Key       []byte
+
+	// Keys by encoder ID, taking the place of the key once the ID is known
+	EncoderKeys map[uint16][]byte
+
+	heartbeat     *net.UDPConn
+	heartbeatAddr *net.UDPAddr
+	sources       []*net.UDPConn
+
+	// Set by control datagrams
+	mutex     sync.Mutex
+	stopped   bool
+	tally     uint8
+	haveSeq   bool
+	ackSeq    uint32
+	ackStatus uint8
+}
+
+type simulateOptions struct {
+	iface         *net.Interface
+	ttl           int
+	sourcePort    int
+	heartbeatPort int
+	interval      time.Duration
+}
+
+func dialSimulated(group net.IP, port int, opts *simulateOptions) (*net.UDPConn, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: group, Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setRelayOptions(conn, group, opts.iface, opts.ttl, 0); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (enc *SimulatedEncoder) Dial(opts *simulateOptions) error {
+	network := "udp4"
+	if isIPv6(enc.Group) {
+		network = "udp6"
+	}
+
+	// Unconnected, so that control datagrams from recstation get through
+	var err error
+
+	enc.heartbeat, err = net.ListenUDP(network, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := setRelayOptions(enc.heartbeat, enc.Group, opts.iface, opts.ttl, 0); err != nil {
+		return err
+	}
+
+	enc.heartbeatAddr = &net.UDPAddr{IP: enc.Group, Port: opts.heartbeatPort}
+
+	for _, group := range []net.IP{enc.Group, enc.Secondary} {
+		if group == nil {
+			continue
+		}
+
+		conn, err := dialSimulated(group, opts.sourcePort, opts)
+		if err != nil {
+			return err
+		}
+
+		enc.sources = append(enc.sources, conn)
+	}
+
+	return nil
+}
+
+func (enc *SimulatedEncoder) HeartbeatLoop(interval time.Duration) {
+	start := time.Now()
+	tick := time.NewTicker(interval)
+	var lastErr string
+
+	hb := hbproto.Heartbeat{
+		EncoderId: enc.Id,
+	}
+
+	for {
+		hb.Uptime = uint32(time.Since(start) / time.Second)
+
+		enc.mutex.Lock()
+		hb.Flags = hbproto.FLAG_AUDIO
+		if !enc.stopped {
+			hb.Flags |= hbproto.FLAG_STREAMING
+		}
+		hb.Tally = enc.tally
+		hb.AckSequence = enc.ackSeq
+		hb.AckStatus = enc.ackStatus
+		enc.mutex.Unlock()
+
+		buf := hb.Encode(nil)
+		if len(enc.Key) > 0 {
+			hb.Timestamp = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+			buf = hb.EncodeSigned(nil, enc.Key)
+		}
+
+		_, err := enc.heartbeat.WriteToUDP(buf, enc.heartbeatAddr)
+		lastErr = logSimulateError(enc.Name, "Heartbeat", err, lastErr)
+
+		hb.Sequence++
+
+		<-tick.C
+	}
+}
+
+// ControlLoop acts on control datagrams. Every picture is a keyframe and the
+// bitrate is what it is, so those two are acknowledged but change nothing.
+func (enc *SimulatedEncoder) ControlLoop() {
+	buf := make([]byte, 2048)
+
+	for {
+		n, src, err := enc.heartbeat.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("Control for %s failed: %s", enc.Name, err)
+			return
+		}
+
+		var ctl hbproto.Control
+
+		if err := hbproto.DecodeControl(buf[:n], enc.Key, &ctl); err != nil {
+			log.Printf("Control for %s from %s: %s", enc.Name, src, err)
+			continue
+		}
+
+		enc.mutex.Lock()
+
+		// Repeats of the last command, or replays of older ones
+		if ctl.EncoderId != enc.Id || (enc.haveSeq && int32(ctl.Sequence-enc.ackSeq) <= 0) {
+			enc.mutex.Unlock()
+			continue
+		}
+
+		log.Printf("Control for %s: %s %d", enc.Name, ctl.Name(), ctl.Argument)
+
+		enc.haveSeq = true
+		enc.ackSeq = ctl.Sequence
+		enc.ackStatus = hbproto.ACK_OK
+
+		switch ctl.Command {
+		case hbproto.COMMAND_START:
+			enc.stopped = false
+
+		case hbproto.COMMAND_STOP:
+			enc.stopped = true
+
+		case hbproto.COMMAND_TALLY:
+			enc.tally = uint8(ctl.Argument)
+
+		case hbproto.COMMAND_KEYFRAME, hbproto.COMMAND_BITRATE:
+
+		default:
+			enc.ackStatus = hbproto.ACK_UNSUPPORTED
+		}
+
+		enc.mutex.Unlock()
+	}
+}
+
+func (enc *SimulatedEncoder) Stopped() bool {
+	enc.mutex.Lock()
+	defer enc.mutex.Unlock()
+
+	return enc.stopped
+}
+
+// logSimulateError logs errors that differ from the last one. Unicast sends
+// to a closed port fail every other write with the ICMP error of the one
+// before, so an error going away is not worth a message either.
+func logSimulateError(name, what string, err error, lastErr string) string {
+	if err == nil || err.Error() == lastErr {
+		return lastErr
+	}
+
+	log.Printf("%s for %s failed: %s", what, name, err)
+
+	return err.Error()
+}
+
+// StreamLoop sends the stream in real time, spreading the datagrams of each
+// frame evenly over the frame.
+func (enc *SimulatedEncoder) StreamLoop() {
+	stream := synth.NewStream(enc.Id)
+	var lastErr string
+
+	hdr := rtp.Header{
+		PayloadType:    rtp.PAYLOAD_TYPE_MP2T,
+		SequenceNumber: uint16(rand.Uint32()),
+		Ssrc:           rand.Uint32(),
+	}
+
+	buf := make([]byte, 0, rtp.HEADER_LENGTH+RELAY_TS_PER_DATAGRAM*mpeg.TS_PACKET_LENGTH)
+	start := time.Now()
+
+	for frame := 0; ; frame++ {
+		pkts := stream.Frame()
+		due := start.Add(time.Duration(frame) * synth.FRAME_DURATION)
+		datagrams := (len(pkts) + RELAY_TS_PER_DATAGRAM - 1) / RELAY_TS_PER_DATAGRAM
+
+		hdr.Timestamp = uint32(frame * rtp.CLOCK_RATE_MP2T / synth.FRAME_RATE)
+
+		for i := 0; i < datagrams; i++ {
+			time.Sleep(time.Until(due.Add(synth.FRAME_DURATION * time.Duration(i) / time.Duration(datagrams))))
+
+			buf = buf[:0]
+			if enc.Rtp {
+				hdr.SequenceNumber++
+				buf = buf[:hdr.Marshal(buf[:rtp.HEADER_LENGTH])]
+			}
+
+			end := (i + 1) * RELAY_TS_PER_DATAGRAM
+			if end > len(pkts) {
+				end = len(pkts)
+			}
+
+			for _, pkt := range pkts[i*RELAY_TS_PER_DATAGRAM : end] {
+				buf = append(buf, pkt...)
+			}
+
+			if enc.Stopped() {
+				continue
+			}
+
+			for _, conn := range enc.sources {
+				_, err := conn.Write(buf)
+				lastErr = logSimulateError(enc.Name, "Stream", err, lastErr)
+			}
+		}
+	}
+}
+
+func listenPort(addr string, def int) (int, error) {
+	if addr == "" {
+		return def, nil
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(port)
+}
+
+func simulatedFromConfig(filename string, opts *simulateOptions) ([]*SimulatedEncoder, error) {
+	var cfg ConfigJson
+
+	if err := cfg.OpenJson(filename); err != nil {
+		return nil, err
+	}
+
+	var err error
+
+	opts.sourcePort, err = listenPort(cfg.SourceListen, opts.sourcePort)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.heartbeatPort, err = listenPort(cfg.HeartbeatListen, opts.heartbeatPort)
+	if err != nil {
+		return nil, err
+	}
+
+	var encs []*SimulatedEncoder
+
+	for multicast, name := range cfg.Multicast2Name {
+		enc := &SimulatedEncoder{
+			Name:  name,
+			Group: net.ParseIP(multicast),
+		}
+
+		if enc.Group == nil {
+			return nil, fmt.Errorf("Bad group '%s' for %s", multicast, name)
+		}
+
+		if sc, ok := cfg.Streams[name]; ok {
+			enc.Rtp = sc.Rtp == RTP_MODE_ON
+			enc.Secondary = net.ParseIP(sc.Secondary)
+
+			enc.Key, err = hex.DecodeString(sc.Key)
+			if err != nil {
+				return nil, fmt.Errorf("Bad key for %s: %s", name, err)
+			}
+
+			enc.EncoderKeys, err = parseEncoderKeys(name, sc.EncoderKeys)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		encs = append(encs, enc)
+	}
+
+	// Keep the encoder IDs the same from run to run
+	sort.Slice(encs, func(i, j int) bool {
+		return encs[i].Name < encs[j].Name
+	})
+
+	return encs, nil
+}
+
+// RunSimulate is the simulate subcommand, which runs fake encoders for the
+// groups of a config file or for groups given on the command line.
+func RunSimulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	configFilename := flags.String("config", "", "Config filename to take groups and ports from")
+	groups := flags.String("groups", "", "Comma separated groups to send to")
+	ifaceName := flags.String("iface", "", "Interface to send multicast on, e.g. lo")
+	ttl := flags.Int("ttl", 1, "Multicast TTL")
+	useRtp := flags.Bool("rtp", false, "Send the streams as RTP")
+	sourcePort := flags.Int("source-port", SIMULATE_DEFAULT_SOURCE_PORT, "Port to send the streams to")
+	heartbeatPort := flags.Int("heartbeat-port", SIMULATE_DEFAULT_HEARTBEAT_PORT, "Port to send heartbeats to")
+	interval := flags.Duration("interval", time.Second, "Heartbeat interval")
+
+	flags.Parse(args)
+
+	opts := &simulateOptions{
+		ttl:           *ttl,
+		sourcePort:    *sourcePort,
+		heartbeatPort: *heartbeatPort,
+		interval:      *interval,
+	}
+
+	if *ifaceName != "" {
+		iface, err := net.InterfaceByName(*ifaceName)
+		if err != nil {
+			panic(err)
+		}
+
+		opts.iface = iface
+	}
+
+	var encs []*SimulatedEncoder
+
+	if *configFilename != "" {
+		var err error
+
+		encs, err = simulatedFromConfig(*configFilename, opts)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *groups != "" {
+		for _, g := range strings.Split(*groups, ",") {
+			group := net.ParseIP(strings.TrimSpace(g))
+			if group == nil {
+				panic(fmt.Errorf("Bad group '%s'", g))
+			}
+
+			encs = append(encs, &SimulatedEncoder{
+				Name:  group.String(),
+				Group: group,
+			})
+		}
+	}
+
+	if len(encs) == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to simulate, give -config or -groups")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	for i, enc := range encs {
+		enc.Id = uint16(i + 1)
+		enc.Rtp = enc.Rtp || *useRtp
+
+		if key, found := enc.EncoderKeys[enc.Id]; found {
+			enc.Key = key
+		}
+
+		if err := enc.Dial(opts); err != nil {
+			panic(err)
+		}
+
+		log.Printf("Simulating encoder %d for %s on %s", enc.Id, enc.Name, enc.Group)
+
+		go enc.HeartbeatLoop(opts.interval)
+		go enc.StreamLoop()
+
+		if len(enc.Key) > 0 {
+			go enc.ControlLoop()
+		}
+	}
+
+	select {}
+}
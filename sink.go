@@ -4,9 +4,12 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
+	"recstation/mp4"
 	"recstation/mpeg"
+	"recstation/rtp"
 
 	"github.com/google/vectorio"
 )
@@ -22,8 +25,12 @@ type Sink struct {
 	File     *os.File
 	Filename string
 	Namer    func(start bool) string
+	Output   OutputConfigJson
+
+	Mp4 *mp4.Remuxer
 
 	Preview *Preview
+	Relays  []*Relay
 
 	StopRequest     chan bool
 	OfflineRequest  chan bool
@@ -31,6 +38,9 @@ type Sink struct {
 	Packets         chan []mpeg.TsBuffer
 	rawWrites       chan sinkRawWrite
 	StatusRequest   chan chan *SinkStatusMessage
+
+	// Closed once the sink has finished its files and stopped its preview
+	Closed chan bool
 }
 
 type SinkStatusMessage struct {
@@ -40,6 +50,15 @@ type SinkStatusMessage struct {
 	BytesInPerSecond  uint64 `json:"bytes_in_per_second"`
 	BytesOut          uint64 `json:"bytes_out"`
 	BytesOutPerSecond uint64 `json:"bytes_out_per_second"`
+
+	Rtp     *rtp.Stats                 `json:"rtp,omitempty"`
+	Paths   []*UdpPathStatusMessage    `json:"paths,omitempty"`
+	Foreign *SourceFilterStatusMessage `json:"foreign,omitempty"`
+	Relays  []*RelayStatusMessage      `json:"relays,omitempty"`
+	Arrival *ArrivalStatusMessage      `json:"arrival,omitempty"`
+
+	Encoders     []*HeartbeatNodeStatusMessage `json:"encoders,omitempty"`
+	Availability *AvailabilityStatusMessage    `json:"availability,omitempty"`
 }
 
 type SinkStatusMessage_ByName []*SinkStatusMessage
@@ -53,16 +72,18 @@ type sinkRawWrite struct {
 	Done chan bool
 }
 
-func MakeSink(name string, namer func(start bool) string) *Sink {
+func MakeSink(name string, namer func(start bool) string, output OutputConfigJson) *Sink {
 	sink := &Sink{
 		Name:            name,
 		Namer:           namer,
+		Output:          output,
 		StopRequest:     make(chan bool),
 		OfflineRequest:  make(chan bool),
 		OpenFileRequest: make(chan bool),
 		Packets:         make(chan []mpeg.TsBuffer),
 		rawWrites:       make(chan sinkRawWrite),
 		StatusRequest:   make(chan chan *SinkStatusMessage),
+		Closed:          make(chan bool),
 	}
 
 	go sink.Runloop()
@@ -70,6 +91,41 @@ func MakeSink(name string, namer func(start bool) string) *Sink {
 	return sink
 }
 
+// WritePackets hands TS packets to the sink and its preview. The packets must
+// not be touched until the next call.
+func (sink *Sink) WritePackets(pkts []mpeg.TsBuffer) {
+	sink.Packets <- pkts
+
+	for _, relay := range sink.Relays {
+		relay.Write(pkts)
+	}
+
+	if sink.Preview != nil && sink.Preview.Input != nil {
+		var multiple [NUM_TS_PER_PACKET][]byte
+
+		npkts := len(pkts)
+		nbytes := 0
+		for i, pkt := range pkts {
+			multiple[i] = pkt[:mpeg.TS_PACKET_LENGTH]
+			nbytes += len(multiple[i])
+
+			if multiple[i][0] != 'G' {
+				log.Printf("bad TS preview")
+			}
+		}
+
+		n, err := vectorio.Writev(sink.Preview.Input, multiple[:npkts])
+		if err != nil {
+			log.Printf("Failed to write into preview (%d bytes): %s", n, err)
+			sink.Preview.Input = nil
+		}
+
+		if n != nbytes {
+			log.Printf("Bad number of preview bytes: %d vs %d", n, nbytes)
+		}
+	}
+}
+
 func (sink *Sink) RawWrite(buf []byte, done chan bool) {
 	sink.rawWrites <- sinkRawWrite{
 		Buf:  buf,
@@ -90,23 +146,61 @@ func ensureExists(path string) error {
 	return nil
 }
 
-func (sink *Sink) closeFile() bool {
-	if sink.File == nil {
-		return false
-	}
-
-	log.Printf("Closing %s file %s", sink.Name, sink.Filename)
+func closeOutputFile(name string, f *os.File) error {
+	log.Printf("Closing %s file %s", name, f.Name())
 
-	sink.File.Close()
-	sink.File = nil
+	err := f.Close()
 
-	fi, err := os.Stat(sink.Filename)
-	if err == nil {
+	fi, statErr := os.Stat(f.Name())
+	if statErr == nil {
 		if fi.Size() == 0 {
-			os.Remove(sink.Filename)
+			os.Remove(f.Name())
 		}
 	}
 
+	return err
+}
+
+func createOutputFile(name, filename string) (*os.File, error) {
+	log.Printf("Opening %s file %s", name, filename)
+
+	dirname := path.Dir(filename)
+	if err := ensureExists(dirname); err != nil {
+		log.Printf("Unable to create directory %s: %s", dirname, err)
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Print("Unable to open: ", err)
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// mp4OutputFile lets the remuxer close each MP4 file itself once it has been
+// completed, which may be some time after the sink has moved on.
+type mp4OutputFile struct {
+	*os.File
+	sinkName string
+}
+
+func (f *mp4OutputFile) Close() error {
+	return closeOutputFile(f.sinkName, f.File)
+}
+
+func mp4Filename(filename string) string {
+	return strings.TrimSuffix(filename, path.Ext(filename)) + ".mp4"
+}
+
+func (sink *Sink) closeFile() bool {
+	if sink.File == nil {
+		return false
+	}
+
+	closeOutputFile(sink.Name, sink.File)
+	sink.File = nil
 	sink.Filename = ""
 
 	return true
@@ -117,26 +211,73 @@ func (sink *Sink) openFile(filename string) (bool, error) {
 		return false, nil
 	}
 
-	log.Printf("Opening %s file %s", sink.Name, filename)
-
-	dirname := path.Dir(filename)
-	if err := ensureExists(dirname); err != nil {
-		log.Printf("Unable to create directory %s: %s", dirname, err)
+	f, err := createOutputFile(sink.Name, filename)
+	if err != nil {
 		return false, err
 	}
 
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	sink.File = f
+	sink.Filename = filename
+
+	return true, nil
+}
+
+func (sink *Sink) closeMp4() bool {
+	if sink.Mp4 == nil {
+		return false
+	}
+
+	if err := sink.Mp4.Close(); err != nil {
+		log.Printf("Error finishing %s MP4 output: %s", sink.Name, err)
+	}
+
+	sink.Mp4 = nil
+
+	return true
+}
+
+// openMp4 starts a new MP4 output file. When one is already being written, the
+// remuxer switches over to the new file at the next keyframe.
+func (sink *Sink) openMp4(filename string) (bool, error) {
+	if filename == "" {
+		return false, nil
+	}
+
+	filename = mp4Filename(filename)
+
+	f, err := createOutputFile(sink.Name, filename)
 	if err != nil {
-		log.Print("Unable to open: ", err)
 		return false, err
 	}
 
-	sink.File = f
-	sink.Filename = filename
+	out := &mp4OutputFile{
+		File:     f,
+		sinkName: sink.Name,
+	}
+
+	if sink.Mp4 == nil {
+		sink.Mp4 = mp4.NewRemuxer(out)
+	} else {
+		sink.Mp4.Switch(out)
+	}
 
 	return true, nil
 }
 
+func (sink *Sink) writeMp4(pkts []mpeg.TsBuffer) {
+	if sink.Mp4 == nil {
+		return
+	}
+
+	for _, pkt := range pkts {
+		if err := sink.Mp4.WritePacket(pkt); err != nil {
+			log.Printf("Error remuxing %s to MP4: %s", sink.Name, err)
+			sink.closeMp4()
+			return
+		}
+	}
+}
+
 func (sink *Sink) Runloop() {
 	online := true
 	multiple := make([][]byte, 10)
@@ -155,6 +296,7 @@ func (sink *Sink) Runloop() {
 		select {
 		case <-sink.StopRequest:
 			sink.closeFile()
+			sink.closeMp4()
 
 			sink.Running = false
 			bytes_out = 0
@@ -165,6 +307,7 @@ func (sink *Sink) Runloop() {
 			log.Printf("Sink '%s' going offline", sink.Name)
 
 			sink.closeFile()
+			sink.closeMp4()
 
 			sink.Running = false
 			bytes_out = 0
@@ -178,13 +321,28 @@ func (sink *Sink) Runloop() {
 			online = false
 
 		case <-sink.OpenFileRequest:
-			start := !sink.closeFile()
+			start := !sink.closeFile() && sink.Mp4 == nil
 
 			filename := sink.Namer(start)
 
-			ok, err := sink.openFile(filename)
-			if err != nil {
-				panic(err)
+			ok := false
+
+			if sink.Output.WantTs() {
+				opened, err := sink.openFile(filename)
+				if err != nil {
+					panic(err)
+				}
+
+				ok = ok || opened
+			}
+
+			if sink.Output.WantMp4() {
+				opened, err := sink.openMp4(filename)
+				if err != nil {
+					panic(err)
+				}
+
+				ok = ok || opened
 			}
 
 			sink.Running = ok
@@ -192,6 +350,16 @@ func (sink *Sink) Runloop() {
 		case msg := <-sink.rawWrites:
 			bytes_in += uint64(len(msg.Buf))
 
+			if sink.Running && sink.Mp4 != nil {
+				var pkts []mpeg.TsBuffer
+
+				for offs := 0; offs+mpeg.TS_PACKET_LENGTH <= len(msg.Buf); offs += mpeg.TS_PACKET_LENGTH {
+					pkts = append(pkts, mpeg.TsBuffer(msg.Buf[offs:offs+mpeg.TS_PACKET_LENGTH]))
+				}
+
+				sink.writeMp4(pkts)
+			}
+
 			if sink.Running && sink.File != nil {
 				n, err := sink.File.Write(msg.Buf)
 
@@ -237,7 +405,13 @@ func (sink *Sink) Runloop() {
 
 			bytes_in += uint64(nbytes)
 
-			if !sink.Running || sink.File == nil {
+			if !sink.Running {
+				continue
+			}
+
+			sink.writeMp4(pkts)
+
+			if sink.File == nil {
 				continue
 			}
 
@@ -275,4 +449,17 @@ func (sink *Sink) Runloop() {
 		sink.File.Close()
 		sink.File = nil
 	}
+
+	sink.closeMp4()
+
+	for _, relay := range sink.Relays {
+		relay.Flush()
+	}
+
+	if sink.Preview != nil {
+		sink.Preview.StopRequest <- true
+		<-sink.Preview.Stopped
+	}
+
+	close(sink.Closed)
 }
@@ -0,0 +1,68 @@
+package recstation
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"recstation/mpeg"
+)
+
+func TestSinkClose(t *testing.T) {
+	filename := path.Join(t.TempDir(), "test.ts")
+
+	sink := MakeSink("test", func(start bool) string { return filename }, OutputConfigJson{})
+
+	// A stand-in for the preview decoder that exits at the end of its input
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := exec.Command("cat")
+	decoder.Stdin = pr
+
+	sink.Preview = &Preview{
+		Input:       pw,
+		Decoder:     decoder,
+		Exits:       make(chan CmdExit),
+		StopRequest: make(chan bool),
+		Stopped:     make(chan bool),
+		RecvBuf:     make(chan PreviewRecvBuf),
+		JpegRequest: make(chan PreviewJpegRequest),
+	}
+
+	RunAndReportCmd(decoder, sink.Preview.Exits)
+	go sink.Preview.RunLoop()
+
+	sink.OpenFileRequest <- true
+
+	pkt := make([]byte, mpeg.TS_PACKET_LENGTH)
+	pkt[0] = 'G'
+	pkt[1] = 0x01
+
+	sink.Packets <- []mpeg.TsBuffer{pkt}
+
+	sink.OfflineRequest <- true
+
+	select {
+	case <-sink.Closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sink did not close")
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != mpeg.TS_PACKET_LENGTH {
+		t.Errorf("File is %d bytes", fi.Size())
+	}
+
+	if decoder.ProcessState == nil {
+		t.Error("Preview decoder still running")
+	}
+}
@@ -0,0 +1,118 @@
+//go:build linux
+// +build linux
+
+package recstation
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Hop-by-hop options header carrying a router alert for MLD (RFC 2711),
+// padded to eight bytes.
+var ROUTER_ALERT_MLD = []byte{0, 0, 5, 2, 0, 0, 1, 0}
+
+func controlFd(conn interface{}, fn func(fd int) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+
+	err = raw.Control(func(fd uintptr) {
+		ferr = fn(int(fd))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return ferr
+}
+
+func setRouterAlert6(conn net.PacketConn) error {
+	return controlFd(conn, func(fd int) error {
+		return syscall.SetsockoptString(fd, syscall.IPPROTO_IPV6, syscall.IPV6_HOPOPTS, string(ROUTER_ALERT_MLD))
+	})
+}
+
+// enableRxqOvfl asks the kernel to attach its count of datagrams dropped on
+// this socket to every received datagram.
+func enableRxqOvfl(conn *net.UDPConn) error {
+	return controlFd(conn, func(fd int) error {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+	})
+}
+
+// enableTimestampNs asks the kernel to attach the time each datagram was
+// received by the network stack.
+func enableTimestampNs(conn *net.UDPConn) error {
+	return controlFd(conn, func(fd int) error {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+}
+
+// getRcvBuf returns the effective receive buffer size, which Linux reports as
+// double the requested size.
+func getRcvBuf(conn *net.UDPConn) (int, error) {
+	var size int
+
+	err := controlFd(conn, func(fd int) error {
+		var err error
+		size, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		return err
+	})
+
+	return size, err
+}
+
+func parseRxqOvfl(oob []byte) (uint32, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			return binary.NativeEndian.Uint32(m.Data), true
+		}
+	}
+
+	return 0, false
+}
+
+func parseTimestampNs(oob []byte) (time.Time, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET || m.Header.Type != syscall.SCM_TIMESTAMPNS {
+			continue
+		}
+
+		// struct timespec is two longs
+		switch len(m.Data) {
+		case 16:
+			sec := int64(binary.NativeEndian.Uint64(m.Data))
+			nsec := int64(binary.NativeEndian.Uint64(m.Data[8:]))
+			return time.Unix(sec, nsec), true
+
+		case 8:
+			sec := int64(int32(binary.NativeEndian.Uint32(m.Data)))
+			nsec := int64(int32(binary.NativeEndian.Uint32(m.Data[4:])))
+			return time.Unix(sec, nsec), true
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,163 @@
+//go:build linux
+// +build linux
+
+package recstation
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// makeTestCmsg lays out a control message as the kernel would.
+func makeTestCmsg(level, typ int, data []byte) []byte {
+	buf := make([]byte, syscall.CmsgSpace(len(data)))
+
+	if syscall.SizeofCmsghdr == 16 {
+		binary.NativeEndian.PutUint64(buf, uint64(syscall.CmsgLen(len(data))))
+	} else {
+		binary.NativeEndian.PutUint32(buf, uint32(syscall.CmsgLen(len(data))))
+	}
+
+	binary.NativeEndian.PutUint32(buf[syscall.SizeofCmsghdr-8:], uint32(level))
+	binary.NativeEndian.PutUint32(buf[syscall.SizeofCmsghdr-4:], uint32(typ))
+	copy(buf[syscall.CmsgLen(0):], data)
+
+	return buf
+}
+
+func TestParseRxqOvfl(t *testing.T) {
+	ts := makeTestCmsg(syscall.SOL_SOCKET, syscall.SCM_TIMESTAMPNS, make([]byte, 16))
+
+	ovfl := make([]byte, 4)
+	binary.NativeEndian.PutUint32(ovfl, 12345)
+
+	oob := append(ts, makeTestCmsg(syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, ovfl)...)
+
+	if drops, ok := parseRxqOvfl(oob); !ok || drops != 12345 {
+		t.Errorf("Parsed %d %v", drops, ok)
+	}
+
+	// The kernel leaves it out until the first drop
+	if _, ok := parseRxqOvfl(ts); ok {
+		t.Error("Parsed a drop count from a timestamp")
+	}
+}
+
+func TestCountDrops(t *testing.T) {
+	var c McastConn
+
+	steps := []struct {
+		ovfl  uint32
+		delta uint32
+	}{
+		{3, 3},
+		{3, 0},
+		{10, 7},
+		{0xfffffffe, 0xfffffff4},
+		{2, 4},
+	}
+
+	for _, s := range steps {
+		if delta := c.countDrops(s.ovfl); delta != s.delta {
+			t.Errorf("Count %d gave %d new drops, expected %d", s.ovfl, delta, s.delta)
+		}
+	}
+
+	if c.Drops != 0xfffffffe+4 {
+		t.Errorf("%d drops in all", c.Drops)
+	}
+}
+
+func TestRecvDrops(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Depends on the kernel dropping loopback datagrams")
+	}
+
+	// Generous, as the test only waits this long when something is wrong
+	const wait = 10 * time.Second
+
+	conn, err := ListenMcast(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.UdpConn.Close()
+
+	// Linux doubles what it is asked for, and has a floor
+	if err := conn.SetReadBuffer(64 << 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if conn.RcvBuf != 128<<10 {
+		t.Errorf("Receive buffer %d", conn.RcvBuf)
+	}
+
+	if err := conn.SetReadBuffer(1); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &UdpSource{
+		Conns:         []*McastConn{conn},
+		Streams:       make(map[IPKey]*UdpStream),
+		RxBufReady:    make(chan *RecvBuf, 1),
+		RxBufPending:  make(chan []*RecvBuf, 1),
+		StatusRequest: make(chan chan *UdpSourceStatusMessage),
+	}
+
+	go source.RunLoop()
+	go source.RecvLoop(conn, source.RxBufReady, source.RxBufPending)
+
+	// With no buffer to read into, everything past what the socket holds
+	// is dropped
+	deadline := time.Now().Add(wait)
+	for atomic.LoadUint64(&source.poolDepleted) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Receive loop never found the pool empty")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	tx, err := net.DialUDP("udp4", nil, conn.UdpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Close()
+
+	sent := uint64(20)
+	for i := uint64(0); i < sent; i++ {
+		if _, err := tx.Write(make([]byte, 7*188)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source.RxBufReady <- &RecvBuf{}
+
+	// Each datagram carries the count as it was when it was queued, so the
+	// drops show once one queued after them is read
+	var st *UdpSourceStatusMessage
+	deadline = time.Now().Add(wait)
+	for {
+		st = source.Status()
+		if st.Sockets[0].Drops > 0 || time.Now().After(deadline) {
+			break
+		}
+
+		if _, err := tx.Write(make([]byte, 7*188)); err == nil {
+			sent++
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if drops := st.Sockets[0].Drops; drops == 0 || drops > sent {
+		t.Errorf("%d of %d datagrams dropped", drops, sent)
+	}
+
+	if st.PoolDepleted == 0 {
+		t.Error("Pool depletion not in the status")
+	}
+}
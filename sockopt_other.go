@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package recstation
+
+import (
+	"net"
+	"time"
+)
+
+func setRouterAlert6(conn net.PacketConn) error {
+	return nil
+}
+
+func enableRxqOvfl(conn *net.UDPConn) error {
+	return nil
+}
+
+func enableTimestampNs(conn *net.UDPConn) error {
+	return nil
+}
+
+func getRcvBuf(conn *net.UDPConn) (int, error) {
+	return 0, nil
+}
+
+func parseRxqOvfl(oob []byte) (uint32, bool) {
+	return 0, false
+}
+
+func parseTimestampNs(oob []byte) (time.Time, bool) {
+	return time.Time{}, false
+}
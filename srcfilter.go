@@ -0,0 +1,102 @@
+package recstation
+
+import (
+	"log"
+	"net"
+)
+
+// sourceFilter drops packets from senders that have no business on a group,
+// either by an allowlist or by locking each path to the first sender heard.
+type sourceFilter struct {
+	Allowed []net.IP
+	Lock    bool
+
+	Foreign     uint64
+	LastForeign net.IP
+
+	locked []net.IP
+}
+
+type SourceFilterStatusMessage struct {
+	Foreign     uint64   `json:"foreign"`
+	LastForeign string   `json:"last_foreign,omitempty"`
+	Locked      []string `json:"locked,omitempty"`
+}
+
+func makeSourceFilter(allowed []net.IP, lock bool) *sourceFilter {
+	if len(allowed) == 0 && !lock {
+		return nil
+	}
+
+	return &sourceFilter{
+		Allowed: allowed,
+		Lock:    lock,
+	}
+}
+
+func (f *sourceFilter) reject(src net.IP, what string) bool {
+	if f.Foreign == 0 || !f.LastForeign.Equal(src) {
+		log.Printf("Dropping %s from foreign source %s", what, src)
+	}
+
+	f.Foreign++
+	f.LastForeign = src
+
+	return false
+}
+
+// Allow reports whether a packet from src may be accepted on the given path.
+func (f *sourceFilter) Allow(src net.IP, path int, what string) bool {
+	if len(f.Allowed) > 0 {
+		found := false
+
+		for _, ip := range f.Allowed {
+			if ip.Equal(src) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return f.reject(src, what)
+		}
+	}
+
+	if f.Lock {
+		for len(f.locked) <= path {
+			f.locked = append(f.locked, nil)
+		}
+
+		if f.locked[path] == nil {
+			log.Printf("Locking %s to source %s", what, src)
+			f.locked[path] = src
+		} else if !f.locked[path].Equal(src) {
+			return f.reject(src, what)
+		}
+	}
+
+	return true
+}
+
+// Unlock forgets the locked senders, for when a stream goes offline.
+func (f *sourceFilter) Unlock() {
+	f.locked = nil
+}
+
+func (f *sourceFilter) Status() *SourceFilterStatusMessage {
+	msg := &SourceFilterStatusMessage{
+		Foreign: f.Foreign,
+	}
+
+	if f.LastForeign != nil {
+		msg.LastForeign = f.LastForeign.String()
+	}
+
+	for _, ip := range f.locked {
+		if ip != nil {
+			msg.Locked = append(msg.Locked, ip.String())
+		}
+	}
+
+	return msg
+}
@@ -0,0 +1,42 @@
+package recstation
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSourceFilter(t *testing.T) {
+	a := net.ParseIP("10.0.0.1").To4()
+	b := net.ParseIP("10.0.0.2").To4()
+	c := net.ParseIP("10.0.0.3").To4()
+
+	allow := makeSourceFilter([]net.IP{a, b}, false)
+
+	if !allow.Allow(a, 0, "test") || !allow.Allow(b, 1, "test") {
+		t.Fatal("Allowed source dropped")
+	}
+
+	if allow.Allow(c, 0, "test") || allow.Foreign != 1 || !allow.LastForeign.Equal(c) {
+		t.Fatal("Foreign source not dropped and counted")
+	}
+
+	lock := makeSourceFilter(nil, true)
+
+	if !lock.Allow(a, 0, "test") || !lock.Allow(b, 1, "test") {
+		t.Fatal("First sender on each path not accepted")
+	}
+
+	if lock.Allow(b, 0, "test") || lock.Allow(a, 1, "test") || lock.Foreign != 2 {
+		t.Fatal("Second sender not dropped")
+	}
+
+	lock.Unlock()
+
+	if !lock.Allow(c, 0, "test") {
+		t.Fatal("New sender not accepted after unlock")
+	}
+
+	if makeSourceFilter(nil, false) != nil {
+		t.Fatal("Filter without rules")
+	}
+}
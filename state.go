@@ -1,15 +1,71 @@
 package recstation
 
 import (
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
+
+	"recstation/mpeg"
+	"recstation/rtp"
 )
 
 type Group struct {
-	Name string
-	Addr net.IP
+	Name   string
+	Addr   net.IP
+	Source net.IP
+
+	Allowed    []net.IP
+	LockSource bool
+
+	// Online while packets arrive rather than while heartbeats do
+	Traffic     bool
+	IdleTimeout time.Duration
+
+	// Encoder key, nil if the encoder cannot be controlled, and the keys of
+	// encoders that have their own
+	Key         []byte
+	EncoderKeys map[uint16][]byte
+
+	// Refuse heartbeats that are not signed with the key
+	SignedHeartbeats bool
+}
+
+// SecondaryGroup is the redundant path of a SMPTE 2022-7 protected stream,
+// possibly arriving on another interface.
+type SecondaryGroup struct {
+	Name    string
+	Primary net.IP
+	Addr    net.IP
+	Source  net.IP
+	Iface   *net.Interface
+
+	Allowed    []net.IP
+	LockSource bool
+
+	Key         []byte
+	EncoderKeys map[uint16][]byte
+
+	SignedHeartbeats bool
+}
+
+// StaticStream is a unicast stream that goes online when its packets arrive.
+type StaticStream struct {
+	Name   string
+	Listen *net.UDPAddr
+	Source net.IP
+}
+
+func (static *StaticStream) String() string {
+	if static.Listen != nil {
+		return static.Listen.String()
+	}
+
+	return static.Source.String()
 }
 
 type State struct {
@@ -19,13 +75,22 @@ type State struct {
 	Iface            *net.Interface
 	NewOutputEvery   time.Duration
 	HeartbeatTimeout time.Duration
-	GroupAddrs       []net.IP
-	Groups           []*Group
-	ListenAddr       string
-	StatusRequest    chan chan *StatusMessage
-	RecordRequest    chan chan bool
-	StopRequest      chan chan bool
-	PreviewRequest   chan PreviewMessage
+	OfflineGrace     time.Duration
+
+	// Zero unless we are to be the IGMP querier
+	IgmpQueryInterval time.Duration
+	GroupAddrs        []net.IP
+	Groups            []*Group
+	Secondaries       map[string]*SecondaryGroup
+	StaticStreams     []*StaticStream
+	PullUrls          map[string]*url.URL
+	ListenAddr        string
+	StatusRequest     chan chan *StatusMessage
+	RecordRequest     chan chan bool
+	StopRequest       chan chan bool
+	PreviewRequest    chan PreviewMessage
+	CaptureRequest    chan CaptureRequestMessage
+	ControlRequest    chan ControlRequestMessage
 
 	Recording      bool
 	RecordingStart time.Time
@@ -36,6 +101,21 @@ type StatusMessage struct {
 	Recording         bool                 `json:"recording"`
 	RecordingDuration float64              `json:"recording_duration"`
 	Sinks             []*SinkStatusMessage `json:"sinks"`
+
+	Sockets           []*UdpSocketStatusMessage `json:"sockets"`
+	RxBufPoolDepleted uint64                    `json:"rxbuf_pool_depleted"`
+
+	ForeignHeartbeats  map[string]*SourceFilterStatusMessage `json:"foreign_heartbeats,omitempty"`
+	Heartbeats         []*HeartbeatNodeStatusMessage         `json:"heartbeats"`
+	InvalidHeartbeats  uint64                                `json:"invalid_heartbeats"`
+	RejectedHeartbeats *HeartbeatRejectStatusMessage         `json:"rejected_heartbeats"`
+
+	Captures []*CaptureStatusMessage `json:"captures"`
+
+	Igmp []*IgmpStatusMessage `json:"igmp"`
+
+	// Every stream seen since startup, online or not
+	Availability []*AvailabilityStatusMessage `json:"availability"`
 }
 
 type PreviewMessage struct {
@@ -45,6 +125,282 @@ type PreviewMessage struct {
 	Ready  chan error
 }
 
+const (
+	CAPTURE_START = iota
+	CAPTURE_STOP
+	CAPTURE_GET
+)
+
+type CaptureRequestMessage struct {
+	Action    int
+	Id        int
+	Group     net.IP
+	Heartbeat bool
+	MaxBytes  int64
+	Duration  time.Duration
+	Resp      chan CaptureResponse
+}
+
+type CaptureResponse struct {
+	Capture *Capture
+	Err     error
+}
+
+func (state *State) SinkOutput(name string) OutputConfigJson {
+	if out, ok := state.Outputs[name]; ok {
+		return out
+	}
+
+	return OutputConfigJson{
+		Format: OUTPUT_FORMAT_TS,
+	}
+}
+
+func (state *State) StreamConfig(name string) StreamConfigJson {
+	if sc, ok := state.Streams[name]; ok {
+		return sc
+	}
+
+	return StreamConfigJson{
+		Rtp: RTP_MODE_AUTO,
+	}
+}
+
+// GroupByName parses a group address or looks up the primary group of a
+// stream by name.
+func (state *State) GroupByName(name string) net.IP {
+	if addr := net.ParseIP(name); addr != nil {
+		return addr
+	}
+
+	for _, group := range state.Groups {
+		if group.Name == name {
+			return group.Addr
+		}
+	}
+
+	return nil
+}
+
+// StreamName names the stream on a group or its secondary, falling back to
+// the primary group address.
+func (state *State) StreamName(group net.IP) string {
+	key := state.PrimaryGroup(group).String()
+
+	if name, ok := state.Multicast2Name[key]; ok {
+		return name
+	}
+
+	return key
+}
+
+// PrimaryGroup maps the address of a secondary group back to the primary
+// group of its stream.
+func (state *State) PrimaryGroup(group net.IP) net.IP {
+	for _, sec := range state.Secondaries {
+		if sec.Addr.Equal(group) {
+			return sec.Primary
+		}
+	}
+
+	return group
+}
+
+// Group returns the secondary as a group of its own for joining.
+func (sec *SecondaryGroup) Group() *Group {
+	return &Group{
+		Name:       sec.Name,
+		Addr:       sec.Addr,
+		Source:     sec.Source,
+		Allowed:    sec.Allowed,
+		LockSource: sec.LockSource,
+		Key:        sec.Key,
+
+		EncoderKeys:      sec.EncoderKeys,
+		SignedHeartbeats: sec.SignedHeartbeats,
+	}
+}
+
+// SourceFor returns the SSM sender of a primary or secondary group, or nil for
+// any-source groups.
+func (state *State) SourceFor(group net.IP) net.IP {
+	for _, g := range state.Groups {
+		if g.Addr.Equal(group) {
+			return g.Source
+		}
+	}
+
+	for _, sec := range state.Secondaries {
+		if sec.Addr.Equal(group) {
+			return sec.Source
+		}
+	}
+
+	return nil
+}
+
+func parseSource(group net.IP, source string) (net.IP, error) {
+	if source == "" {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("Bad source address '%s' for %s", source, group)
+	}
+
+	if isIPv6(ip) != isIPv6(group) {
+		return nil, fmt.Errorf("Source %s and group %s are of different address families", ip, group)
+	}
+
+	return normalizeIP(ip), nil
+}
+
+func parseSourceList(name string, sources []string) ([]net.IP, error) {
+	var ips []net.IP
+
+	for _, s := range sources {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Bad allowed source '%s' for %s", s, name)
+		}
+
+		ips = append(ips, normalizeIP(ip))
+	}
+
+	return ips, nil
+}
+
+// IsTraffic reports whether a primary group has traffic liveness.
+func (state *State) IsTraffic(group net.IP) bool {
+	for _, g := range state.Groups {
+		if g.Addr.Equal(group) {
+			return g.Traffic
+		}
+	}
+
+	return false
+}
+
+// HeartbeatGroups returns the groups whose streams are announced by
+// heartbeats.
+func (state *State) HeartbeatGroups() []*Group {
+	var groups []*Group
+
+	for _, group := range state.Groups {
+		if !group.Traffic {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// Ifaces returns the interfaces that groups are joined on.
+func (state *State) Ifaces() []*net.Interface {
+	ifaces := []*net.Interface{state.Iface}
+
+	for _, sec := range state.Secondaries {
+		ifaces = append(ifaces, sec.Iface)
+	}
+
+	return ifaces
+}
+
+func (state *State) AnyFec() bool {
+	for _, sc := range state.Streams {
+		if sc.Fec {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (state *State) AnyIPv6() bool {
+	for _, group := range state.GroupAddrs {
+		if isIPv6(group) {
+			return true
+		}
+	}
+
+	for _, sec := range state.Secondaries {
+		if isIPv6(sec.Addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseEncoderKeys reads the hex keys of single encoders, by decimal encoder
+// ID.
+func parseEncoderKeys(name string, keys map[string]string) (map[uint16][]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[uint16][]byte)
+
+	for id, key := range keys {
+		n, err := strconv.ParseUint(id, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Bad encoder ID '%s' for %s", id, name)
+		}
+
+		parsed[uint16(n)], err = hex.DecodeString(key)
+		if err != nil || len(parsed[uint16(n)]) == 0 {
+			return nil, fmt.Errorf("Bad key for encoder %s of %s", id, name)
+		}
+	}
+
+	return parsed, nil
+}
+
+// listenOverlaps reports whether two listen addresses would take the same
+// port.
+func listenOverlaps(a, b *net.UDPAddr) bool {
+	if a.Port != b.Port {
+		return false
+	}
+
+	wildcard := func(ip net.IP) bool {
+		return ip == nil || ip.IsUnspecified()
+	}
+
+	return wildcard(a.IP) || wildcard(b.IP) || a.IP.Equal(b.IP)
+}
+
+// sharedListens returns the addresses of the sockets that are not a static
+// stream's own, by what they are for.
+func (state *State) sharedListens() (map[string]*net.UDPAddr, error) {
+	shared := make(map[string]*net.UDPAddr)
+
+	for what, listen := range map[string]string{"source_listen": state.SourceListen, "heartbeat_listen": state.HeartbeatListen} {
+		if listen == "" {
+			continue
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", listen)
+		if err != nil {
+			return nil, err
+		}
+
+		shared[what] = addr
+	}
+
+	if source, ok := shared["source_listen"]; ok && state.AnyFec() {
+		for _, offset := range []int{rtp.FEC_PORT_OFFSET_COLUMN, rtp.FEC_PORT_OFFSET_ROW} {
+			fec := *source
+			fec.Port += offset
+
+			shared[fmt.Sprintf("FEC port %d", fec.Port)] = &fec
+		}
+	}
+
+	return shared, nil
+}
+
 func MakeState(cfg ConfigJson) (*State, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -66,30 +422,305 @@ func MakeState(cfg ConfigJson) (*State, error) {
 		return nil, err
 	}
 
+	offline_grace := OFFLINE_DEFAULT_GRACE
+	if cfg.OfflineGraceDur != "" {
+		offline_grace, err = time.ParseDuration(cfg.OfflineGraceDur)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	state := &State{
 		ConfigJson:       cfg,
 		Hostname:         hostname,
 		Iface:            iface,
 		NewOutputEvery:   new_output_every,
 		HeartbeatTimeout: heartbeat_timeout,
+		OfflineGrace:     offline_grace,
 		StatusRequest:    make(chan chan *StatusMessage),
 		RecordRequest:    make(chan chan bool),
 		StopRequest:      make(chan chan bool),
 		PreviewRequest:   make(chan PreviewMessage),
+		CaptureRequest:   make(chan CaptureRequestMessage),
+		ControlRequest:   make(chan ControlRequestMessage),
+		Secondaries:      make(map[string]*SecondaryGroup),
+		PullUrls:         make(map[string]*url.URL),
+	}
+
+	for name, out := range state.Outputs {
+		switch out.Format {
+		case "", OUTPUT_FORMAT_TS, OUTPUT_FORMAT_MP4:
+		default:
+			return nil, fmt.Errorf("Unknown output format '%s' for %s", out.Format, name)
+		}
+
+		// The ALSA capture is not written in TS packets, so there is nothing
+		// to remux
+		if name == AUDIO_SINK_NAME && out.WantMp4() {
+			return nil, fmt.Errorf("Output format %s is not supported for %s", out.Format, name)
+		}
+	}
+
+	for name, sc := range state.Streams {
+		switch sc.Rtp {
+		case "", RTP_MODE_AUTO, RTP_MODE_ON, RTP_MODE_OFF:
+		default:
+			return nil, fmt.Errorf("Unknown RTP mode '%s' for %s", sc.Rtp, name)
+		}
+
+		if sc.Fec && !sc.AllowRtp() {
+			return nil, fmt.Errorf("FEC requires RTP for %s", name)
+		}
+
+		if _, err := parseSourceList(name, sc.AllowedSources); err != nil {
+			return nil, err
+		}
+
+		switch sc.Liveness {
+		case "", LIVENESS_HEARTBEAT, LIVENESS_TRAFFIC:
+		default:
+			return nil, fmt.Errorf("Unknown liveness '%s' for %s", sc.Liveness, name)
+		}
+
+		if _, err := hex.DecodeString(sc.Key); err != nil {
+			return nil, fmt.Errorf("Bad key for %s: %s", name, err)
+		}
+
+		if _, err := parseEncoderKeys(name, sc.EncoderKeys); err != nil {
+			return nil, err
+		}
+
+		if sc.SignedHeartbeats && !sc.HasKeys() {
+			return nil, fmt.Errorf("Signed heartbeats need a key for %s", name)
+		}
+
+		if sc.SignedHeartbeats && sc.AllowUnsignedHeartbeats {
+			return nil, fmt.Errorf("Heartbeats for %s cannot be both signed and unsigned", name)
+		}
 	}
 
 	for multicast, name := range state.Multicast2Name {
 		addr := net.ParseIP(multicast)
 
-		state.Groups = append(state.Groups, &Group{
-			Name: name,
-			Addr: addr,
-		})
+		sc := state.StreamConfig(name)
+
+		source, err := parseSource(addr, sc.Source)
+		if err != nil {
+			return nil, err
+		}
+
+		allowed, err := parseSourceList(name, sc.AllowedSources)
+		if err != nil {
+			return nil, err
+		}
+
+		group := &Group{
+			Name:        name,
+			Addr:        addr,
+			Source:      source,
+			Allowed:     allowed,
+			LockSource:  sc.LockSource,
+			Traffic:     sc.TrafficLiveness(),
+			IdleTimeout: heartbeat_timeout,
+
+			SignedHeartbeats: sc.WantSignedHeartbeats(),
+		}
+
+		if sc.Key != "" {
+			group.Key, _ = hex.DecodeString(sc.Key)
+		}
+
+		group.EncoderKeys, _ = parseEncoderKeys(name, sc.EncoderKeys)
+
+		if sc.IdleTimeoutDur != "" {
+			group.IdleTimeout, err = time.ParseDuration(sc.IdleTimeoutDur)
+			if err != nil {
+				return nil, fmt.Errorf("Bad idle timeout for %s: %s", name, err)
+			}
+		}
+
+		state.Groups = append(state.Groups, group)
 	}
 
 	for _, group := range state.Groups {
 		state.GroupAddrs = append(state.GroupAddrs, group.Addr)
 	}
 
+	for name, sc := range state.Streams {
+		if sc.Secondary == "" {
+			continue
+		}
+
+		sec := &SecondaryGroup{
+			Name:       name,
+			Addr:       net.ParseIP(sc.Secondary),
+			Iface:      iface,
+			LockSource: sc.LockSource,
+
+			SignedHeartbeats: sc.WantSignedHeartbeats(),
+		}
+
+		if sc.Key != "" {
+			sec.Key, _ = hex.DecodeString(sc.Key)
+		}
+
+		sec.EncoderKeys, _ = parseEncoderKeys(name, sc.EncoderKeys)
+
+		if sec.Addr == nil {
+			return nil, fmt.Errorf("Bad secondary group '%s' for %s", sc.Secondary, name)
+		}
+
+		sec.Source, err = parseSource(sec.Addr, sc.SecondarySource)
+		if err != nil {
+			return nil, err
+		}
+
+		sec.Allowed, err = parseSourceList(name, sc.AllowedSources)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, group := range state.Groups {
+			if group.Name == name {
+				sec.Primary = group.Addr
+			}
+		}
+
+		if sec.Primary == nil {
+			return nil, fmt.Errorf("Secondary group for %s has no primary in multicasts", name)
+		}
+
+		if sc.SecondaryIface != "" {
+			sec.Iface, err = net.InterfaceByName(sc.SecondaryIface)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		state.Secondaries[name] = sec
+	}
+
+	shared, err := state.sharedListens()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, sc := range state.Statics {
+		static := &StaticStream{
+			Name: name,
+		}
+
+		if (sc.Listen == "") == (sc.Source == "") {
+			return nil, fmt.Errorf("Static stream %s needs exactly one of listen or source", name)
+		}
+
+		if sc.Listen != "" {
+			static.Listen, err = net.ResolveUDPAddr("udp", sc.Listen)
+			if err != nil {
+				return nil, err
+			}
+
+			for what, addr := range shared {
+				if listenOverlaps(static.Listen, addr) {
+					return nil, fmt.Errorf("Static stream %s listens on %s, which is taken by %s", name, sc.Listen, what)
+				}
+			}
+		} else {
+			static.Source = net.ParseIP(sc.Source)
+			if static.Source == nil {
+				return nil, fmt.Errorf("Bad source address '%s' for static stream %s", sc.Source, name)
+			}
+
+			static.Source = normalizeIP(static.Source)
+		}
+
+		state.StaticStreams = append(state.StaticStreams, static)
+	}
+
+	for name, rawurl := range state.Pulls {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+
+		switch u.Scheme {
+		case "http", "https", "tcp":
+		default:
+			return nil, fmt.Errorf("Unsupported pull URL '%s' for %s", rawurl, name)
+		}
+
+		state.PullUrls[name] = u
+	}
+
+	for name, rc := range state.Replays {
+		if rc.File == "" {
+			return nil, fmt.Errorf("Replay %s has no file", name)
+		}
+	}
+
+	for name, rc := range state.Relays {
+		if rc.Stream == "" {
+			return nil, fmt.Errorf("Relay %s has no stream", name)
+		}
+
+		stream := false
+		for _, name := range state.Multicast2Name {
+			stream = stream || name == rc.Stream
+		}
+
+		_, static := state.Statics[rc.Stream]
+		_, pull := state.Pulls[rc.Stream]
+		_, replay := state.Replays[rc.Stream]
+
+		if !stream && !static && !pull && !replay {
+			return nil, fmt.Errorf("Relay %s has unknown stream %s", name, rc.Stream)
+		}
+
+		if _, err := net.ResolveUDPAddr("udp", rc.Dest); err != nil {
+			return nil, fmt.Errorf("Bad destination '%s' for relay %s: %s", rc.Dest, name, err)
+		}
+
+		if rc.Ttl < 0 || rc.Ttl > 255 {
+			return nil, fmt.Errorf("Bad TTL %d for relay %s", rc.Ttl, name)
+		}
+
+		if rc.Dscp < 0 || rc.Dscp > DSCP_MAX {
+			return nil, fmt.Errorf("Bad DSCP %d for relay %s", rc.Dscp, name)
+		}
+
+		for _, pid := range rc.Pids {
+			if pid < 0 || pid > int(mpeg.PID_PADDING) {
+				return nil, fmt.Errorf("Bad PID %d for relay %s", pid, name)
+			}
+		}
+	}
+
+	if state.HeartbeatOnlineCount < 0 {
+		return nil, fmt.Errorf("Bad heartbeat online count %d", state.HeartbeatOnlineCount)
+	}
+
+	if state.HeartbeatOnlineCount == 0 {
+		state.HeartbeatOnlineCount = HEARTBEAT_DEFAULT_ONLINE_COUNT
+	}
+
+	if state.IgmpQuerier {
+		state.IgmpQueryInterval = IGMP_DEFAULT_QUERY_INTERVAL
+
+		if state.IgmpQueryIntervalDur != "" {
+			state.IgmpQueryInterval, err = time.ParseDuration(state.IgmpQueryIntervalDur)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if state.IgmpQueryInterval <= IGMP_QUERY_RESPONSE_TIME {
+			return nil, fmt.Errorf("IGMP query interval %s is not longer than the response time", state.IgmpQueryInterval)
+		}
+	}
+
+	if state.CaptureDir == "" {
+		state.CaptureDir = os.TempDir()
+	}
+
 	return state, nil
 }
@@ -0,0 +1,140 @@
+package recstation
+
+import (
+	"testing"
+)
+
+func makeTestConfig() ConfigJson {
+	return ConfigJson{
+		IfaceName:           "lo",
+		NewOutputEveryDur:   "1h",
+		HeartbeatTimeoutDur: "3s",
+		SourceListen:        "0.0.0.0:5004",
+		HeartbeatListen:     "0.0.0.0:6000",
+		Outputs:             make(map[string]OutputConfigJson),
+	}
+}
+
+func TestStateOutputFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		output OutputConfigJson
+		ok     bool
+	}{
+		{"vancouver", OutputConfigJson{}, true},
+		{"vancouver", OutputConfigJson{KeepTs: true}, true},
+		{"vancouver", OutputConfigJson{Format: OUTPUT_FORMAT_MP4}, true},
+		{"vancouver", OutputConfigJson{Format: "mkv"}, false},
+		{AUDIO_SINK_NAME, OutputConfigJson{Format: OUTPUT_FORMAT_TS}, true},
+		{AUDIO_SINK_NAME, OutputConfigJson{Format: OUTPUT_FORMAT_MP4}, false},
+	}
+
+	for _, c := range cases {
+		cfg := makeTestConfig()
+		cfg.Outputs[c.name] = c.output
+
+		if _, err := MakeState(cfg); (err == nil) != c.ok {
+			t.Errorf("Output %+v for %s gave %v", c.output, c.name, err)
+		}
+	}
+}
+
+func TestStateStaticListen(t *testing.T) {
+	cases := []struct {
+		listen string
+		fec    bool
+		ok     bool
+	}{
+		{"0.0.0.0:5010", false, true},
+		{"0.0.0.0:5004", false, false},
+		{"127.0.0.1:5004", false, false},
+		{":6000", false, false},
+		{"0.0.0.0:5006", false, true},
+		{"0.0.0.0:5006", true, false},
+	}
+
+	for _, c := range cases {
+		cfg := makeTestConfig()
+		cfg.Statics = map[string]StaticStreamConfigJson{
+			"whitehorse": {Listen: c.listen},
+		}
+
+		if c.fec {
+			cfg.Streams = map[string]StreamConfigJson{
+				"calgary": {Rtp: RTP_MODE_ON, Fec: true},
+			}
+		}
+
+		if _, err := MakeState(cfg); (err == nil) != c.ok {
+			t.Errorf("Static listen %s (FEC %v) gave %v", c.listen, c.fec, err)
+		}
+	}
+}
+
+func TestStateSignedHeartbeats(t *testing.T) {
+	cases := []struct {
+		stream StreamConfigJson
+		signed bool
+	}{
+		{StreamConfigJson{}, false},
+		{StreamConfigJson{Key: "0123abcd"}, true},
+		{StreamConfigJson{Key: "0123abcd", AllowUnsignedHeartbeats: true}, false},
+		{StreamConfigJson{Key: "0123abcd", SignedHeartbeats: true}, true},
+		{StreamConfigJson{EncoderKeys: map[string]string{"2": "0123abcd"}}, true},
+	}
+
+	for _, c := range cases {
+		cfg := makeTestConfig()
+		cfg.Multicast2Name = map[string]string{"239.255.42.42": "vancouver"}
+		cfg.Streams = map[string]StreamConfigJson{"vancouver": c.stream}
+
+		state, err := MakeState(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if state.Groups[0].SignedHeartbeats != c.signed {
+			t.Errorf("Stream %+v takes unsigned heartbeats: %v", c.stream, !state.Groups[0].SignedHeartbeats)
+		}
+	}
+
+	bad := []StreamConfigJson{
+		{Key: "0123abcd", SignedHeartbeats: true, AllowUnsignedHeartbeats: true},
+		{EncoderKeys: map[string]string{"70000": "0123abcd"}},
+		{EncoderKeys: map[string]string{"2": ""}},
+	}
+
+	for _, sc := range bad {
+		cfg := makeTestConfig()
+		cfg.Streams = map[string]StreamConfigJson{"vancouver": sc}
+
+		if _, err := MakeState(cfg); err == nil {
+			t.Errorf("Took stream %+v", sc)
+		}
+	}
+}
+
+func TestStateRelayStream(t *testing.T) {
+	cases := []struct {
+		stream string
+		ok     bool
+	}{
+		{"vancouver", true},
+		{"whitehorse", true},
+		{"yellowknife", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		cfg := makeTestConfig()
+		cfg.Multicast2Name = map[string]string{"239.255.42.42": "vancouver"}
+		cfg.Pulls = map[string]string{"whitehorse": "http://127.0.0.1:8080/whitehorse.ts"}
+		cfg.Relays = map[string]RelayConfigJson{
+			"out": {Stream: c.stream, Dest: "239.255.43.1:5004"},
+		}
+
+		if _, err := MakeState(cfg); (err == nil) != c.ok {
+			t.Errorf("Relay of %q gave %v", c.stream, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package recstation
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+const STATIC_LIVENESS_INTERVAL = 1 * time.Second
+
+type attachSinkMsg struct {
+	Name string
+	Sink *Sink
+}
+
+// AddStatic registers a unicast stream. A stream with a listen address gets a
+// socket of its own, otherwise it is picked out of the shared source port by
+// its sender address.
+func (source *UdpSource) AddStatic(static *StaticStream, config StreamConfigJson, timeout time.Duration) error {
+	stream := &UdpStream{
+		Name:    static.Name,
+		Config:  config,
+		Rtp:     makeStreamRtp(config),
+		filter:  makeStreamFilter(static.Name, config),
+		Static:  static,
+		timeout: timeout,
+	}
+
+	stream.paths = append(stream.paths, &udpPath{})
+
+	if static.Listen != nil {
+		conn, err := ListenMcast(static.Listen)
+		if err != nil {
+			return err
+		}
+
+		if source.RcvBuf > 0 {
+			if err := conn.SetReadBuffer(source.RcvBuf); err != nil {
+				return err
+			}
+		}
+
+		stream.conn = conn
+	}
+
+	source.addStatic <- stream
+
+	if stream.conn != nil {
+		go source.RecvLoop(stream.conn, source.RxBufReady, source.RxBufPending)
+	}
+
+	return nil
+}
+
+func (source *UdpSource) AttachSink(name string, sink *Sink) {
+	source.attachSink <- attachSinkMsg{
+		Name: name,
+		Sink: sink,
+	}
+}
+
+func (source *UdpSource) DetachSink(name string) {
+	source.detachSink <- name
+}
+
+// streamByName finds a stream that announces itself, static or with traffic
+// liveness.
+func (source *UdpSource) streamByName(name string) *UdpStream {
+	for _, stream := range source.statics {
+		if stream.Name == name {
+			return stream
+		}
+	}
+
+	for key, stream := range source.Streams {
+		if stream.Traffic && stream.Name == name && key == MakeIPKey(stream.Group) {
+			return stream
+		}
+	}
+
+	return nil
+}
+
+func (source *UdpSource) staticFor(rx *RecvBuf) *UdpStream {
+	for _, stream := range source.statics {
+		if stream.conn != nil {
+			if stream.conn == rx.Conn {
+				return stream
+			}
+
+			continue
+		}
+
+		if stream.Static.Source.Equal(rx.Src) && !source.isStaticConn(rx.Conn) {
+			return stream
+		}
+	}
+
+	return nil
+}
+
+func (source *UdpSource) isStaticConn(conn *McastConn) bool {
+	for _, stream := range source.statics {
+		if stream.conn == conn {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (source *UdpSource) touchStream(stream *UdpStream, rx *RecvBuf, now time.Time) {
+	stream.lastSeen = now
+
+	if stream.online {
+		return
+	}
+
+	if stream.Traffic {
+		log.Printf("Traffic on %s (%s) from %s", stream.Group, stream.Name, rx.Src)
+	} else {
+		log.Printf("Static stream %s online from %s", stream.Name, rx.Src)
+	}
+
+	stream.online = true
+
+	source.emit(HeartbeatEvent{
+		Event: HEARTBEAT_ONLINE,
+		Src:   rx.Src,
+		Dst:   rx.Dst,
+		Name:  stream.Name,
+		Input: source,
+	})
+}
+
+// checkLiveness takes static streams offline once their packets have stopped
+// for longer than the heartbeat timeout, and groups with traffic liveness
+// after their idle timeout.
+func (source *UdpSource) checkLiveness(now time.Time) {
+	for _, stream := range source.statics {
+		if !stream.online || now.Sub(stream.lastSeen) < stream.timeout {
+			continue
+		}
+
+		log.Printf("Static stream %s offline", stream.Name)
+
+		source.goOffline(stream, stream.Static.Source, nil)
+	}
+
+	for key, stream := range source.Streams {
+		if !stream.Traffic || key != MakeIPKey(stream.Group) {
+			continue
+		}
+
+		if !stream.online || now.Sub(stream.lastSeen) < stream.timeout {
+			continue
+		}
+
+		log.Printf("No traffic on %s (%s) for %s", stream.Group, stream.Name, stream.timeout)
+
+		source.goOffline(stream, nil, stream.Group)
+	}
+}
+
+func (source *UdpSource) goOffline(stream *UdpStream, src, dst net.IP) {
+	stream.online = false
+
+	if stream.filter != nil {
+		stream.filter.Unlock()
+	}
+
+	source.emit(HeartbeatEvent{
+		Event: HEARTBEAT_OFFLINE,
+		Src:   src,
+		Dst:   dst,
+		Name:  stream.Name,
+		Input: source,
+	})
+}
@@ -0,0 +1,129 @@
+package recstation
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStaticFor(t *testing.T) {
+	own := &McastConn{}
+	shared := &McastConn{}
+	sender := net.IPv4(10, 1, 1, 50).To4()
+
+	whitehorse := &UdpStream{Name: "whitehorse", Static: &StaticStream{Name: "whitehorse"}, conn: own}
+	yellowknife := &UdpStream{Name: "yellowknife", Static: &StaticStream{Name: "yellowknife", Source: sender}}
+
+	source := &UdpSource{
+		statics: []*UdpStream{whitehorse, yellowknife},
+	}
+
+	cases := []struct {
+		conn *McastConn
+		src  net.IP
+		want *UdpStream
+	}{
+		{own, net.IPv4(10, 9, 9, 9), whitehorse},
+		{shared, sender, yellowknife},
+
+		// A stream's own socket is its alone, whoever sends to it
+		{own, sender, whitehorse},
+
+		{shared, net.IPv4(10, 9, 9, 9), nil},
+	}
+
+	for _, c := range cases {
+		if got := source.staticFor(&RecvBuf{Conn: c.conn, Src: c.src}); got != c.want {
+			t.Errorf("Datagram from %s on %p went to %v, expected %v", c.src, c.conn, got, c.want)
+		}
+	}
+}
+
+func TestStaticLiveness(t *testing.T) {
+	sender := net.IPv4(10, 1, 1, 50).To4()
+	timeout := 3 * time.Second
+
+	stream := &UdpStream{
+		Name:    "yellowknife",
+		Static:  &StaticStream{Name: "yellowknife", Source: sender},
+		timeout: timeout,
+	}
+
+	source := &UdpSource{
+		statics: []*UdpStream{stream},
+		Events:  make(chan HeartbeatEvent, 4),
+	}
+
+	now := time.Now()
+
+	source.touchStream(stream, &RecvBuf{Src: sender}, now)
+	source.touchStream(stream, &RecvBuf{Src: sender}, now.Add(time.Second))
+
+	if ev := <-source.Events; ev.Event != HEARTBEAT_ONLINE || ev.Name != "yellowknife" || !ev.Src.Equal(sender) {
+		t.Errorf("Event %+v", ev)
+	}
+
+	source.checkLiveness(now.Add(timeout))
+
+	if len(source.Events) != 0 {
+		t.Fatalf("Event %+v before the timeout", <-source.Events)
+	}
+
+	source.checkLiveness(now.Add(time.Second + timeout))
+
+	if ev := <-source.Events; ev.Event != HEARTBEAT_OFFLINE || ev.Name != "yellowknife" || !ev.Src.Equal(sender) {
+		t.Errorf("Event %+v", ev)
+	}
+
+	source.checkLiveness(now.Add(2 * timeout))
+
+	if len(source.Events) != 0 || stream.online {
+		t.Errorf("Offline again, online %v", stream.online)
+	}
+}
+
+// Events beyond the room in Events wait in the source, which goes on serving
+// requests from the main loop meanwhile.
+func TestStaticEventsQueued(t *testing.T) {
+	names := []string{"whitehorse", "yellowknife", "iqaluit"}
+
+	source := &UdpSource{
+		Events:            make(chan HeartbeatEvent, 1),
+		removeSinkRequest: make(chan net.IP),
+		Streams:           make(map[IPKey]*UdpStream),
+	}
+
+	now := time.Now()
+
+	for i, name := range names {
+		sender := net.IPv4(10, 1, 1, byte(50+i)).To4()
+		stream := &UdpStream{
+			Name:    name,
+			Static:  &StaticStream{Name: name, Source: sender},
+			timeout: time.Hour,
+		}
+
+		source.statics = append(source.statics, stream)
+		source.touchStream(stream, &RecvBuf{Src: sender}, now)
+	}
+
+	go source.RunLoop()
+
+	done := make(chan bool)
+	go func() {
+		source.RemoveSink(net.IPv4(239, 255, 1, 1))
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RemoveSink blocked behind the events")
+	}
+
+	for _, name := range names {
+		if ev := <-source.Events; ev.Event != HEARTBEAT_ONLINE || ev.Name != name {
+			t.Errorf("Event %+v, expected %s online", ev, name)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package synth
+
+const (
+	MB_SIZE = 16
+
+	NAL_REF_IDC_HIGH = 0x60
+
+	NAL_TYPE_IDR = 5
+	NAL_TYPE_SPS = 7
+	NAL_TYPE_PPS = 8
+	NAL_TYPE_AUD = 9
+
+	PROFILE_BASELINE = 66
+	LEVEL_3          = 30
+
+	SLICE_TYPE_I_ALL = 7
+	MB_TYPE_I_PCM    = 25
+
+	// log2_max_frame_num, every picture is an IDR so frame_num stays 0
+	LOG2_MAX_FRAME_NUM = 4
+)
+
+type yuv struct {
+	y, u, v uint8
+}
+
+// 75% colour bars in BT.601 studio range
+var BARS = []yuv{
+	{180, 128, 128}, // white
+	{162, 44, 142},  // yellow
+	{131, 156, 44},  // cyan
+	{112, 72, 58},   // green
+	{84, 184, 198},  // magenta
+	{65, 100, 212},  // red
+	{35, 212, 114},  // blue
+}
+
+var (
+	BLACK = yuv{16, 128, 128}
+	WHITE = yuv{235, 128, 128}
+)
+
+type bitWriter struct {
+	buf  []byte
+	bits uint
+}
+
+func (w *bitWriter) u(n uint, v uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+
+		if (v>>uint(i))&1 != 0 {
+			w.buf[len(w.buf)-1] |= 1 << (7 - (w.bits % 8))
+		}
+
+		w.bits++
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	n := uint(0)
+	for (v >> n) > 1 {
+		n++
+	}
+
+	w.u(n, 0)
+	w.u(n+1, v)
+}
+
+func (w *bitWriter) se(v int) {
+	if v > 0 {
+		w.ue(uint(2*v - 1))
+	} else {
+		w.ue(uint(-2 * v))
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.bits%8 != 0 {
+		w.u(1, 0)
+	}
+}
+
+func (w *bitWriter) trailing() {
+	w.u(1, 1)
+	w.align()
+}
+
+// escapeRbsp inserts emulation prevention bytes so that the payload never
+// contains a start code.
+func escapeRbsp(rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+
+		out = append(out, b)
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return out
+}
+
+func appendNal(buf []byte, header byte, rbsp []byte) []byte {
+	buf = append(buf, 0, 0, 0, 1, header)
+	return append(buf, escapeRbsp(rbsp)...)
+}
+
+// ColorBars encodes colour bars with a moving block underneath as H.264.
+// Every picture is an IDR made of I_PCM macroblocks, which needs no
+// transform or entropy coding at all, at the price of an uncompressed
+// bitrate. Keep the picture small.
+type ColorBars struct {
+	WidthMbs  int
+	HeightMbs int
+
+	frame int
+	luma  []byte
+	cb    []byte
+	cr    []byte
+}
+
+func NewColorBars(widthMbs, heightMbs int) *ColorBars {
+	width := widthMbs * MB_SIZE
+	height := heightMbs * MB_SIZE
+
+	return &ColorBars{
+		WidthMbs:  widthMbs,
+		HeightMbs: heightMbs,
+		luma:      make([]byte, width*height),
+		cb:        make([]byte, width*height/4),
+		cr:        make([]byte, width*height/4),
+	}
+}
+
+func (bars *ColorBars) Width() int {
+	return bars.WidthMbs * MB_SIZE
+}
+
+func (bars *ColorBars) Height() int {
+	return bars.HeightMbs * MB_SIZE
+}
+
+func (bars *ColorBars) Sps() []byte {
+	var w bitWriter
+	w.u(8, PROFILE_BASELINE)
+	w.u(8, 0xc0) // constraint_set0_flag, constraint_set1_flag
+	w.u(8, LEVEL_3)
+	w.ue(0)                      // seq_parameter_set_id
+	w.ue(LOG2_MAX_FRAME_NUM - 4) // log2_max_frame_num_minus4
+	w.ue(2)                      // pic_order_cnt_type
+	w.ue(1)                      // max_num_ref_frames
+	w.u(1, 0)                    // gaps_in_frame_num_value_allowed_flag
+	w.ue(uint(bars.WidthMbs - 1))
+	w.ue(uint(bars.HeightMbs - 1))
+	w.u(1, 1) // frame_mbs_only_flag
+	w.u(1, 1) // direct_8x8_inference_flag
+	w.u(1, 0) // frame_cropping_flag
+	w.u(1, 0) // vui_parameters_present_flag
+	w.trailing()
+
+	return w.buf
+}
+
+func (bars *ColorBars) Pps() []byte {
+	var w bitWriter
+	w.ue(0)   // pic_parameter_set_id
+	w.ue(0)   // seq_parameter_set_id
+	w.u(1, 0) // entropy_coding_mode_flag
+	w.u(1, 0) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)   // num_slice_groups_minus1
+	w.ue(0)   // num_ref_idx_l0_default_active_minus1
+	w.ue(0)   // num_ref_idx_l1_default_active_minus1
+	w.u(1, 0) // weighted_pred_flag
+	w.u(2, 0) // weighted_bipred_idc
+	w.se(0)   // pic_init_qp_minus26
+	w.se(0)   // pic_init_qs_minus26
+	w.se(0)   // chroma_qp_index_offset
+	w.u(1, 0) // deblocking_filter_control_present_flag
+	w.u(1, 0) // constrained_intra_pred_flag
+	w.u(1, 0) // redundant_pic_cnt_present_flag
+	w.trailing()
+
+	return w.buf
+}
+
+func (bars *ColorBars) fill(x, y int, c yuv) {
+	width := bars.Width()
+
+	bars.luma[y*width+x] = c.y
+
+	if x%2 == 0 && y%2 == 0 {
+		bars.cb[(y/2)*(width/2)+x/2] = c.u
+		bars.cr[(y/2)*(width/2)+x/2] = c.v
+	}
+}
+
+// draw paints the bars over the top two thirds and a white block that moves
+// one macroblock per frame across a black band underneath.
+func (bars *ColorBars) draw() {
+	width := bars.Width()
+	height := bars.Height()
+	split := height * 2 / 3
+
+	block := bars.frame % bars.WidthMbs
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := BARS[x*len(BARS)/width]
+
+			if y >= split {
+				c = BLACK
+				if x/MB_SIZE == block {
+					c = WHITE
+				}
+			}
+
+			bars.fill(x, y, c)
+		}
+	}
+}
+
+func (bars *ColorBars) slice() []byte {
+	width := bars.Width()
+
+	var w bitWriter
+	w.ue(0) // first_mb_in_slice
+	w.ue(SLICE_TYPE_I_ALL)
+	w.ue(0)                    // pic_parameter_set_id
+	w.u(LOG2_MAX_FRAME_NUM, 0) // frame_num
+	w.ue(uint(bars.frame % 2)) // idr_pic_id, differs between neighbours
+	w.u(1, 0)                  // no_output_of_prior_pics_flag
+	w.u(1, 0)                  // long_term_reference_flag
+	w.se(0)                    // slice_qp_delta
+
+	for mby := 0; mby < bars.HeightMbs; mby++ {
+		for mbx := 0; mbx < bars.WidthMbs; mbx++ {
+			w.ue(MB_TYPE_I_PCM)
+			w.align()
+
+			for y := 0; y < MB_SIZE; y++ {
+				offs := (mby*MB_SIZE+y)*width + mbx*MB_SIZE
+				w.buf = append(w.buf, bars.luma[offs:offs+MB_SIZE]...)
+			}
+
+			for _, plane := range [][]byte{bars.cb, bars.cr} {
+				for y := 0; y < MB_SIZE/2; y++ {
+					offs := (mby*MB_SIZE/2+y)*(width/2) + mbx*MB_SIZE/2
+					w.buf = append(w.buf, plane[offs:offs+MB_SIZE/2]...)
+				}
+			}
+
+			w.bits = uint(len(w.buf)) * 8
+		}
+	}
+
+	w.trailing()
+
+	return w.buf
+}
+
+// Frame returns the next picture as an Annex B access unit, repeating the
+// parameter sets so that a receiver can start anywhere.
+func (bars *ColorBars) Frame() []byte {
+	bars.draw()
+
+	var buf []byte
+	buf = appendNal(buf, NAL_TYPE_AUD, []byte{0xf0}) // primary_pic_type 7
+	buf = appendNal(buf, NAL_REF_IDC_HIGH|NAL_TYPE_SPS, bars.Sps())
+	buf = appendNal(buf, NAL_REF_IDC_HIGH|NAL_TYPE_PPS, bars.Pps())
+	buf = appendNal(buf, NAL_REF_IDC_HIGH|NAL_TYPE_IDR, bars.slice())
+
+	bars.frame++
+
+	return buf
+}
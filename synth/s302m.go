@@ -0,0 +1,81 @@
+package synth
+
+import (
+	"math"
+	"math/bits"
+
+	"recstation/mpeg"
+)
+
+const (
+	SAMPLE_RATE = 48000
+
+	// SMPTE 302M carries PCM in private PES packets, identified by this
+	// registration descriptor in the PMT
+	S302M_FORMAT_ID     = "BSSD"
+	S302M_HEADER_LENGTH = 4
+
+	// Each pair of 16-bit samples takes 5 bytes with its validity, user,
+	// channel status and frame bits
+	S302M_PAIR_LENGTH = 5
+
+	// The frame bit marks the start of each AES3 block
+	AES3_BLOCK_FRAMES = 192
+	AES3_FRAME_BIT    = 0x10
+)
+
+// Tone generates a stereo sine wave as SMPTE 302M audio, 16 bits per sample.
+type Tone struct {
+	Frequency float64
+	Amplitude float64
+
+	sample uint64
+}
+
+// NewTone makes a tone at a level given in dBFS.
+func NewTone(frequency, level float64) *Tone {
+	return &Tone{
+		Frequency: frequency,
+		Amplitude: math.Pow(10, level/20) * math.MaxInt16,
+	}
+}
+
+func (tone *Tone) RegistrationDescriptor() []byte {
+	return append([]byte{mpeg.DESCRIPTOR_TAG_REGISTRATION, byte(len(S302M_FORMAT_ID))}, S302M_FORMAT_ID...)
+}
+
+// Samples returns the next n sample pairs as a 302M PES payload.
+func (tone *Tone) Samples(n int) []byte {
+	size := n * S302M_PAIR_LENGTH
+	buf := make([]byte, S302M_HEADER_LENGTH, S302M_HEADER_LENGTH+size)
+
+	// audio_packet_size, then zero for two channels, channel
+	// identification and 16 bits per sample
+	buf[0] = byte(size >> 8)
+	buf[1] = byte(size)
+
+	for i := 0; i < n; i++ {
+		t := float64(tone.sample) / SAMPLE_RATE
+		s := uint16(int16(tone.Amplitude * math.Sin(2*math.Pi*tone.Frequency*t)))
+
+		var frame byte
+		if tone.sample%AES3_BLOCK_FRAMES == 0 {
+			frame = AES3_FRAME_BIT
+		}
+
+		buf = appendPair(buf, s, s, frame)
+		tone.sample++
+	}
+
+	return buf
+}
+
+func appendPair(buf []byte, a, b uint16, frame byte) []byte {
+	return append(buf,
+		bits.Reverse8(byte(a)),
+		bits.Reverse8(byte(a>>8)),
+		bits.Reverse8(byte(b&0x0f)<<4)|frame,
+		bits.Reverse8(byte(b>>4)),
+		bits.Reverse8(byte(b>>12)),
+	)
+}
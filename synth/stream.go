@@ -0,0 +1,77 @@
+package synth
+
+import (
+	"time"
+
+	"recstation/mpeg"
+)
+
+const (
+	PROGRAM   = 1
+	PMT_PID   = mpeg.PID(0x1000)
+	VIDEO_PID = mpeg.PID(0x0100)
+	AUDIO_PID = mpeg.PID(0x0101)
+
+	FRAME_RATE     = 25
+	FRAME_DURATION = time.Second / FRAME_RATE
+
+	// 160x96, small enough for a few streams over loopback
+	WIDTH_MBS  = 10
+	HEIGHT_MBS = 6
+
+	TONE_FREQUENCY = 1000
+	TONE_LEVEL     = -20
+
+	// How far the timestamps run ahead of the PCR, in 90kHz units
+	PTS_DELAY = mpeg.TIMESTAMP_HZ / 10
+)
+
+// Stream muxes the colour bars and tone into a transport stream, one frame
+// at a time, with the PAT and PMT in front of every frame.
+type Stream struct {
+	TransportStreamId uint16
+
+	muxer *mpeg.Muxer
+	bars  *ColorBars
+	tone  *Tone
+	frame uint64
+	pat   []byte
+	pmt   []byte
+}
+
+func NewStream(transportStreamId uint16) *Stream {
+	stream := &Stream{
+		TransportStreamId: transportStreamId,
+		muxer:             mpeg.NewMuxer(),
+		bars:              NewColorBars(WIDTH_MBS, HEIGHT_MBS),
+		tone:              NewTone(TONE_FREQUENCY, TONE_LEVEL),
+	}
+
+	stream.pat = mpeg.MakePat(transportStreamId, PROGRAM, PMT_PID)
+	stream.pmt = mpeg.MakePmt(PROGRAM, VIDEO_PID, []mpeg.PmtStream{
+		{StreamType: mpeg.STREAM_TYPE_H264, Pid: VIDEO_PID},
+		{StreamType: mpeg.STREAM_TYPE_PRIVATE_PES, Pid: AUDIO_PID, Descriptors: stream.tone.RegistrationDescriptor()},
+	})
+
+	return stream
+}
+
+// Frame returns the TS packets of the next frame. The PCR on the first video
+// packet is the time at which the frame is due to be sent.
+func (stream *Stream) Frame() []mpeg.TsBuffer {
+	pcr := stream.frame * mpeg.PCR_HZ / FRAME_RATE
+	pts := pcr/300 + PTS_DELAY
+
+	// Samples for this frame, rounded so that they never drift
+	samples := int((stream.frame+1)*SAMPLE_RATE/FRAME_RATE - stream.frame*SAMPLE_RATE/FRAME_RATE)
+
+	var pkts []mpeg.TsBuffer
+	pkts = append(pkts, stream.muxer.Packetize(mpeg.PID_PAT, stream.pat)...)
+	pkts = append(pkts, stream.muxer.Packetize(PMT_PID, stream.pmt)...)
+	pkts = append(pkts, stream.muxer.PacketizeWithPcr(VIDEO_PID, mpeg.MakePes(mpeg.STREAM_ID_VIDEO, pts, stream.bars.Frame()), pcr)...)
+	pkts = append(pkts, stream.muxer.Packetize(AUDIO_PID, mpeg.MakePes(mpeg.STREAM_ID_PRIVATE_STREAM_1, pts, stream.tone.Samples(samples)))...)
+
+	stream.frame++
+
+	return pkts
+}
@@ -0,0 +1,204 @@
+package synth
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"testing"
+
+	"recstation/mp4"
+	"recstation/mpeg"
+)
+
+type bitReader struct {
+	buf  []byte
+	offs uint
+}
+
+func (r *bitReader) u(n uint) uint {
+	v := uint(0)
+
+	for i := uint(0); i < n; i++ {
+		v = v<<1 | uint(r.buf[r.offs/8]>>(7-r.offs%8))&1
+		r.offs++
+	}
+
+	return v
+}
+
+func (r *bitReader) ue() uint {
+	n := uint(0)
+	for r.u(1) == 0 {
+		n++
+	}
+
+	return (1 << n) - 1 + r.u(n)
+}
+
+func unescape(nal []byte) []byte {
+	var out []byte
+	zeros := 0
+
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+
+		out = append(out, b)
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return out
+}
+
+type nopCloser struct {
+	bytes.Buffer
+}
+
+func (_ *nopCloser) Close() error { return nil }
+
+func Test_Synth_Escape(t *testing.T) {
+	in := []byte{0, 0, 0, 0, 0, 1, 0, 0, 4}
+	out := escapeRbsp(in)
+
+	if !bytes.Equal(out, []byte{0, 0, 3, 0, 0, 3, 0, 1, 0, 0, 4}) {
+		t.Errorf("Escaped to %x", out)
+	}
+
+	if !bytes.Equal(unescape(out), in) {
+		t.Error("Escape does not roundtrip")
+	}
+}
+
+func Test_Synth_ColorBars(t *testing.T) {
+	bars := NewColorBars(WIDTH_MBS, HEIGHT_MBS)
+	nals := mp4.SplitAnnexB(bars.Frame())
+
+	if len(nals) != 4 {
+		t.Fatalf("Got %d NAL units", len(nals))
+	}
+
+	sps, err := mp4.ParseSps(nals[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sps.Width != 160 || sps.Height != 96 || sps.ProfileIdc != PROFILE_BASELINE {
+		t.Errorf("SPS is %+v", sps)
+	}
+
+	if nals[3][0]&0x1f != NAL_TYPE_IDR {
+		t.Fatalf("Last NAL unit has type %d", nals[3][0]&0x1f)
+	}
+
+	// Walk the slice macroblock by macroblock
+	r := bitReader{buf: unescape(nals[3][1:])}
+	r.ue()                  // first_mb_in_slice
+	r.ue()                  // slice_type
+	r.ue()                  // pic_parameter_set_id
+	r.u(LOG2_MAX_FRAME_NUM) // frame_num
+	r.ue()                  // idr_pic_id
+	r.u(2)                  // dec_ref_pic_marking
+	r.ue()                  // slice_qp_delta
+
+	for i := 0; i < WIDTH_MBS*HEIGHT_MBS; i++ {
+		if mbType := r.ue(); mbType != MB_TYPE_I_PCM {
+			t.Fatalf("Macroblock %d has type %d", i, mbType)
+		}
+
+		r.offs = (r.offs + 7) / 8 * 8
+
+		if i == 0 && (r.buf[r.offs/8] != BARS[0].y || r.buf[r.offs/8+256] != BARS[0].u) {
+			t.Errorf("First macroblock starts %x", r.buf[r.offs/8:r.offs/8+4])
+		}
+
+		r.offs += (256 + 2*64) * 8
+	}
+
+	if r.u(1) != 1 || int(r.offs+7)/8 != len(r.buf) {
+		t.Error("Slice does not end with its trailing bits")
+	}
+}
+
+func Test_Synth_Stream(t *testing.T) {
+	stream := NewStream(1)
+	out := &nopCloser{}
+	remux := mp4.NewRemuxer(out)
+
+	audio := mpeg.PesAssembler{Pid: AUDIO_PID}
+	var pmt mpeg.PMT
+	var pcm []int16
+
+	for i := 0; i < 3*FRAME_RATE; i++ {
+		for _, pkt := range stream.Frame() {
+			if err := remux.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+
+			switch pkt.GetPid() {
+			case PMT_PID:
+				pmt.ParsePMT(pkt)
+
+			case AUDIO_PID:
+				if buf := audio.Push(pkt); buf != nil {
+					var pes mpeg.Pes
+					if !pes.ParsePes(buf) {
+						t.Fatal("Audio PES does not parse")
+					}
+
+					pcm = append(pcm, decode302m(t, pes.Payload)...)
+				}
+			}
+		}
+	}
+
+	if err := remux.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if pmt.NumEntry != 2 || pmt.Entry[1].StreamType != mpeg.STREAM_TYPE_PRIVATE_PES {
+		t.Errorf("PMT has %d entries", pmt.NumEntry)
+	}
+
+	if !bytes.HasPrefix(out.Bytes()[4:], []byte("ftyp")) || !bytes.Contains(out.Bytes(), []byte("avc1")) {
+		t.Error("Remuxed stream has no video track")
+	}
+
+	if len(pcm) != 2*3*SAMPLE_RATE {
+		t.Fatalf("Got %d samples", len(pcm))
+	}
+
+	amplitude := math.Pow(10, TONE_LEVEL/20.0) * math.MaxInt16
+
+	for i := 0; i < len(pcm); i += 2 {
+		want := int16(amplitude * math.Sin(2*math.Pi*TONE_FREQUENCY*float64(i/2)/SAMPLE_RATE))
+
+		if pcm[i] != want || pcm[i+1] != want {
+			t.Fatalf("Sample %d is %d/%d, expected %d", i/2, pcm[i], pcm[i+1], want)
+		}
+	}
+}
+
+func decode302m(t *testing.T, buf []byte) []int16 {
+	size := int(buf[0])<<8 | int(buf[1])
+	if size != len(buf)-S302M_HEADER_LENGTH {
+		t.Fatalf("302M size %d for %d bytes", size, len(buf))
+	}
+
+	var out []int16
+
+	for buf = buf[S302M_HEADER_LENGTH:]; len(buf) >= S302M_PAIR_LENGTH; buf = buf[S302M_PAIR_LENGTH:] {
+		a := uint16(bits.Reverse8(buf[1]))<<8 | uint16(bits.Reverse8(buf[0]))
+		b := uint16(bits.Reverse8(buf[4]&0xf0))<<12 | uint16(bits.Reverse8(buf[3]))<<4 | uint16(bits.Reverse8(buf[2]))>>4
+
+		out = append(out, int16(a), int16(b))
+	}
+
+	return out
+}
@@ -1,18 +1,31 @@
 package recstation
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"recstation/mpeg"
+	"recstation/rtp"
 
-	"github.com/google/vectorio"
 	"golang.org/x/net/ipv4"
 )
 
 const (
 	NUM_INFLIGHT_PACKETS = 2048
 	NUM_TS_PER_PACKET    = 10
+
+	// Datagrams read per recvmmsg call
+	RECV_BATCH_SIZE = 64
+
+	NUM_STREAM_EVENTS = 64
+
+	// How often RTP packets held behind a gap are checked for having waited
+	// long enough
+	RTP_EXPIRE_INTERVAL = 100 * time.Millisecond
 )
 
 type RecvPacket struct {
@@ -23,60 +36,219 @@ type RecvPacket struct {
 }
 
 type RecvBuf struct {
-	Stop   bool
-	Err    error
-	Flags  int
-	RawOob [1024]byte
-	RawBuf [2048]byte
-	Oob    []byte
-	Buf    []byte
-	Src    net.IP
-	Dst    net.IP
-	Pkts   []mpeg.TsBuffer
+	Stop    bool
+	Err     error
+	Flags   int
+	IfIndex int
+	RawOob  [1024]byte
+	RawBuf  [2048]byte
+	Oob     []byte
+	Buf     []byte
+	Src     net.IP
+	SrcPort int
+	Dst     net.IP
+	Pkts    []mpeg.TsBuffer
+
+	// Kernel receive time when available
+	Time       time.Time
+	KernelTime bool
+
+	Conn     *McastConn
+	Drops    uint32
+	HasDrops bool
+}
+
+type UdpStream struct {
+	Name   string
+	Group  net.IP
+	Sink   *Sink
+	Config StreamConfigJson
+
+	Rtp       *rtp.Receiver
+	rtpPkts   [rtp.WINDOW_SIZE][]mpeg.TsBuffer
+	rtpHdr    rtp.Header
+	fecHdr    rtp.FecHeader
+	fecJoined bool
+	tsPkts    uint64
+	rtpCount  uint64
+
+	Secondary *SecondaryGroup
+	paths     []*udpPath
+	dedup     tsDedup
+	merge     rtpMerge
+	filter    *sourceFilter
+
+	// Static streams and groups with traffic liveness go online when their
+	// packets arrive rather than on a heartbeat
+	Static   *StaticStream
+	Traffic  bool
+	conn     *McastConn
+	online   bool
+	lastSeen time.Time
+	timeout  time.Duration
+}
+
+func (stream *UdpStream) groups() []net.IP {
+	groups := []net.IP{stream.Group}
+
+	if stream.Secondary != nil && !stream.Secondary.Addr.Equal(stream.Group) {
+		groups = append(groups, stream.Secondary.Addr)
+	}
+
+	return groups
+}
+
+func (stream *UdpStream) pathFor(rx *RecvBuf) int {
+	for i, path := range stream.paths {
+		if !path.Group.Equal(rx.Dst) {
+			continue
+		}
+
+		if path.Iface == nil || rx.IfIndex == 0 || path.Iface.Index == rx.IfIndex {
+			return i
+		}
+	}
+
+	return 0
 }
 
 type UdpSource struct {
-	Iface   *net.Interface
-	UdpConn *net.UDPConn
-	PktConn *ipv4.PacketConn
+	// Times a receive loop found RxBufReady empty. First in the struct for
+	// 64-bit atomic alignment.
+	poolDepleted uint64
 
-	SinkMap map[uint32]*Sink
+	Iface *net.Interface
+
+	// One socket per address family on the media port
+	Conns []*McastConn
+
+	// SMPTE 2022-1 column and row FEC arrive on the ports two and four above
+	// the media port.
+	FecConns []*McastConn
+
+	Streams map[IPKey]*UdpStream
+
+	// Unicast streams, matched by socket or sender address
+	statics []*UdpStream
+	RcvBuf  int
+
+	// Online and offline events for static streams
+	Events chan HeartbeatEvent
+
+	// Events waiting for room in Events, so that the run loop never blocks
+	// on the main loop while it may be waiting on us
+	queued []HeartbeatEvent
+
+	captures []*Capture
 
 	ListenError       chan error
 	RxBufReady        chan *RecvBuf
-	RxBufPending      chan *RecvBuf
+	RxBufPending      chan []*RecvBuf
+	FecPending        chan []*RecvBuf
 	RecvPackets       chan *RecvPacket
+	StatusRequest     chan chan *UdpSourceStatusMessage
 	leaveGroup        chan net.IP
 	addSink           chan addSinkMsg
 	removeSinkRequest chan net.IP
+	addStatic         chan *UdpStream
+	addTraffic        chan addSinkMsg
+	attachSink        chan attachSinkMsg
+	detachSink        chan string
+	addCapture        chan *Capture
+}
+
+type UdpSourceStatusMessage struct {
+	Streams      []*UdpStreamStatusMessage `json:"streams"`
+	Sockets      []*UdpSocketStatusMessage `json:"sockets"`
+	PoolDepleted uint64                    `json:"pool_depleted"`
+}
+
+type UdpSocketStatusMessage struct {
+	Addr   string `json:"addr"`
+	RcvBuf int    `json:"rcvbuf"`
+	Drops  uint64 `json:"drops"`
+}
+
+type UdpStreamStatusMessage struct {
+	Name      string     `json:"name"`
+	Group     string     `json:"group"`
+	TsPackets uint64     `json:"ts_packets"`
+	Rtp       *rtp.Stats `json:"rtp,omitempty"`
+
+	Paths   []*UdpPathStatusMessage    `json:"paths,omitempty"`
+	Foreign *SourceFilterStatusMessage `json:"foreign,omitempty"`
+	Arrival *ArrivalStatusMessage      `json:"arrival,omitempty"`
 }
 
 type addSinkMsg struct {
-	Group net.IP
-	Sink  *Sink
+	Name      string
+	Group     net.IP
+	Source    net.IP
+	Sink      *Sink
+	Config    StreamConfigJson
+	Secondary *SecondaryGroup
+	Timeout   time.Duration
 }
 
-func (source *UdpSource) AddSink(group net.IP, sink *Sink) {
+func (source *UdpSource) AddSink(group, src net.IP, sink *Sink, config StreamConfigJson, secondary *SecondaryGroup) {
 	source.addSink <- addSinkMsg{
-		Group: group,
-		Sink:  sink,
+		Group:     group,
+		Source:    src,
+		Sink:      sink,
+		Config:    config,
+		Secondary: secondary,
+	}
+}
+
+// AddTraffic joins a group with traffic liveness. Its stream goes online
+// through Events once packets arrive and offline after they have stopped for
+// the idle timeout.
+func (source *UdpSource) AddTraffic(group *Group, config StreamConfigJson, secondary *SecondaryGroup) {
+	source.addTraffic <- addSinkMsg{
+		Name:      group.Name,
+		Group:     group.Addr,
+		Source:    group.Source,
+		Config:    config,
+		Secondary: secondary,
+		Timeout:   group.IdleTimeout,
 	}
 }
 
+func (source *UdpSource) Status() *UdpSourceStatusMessage {
+	ch := make(chan *UdpSourceStatusMessage)
+
+	source.StatusRequest <- ch
+
+	return <-ch
+}
+
 func (source *UdpSource) RemoveSink(group net.IP) {
 	source.removeSinkRequest <- group
 }
 
-func MakeUdpSource(iface *net.Interface, listenAddr string) (*UdpSource, error) {
+func (source *UdpSource) AddCapture(capture *Capture) {
+	source.addCapture <- capture
+}
+
+func MakeUdpSource(iface *net.Interface, listenAddr string, enableFec bool, enableV6 bool, rcvbuf int, memberships *Memberships) (*UdpSource, error) {
 	source := &UdpSource{
 		Iface:             iface,
+		RcvBuf:            rcvbuf,
+		Events:            make(chan HeartbeatEvent, NUM_STREAM_EVENTS),
 		ListenError:       make(chan error),
 		RxBufReady:        make(chan *RecvBuf, NUM_INFLIGHT_PACKETS),
-		RxBufPending:      make(chan *RecvBuf, NUM_INFLIGHT_PACKETS),
+		RxBufPending:      make(chan []*RecvBuf, NUM_INFLIGHT_PACKETS/RECV_BATCH_SIZE),
+		FecPending:        make(chan []*RecvBuf, NUM_INFLIGHT_PACKETS/RECV_BATCH_SIZE),
+		StatusRequest:     make(chan chan *UdpSourceStatusMessage),
 		leaveGroup:        make(chan net.IP),
 		addSink:           make(chan addSinkMsg),
 		removeSinkRequest: make(chan net.IP),
-		SinkMap:           make(map[uint32]*Sink),
+		addStatic:         make(chan *UdpStream),
+		addTraffic:        make(chan addSinkMsg),
+		attachSink:        make(chan attachSinkMsg),
+		detachSink:        make(chan string),
+		addCapture:        make(chan *Capture),
+		Streams:           make(map[IPKey]*UdpStream),
 	}
 
 	laddr, err := net.ResolveUDPAddr("udp4", listenAddr)
@@ -84,17 +256,44 @@ func MakeUdpSource(iface *net.Interface, listenAddr string) (*UdpSource, error)
 		return nil, err
 	}
 
-	conn, err := net.ListenUDP("udp4", laddr)
-	if err != nil {
-		return nil, err
+	laddrs := []*net.UDPAddr{laddr}
+	if enableV6 {
+		laddrs = append(laddrs, &net.UDPAddr{IP: net.IPv6unspecified, Port: laddr.Port})
 	}
 
-	source.UdpConn = conn
+	for _, addr := range laddrs {
+		conn, err := ListenMcast(addr)
+		if err != nil {
+			return nil, err
+		}
 
-	source.PktConn = ipv4.NewPacketConn(source.UdpConn)
+		conn.Memberships = memberships
 
-	if err := source.PktConn.SetControlMessage(ipv4.FlagDst, true); err != nil {
-		return nil, err
+		if rcvbuf > 0 {
+			if err := conn.SetReadBuffer(rcvbuf); err != nil {
+				return nil, err
+			}
+		}
+
+		source.Conns = append(source.Conns, conn)
+
+		if !enableFec {
+			continue
+		}
+
+		for _, offset := range []int{rtp.FEC_PORT_OFFSET_COLUMN, rtp.FEC_PORT_OFFSET_ROW} {
+			fecAddr := *addr
+			fecAddr.Port += offset
+
+			conn, err := ListenMcast(&fecAddr)
+			if err != nil {
+				return nil, err
+			}
+
+			conn.Memberships = memberships
+
+			source.FecConns = append(source.FecConns, conn)
+		}
 	}
 
 	for i := 0; i < NUM_INFLIGHT_PACKETS; i++ {
@@ -104,124 +303,613 @@ func MakeUdpSource(iface *net.Interface, listenAddr string) (*UdpSource, error)
 	}
 
 	go source.RunLoop()
-	go source.RecvLoop(source.UdpConn, source.RxBufReady, source.RxBufPending)
+
+	for _, conn := range source.Conns {
+		go source.RecvLoop(conn, source.RxBufReady, source.RxBufPending)
+	}
+
+	for _, conn := range source.FecConns {
+		go source.RecvLoop(conn, source.RxBufReady, source.FecPending)
+	}
 
 	return source, nil
 }
 
+func (source *UdpSource) pathIface(path *udpPath) *net.Interface {
+	if path.Iface != nil {
+		return path.Iface
+	}
+
+	return source.Iface
+}
+
+func (source *UdpSource) joinStream(stream *UdpStream) error {
+	for _, path := range stream.paths {
+		conns := mcastConnsFor(source.Conns, path.Group)
+		if len(conns) == 0 {
+			return fmt.Errorf("No socket for group %s", path.Group)
+		}
+
+		if stream.Config.Fec {
+			conns = append(conns, mcastConnsFor(source.FecConns, path.Group)...)
+			stream.fecJoined = true
+		}
+
+		for _, conn := range conns {
+			if err := conn.JoinGroup(source.pathIface(path), path.Group, path.Source); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (source *UdpSource) leaveStream(stream *UdpStream) error {
+	for _, path := range stream.paths {
+		conns := mcastConnsFor(source.Conns, path.Group)
+
+		if stream.fecJoined {
+			conns = append(conns, mcastConnsFor(source.FecConns, path.Group)...)
+		}
+
+		for _, conn := range conns {
+			if err := conn.LeaveGroup(source.pathIface(path), path.Group, path.Source); err != nil {
+				return err
+			}
+		}
+	}
+
+	stream.fecJoined = false
+
+	return nil
+}
+
+func makeStreamFilter(name string, config StreamConfigJson) *sourceFilter {
+	// Validated by MakeState
+	allowed, _ := parseSourceList(name, config.AllowedSources)
+
+	return makeSourceFilter(allowed, config.LockSource)
+}
+
+func makeStreamRtp(config StreamConfigJson) *rtp.Receiver {
+	if !config.AllowRtp() {
+		return nil
+	}
+
+	depth := config.RtpReorderDepth
+	if config.Fec && depth == 0 {
+		depth = rtp.FEC_REORDER_DEPTH
+	}
+
+	return rtp.NewReceiver(depth)
+}
+
+// streamFor finds the stream a datagram belongs to, by multicast group first
+// and then among the static streams.
+func (source *UdpSource) streamFor(rx *RecvBuf) *UdpStream {
+	if stream, found := source.Streams[MakeIPKey(rx.Dst)]; found {
+		return stream
+	}
+
+	return source.staticFor(rx)
+}
+
+// makeGroupStream sets up the stream of a group and its secondary, and
+// joins them.
+func (source *UdpSource) makeGroupStream(name string, msg addSinkMsg) *UdpStream {
+	stream := &UdpStream{
+		Name:      name,
+		Group:     msg.Group,
+		Sink:      msg.Sink,
+		Config:    msg.Config,
+		Secondary: msg.Secondary,
+	}
+
+	stream.paths = append(stream.paths, &udpPath{
+		Group:  msg.Group,
+		Source: msg.Source,
+	})
+
+	if msg.Secondary != nil {
+		log.Printf("Adding %s on %s as secondary for %s", msg.Secondary.Addr, msg.Secondary.Iface.Name, msg.Group)
+
+		stream.paths[0].Iface = source.Iface
+		stream.paths = append(stream.paths, &udpPath{
+			Group:  msg.Secondary.Addr,
+			Source: msg.Secondary.Source,
+			Iface:  msg.Secondary.Iface,
+		})
+	}
+
+	stream.Rtp = makeStreamRtp(msg.Config)
+	stream.filter = makeStreamFilter(stream.Name, msg.Config)
+
+	if err := source.joinStream(stream); err != nil {
+		panic(err)
+	}
+
+	for _, group := range stream.groups() {
+		source.Streams[MakeIPKey(group)] = stream
+	}
+
+	return stream
+}
+
+// emit sends an event, queueing it when Events is full.
+func (source *UdpSource) emit(ev HeartbeatEvent) {
+	if len(source.queued) == 0 {
+		select {
+		case source.Events <- ev:
+			return
+		default:
+		}
+	}
+
+	source.queued = append(source.queued, ev)
+}
+
 func (source *UdpSource) RunLoop() {
 	running := true
 
-	npkts := 0
+	liveness := time.NewTicker(STATIC_LIVENESS_INTERVAL)
+	defer liveness.Stop()
+
+	expire := time.NewTicker(RTP_EXPIRE_INTERVAL)
+	defer expire.Stop()
+
 	for running {
+		var events chan HeartbeatEvent
+		var next HeartbeatEvent
+
+		if len(source.queued) > 0 {
+			events = source.Events
+			next = source.queued[0]
+		}
+
 		select {
+		case events <- next:
+			source.queued = source.queued[1:]
+
 		case msg := <-source.addSink:
 			log.Printf("Adding %s", msg.Group)
 
-			if err := source.PktConn.JoinGroup(source.Iface, &net.UDPAddr{IP: msg.Group}); err != nil {
-				panic(err)
-			}
+			source.makeGroupStream(msg.Sink.Name, msg)
 
-			key := IPtoU32(msg.Group)
-			source.SinkMap[key] = msg.Sink
+		case msg := <-source.addTraffic:
+			log.Printf("Joining %s, online while packets arrive", msg.Group)
+
+			stream := source.makeGroupStream(msg.Name, msg)
+			stream.Traffic = true
+			stream.timeout = msg.Timeout
 
 		case addr := <-source.removeSinkRequest:
 			log.Printf("Removing sink for %s", addr)
 
-			key := IPtoU32(addr)
-			delete(source.SinkMap, key)
+			if stream, found := source.Streams[MakeIPKey(addr)]; found {
+				for _, group := range stream.groups() {
+					delete(source.Streams, MakeIPKey(group))
+				}
+			}
 
 		case group := <-source.leaveGroup:
-			if err := source.PktConn.LeaveGroup(source.Iface, &net.UDPAddr{IP: group}); err != nil {
+			stream, found := source.Streams[MakeIPKey(group)]
+			if !found {
+				for _, conn := range mcastConnsFor(source.Conns, group) {
+					if err := conn.LeaveGroup(source.Iface, group, nil); err != nil {
+						panic(err)
+					}
+				}
+
+				continue
+			}
+
+			if err := source.leaveStream(stream); err != nil {
 				panic(err)
 			}
 
 		case err := <-source.ListenError:
 			panic(err)
 
-		case rx := <-source.RxBufPending:
-			n := len(rx.Buf)
-			rx.Pkts = rx.Pkts[:0]
+		case resp := <-source.StatusRequest:
+			st := &UdpSourceStatusMessage{
+				PoolDepleted: atomic.LoadUint64(&source.poolDepleted),
+			}
+
+			for _, conn := range append(source.Conns, source.FecConns...) {
+				st.Sockets = append(st.Sockets, &UdpSocketStatusMessage{
+					Addr:   conn.UdpConn.LocalAddr().String(),
+					RcvBuf: conn.RcvBuf,
+					Drops:  conn.Drops,
+				})
+			}
 
-			for offs := 0; offs < n; offs += mpeg.TS_PACKET_LENGTH {
-				pkt := mpeg.TsBuffer(rx.Buf[offs:(offs + mpeg.TS_PACKET_LENGTH)])
+			for key, stream := range source.Streams {
+				if key != MakeIPKey(stream.Group) {
+					continue
+				}
 
-				if pkt.IsValid() && pkt.GetPid() != mpeg.PID_PADDING {
-					rx.Pkts = append(rx.Pkts, pkt)
+				msg := &UdpStreamStatusMessage{
+					Name:      stream.Name,
+					Group:     stream.Group.String(),
+					TsPackets: stream.tsPkts,
 				}
+
+				if stream.Rtp != nil && stream.rtpCount > 0 {
+					stats := stream.Rtp.Stats
+					msg.Rtp = &stats
+				}
+
+				if stream.filter != nil {
+					msg.Foreign = stream.filter.Status()
+				}
+
+				msg.Arrival = stream.paths[0].arrival.Status()
+
+				if len(stream.paths) > 1 {
+					for _, path := range stream.paths {
+						msg.Paths = append(msg.Paths, path.Status())
+					}
+				}
+
+				st.Streams = append(st.Streams, msg)
+			}
+
+			for _, stream := range source.statics {
+				if stream.conn != nil {
+					st.Sockets = append(st.Sockets, &UdpSocketStatusMessage{
+						Addr:   stream.conn.UdpConn.LocalAddr().String(),
+						RcvBuf: stream.conn.RcvBuf,
+						Drops:  stream.conn.Drops,
+					})
+				}
+
+				if !stream.online {
+					continue
+				}
+
+				msg := &UdpStreamStatusMessage{
+					Name:      stream.Name,
+					Group:     stream.Static.String(),
+					TsPackets: stream.tsPkts,
+				}
+
+				if stream.Rtp != nil && stream.rtpCount > 0 {
+					stats := stream.Rtp.Stats
+					msg.Rtp = &stats
+				}
+
+				if stream.filter != nil {
+					msg.Foreign = stream.filter.Status()
+				}
+
+				msg.Arrival = stream.paths[0].arrival.Status()
+
+				st.Streams = append(st.Streams, msg)
 			}
 
-			if len(rx.Pkts) > 0 {
-				npkts += len(rx.Pkts)
+			resp <- st
 
-				key := IPtoU32(rx.Dst)
+		case stream := <-source.addStatic:
+			log.Printf("Adding static stream %s on %s", stream.Name, stream.Static)
 
-				if sink, found := source.SinkMap[key]; found {
-					//log.Printf("%s => %s: n=%d", rp.Src, rp.Dst, len(rp.Pkts))
-					sink.Packets <- rx.Pkts
+			source.statics = append(source.statics, stream)
 
-					if sink.Preview != nil && sink.Preview.Input != nil {
-						var multiple [10][]byte
+		case msg := <-source.attachSink:
+			if stream := source.streamByName(msg.Name); stream != nil {
+				stream.Sink = msg.Sink
+			}
+
+		case name := <-source.detachSink:
+			if stream := source.streamByName(name); stream != nil {
+				stream.Sink = nil
+				stream.Rtp = makeStreamRtp(stream.Config)
+			}
 
-						npkts := len(rx.Pkts)
-						nbytes := 0
-						for i, pkt := range rx.Pkts {
-							multiple[i] = pkt[:mpeg.TS_PACKET_LENGTH]
-							nbytes += len(multiple[i])
+		case now := <-liveness.C:
+			source.checkLiveness(now)
 
-							if multiple[i][0] != 'G' {
-								log.Printf("bad TS preview")
-							}
-						}
+		case now := <-expire.C:
+			source.expireRtp(now)
 
-						n, err := vectorio.Writev(sink.Preview.Input, multiple[:npkts])
-						if err != nil {
-							log.Printf("Failed to write into preview (%d bytes): %s", n, err)
-							sink.Preview.Input = nil
-						}
+		case capture := <-source.addCapture:
+			source.captures = append(source.captures, capture)
 
-						if n != nbytes {
-							log.Printf("Bad number of preview bytes: %d vs %d", n, nbytes)
-						}
+		case batch := <-source.RxBufPending:
+			for _, rx := range batch {
+				if rx.HasDrops {
+					rx.Conn.countDrops(rx.Drops)
+				}
+
+				if rx.Err == nil && len(source.captures) > 0 {
+					source.capture(rx)
+				}
+
+				if rx.Err == nil {
+					if stream := source.streamFor(rx); stream != nil {
+						source.receive(stream, rx)
 					}
 				}
+
+				rx.Stop = false
+				source.RxBufReady <- rx
 			}
 
-			rx.Stop = false
-			source.RxBufReady <- rx
+		case batch := <-source.FecPending:
+			for _, rx := range batch {
+				if rx.HasDrops {
+					rx.Conn.countDrops(rx.Drops)
+				}
+
+				if rx.Err == nil && len(source.captures) > 0 {
+					source.capture(rx)
+				}
+
+				if rx.Err == nil {
+					if stream := source.streamFor(rx); stream != nil {
+						source.receiveFec(stream, rx)
+					}
+				}
+
+				rx.Stop = false
+				source.RxBufReady <- rx
+			}
+		}
+	}
+}
+
+func (source *UdpSource) capture(rx *RecvBuf) {
+	src := &net.UDPAddr{IP: rx.Src, Port: rx.SrcPort}
+	dst := &net.UDPAddr{IP: rx.Dst, Port: rx.Conn.UdpConn.LocalAddr().(*net.UDPAddr).Port}
+
+	source.captures = writeCaptures(source.captures, false, rx.Time, src, dst, rx.Buf)
+}
+
+func (source *UdpSource) receiveFec(stream *UdpStream, rx *RecvBuf) {
+	if stream.Rtp == nil || !stream.Config.Fec {
+		return
+	}
+
+	if stream.filter != nil && !stream.filter.Allow(rx.Src, stream.pathFor(rx), stream.Name) {
+		return
+	}
+
+	payload, err := rtp.Parse(rx.Buf, &stream.rtpHdr)
+	if err != nil {
+		stream.Rtp.Errors++
+		return
+	}
+
+	payload, err = rtp.ParseFec(payload, &stream.fecHdr)
+	if err != nil {
+		stream.Rtp.Errors++
+		return
+	}
+
+	stream.Rtp.PushFec(&stream.fecHdr, payload)
+
+	source.drainRtp(stream)
+}
+
+func (source *UdpSource) receive(stream *UdpStream, rx *RecvBuf) {
+	now := time.Now()
+
+	pathIdx := stream.pathFor(rx)
+
+	if stream.filter != nil && !stream.filter.Allow(rx.Src, pathIdx, stream.Name) {
+		return
+	}
+
+	path := stream.paths[pathIdx]
+	path.Datagrams++
+	path.lastSeen = now
+	path.arrival.Arrive(rx.Time, rx.KernelTime)
+
+	if stream.Static != nil || stream.Traffic {
+		source.touchStream(stream, rx, now)
+	}
+
+	if stream.Rtp != nil && rtp.IsRtp(rx.Buf) {
+		stream.rtpCount++
+
+		payload, err := rtp.Parse(rx.Buf, &stream.rtpHdr)
+		if err != nil {
+			stream.Rtp.Errors++
+			return
+		}
+
+		path.trackSeq(stream.rtpHdr.SequenceNumber)
+		path.arrival.ScanPcr(payload, rx.Time)
+
+		// Both paths carry identical sequence numbers, and the second
+		// copy is no duplicate
+		if len(stream.paths) > 1 && !stream.merge.Check(stream.rtpHdr.SequenceNumber, pathIdx) {
+			return
+		}
+
+		stream.Rtp.Push(&stream.rtpHdr, payload, rx.Time)
+
+		source.drainRtp(stream)
+
+		return
+	}
+
+	if !stream.Config.AllowTs() {
+		return
+	}
+
+	path.arrival.ScanPcr(rx.Buf, rx.Time)
+
+	if len(stream.paths) > 1 && !stream.dedup.Check(rx.Buf, pathIdx, stream.paths, now) {
+		return
+	}
+
+	rx.Pkts = source.deliver(stream, rx.Buf, rx.Pkts)
+}
+
+// expireRtp hands over the RTP packets that have waited too long behind a
+// gap, for streams whose sender has paused.
+func (source *UdpSource) expireRtp(now time.Time) {
+	streams := append([]*UdpStream(nil), source.statics...)
+
+	for key, stream := range source.Streams {
+		if key == MakeIPKey(stream.Group) {
+			streams = append(streams, stream)
+		}
+	}
+
+	for _, stream := range streams {
+		if stream.Rtp == nil || stream.rtpCount == 0 {
+			continue
 		}
+
+		stream.Rtp.Expire(now)
+
+		source.drainRtp(stream)
 	}
 }
 
-func (_ *UdpSource) RecvLoop(conn *net.UDPConn, source chan *RecvBuf, sink chan *RecvBuf) {
+func (source *UdpSource) drainRtp(stream *UdpStream) {
 	for {
-		rx := <-source
+		seq, payload, ok := stream.Rtp.Pop()
+		if !ok {
+			break
+		}
+
+		slot := seq % rtp.WINDOW_SIZE
+		if stream.rtpPkts[slot] == nil {
+			stream.rtpPkts[slot] = make([]mpeg.TsBuffer, 0, NUM_TS_PER_PACKET)
+		}
+
+		stream.rtpPkts[slot] = source.deliver(stream, payload, stream.rtpPkts[slot])
+	}
+}
+
+// deliver splits a datagram payload into TS packets and hands them to the
+// stream's sink. The pkts slice is reused to hold the packets and
+// must not be touched again until the sink is done with it.
+func (source *UdpSource) deliver(stream *UdpStream, buf []byte, pkts []mpeg.TsBuffer) []mpeg.TsBuffer {
+	n := len(buf)
+	pkts = pkts[:0]
+
+	// A static stream has no sink until RunMain has handled its online event
+	if stream.Sink == nil {
+		return pkts
+	}
+
+	for offs := 0; offs+mpeg.TS_PACKET_LENGTH <= n && len(pkts) < NUM_TS_PER_PACKET; offs += mpeg.TS_PACKET_LENGTH {
+		pkt := mpeg.TsBuffer(buf[offs:(offs + mpeg.TS_PACKET_LENGTH)])
+
+		if pkt.IsValid() && pkt.GetPid() != mpeg.PID_PADDING {
+			pkts = append(pkts, pkt)
+		}
+	}
+
+	if len(pkts) == 0 {
+		return pkts
+	}
+
+	stream.tsPkts += uint64(len(pkts))
+
+	stream.Sink.WritePackets(pkts)
+
+	return pkts
+}
+
+// RecvLoop reads datagrams into as many free buffers as are available, up to
+// RECV_BATCH_SIZE per syscall, and hands them to the pending channel as a
+// batch.
+func (source *UdpSource) RecvLoop(conn *McastConn, ready chan *RecvBuf, pending chan []*RecvBuf) {
+	msgs := make([]ipv4.Message, RECV_BATCH_SIZE)
+
+	for {
+		var rx *RecvBuf
+
+		select {
+		case rx = <-ready:
+		default:
+			atomic.AddUint64(&source.poolDepleted, 1)
+			rx = <-ready
+		}
 
 		if rx.Stop {
 			break
 		}
 
-		var n, oobn int
-		var src *net.UDPAddr
+		batch := make([]*RecvBuf, 1, RECV_BATCH_SIZE)
+		batch[0] = rx
 
-		for n == 0 {
-			n, oobn, rx.Flags, src, rx.Err = conn.ReadMsgUDP(rx.RawBuf[:], rx.RawOob[:])
+	fill:
+		for len(batch) < RECV_BATCH_SIZE {
+			select {
+			case rx := <-ready:
+				batch = append(batch, rx)
+			default:
+				break fill
+			}
 		}
 
-		if rx.Err == nil {
-			rx.Oob = rx.RawOob[:oobn]
-			rx.Buf = rx.RawBuf[:n]
-			rx.Src = src.IP.To4()
+		for i, rx := range batch {
+			msgs[i].Buffers = [][]byte{rx.RawBuf[:]}
+			msgs[i].OOB = rx.RawOob[:]
+		}
 
-			var cm ipv4.ControlMessage
+		n, err := conn.ReadBatch(msgs[:len(batch)])
+		if err != nil {
+			for _, rx := range batch[1:] {
+				ready <- rx
+			}
 
-			if err := cm.Parse(rx.Oob); err != nil {
-				rx.Err = err
-			} else {
-				rx.Dst = cm.Dst.To4()
+			if errors.Is(err, net.ErrClosed) {
+				ready <- batch[0]
+				return
 			}
+
+			batch[0].Err = err
+			pending <- batch[:1]
+
+			continue
+		}
+
+		received := batch[:0]
+		now := time.Now()
+
+		for i, rx := range batch[:n] {
+			m := &msgs[i]
+
+			if m.N == 0 {
+				ready <- rx
+				continue
+			}
+
+			rx.Err = nil
+			rx.Conn = conn
+			rx.Flags = m.Flags
+			rx.Oob = rx.RawOob[:m.NN]
+			rx.Buf = rx.RawBuf[:m.N]
+
+			rx.Time, rx.KernelTime = conn.ParseTimestamp(rx.Oob)
+			if !rx.KernelTime {
+				rx.Time = now
+			}
+
+			if src, ok := m.Addr.(*net.UDPAddr); ok {
+				rx.Src = normalizeIP(src.IP)
+				rx.SrcPort = src.Port
+			}
+
+			rx.Dst, rx.IfIndex, rx.Err = conn.ParseControl(rx.Oob)
+			rx.Drops, rx.HasDrops = conn.ParseDrops(rx.Oob)
+
+			received = append(received, rx)
+		}
+
+		for _, rx := range batch[n:] {
+			ready <- rx
 		}
 
-		sink <- rx
+		if len(received) > 0 {
+			pending <- received
+		}
 	}
 }
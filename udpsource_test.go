@@ -0,0 +1,202 @@
+package recstation
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"recstation/mpeg"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Datagrams queued on the socket before each timed drain. Loopback delivery
+// happens inside the sender's syscall, so sending and receiving concurrently
+// would mostly measure the sender.
+const BENCH_CHUNK = 1024
+
+type benchSocket struct {
+	rx   *McastConn
+	tx   *ipv4.PacketConn
+	msgs []ipv4.Message
+}
+
+func makeBenchSocket(b *testing.B) *benchSocket {
+	rx, err := ListenMcast(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	if err := rx.UdpConn.SetReadBuffer(8 << 20); err != nil {
+		b.Fatal(err)
+	}
+
+	dst := rx.UdpConn.LocalAddr().(*net.UDPAddr)
+
+	tx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: dst.IP})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	payload := make([]byte, 7*188)
+
+	msgs := make([]ipv4.Message, RECV_BATCH_SIZE)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{payload}
+		msgs[i].Addr = dst
+	}
+
+	return &benchSocket{
+		rx:   rx,
+		tx:   ipv4.NewPacketConn(tx),
+		msgs: msgs,
+	}
+}
+
+func (s *benchSocket) fill(b *testing.B, n int) {
+	for n > 0 {
+		m := s.msgs
+		if n < len(m) {
+			m = m[:n]
+		}
+
+		sent, err := s.tx.WriteBatch(m, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		n -= sent
+	}
+}
+
+func (s *benchSocket) Close() {
+	s.rx.UdpConn.Close()
+	s.tx.Close()
+}
+
+// BenchmarkRecvSingle is the old receive path, one ReadMsgUDP per datagram.
+func BenchmarkRecvSingle(b *testing.B) {
+	s := makeBenchSocket(b)
+	defer s.Close()
+
+	rx := &RecvBuf{}
+
+	b.ResetTimer()
+
+	total := 0
+
+	for total < b.N {
+		b.StopTimer()
+		s.fill(b, BENCH_CHUNK)
+		b.StartTimer()
+
+		for j := 0; j < BENCH_CHUNK; j++ {
+			n, oobn, _, _, err := s.rx.UdpConn.ReadMsgUDP(rx.RawBuf[:], rx.RawOob[:])
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			rx.Buf = rx.RawBuf[:n]
+			rx.Dst, rx.IfIndex, rx.Err = s.rx.ParseControl(rx.RawOob[:oobn])
+		}
+
+		total += BENCH_CHUNK
+	}
+
+	b.ReportMetric(float64(total)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+// BenchmarkRecvBatch is the recvmmsg path used by RecvLoop.
+func BenchmarkRecvBatch(b *testing.B) {
+	s := makeBenchSocket(b)
+	defer s.Close()
+
+	bufs := make([]*RecvBuf, RECV_BATCH_SIZE)
+	msgs := make([]ipv4.Message, RECV_BATCH_SIZE)
+
+	for i := range bufs {
+		bufs[i] = &RecvBuf{}
+		msgs[i].Buffers = [][]byte{bufs[i].RawBuf[:]}
+		msgs[i].OOB = bufs[i].RawOob[:]
+	}
+
+	b.ResetTimer()
+
+	total := 0
+
+	for total < b.N {
+		b.StopTimer()
+		s.fill(b, BENCH_CHUNK)
+		b.StartTimer()
+
+		for j := 0; j < BENCH_CHUNK; {
+			n, err := s.rx.ReadBatch(msgs)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for k, rx := range bufs[:n] {
+				rx.Buf = rx.RawBuf[:msgs[k].N]
+				rx.Dst, rx.IfIndex, rx.Err = s.rx.ParseControl(rx.RawOob[:msgs[k].NN])
+			}
+
+			j += n
+		}
+
+		total += BENCH_CHUNK
+	}
+
+	b.ReportMetric(float64(total)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+func TestTrafficLiveness(t *testing.T) {
+	group := net.IPv4(239, 1, 2, 3).To4()
+
+	source := &UdpSource{
+		Streams: make(map[IPKey]*UdpStream),
+		Events:  make(chan HeartbeatEvent, NUM_STREAM_EVENTS),
+	}
+
+	stream := &UdpStream{
+		Name:    "traffic",
+		Group:   group,
+		Traffic: true,
+		timeout: time.Second,
+	}
+	stream.paths = append(stream.paths, &udpPath{Group: group})
+	source.Streams[MakeIPKey(group)] = stream
+
+	rx := &RecvBuf{
+		Buf:  make([]byte, 7*mpeg.TS_PACKET_LENGTH),
+		Src:  net.IPv4(10, 0, 0, 1).To4(),
+		Dst:  group,
+		Time: time.Now(),
+	}
+
+	if source.streamByName("traffic") != stream {
+		t.Fatal("Traffic stream not found by name")
+	}
+
+	source.receive(stream, rx)
+	source.receive(stream, rx)
+
+	ev := expectEvent(t, source.Events, HEARTBEAT_ONLINE)
+	if ev.Name != "traffic" || ev.Input != source || !ev.Dst.Equal(group) {
+		t.Errorf("Bad online event %+v", ev)
+	}
+
+	// Still within the idle timeout
+	source.checkLiveness(time.Now())
+
+	if len(source.Events) != 0 {
+		t.Fatal("Went offline early")
+	}
+
+	source.checkLiveness(time.Now().Add(2 * time.Second))
+
+	expectEvent(t, source.Events, HEARTBEAT_OFFLINE)
+
+	source.receive(stream, rx)
+
+	expectEvent(t, source.Events, HEARTBEAT_ONLINE)
+}
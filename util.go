@@ -4,8 +4,35 @@ import (
 	"net"
 )
 
-func IPtoU32(ip net.IP) uint32 {
-	ip = ip.To4()
+// IPKey is a comparable form of an IPv4 or IPv6 address, suitable for use as
+// a map key. IPv4 addresses are held in their IPv4-mapped form.
+type IPKey [net.IPv6len]byte
 
-	return uint32(ip[0]) | (uint32(ip[1]) << 8) | (uint32(ip[2]) << 16) | (uint32(ip[3]) << 24)
+func MakeIPKey(ip net.IP) IPKey {
+	var key IPKey
+
+	copy(key[:], ip.To16())
+
+	return key
+}
+
+func (key IPKey) IP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, key[:])
+
+	return normalizeIP(ip)
+}
+
+// normalizeIP returns IPv4 addresses in their four byte form and leaves IPv6
+// addresses untouched.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip != nil && ip.To4() == nil
 }
@@ -2,8 +2,15 @@ package recstation
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"recstation/hbproto"
 
 	"github.com/elazarl/go-bindata-assetfs"
 )
@@ -145,11 +152,199 @@ func servePreview(state *State) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func captureRequest(state *State, req CaptureRequestMessage) CaptureResponse {
+	req.Resp = make(chan CaptureResponse)
+
+	state.CaptureRequest <- req
+
+	return <-req.Resp
+}
+
+func serveCaptureStart(state *State) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Bad method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+
+		req := CaptureRequestMessage{
+			Action:    CAPTURE_START,
+			Heartbeat: q.Get("heartbeat") == "1",
+		}
+
+		if group := q.Get("group"); group != "" {
+			req.Group = state.GroupByName(group)
+			if req.Group == nil {
+				http.Error(w, fmt.Sprintf("Unknown group '%s'", group), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if v := q.Get("max_bytes"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "Bad max_bytes", http.StatusBadRequest)
+				return
+			}
+
+			req.MaxBytes = n
+		}
+
+		if v := q.Get("duration"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "Bad duration", http.StatusBadRequest)
+				return
+			}
+
+			req.Duration = d
+		}
+
+		resp := captureRequest(state, req)
+		if resp.Err != nil {
+			http.Error(w, resp.Err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		corsHeaders(w)
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(resp.Capture.Status()); err != nil {
+			log.Print("Capture:", err)
+		}
+	}
+}
+
+func serveCaptureStop(state *State) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Bad method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+
+		resp := captureRequest(state, CaptureRequestMessage{
+			Action: CAPTURE_STOP,
+			Id:     id,
+		})
+
+		corsHeaders(w)
+		w.Header().Set("Content-Type", "application/json")
+
+		var st struct {
+			Success bool `json:"success"`
+		}
+		st.Success = resp.Capture != nil
+
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(st); err != nil {
+			log.Print("Capture:", err)
+		}
+	}
+}
+
+func serveCaptureDownload(state *State) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+
+		resp := captureRequest(state, CaptureRequestMessage{
+			Action: CAPTURE_GET,
+			Id:     id,
+		})
+
+		capture := resp.Capture
+		if capture == nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		if !capture.Finished() {
+			http.Error(w, "Capture still running", http.StatusConflict)
+			return
+		}
+
+		corsHeaders(w)
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(capture.Filename)))
+
+		http.ServeFile(w, r, capture.Filename)
+	}
+}
+
+func serveControl(state *State) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Bad method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+
+		req := ControlRequestMessage{
+			Src:     net.ParseIP(q.Get("src")),
+			Dst:     net.ParseIP(q.Get("dst")),
+			Command: hbproto.CommandByName(q.Get("command")),
+			Resp:    make(chan ControlResponse),
+		}
+
+		if req.Src == nil || req.Dst == nil {
+			http.Error(w, "Bad src or dst", http.StatusBadRequest)
+			return
+		}
+
+		if req.Command == 0 {
+			http.Error(w, fmt.Sprintf("Unknown command '%s'", q.Get("command")), http.StatusBadRequest)
+			return
+		}
+
+		if v := q.Get("argument"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				http.Error(w, "Bad argument", http.StatusBadRequest)
+				return
+			}
+
+			req.Argument = uint32(n)
+		}
+
+		state.ControlRequest <- req
+		resp := <-req.Resp
+
+		if resp.Err != nil {
+			http.Error(w, resp.Err.Error(), http.StatusConflict)
+			return
+		}
+
+		corsHeaders(w)
+		w.Header().Set("Content-Type", "application/json")
+
+		var st struct {
+			Success  bool   `json:"success"`
+			Sequence uint32 `json:"sequence"`
+		}
+		st.Success = true
+		st.Sequence = resp.Sequence
+
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(st); err != nil {
+			log.Print("Control:", err)
+		}
+	}
+}
+
 func StartWeb(state *State, addr string) error {
 	http.HandleFunc("/api/v1/status", serveStatus(state))
 	http.HandleFunc("/api/v1/record", serveRecord(state))
 	http.HandleFunc("/api/v1/stop", serveStop(state))
 	http.HandleFunc("/api/v1/preview", servePreview(state))
+	http.HandleFunc("/api/v1/capture", serveCaptureStart(state))
+	http.HandleFunc("/api/v1/capture/stop", serveCaptureStop(state))
+	http.HandleFunc("/api/v1/capture/download", serveCaptureDownload(state))
+	http.HandleFunc("/api/v1/control", serveControl(state))
 
 	http.Handle("/", http.FileServer(
 		&assetfs.AssetFS{